@@ -0,0 +1,78 @@
+package activity
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+	. "github.com/sclasen/swfsm/log"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+// DefaultHeartbeatInterval is the default ActivityWorker.HeartbeatInterval.
+const DefaultHeartbeatInterval = 30 * time.Second
+
+// ContextActivityHandlerFunc is an ActivityHandlerFunc that also receives a context.Context,
+// which is canceled when cancellation of the activity is requested.
+type ContextActivityHandlerFunc func(ctx context.Context, activityTask *swf.PollForActivityTaskOutput, input interface{}) (interface{}, error)
+
+// AddContextHandler adds a handler for the activity, which is given a context that is canceled when a heartbeat
+// reports that cancellation of the activity was requested, or that the activity is gone. The worker records heartbeats
+// every HeartbeatInterval while the handler runs. When the handler returns after cancellation was requested,
+// the activity task is responded to as canceled, with the details of the ActivityTaskCanceledError it returned, if any.
+// The input is the zero value of the input type, as the Input of an ActivityHandler.
+func (w *ActivityWorker) AddContextHandler(activity string, input interface{}, handler ContextActivityHandlerFunc) {
+	adapter := &contextActivityAdapter{
+		worker:  w,
+		handler: handler,
+	}
+	w.AddHandler(&ActivityHandler{
+		Activity:    activity,
+		HandlerFunc: adapter.handle,
+		Input:       input,
+	})
+}
+
+type contextActivityAdapter struct {
+	worker  *ActivityWorker
+	handler ContextActivityHandlerFunc
+}
+
+func (c *contextActivityAdapter) handle(activityTask *swf.PollForActivityTaskOutput, input interface{}) (interface{}, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cancelActivity := make(chan error, 1)
+	stopHeartbeating := make(chan struct{})
+	defer close(stopHeartbeating)
+	go c.worker.heartbeat(activityTask, c.worker.heartbeatInterval(), stopHeartbeating, cancelActivity)
+
+	var cancelRequested int32
+	go func() {
+		select {
+		case cause := <-cancelActivity:
+			if cause != nil {
+				atomic.StoreInt32(&cancelRequested, 1)
+			}
+			cancel()
+		case <-stopHeartbeating:
+		}
+	}()
+
+	result, err := c.handler(ctx, activityTask, input)
+	if atomic.LoadInt32(&cancelRequested) == 1 {
+		if _, ok := err.(ActivityTaskCanceledError); !ok {
+			Logf(c.worker.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=activity-canceled", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId))
+			return nil, ActivityTaskCanceledError{}
+		}
+	}
+	return result, err
+}
+
+func (w *ActivityWorker) heartbeatInterval() time.Duration {
+	if w.HeartbeatInterval <= 0 {
+		return DefaultHeartbeatInterval
+	}
+	return w.HeartbeatInterval
+}
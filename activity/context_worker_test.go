@@ -0,0 +1,61 @@
+package activity
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+func contextTestTask() *swf.PollForActivityTaskOutput {
+	return &swf.PollForActivityTaskOutput{
+		TaskToken:         S("token"),
+		WorkflowExecution: &swf.WorkflowExecution{},
+		ActivityType:      &swf.ActivityType{Name: S("activity")},
+		ActivityId:        S("id"),
+	}
+}
+
+func TestContextActivityHandler_Cancel(t *testing.T) {
+	mockSwf := &MockSWF{Canceled: true}
+	worker := ActivityWorker{
+		SWF:               mockSwf,
+		HeartbeatInterval: 5 * time.Millisecond,
+	}
+	worker.AddContextHandler("activity", "", func(ctx context.Context, task *swf.PollForActivityTaskOutput, input interface{}) (interface{}, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return "not canceled", nil
+		}
+	})
+	worker.Init()
+
+	worker.HandleActivityTask(contextTestTask())
+
+	if !mockSwf.CanceledSet || mockSwf.CompletedSet || mockSwf.Failed {
+		t.Fatal("expected the activity canceled", mockSwf.CanceledSet, mockSwf.CompletedSet, mockSwf.Failed)
+	}
+}
+
+func TestContextActivityHandler_Complete(t *testing.T) {
+	mockSwf := &MockSWF{}
+	worker := ActivityWorker{
+		SWF:               mockSwf,
+		HeartbeatInterval: time.Millisecond,
+	}
+	worker.AddContextHandler("activity", "", func(ctx context.Context, task *swf.PollForActivityTaskOutput, input interface{}) (interface{}, error) {
+		time.Sleep(10 * time.Millisecond)
+		return "done", ctx.Err()
+	})
+	worker.Init()
+
+	worker.HandleActivityTask(contextTestTask())
+
+	if !mockSwf.CompletedSet || LS(mockSwf.Completed) != "done" || mockSwf.CanceledSet {
+		t.Fatal("expected the activity completed", LS(mockSwf.Completed), mockSwf.CanceledSet)
+	}
+}
@@ -46,25 +46,27 @@ type coordinatedActivityAdapter struct {
 	handler           *CoordinatedActivityHandler
 }
 
-func (c *coordinatedActivityAdapter) heartbeat(activityTask *swf.PollForActivityTaskOutput, stop <-chan struct{}, cancelActivity chan error) {
-	heartbeats := time.NewTicker(c.heartbeatInterval)
+// heartbeat records heartbeats for the activity task every interval until stopped. When the activity task is gone
+// it sends nil on cancelActivity, and when cancellation of the activity is requested an ActivityTaskCanceledError.
+func (w *ActivityWorker) heartbeat(activityTask *swf.PollForActivityTaskOutput, interval time.Duration, stop <-chan struct{}, cancelActivity chan error) {
+	heartbeats := time.NewTicker(interval)
 	defer heartbeats.Stop()
 	for {
 		select {
 		case <-heartbeats.C:
-			if status, err := c.worker.SWF.RecordActivityTaskHeartbeat(&swf.RecordActivityTaskHeartbeatInput{
+			if status, err := w.SWF.RecordActivityTaskHeartbeat(&swf.RecordActivityTaskHeartbeatInput{
 				TaskToken: activityTask.TaskToken,
 			}); err != nil {
 				if ae, ok := err.(awserr.Error); ok && isGoneError(ae) {
-					Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=activity-gone", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId))
+					Logf(w.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=activity-gone", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId))
 					cancelActivity <- nil
 					return
 				}
-				Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=heartbeat-error error=%q", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId), err.Error())
+				Logf(w.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=heartbeat-error error=%q", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId), err.Error())
 			} else {
-				Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=heartbeat-recorded", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId))
+				Logf(w.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=heartbeat-recorded", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId))
 				if *status.CancelRequested {
-					Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=activity-cancel-requested", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId))
+					Logf(w.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=activity-cancel-requested", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId))
 					cancelActivity <- ActivityTaskCanceledError{}
 					return
 				}
@@ -89,7 +91,7 @@ func (c *coordinatedActivityAdapter) coordinate(activityTask *swf.PollForActivit
 	cancel := make(chan error, 2)
 	stopHeartbeating := make(chan struct{})
 
-	go c.heartbeat(activityTask, stopHeartbeating, cancel)
+	go c.worker.heartbeat(activityTask, c.heartbeatInterval, stopHeartbeating, cancel)
 	defer close(stopHeartbeating)
 
 	ticks := time.NewTicker(c.tickMinInterval)
@@ -107,11 +109,11 @@ func (c *coordinatedActivityAdapter) coordinate(activityTask *swf.PollForActivit
 			if res != nil {
 				//send an activity update when the result is not null, but we are continuing
 				if err := c.worker.signalUpdate(activityTask, res); err != nil {
-					Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=signal-update-error error=%q", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId), err)
+					Logf(c.worker.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=signal-update-error error=%q", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId), err)
 					cancel <- err
 					continue // go pick up the cancel message
 				}
-				Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=signal-update", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId))
+				Logf(c.worker.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=signal-update", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId))
 			}
 		}
 	}
@@ -119,13 +121,13 @@ func (c *coordinatedActivityAdapter) coordinate(activityTask *swf.PollForActivit
 
 func (c *coordinatedActivityAdapter) cancel(activityTask *swf.PollForActivityTaskOutput, input interface{}) {
 	if err := c.handler.Cancel(activityTask, input); err != nil {
-		Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=activity-cancel-err error=%q", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId), err)
+		Logf(c.worker.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=activity-cancel-err error=%q", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId), err)
 	}
 }
 
 func (c *coordinatedActivityAdapter) finish(activityTask *swf.PollForActivityTaskOutput, input interface{}) {
 	if err := c.handler.Finish(activityTask, input); err != nil {
-		Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=activity-finish-err error=%q", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId), err)
+		Logf(c.worker.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=activity-finish-err error=%q", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId), err)
 	}
 }
 
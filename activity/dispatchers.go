@@ -2,6 +2,7 @@ package activity
 
 import (
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,6 +16,13 @@ type ActivityTaskDispatcher interface {
 	DispatchTask(*swf.PollForActivityTaskOutput, func(*swf.PollForActivityTaskOutput))
 }
 
+//ConcurrencyGauge is implemented by dispatchers that limit concurrency, so that their saturation can be monitored.
+//A worker whose InFlight is consistently at Capacity should be scaled out.
+type ConcurrencyGauge interface {
+	InFlight() int
+	Capacity() int
+}
+
 //CallingGoroutineDispatcher is a DecisionTaskDispatcher that runs the decision handler in the polling goroutine
 type CallingGoroutineDispatcher struct{}
 
@@ -25,18 +33,32 @@ func (*CallingGoroutineDispatcher) DispatchTask(task *swf.PollForActivityTaskOut
 
 //NewGoroutineDispatcher is a DecisionTaskDispatcher that runs the decision handler in a new goroutine.
 type NewGoroutineDispatcher struct {
+	inFlight int32
 }
 
 //DispatchTask calls the handler in a new  goroutine.
-func (*NewGoroutineDispatcher) DispatchTask(task *swf.PollForActivityTaskOutput, handler func(*swf.PollForActivityTaskOutput)) {
-	go handler(task)
+func (n *NewGoroutineDispatcher) DispatchTask(task *swf.PollForActivityTaskOutput, handler func(*swf.PollForActivityTaskOutput)) {
+	atomic.AddInt32(&n.inFlight, 1)
+	go func() {
+		defer atomic.AddInt32(&n.inFlight, -1)
+		handler(task)
+	}()
+}
+
+//InFlight returns the number of tasks being handled, it implements poller.Drainer.
+func (n *NewGoroutineDispatcher) InFlight() int {
+	return int(atomic.LoadInt32(&n.inFlight))
 }
 
 //BoundedGoroutineDispatcher is a DecisionTaskDispatcher that uses a bounded number of goroutines to run decision handlers.
 type BoundedGoroutineDispatcher struct {
 	NumGoroutines int
-	started       bool
-	tasks         chan *swf.PollForActivityTaskOutput
+	//ConcurrencyReporter, if set, is called with the in-flight count and the capacity whenever a task is dispatched or completes.
+	//It is called from multiple goroutines.
+	ConcurrencyReporter func(inFlight, capacity int)
+	started             bool
+	tasks               chan *swf.PollForActivityTaskOutput
+	inFlight            int32
 }
 
 //DispatchTask calls sends the task on a channel that NumGoroutines goroutines are selecting on.
@@ -56,6 +78,7 @@ func (b *BoundedGoroutineDispatcher) DispatchTask(task *swf.PollForActivityTaskO
 					select {
 					case t := <-b.tasks:
 						handler(t)
+						b.report(atomic.AddInt32(&b.inFlight, -1))
 					}
 				}
 			}()
@@ -63,9 +86,69 @@ func (b *BoundedGoroutineDispatcher) DispatchTask(task *swf.PollForActivityTaskO
 		b.started = true
 	}
 
+	b.report(atomic.AddInt32(&b.inFlight, 1))
 	b.tasks <- task
 }
 
+func (b *BoundedGoroutineDispatcher) report(inFlight int32) {
+	if b.ConcurrencyReporter != nil {
+		b.ConcurrencyReporter(int(inFlight), b.Capacity())
+	}
+}
+
+//InFlight returns the number of tasks being handled or waiting for a goroutine, it implements poller.Drainer.
+func (b *BoundedGoroutineDispatcher) InFlight() int {
+	return int(atomic.LoadInt32(&b.inFlight))
+}
+
+//Capacity returns the number of goroutines handling tasks, it implements ConcurrencyGauge.
+//InFlight may exceed Capacity by one while the polling goroutine waits to hand off a task.
+func (b *BoundedGoroutineDispatcher) Capacity() int {
+	if b.NumGoroutines == 0 {
+		return 1
+	}
+	return b.NumGoroutines
+}
+
+//SemaphoreDispatcher is an ActivityTaskDispatcher that runs the handler in a new goroutine once one of MaxConcurrent tokens is acquired.
+//When all tokens are taken, DispatchTask blocks the poller, so no more tasks are polled until a handler completes.
+type SemaphoreDispatcher struct {
+	MaxConcurrent int
+	once          sync.Once
+	tokens        chan struct{}
+	inFlight      int32
+}
+
+//DispatchTask acquires a token, then calls the handler in a new goroutine that releases the token on completion.
+func (s *SemaphoreDispatcher) DispatchTask(task *swf.PollForActivityTaskOutput, handler func(*swf.PollForActivityTaskOutput)) {
+	s.once.Do(func() {
+		s.tokens = make(chan struct{}, s.Capacity())
+	})
+	s.tokens <- struct{}{}
+	atomic.AddInt32(&s.inFlight, 1)
+	go func() {
+		defer func() {
+			atomic.AddInt32(&s.inFlight, -1)
+			<-s.tokens
+		}()
+		handler(task)
+	}()
+}
+
+//InFlight returns the number of tasks being handled, it implements poller.Drainer.
+func (s *SemaphoreDispatcher) InFlight() int {
+	return int(atomic.LoadInt32(&s.inFlight))
+}
+
+//Capacity returns MaxConcurrent, or 1 if unset, it implements ConcurrencyGauge.
+func (s *SemaphoreDispatcher) Capacity() int {
+	if s.MaxConcurrent <= 0 {
+		//use at least 1
+		return 1
+	}
+	return s.MaxConcurrent
+}
+
 // CountdownGoroutineDispatcher is a dispatcher that you can register with a  ShutdownManager.  Used in your
 // ActivityWorkers, it will count in-flight activities.  It doesnt ack shutdowns until the number of in-flight activities are zero.
 type CountdownGoroutineDispatcher struct {
@@ -101,6 +184,11 @@ func (m *CountdownGoroutineDispatcher) DispatchTask(t *swf.PollForActivityTaskOu
 	}()
 }
 
+//InFlight returns the number of activities being handled, it implements poller.Drainer.
+func (m *CountdownGoroutineDispatcher) InFlight() int {
+	return int(atomic.LoadInt64(&m.inFlight))
+}
+
 func (m *CountdownGoroutineDispatcher) Start() {
 	<-m.Stop
 	for atomic.LoadInt64(&m.inFlight) > 0 {
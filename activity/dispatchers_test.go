@@ -20,6 +20,86 @@ func TestBoundedGoroutineDispatcher(t *testing.T) {
 	testDispatcher(&BoundedGoroutineDispatcher{NumGoroutines: 8}, t)
 }
 
+func TestBoundedGoroutineDispatcherConcurrencyReporter(t *testing.T) {
+	var gauge ConcurrencyGauge = &BoundedGoroutineDispatcher{NumGoroutines: 2}
+	dispatcher := gauge.(*BoundedGoroutineDispatcher)
+	var maxInFlight, reportedCapacity int32
+	dispatcher.ConcurrencyReporter = func(inFlight, capacity int) {
+		// the reporter may run on the dispatcher goroutines, so record the capacity and assert on the test goroutine
+		if capacity != 2 {
+			atomic.StoreInt32(&reportedCapacity, int32(capacity))
+		}
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if int32(inFlight) <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, int32(inFlight)) {
+				return
+			}
+		}
+	}
+
+	release := make(chan struct{})
+	handler := func(d *swf.PollForActivityTaskOutput) {
+		<-release
+	}
+	dispatcher.DispatchTask(&swf.PollForActivityTaskOutput{}, handler)
+	dispatcher.DispatchTask(&swf.PollForActivityTaskOutput{}, handler)
+
+	if gauge.InFlight() != 2 || gauge.Capacity() != 2 {
+		t.Fatal("expected saturated dispatcher, got in-flight", gauge.InFlight(), "capacity", gauge.Capacity())
+	}
+	if atomic.LoadInt32(&maxInFlight) != 2 {
+		t.Fatal("expected reported in-flight 2, got", maxInFlight)
+	}
+
+	close(release)
+	deadline := time.Now().Add(1 * time.Second)
+	for gauge.InFlight() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for tasks to complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c := atomic.LoadInt32(&reportedCapacity); c != 0 {
+		t.Fatal("expected reported capacity 2, got", c)
+	}
+}
+
+func TestSemaphoreDispatcher(t *testing.T) {
+	testDispatcher(&SemaphoreDispatcher{MaxConcurrent: 8}, t)
+}
+
+func TestSemaphoreDispatcherBlocksWhenSaturated(t *testing.T) {
+	dispatcher := &SemaphoreDispatcher{MaxConcurrent: 2}
+	release := make(chan struct{})
+	handler := func(d *swf.PollForActivityTaskOutput) {
+		<-release
+	}
+	dispatcher.DispatchTask(&swf.PollForActivityTaskOutput{}, handler)
+	dispatcher.DispatchTask(&swf.PollForActivityTaskOutput{}, handler)
+
+	dispatched := make(chan struct{})
+	go func() {
+		dispatcher.DispatchTask(&swf.PollForActivityTaskOutput{}, func(d *swf.PollForActivityTaskOutput) {})
+		close(dispatched)
+	}()
+
+	select {
+	case <-dispatched:
+		t.Fatal("expected DispatchTask to block while saturated")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if dispatcher.InFlight() != 2 {
+		t.Fatal("expected 2 in-flight, got", dispatcher.InFlight())
+	}
+
+	close(release)
+	select {
+	case <-dispatched:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for DispatchTask to unblock")
+	}
+}
+
 func TestCountdownGoroutineDispatcher(t *testing.T) {
 	dispatcher := &CountdownGoroutineDispatcher{
 		Stop:    make(chan bool, 1),
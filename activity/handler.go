@@ -5,6 +5,7 @@ import (
 	"reflect"
 
 	"github.com/aws/aws-sdk-go/service/swf"
+	"github.com/sclasen/swfsm/fsm"
 )
 
 type ActivityHandlerFunc func(activityTask *swf.PollForActivityTaskOutput, input interface{}) (interface{}, error)
@@ -13,6 +14,15 @@ type ActivityHandler struct {
 	Activity    string
 	HandlerFunc ActivityHandlerFunc
 	Input       interface{}
+	// Serializer, if set, is used instead of the ActivityWorker Serializer for the input and result of this activity,
+	// e.g. an s3serializer.S3Serializer to pass large inputs and results through S3.
+	Serializer fsm.StateSerializer
+	// MaxPerSecond, if set, limits how many tasks of this activity start per second on the worker,
+	// e.g. when the activity calls a rate limited api. Tasks over the limit are held in memory, off the polling goroutine,
+	// and dispatched once their turn comes, so tasks of other activities are not delayed whatever the ActivityTaskDispatcher.
+	// The worker keeps polling meanwhile, and the StartToCloseTimeout and HeartbeatTimeout of held tasks are running,
+	// so they must allow for the wait of a burst of tasks.
+	MaxPerSecond float64
 }
 
 type CoordinatedActivityHandlerStartFunc func(*swf.PollForActivityTaskOutput, interface{}) (interface{}, error)
@@ -1,6 +1,9 @@
 package activity
 
 import (
+	"sync"
+	"time"
+
 	"github.com/aws/aws-sdk-go/service/swf"
 )
 
@@ -57,6 +60,89 @@ func (i *FuncInterceptor) AfterTaskCanceled(activity *swf.PollForActivityTaskOut
 	}
 }
 
+//DefaultTimingMaxAge is the TimingInterceptor MaxAge used when it is unset.
+const DefaultTimingMaxAge = 24 * time.Hour
+
+//TimingInterceptor is an ActivityInterceptor that records when each task starts in BeforeTask,
+//and calls ElapsedFn with the elapsed time when the task completes, fails or is canceled.
+//Compose it with other interceptors using NewComposedDecisionInterceptor.
+type TimingInterceptor struct {
+	//ElapsedFn receives a nil err on completion, and an ActivityTaskCanceledError on cancellation.
+	ElapsedFn func(t *swf.PollForActivityTaskOutput, elapsed time.Duration, err error)
+	//MaxAge is how long the start time of a task is kept. Tasks whose handler panicked under HandleWithRecovery
+	//never complete, fail or cancel, so their start times are dropped in BeforeTask once older than MaxAge.
+	//Set it to the longest StartToCloseTimeout of the activities; defaults to DefaultTimingMaxAge.
+	MaxAge time.Duration
+
+	mu      sync.Mutex
+	started map[string]time.Time
+}
+
+//NewTimingInterceptor builds a TimingInterceptor calling the elapsedFn, e.g. to record latency histograms per activity type.
+func NewTimingInterceptor(elapsedFn func(t *swf.PollForActivityTaskOutput, elapsed time.Duration, err error)) *TimingInterceptor {
+	return &TimingInterceptor{
+		ElapsedFn: elapsedFn,
+		started:   make(map[string]time.Time),
+	}
+}
+
+//BeforeTask records the start time of the task, and drops start times older than MaxAge
+func (i *TimingInterceptor) BeforeTask(t *swf.PollForActivityTaskOutput) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.started == nil {
+		i.started = make(map[string]time.Time)
+	}
+	now := time.Now()
+	maxAge := i.MaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultTimingMaxAge
+	}
+	for key, start := range i.started {
+		if now.Sub(start) > maxAge {
+			delete(i.started, key)
+		}
+	}
+	i.started[i.key(t)] = now
+}
+
+func (i *TimingInterceptor) AfterTask(t *swf.PollForActivityTaskOutput, result interface{}, err error) (interface{}, error) {
+	return result, err
+}
+
+//AfterTaskComplete calls the ElapsedFn with a nil error
+func (i *TimingInterceptor) AfterTaskComplete(t *swf.PollForActivityTaskOutput, result interface{}) {
+	i.elapsed(t, nil)
+}
+
+//AfterTaskFailed calls the ElapsedFn with the error
+func (i *TimingInterceptor) AfterTaskFailed(t *swf.PollForActivityTaskOutput, err error) {
+	i.elapsed(t, err)
+}
+
+//AfterTaskCanceled calls the ElapsedFn with an ActivityTaskCanceledError
+func (i *TimingInterceptor) AfterTaskCanceled(t *swf.PollForActivityTaskOutput, details string) {
+	i.elapsed(t, ActivityTaskCanceledError{details: details})
+}
+
+func (i *TimingInterceptor) elapsed(t *swf.PollForActivityTaskOutput, err error) {
+	i.mu.Lock()
+	start, ok := i.started[i.key(t)]
+	delete(i.started, i.key(t))
+	i.mu.Unlock()
+	if !ok || i.ElapsedFn == nil {
+		return
+	}
+	i.ElapsedFn(t, time.Since(start), err)
+}
+
+func (i *TimingInterceptor) key(t *swf.PollForActivityTaskOutput) string {
+	if t.TaskToken != nil {
+		return *t.TaskToken
+	}
+	return ""
+}
+
 type ComposedDecisionInterceptor struct {
 	interceptors []ActivityInterceptor
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/swf"
 	. "github.com/sclasen/swfsm/sugar"
@@ -245,3 +246,95 @@ func TestComposedInterceptor(t *testing.T) {
 		t.Fatalf("passed through value not returned")
 	}
 }
+
+func TestTimingInterceptor(t *testing.T) {
+	type call struct {
+		elapsed time.Duration
+		err     error
+	}
+	calls := make(map[string]call)
+	interceptor := NewTimingInterceptor(func(task *swf.PollForActivityTaskOutput, elapsed time.Duration, err error) {
+		calls[*task.ActivityType.Name] = call{elapsed, err}
+	})
+
+	worker := &ActivityWorker{
+		ActivityInterceptor: NewComposedDecisionInterceptor(interceptor),
+		SWF:                 &MockSWF{},
+	}
+	worker.AddHandler(&ActivityHandler{
+		Activity: "complete",
+		HandlerFunc: func(activityTask *swf.PollForActivityTaskOutput, input interface{}) (interface{}, error) {
+			time.Sleep(5 * time.Millisecond)
+			return nil, nil
+		},
+	})
+	worker.AddHandler(&ActivityHandler{
+		Activity: "fail",
+		HandlerFunc: func(activityTask *swf.PollForActivityTaskOutput, input interface{}) (interface{}, error) {
+			return nil, errors.New("fail")
+		},
+	})
+	worker.AddHandler(&ActivityHandler{
+		Activity: "cancel",
+		HandlerFunc: func(activityTask *swf.PollForActivityTaskOutput, input interface{}) (interface{}, error) {
+			return nil, ActivityTaskCanceledError{details: "canceled"}
+		},
+	})
+
+	for _, name := range []string{"complete", "fail", "cancel"} {
+		worker.HandleActivityTask(&swf.PollForActivityTaskOutput{
+			ActivityType:      &swf.ActivityType{Name: S(name), Version: S("test")},
+			ActivityId:        S("ID"),
+			TaskToken:         S("token-" + name),
+			WorkflowExecution: &swf.WorkflowExecution{WorkflowId: S("ID"), RunId: S("run")},
+		})
+	}
+
+	if c, ok := calls["complete"]; !ok || c.err != nil || c.elapsed < 5*time.Millisecond {
+		t.Fatal("expected completion timed with nil error", c)
+	}
+	if c, ok := calls["fail"]; !ok || c.err == nil || c.err.Error() != "fail" {
+		t.Fatal("expected failure timed with the error", c)
+	}
+	if c, ok := calls["cancel"]; !ok {
+		t.Fatal("expected cancellation timed")
+	} else if _, canceled := c.err.(ActivityTaskCanceledError); !canceled {
+		t.Fatal("expected an ActivityTaskCanceledError", c.err)
+	}
+	if len(interceptor.started) != 0 {
+		t.Fatal("expected start times removed once reported", interceptor.started)
+	}
+}
+
+func TestTimingInterceptorDropsStartTimesOfPanickedTasks(t *testing.T) {
+	interceptor := NewTimingInterceptor(nil)
+	interceptor.MaxAge = 5 * time.Millisecond
+
+	worker := &ActivityWorker{
+		ActivityInterceptor: interceptor,
+		SWF:                 &MockSWF{},
+	}
+	worker.AddHandler(&ActivityHandler{
+		Activity: "panic",
+		HandlerFunc: func(activityTask *swf.PollForActivityTaskOutput, input interface{}) (interface{}, error) {
+			panic("boom")
+		},
+	})
+
+	worker.HandleWithRecovery(worker.HandleActivityTask)(&swf.PollForActivityTaskOutput{
+		ActivityType:      &swf.ActivityType{Name: S("panic"), Version: S("test")},
+		ActivityId:        S("ID"),
+		TaskToken:         S("token-panic"),
+		WorkflowExecution: &swf.WorkflowExecution{WorkflowId: S("ID"), RunId: S("run")},
+	})
+	if len(interceptor.started) != 1 {
+		t.Fatal("expected the start time of the panicked task kept", interceptor.started)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	interceptor.BeforeTask(&swf.PollForActivityTaskOutput{TaskToken: S("token-next")})
+
+	if _, ok := interceptor.started["token-panic"]; ok || len(interceptor.started) != 1 {
+		t.Fatal("expected the start time of the panicked task dropped once older than MaxAge", interceptor.started)
+	}
+}
@@ -0,0 +1,50 @@
+package activity
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimiter spaces tasks at least 1/perSecond apart, so tasks beyond the rate are delayed
+// until their turn. Delayed tasks reserve their slot, so they are released in order.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+	now      func() time.Time
+	after    func(time.Duration, func())
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{
+		interval: time.Duration(float64(time.Second) / perSecond),
+		now:      time.Now,
+		after: func(d time.Duration, f func()) {
+			time.AfterFunc(d, f)
+		},
+	}
+}
+
+// reserve takes the next slot, and returns how long the caller must wait for it.
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	return delay
+}
+
+// delayedTasks counts the tasks waiting for their slot, so that StopPollersAndDrain waits for them as well.
+type delayedTasks struct {
+	count int32
+}
+
+// InFlight returns the number of tasks waiting for their slot.
+func (d *delayedTasks) InFlight() int {
+	return int(atomic.LoadInt32(&d.count))
+}
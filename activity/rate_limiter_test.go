@@ -0,0 +1,69 @@
+package activity
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+func TestRateLimiterSpacesCalls(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := newRateLimiter(2)
+	limiter.now = func() time.Time { return now }
+
+	var delays []time.Duration
+	for i := 0; i < 3; i++ {
+		delays = append(delays, limiter.reserve())
+	}
+	if delays[0] != 0 || delays[1] != 500*time.Millisecond || delays[2] != time.Second {
+		t.Fatal("expected the second and third calls to wait for their turn", delays)
+	}
+
+	now = now.Add(10 * time.Second)
+	if delay := limiter.reserve(); delay != 0 {
+		t.Fatal("expected no wait once the rate is respected", delay)
+	}
+}
+
+func TestMaxPerSecondOnlyLimitsItsActivity(t *testing.T) {
+	worker := &ActivityWorker{SWF: &MockSWF{}, ActivityTaskDispatcher: &CallingGoroutineDispatcher{}}
+	worker.Init()
+	var handled []string
+	handlerFunc := func(activityTask *swf.PollForActivityTaskOutput, input interface{}) (interface{}, error) {
+		handled = append(handled, *activityTask.ActivityId)
+		return nil, nil
+	}
+	worker.AddHandler(&ActivityHandler{Activity: "limited", HandlerFunc: handlerFunc, MaxPerSecond: 1})
+	worker.AddHandler(&ActivityHandler{Activity: "unlimited", HandlerFunc: handlerFunc})
+
+	var delayed []func()
+	worker.limiters["limited"].after = func(d time.Duration, f func()) { delayed = append(delayed, f) }
+
+	task := func(name, id string) *swf.PollForActivityTaskOutput {
+		return &swf.PollForActivityTaskOutput{
+			ActivityType:      &swf.ActivityType{Name: S(name), Version: S("1")},
+			ActivityId:        S(id),
+			TaskToken:         S("token"),
+			WorkflowExecution: &swf.WorkflowExecution{WorkflowId: S("ID"), RunId: S("run")},
+		}
+	}
+	worker.dispatchTask(task("limited", "limited-1"))
+	worker.dispatchTask(task("limited", "limited-2"))
+	worker.dispatchTask(task("unlimited", "unlimited-1"))
+	worker.dispatchTask(task("unlimited", "unlimited-2"))
+
+	if len(delayed) != 1 || worker.delayed.InFlight() != 1 || worker.limiters["unlimited"] != nil {
+		t.Fatal("expected only the second limited task to wait", len(delayed), worker.delayed.InFlight())
+	}
+	if strings.Join(handled, ",") != "limited-1,unlimited-1,unlimited-2" {
+		t.Fatal("expected the unlimited tasks not to be delayed by the waiting limited task", handled)
+	}
+
+	delayed[0]()
+	if handled[len(handled)-1] != "limited-2" || worker.delayed.InFlight() != 0 {
+		t.Fatal("expected the limited task to be handled once its turn came", handled)
+	}
+}
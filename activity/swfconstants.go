@@ -3,4 +3,11 @@ package activity
 // Various constants defined by SWF
 const (
 	FailureReasonMaxChars = 256
+	ResultMaxBytes        = 32768
+)
+
+// prefixes used by ActivityWorker.ClassifyError to encode a classification into a failure reason
+const (
+	FailureRetryablePrefix    = "retryable: "
+	FailureNonRetryablePrefix = "non-retryable: "
 )
@@ -2,6 +2,8 @@ package activity
 
 import (
 	"fmt"
+	"strings"
+	"sync/atomic"
 
 	"time"
 
@@ -50,12 +52,16 @@ type ActivityWorker struct {
 	Domain string
 	// TaskList that the underlying poller will poll for decision tasks.
 	TaskList string
-	// Identity used in PollForActivityTaskRequests, can be empty.
+	// Identity used in PollForActivityTaskRequests, can be empty. {host} and {pid} are expanded, see poller.ExpandIdentity.
 	Identity string
 	// Client used to make SWF api requests.
 	SWF SWFOps
 	// Type Info for handled activities
 	handlers map[string]*ActivityHandler
+	// rate limiters for handled activities with MaxPerSecond set
+	limiters map[string]*rateLimiter
+	// tasks delayed by the rate limiters
+	delayed delayedTasks
 	// ShutdownManager
 	ShutdownManager *poller.ShutdownManager
 	// ActivityTaskDispatcher
@@ -68,6 +74,30 @@ type ActivityWorker struct {
 	BackoffOnFailure bool
 	// maximum backoff sleep on retries that fail.
 	MaxBackoffSeconds int
+	// ClassifyError decides whether a failed activity should be retried by the decider.
+	// The classification is encoded into the Reason of the RespondActivityTaskFailed request,
+	// and can be read back by deciders with ParseFailureReason.
+	// If unset, errors are reported as they are today, and treated as retryable.
+	ClassifyError func(err error) (retryable bool, reason string)
+	// HeartbeatInterval is how often heartbeats are recorded for activities handled by handlers added with AddContextHandler.
+	// Defaults to DefaultHeartbeatInterval.
+	HeartbeatInterval time.Duration
+	// MaxResultBytes is the largest serialized result that is sent with RespondActivityTaskCompleted,
+	// larger results are given to the LargeResultHandler. Defaults to ResultMaxBytes, the SWF limit.
+	MaxResultBytes int
+	// LargeResultHandler is called with serialized results larger than MaxResultBytes, and can return a smaller result
+	// to complete the activity with instead, e.g. a pointer to the result offloaded to S3.
+	// If unset, or if it errors, the activity fails instead of completing.
+	LargeResultHandler func(activityTask *swf.PollForActivityTaskOutput, result string) (string, error)
+	// SignalStartOnBegin signals the workflow with ActivityStartedSignal and the input, serialized like the handler's, before each handler is called,
+	// so deciders can tell that an activity actually began rather than just being scheduled.
+	// Errors signaling are logged, and the handler is still called. Coordinated handlers already signal their start, so leave this unset for them.
+	SignalStartOnBegin bool
+	// IDGenerator generates the poll ids of the poller. If not set, will use poller.IDGenerator.
+	IDGenerator func() string
+	// Logger is used for output on the worker and its poller. If not set, will use log.Log.
+	// If it implements log.StructuredLogger, log lines are passed to it as fields.
+	Logger StdLogger
 }
 
 func (a *ActivityWorker) AddHandler(handler *ActivityHandler) {
@@ -75,6 +105,15 @@ func (a *ActivityWorker) AddHandler(handler *ActivityHandler) {
 		a.handlers = map[string]*ActivityHandler{}
 	}
 	a.handlers[handler.Activity] = handler
+
+	if a.limiters == nil {
+		a.limiters = map[string]*rateLimiter{}
+	}
+	if handler.MaxPerSecond > 0 {
+		a.limiters[handler.Activity] = newRateLimiter(handler.MaxPerSecond)
+	} else {
+		delete(a.limiters, handler.Activity)
+	}
 }
 
 func (a *ActivityWorker) Init() {
@@ -101,11 +140,34 @@ func (a *ActivityWorker) Init() {
 
 func (a *ActivityWorker) Start() {
 	a.Init()
+	if drainer, ok := a.ActivityTaskDispatcher.(poller.Drainer); ok {
+		a.ShutdownManager.RegisterDrainer(fmt.Sprintf("%s-dispatcher", a.Identity), drainer)
+	}
+	a.ShutdownManager.RegisterDrainer(fmt.Sprintf("%s-rate-limited", a.Identity), &a.delayed)
 	poller := poller.NewActivityTaskPoller(a.SWF, a.Domain, a.Identity, a.TaskList)
+	poller.Logger = a.Logger
+	poller.IDGenerator = a.IDGenerator
 	go poller.PollUntilShutdownBy(a.ShutdownManager, fmt.Sprintf("%s-poller", a.Identity), a.dispatchTask)
 }
 
+// dispatchTask dispatches the polled task, or for activities over their MaxPerSecond, dispatches it once its turn comes
+// without blocking the polling goroutine, so that tasks of other activities are not delayed.
 func (a *ActivityWorker) dispatchTask(activityTask *swf.PollForActivityTaskOutput) {
+	if limiter := a.limiters[LS(activityTask.ActivityType.Name)]; limiter != nil {
+		if delay := limiter.reserve(); delay > 0 {
+			Logf(a.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=rate-limited delay=%s", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId), delay)
+			atomic.AddInt32(&a.delayed.count, 1)
+			limiter.after(delay, func() {
+				defer atomic.AddInt32(&a.delayed.count, -1)
+				a.dispatch(activityTask)
+			})
+			return
+		}
+	}
+	a.dispatch(activityTask)
+}
+
+func (a *ActivityWorker) dispatch(activityTask *swf.PollForActivityTaskOutput) {
 	if a.AllowPanics {
 		a.ActivityTaskDispatcher.DispatchTask(activityTask, a.HandleActivityTask)
 	} else {
@@ -121,6 +183,8 @@ func (a *ActivityWorker) dispatchTask(activityTask *swf.PollForActivityTaskOutpu
 //
 // Note: You will need to handle recovering from panics if you call this directly without wrapping
 // with HandleWithRecovery.
+//
+// The MaxPerSecond of handlers is applied when the worker dispatches the tasks it polls, not by HandleActivityTask.
 func (a *ActivityWorker) HandleActivityTask(activityTask *swf.PollForActivityTaskOutput) {
 	a.ActivityInterceptor.BeforeTask(activityTask)
 	handler := a.handlers[*activityTask.ActivityType.Name]
@@ -139,7 +203,7 @@ func (a *ActivityWorker) HandleActivityTask(activityTask *swf.PollForActivityTas
 			deserialized = *activityTask.Input
 		default:
 			deserialized = handler.ZeroInput()
-			err := a.Serializer.Deserialize(*activityTask.Input, deserialized)
+			err := a.serializerFor(handler).Deserialize(*activityTask.Input, deserialized)
 			if err != nil {
 				a.ActivityInterceptor.AfterTaskFailed(activityTask, err)
 				a.fail(activityTask, errors.Annotate(err, "deserialize"))
@@ -150,6 +214,12 @@ func (a *ActivityWorker) HandleActivityTask(activityTask *swf.PollForActivityTas
 		deserialized = nil
 	}
 
+	if a.SignalStartOnBegin {
+		if err := a.signal(activityTask, fsm.ActivityStartedSignal, a.serializerFor(handler), deserialized); err != nil {
+			Logf(a.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=signal-start-error error=%q", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId), err.Error())
+		}
+	}
+
 	result, err := handler.HandlerFunc(activityTask, deserialized)
 	result, err = a.ActivityInterceptor.AfterTask(activityTask, result, err)
 	if err != nil {
@@ -162,24 +232,68 @@ func (a *ActivityWorker) HandleActivityTask(activityTask *swf.PollForActivityTas
 		}
 	} else {
 		a.ActivityInterceptor.AfterTaskComplete(activityTask, result)
-		a.result(activityTask, result)
+		a.result(activityTask, a.serializerFor(handler), result)
+	}
+}
+
+// serializerFor returns the handler Serializer if set, otherwise the worker Serializer.
+func (a *ActivityWorker) serializerFor(handler *ActivityHandler) fsm.StateSerializer {
+	if handler.Serializer != nil {
+		return handler.Serializer
 	}
+	return a.Serializer
 }
 
-func (a *ActivityWorker) result(activityTask *swf.PollForActivityTaskOutput, result interface{}) {
+func (a *ActivityWorker) result(activityTask *swf.PollForActivityTaskOutput, serializer fsm.StateSerializer, result interface{}) {
+	var serialized string
 	switch t := result.(type) {
 	case string:
-		a.done(activityTask, &t)
+		serialized = t
 	case nil:
 		a.done(activityTask, nil)
+		return
 	default:
-		serialized, err := a.Serializer.Serialize(result)
+		var err error
+		serialized, err = serializer.Serialize(result)
 		if err != nil {
 			a.fail(activityTask, errors.Annotate(err, "serialize"))
-		} else {
-			a.done(activityTask, &serialized)
+			return
 		}
 	}
+
+	if len(serialized) > a.maxResultBytes() {
+		var err error
+		serialized, err = a.largeResult(activityTask, serialized)
+		if err != nil {
+			a.fail(activityTask, err)
+			return
+		}
+	}
+	a.done(activityTask, &serialized)
+}
+
+func (a *ActivityWorker) maxResultBytes() int {
+	if a.MaxResultBytes <= 0 {
+		return ResultMaxBytes
+	}
+	return a.MaxResultBytes
+}
+
+// largeResult replaces a result larger than MaxResultBytes with the one returned by the LargeResultHandler.
+func (a *ActivityWorker) largeResult(activityTask *swf.PollForActivityTaskOutput, serialized string) (string, error) {
+	tooLarge := errors.Errorf("result of %d bytes exceeds MaxResultBytes %d", len(serialized), a.maxResultBytes())
+	if a.LargeResultHandler == nil {
+		return "", tooLarge
+	}
+	Logf(a.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=large-result bytes=%d", LS(activityTask.WorkflowExecution.WorkflowId), LS(activityTask.ActivityType.Name), LS(activityTask.ActivityId), len(serialized))
+	handled, err := a.LargeResultHandler(activityTask, serialized)
+	if err != nil {
+		return "", errors.Annotate(err, tooLarge.Error())
+	}
+	if len(handled) > a.maxResultBytes() {
+		return "", errors.Errorf("result of %d bytes from LargeResultHandler exceeds MaxResultBytes %d", len(handled), a.maxResultBytes())
+	}
+	return handled, nil
 }
 
 func (h *ActivityWorker) fail(task *swf.PollForActivityTaskOutput, err error) {
@@ -197,7 +311,7 @@ func (h *ActivityWorker) fail(task *swf.PollForActivityTaskOutput, err error) {
 					if err == nil {
 						attempts := correlator.ActivityAttempts[*task.ActivityId]
 						backoff := h.backoff(attempts)
-						Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=retry-backoff attempts=%d sleep=%ds ", LS(task.WorkflowExecution.WorkflowId), LS(task.ActivityType.Name), LS(task.ActivityId), attempts, backoff)
+						Logf(h.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=retry-backoff attempts=%d sleep=%ds ", LS(task.WorkflowExecution.WorkflowId), LS(task.ActivityType.Name), LS(task.ActivityId), attempts, backoff)
 						time.Sleep(time.Duration(backoff) * time.Second)
 					}
 					break
@@ -205,33 +319,67 @@ func (h *ActivityWorker) fail(task *swf.PollForActivityTaskOutput, err error) {
 			}
 		}
 	}
-	Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=fail error=%q", LS(task.WorkflowExecution.WorkflowId), LS(task.ActivityType.Name), LS(task.ActivityId), err.Error())
+	Logf(h.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=fail error=%q", LS(task.WorkflowExecution.WorkflowId), LS(task.ActivityType.Name), LS(task.ActivityId), err.Error())
 	if len(err.Error()) > FailureReasonMaxChars {
-		Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=truncating-failure-reason error=%q", LS(task.WorkflowExecution.WorkflowId), LS(task.ActivityType.Name), LS(task.ActivityId), err.Error())
+		Logf(h.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=truncating-failure-reason error=%q", LS(task.WorkflowExecution.WorkflowId), LS(task.ActivityType.Name), LS(task.ActivityId), err.Error())
 	}
 	_, failErr := h.SWF.RespondActivityTaskFailed(&swf.RespondActivityTaskFailedInput{
 		TaskToken: task.TaskToken,
-		Reason:    S(truncate(err.Error(), FailureReasonMaxChars)),
+		Reason:    S(truncate(h.failureReason(err), FailureReasonMaxChars)),
 		Details:   S(err.Error()),
 	})
 	if failErr != nil {
-		Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=failed-response-fail error=%q", LS(task.WorkflowExecution.WorkflowId), LS(task.ActivityType.Name), LS(task.ActivityId), failErr.Error())
+		Logf(h.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=failed-response-fail error=%q", LS(task.WorkflowExecution.WorkflowId), LS(task.ActivityType.Name), LS(task.ActivityId), failErr.Error())
 	}
 }
 
+func (h *ActivityWorker) failureReason(err error) string {
+	if h.ClassifyError == nil {
+		return err.Error()
+	}
+	retryable, reason := h.ClassifyError(err)
+	if reason == "" {
+		reason = err.Error()
+	}
+	if retryable {
+		return FailureRetryablePrefix + reason
+	}
+	return FailureNonRetryablePrefix + reason
+}
+
+// ParseFailureReason reads the classification encoded in an ActivityTaskFailed reason by an ActivityWorker with ClassifyError set.
+// Reasons without a classification are considered retryable, and are returned unchanged.
+func ParseFailureReason(reason string) (retryable bool, classified string) {
+	switch {
+	case strings.HasPrefix(reason, FailureNonRetryablePrefix):
+		return false, strings.TrimPrefix(reason, FailureNonRetryablePrefix)
+	case strings.HasPrefix(reason, FailureRetryablePrefix):
+		return true, strings.TrimPrefix(reason, FailureRetryablePrefix)
+	}
+	return true, reason
+}
+
+// SignalProgress signals the workflow of the activity task with ActivityUpdatedSignal and the details,
+// so deciders can read the latest progress of the activity with FSMContext.ActivityProgress.
+// Unlike heartbeat details, which SWF does not record in history, the signal is seen by the workflow.
+func (h *ActivityWorker) SignalProgress(activityTask *swf.PollForActivityTaskOutput, details interface{}) error {
+	return h.signalUpdate(activityTask, details)
+}
+
 func (h *ActivityWorker) signalStart(activityTask *swf.PollForActivityTaskOutput, data interface{}) error {
-	return h.signal(activityTask, fsm.ActivityStartedSignal, data)
+	return h.signal(activityTask, fsm.ActivityStartedSignal, h.Serializer, data)
 }
 
 func (h *ActivityWorker) signalUpdate(activityTask *swf.PollForActivityTaskOutput, data interface{}) error {
-	return h.signal(activityTask, fsm.ActivityUpdatedSignal, data)
+	return h.signal(activityTask, fsm.ActivityUpdatedSignal, h.Serializer, data)
 }
 
-func (h *ActivityWorker) signal(activityTask *swf.PollForActivityTaskOutput, signal string, data interface{}) error {
+// signal signals the workflow with the data serialized with the serializer.
+func (h *ActivityWorker) signal(activityTask *swf.PollForActivityTaskOutput, signal string, serializer fsm.StateSerializer, data interface{}) error {
 	state := new(fsm.SerializedActivityState)
 	state.ActivityId = *activityTask.ActivityId
 	if data != nil {
-		ser, err := h.Serializer.Serialize(data)
+		ser, err := serializer.Serialize(data)
 		if err != nil {
 			return err
 		}
@@ -269,26 +417,26 @@ func (h *ActivityWorker) backoff(attempts int) int {
 }
 
 func (h *ActivityWorker) done(resp *swf.PollForActivityTaskOutput, result *string) {
-	Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=done", LS(resp.WorkflowExecution.WorkflowId), LS(resp.ActivityType.Name), LS(resp.ActivityId))
+	Logf(h.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=done", LS(resp.WorkflowExecution.WorkflowId), LS(resp.ActivityType.Name), LS(resp.ActivityId))
 
 	_, completeErr := h.SWF.RespondActivityTaskCompleted(&swf.RespondActivityTaskCompletedInput{
 		TaskToken: resp.TaskToken,
 		Result:    result,
 	})
 	if completeErr != nil {
-		Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=completed-response-fail error=%q", LS(resp.WorkflowExecution.WorkflowId), LS(resp.ActivityType.Name), LS(resp.ActivityId), completeErr.Error())
+		Logf(h.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=completed-response-fail error=%q", LS(resp.WorkflowExecution.WorkflowId), LS(resp.ActivityType.Name), LS(resp.ActivityId), completeErr.Error())
 	}
 }
 
 func (h *ActivityWorker) canceled(resp *swf.PollForActivityTaskOutput, details *string) {
-	Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=canceled", LS(resp.WorkflowExecution.WorkflowId), LS(resp.ActivityType.Name), LS(resp.ActivityId))
+	Logf(h.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=canceled", LS(resp.WorkflowExecution.WorkflowId), LS(resp.ActivityType.Name), LS(resp.ActivityId))
 
 	_, canceledErr := h.SWF.RespondActivityTaskCanceled(&swf.RespondActivityTaskCanceledInput{
 		TaskToken: resp.TaskToken,
 		Details:   details,
 	})
 	if canceledErr != nil {
-		Log.Printf("workflow-id=%s activity-id=%s activity-id=%s at=canceled-response-fail error=%q", LS(resp.WorkflowExecution.WorkflowId), LS(resp.ActivityType.Name), LS(resp.ActivityId), canceledErr.Error())
+		Logf(h.Logger, "workflow-id=%s activity-type=%s activity-id=%s at=canceled-response-fail error=%q", LS(resp.WorkflowExecution.WorkflowId), LS(resp.ActivityType.Name), LS(resp.ActivityId), canceledErr.Error())
 	}
 }
 
@@ -309,11 +457,11 @@ func (h *ActivityWorker) HandleWithRecovery(handler func(*swf.PollForActivityTas
 			if r := recover(); r != nil {
 				file, line, name := panicinfo.LocatePanic(r)
 				if err, ok := r.(error); ok && err != nil {
-					anErr = err
+					anErr = errors.Annotatef(err, "panic in activity %s", panicinfo.Describe(file, line, name))
 				} else {
-					anErr = errors.New("panic in activity with nil error")
+					anErr = errors.Errorf("panic in activity: %#v %s", r, panicinfo.Describe(file, line, name))
 				}
-				Log.Printf("component=activity at=activity-panic-recovery-error func=%q file=\"%s:%d\" error=%q", name, file, line, r)
+				Logf(h.Logger, "component=activity at=activity-panic-recovery-error func=%q file=\"%s:%d\" error=%q", name, file, line, r)
 				h.fail(resp, anErr)
 			}
 		}()
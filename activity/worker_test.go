@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -27,7 +28,9 @@ type MockSWF struct {
 	CompletedSet bool
 	History      *swf.GetWorkflowExecutionHistoryOutput
 	Canceled     bool
+	CanceledSet  bool
 	SignalFail   bool
+	Signals      []*swf.SignalWorkflowExecutionInput
 }
 
 func (m *MockSWF) RecordActivityTaskHeartbeat(req *swf.RecordActivityTaskHeartbeatInput) (*swf.RecordActivityTaskHeartbeatOutput, error) {
@@ -35,7 +38,8 @@ func (m *MockSWF) RecordActivityTaskHeartbeat(req *swf.RecordActivityTaskHeartbe
 		CancelRequested: &m.Canceled,
 	}, nil
 }
-func (*MockSWF) RespondActivityTaskCanceled(req *swf.RespondActivityTaskCanceledInput) (*swf.RespondActivityTaskCanceledOutput, error) {
+func (m *MockSWF) RespondActivityTaskCanceled(req *swf.RespondActivityTaskCanceledInput) (*swf.RespondActivityTaskCanceledOutput, error) {
+	m.CanceledSet = true
 	return nil, nil
 }
 func (m *MockSWF) RespondActivityTaskCompleted(req *swf.RespondActivityTaskCompletedInput) (*swf.RespondActivityTaskCompletedOutput, error) {
@@ -60,6 +64,7 @@ func (m *MockSWF) SignalWorkflowExecution(req *swf.SignalWorkflowExecutionInput)
 	if m.SignalFail {
 		return nil, errors.New("signaling failed")
 	}
+	m.Signals = append(m.Signals, req)
 	return nil, nil
 }
 
@@ -415,6 +420,145 @@ func TestStringHandler(t *testing.T) {
 
 }
 
+func TestSignalStartOnBegin(t *testing.T) {
+	ops := &MockSWF{}
+	worker := &ActivityWorker{
+		SWF:    ops,
+		Domain: "domain",
+	}
+	worker.Init()
+	worker.AllowPanics = true
+
+	signalsBeforeHandler := -1
+	worker.AddHandler(NewActivityHandler("activity", func(task *swf.PollForActivityTaskOutput, input *Input1) (*Output1, error) {
+		signalsBeforeHandler = len(ops.Signals)
+		return &Output1{Data: input.Data}, nil
+	}))
+	task := &swf.PollForActivityTaskOutput{
+		WorkflowExecution: &swf.WorkflowExecution{WorkflowId: S("workflow")},
+		ActivityType:      &swf.ActivityType{Name: S("activity")},
+		ActivityId:        S("activity-id"),
+		Input:             S(`{"Data":"in"}`),
+	}
+
+	worker.HandleActivityTask(task)
+	if len(ops.Signals) != 0 {
+		t.Fatal("expected no signals unless SignalStartOnBegin is set", ops.Signals)
+	}
+
+	worker.SignalStartOnBegin = true
+	worker.HandleActivityTask(task)
+	if signalsBeforeHandler != 1 {
+		t.Fatal("expected start signal before handler, got", signalsBeforeHandler)
+	}
+	signal := ops.Signals[0]
+	if *signal.SignalName != fsm.ActivityStartedSignal || *signal.WorkflowId != "workflow" {
+		t.Fatal("unexpected signal", signal)
+	}
+	state := new(fsm.SerializedActivityState)
+	worker.SystemSerializer.Deserialize(*signal.Input, state)
+	input := new(Input1)
+	worker.Serializer.Deserialize(*state.Input, input)
+	if state.ActivityId != "activity-id" || input.Data != "in" {
+		t.Fatal("unexpected signal state", state, input)
+	}
+
+	ops.SignalFail = true
+	ops.CompletedSet = false
+	worker.HandleActivityTask(task)
+	if !ops.CompletedSet {
+		t.Fatal("expected activity to complete when the start signal fails")
+	}
+}
+
+type prefixSerializer struct {
+	fsm.JSONStateSerializer
+}
+
+func (s prefixSerializer) Serialize(state interface{}) (string, error) {
+	serialized, err := s.JSONStateSerializer.Serialize(state)
+	return "prefix:" + serialized, err
+}
+
+func (s prefixSerializer) Deserialize(serialized string, state interface{}) error {
+	return s.JSONStateSerializer.Deserialize(strings.TrimPrefix(serialized, "prefix:"), state)
+}
+
+func TestSignalStartOnBeginWhenHandlerSerializerExpectsInputSerializedWithIt(t *testing.T) {
+	ops := &MockSWF{}
+	worker := &ActivityWorker{
+		SWF:                ops,
+		Domain:             "domain",
+		SignalStartOnBegin: true,
+	}
+	worker.Init()
+	handler := NewActivityHandler("activity", func(task *swf.PollForActivityTaskOutput, input *Input1) (*Output1, error) {
+		return &Output1{Data: input.Data}, nil
+	})
+	handler.Serializer = prefixSerializer{}
+	worker.AddHandler(handler)
+
+	worker.HandleActivityTask(&swf.PollForActivityTaskOutput{
+		WorkflowExecution: &swf.WorkflowExecution{WorkflowId: S("workflow")},
+		ActivityType:      &swf.ActivityType{Name: S("activity")},
+		ActivityId:        S("activity-id"),
+		Input:             S(`prefix:{"Data":"in"}`),
+	})
+
+	state := new(fsm.SerializedActivityState)
+	worker.SystemSerializer.Deserialize(*ops.Signals[0].Input, state)
+	input := new(Input1)
+	if state.Input == nil || !strings.HasPrefix(*state.Input, "prefix:") || (prefixSerializer{}).Deserialize(*state.Input, input) != nil || input.Data != "in" {
+		t.Fatal("expected the input serialized with the handler Serializer", LS(state.Input))
+	}
+}
+
+func TestHandleWithRecoveryExpectsPanicLocationInFailure(t *testing.T) {
+	ops := &MockSWF{}
+	worker := &ActivityWorker{
+		SWF: ops,
+	}
+	worker.Init()
+	worker.AddHandler(NewActivityHandler("activity", func(task *swf.PollForActivityTaskOutput, input string) (string, error) {
+		panic("oops")
+	}))
+
+	worker.HandleWithRecovery(worker.HandleActivityTask)(&swf.PollForActivityTaskOutput{
+		WorkflowExecution: &swf.WorkflowExecution{},
+		ActivityType:      &swf.ActivityType{Name: S("activity")},
+		Input:             S("theInput"),
+	})
+
+	if !ops.Failed || !strings.Contains(*ops.FailedReason, `panic in activity: "oops"`) || !strings.Contains(*ops.FailedReason, "file=worker_test.go:") {
+		t.Fatal("expected failure with the panic location", LS(ops.FailedReason))
+	}
+}
+
+func TestSignalProgress(t *testing.T) {
+	ops := &MockSWF{}
+	worker := &ActivityWorker{
+		SWF:    ops,
+		Domain: "domain",
+	}
+	worker.Init()
+
+	err := worker.SignalProgress(&swf.PollForActivityTaskOutput{
+		WorkflowExecution: &swf.WorkflowExecution{WorkflowId: S("workflow")},
+		ActivityId:        S("activity-id"),
+	}, &Output1{Data: "half-way"})
+	if err != nil || len(ops.Signals) != 1 || *ops.Signals[0].SignalName != fsm.ActivityUpdatedSignal {
+		t.Fatal("expected an ActivityUpdatedSignal", err, ops.Signals)
+	}
+
+	state := new(fsm.SerializedActivityState)
+	worker.SystemSerializer.Deserialize(*ops.Signals[0].Input, state)
+	progress := new(Output1)
+	worker.Serializer.Deserialize(*state.Input, progress)
+	if state.ActivityId != "activity-id" || progress.Data != "half-way" {
+		t.Fatal("unexpected progress", state, progress)
+	}
+}
+
 func TestBackoff(t *testing.T) {
 	serializer := fsm.JSONStateSerializer{}
 
@@ -515,3 +659,65 @@ func TestFailWhenErrorLessThanMaxCharactersExpectsErrorNotTruncated(t *testing.T
 	assert.Equal(t, shortErrorMessage, *ops.FailedReason,
 		"Expected failure reason to match the short error message")
 }
+
+func TestFailWhenClassifyErrorSetExpectsClassificationInReason(t *testing.T) {
+	// arrange
+	ops := &MockSWF{}
+	worker := &ActivityWorker{
+		SWF:        ops,
+		Serializer: fsm.JSONStateSerializer{},
+		ClassifyError: func(err error) (bool, string) {
+			return false, "bad input"
+		},
+	}
+
+	// act
+	worker.fail(&swf.PollForActivityTaskOutput{
+		WorkflowExecution: &swf.WorkflowExecution{},
+		ActivityType:      &swf.ActivityType{Name: S("activity")},
+		ActivityId:        S("the-id"),
+		Input:             S("theInput"),
+	}, errors.New("the error"))
+
+	// assert
+	assert.Equal(t, FailureNonRetryablePrefix+"bad input", *ops.FailedReason,
+		"Expected failure reason to carry the non-retryable classification")
+	retryable, reason := ParseFailureReason(*ops.FailedReason)
+	assert.False(t, retryable, "Expected parsed reason to be non-retryable")
+	assert.Equal(t, "bad input", reason, "Expected parsed reason to strip the classification")
+
+	retryable, reason = ParseFailureReason("the error")
+	assert.True(t, retryable, "Expected unclassified reasons to be retryable")
+	assert.Equal(t, "the error", reason, "Expected unclassified reasons to be unchanged")
+}
+
+func TestResultWhenLargerThanMaxResultBytesExpectsLargeResultHandlerOrFailure(t *testing.T) {
+	// arrange
+	task := &swf.PollForActivityTaskOutput{
+		WorkflowExecution: &swf.WorkflowExecution{},
+		ActivityType:      &swf.ActivityType{Name: S("activity")},
+		ActivityId:        S("the-id"),
+	}
+	unhandledOps := &MockSWF{}
+	unhandled := &ActivityWorker{SWF: unhandledOps, MaxResultBytes: 16}
+	handledOps := &MockSWF{}
+	handled := &ActivityWorker{SWF: handledOps, MaxResultBytes: 16,
+		LargeResultHandler: func(activityTask *swf.PollForActivityTaskOutput, result string) (string, error) {
+			return "s3://" + LS(activityTask.ActivityId), nil
+		},
+	}
+	smallOps := &MockSWF{}
+	small := &ActivityWorker{SWF: smallOps, MaxResultBytes: 16}
+
+	// act
+	unhandled.result(task, fsm.JSONStateSerializer{}, "a result that is too large")
+	handled.result(task, fsm.JSONStateSerializer{}, "a result that is too large")
+	small.result(task, fsm.JSONStateSerializer{}, "small")
+
+	// assert
+	assert.True(t, unhandledOps.Failed, "Expected the activity failed without a LargeResultHandler")
+	assert.False(t, unhandledOps.CompletedSet)
+	assert.Contains(t, *unhandledOps.FailedReason, "exceeds MaxResultBytes 16")
+	assert.Equal(t, "s3://the-id", LS(handledOps.Completed), "Expected the result of the LargeResultHandler")
+	assert.Equal(t, "small", LS(smallOps.Completed), "Expected a small result completed as is")
+}
@@ -1,12 +1,14 @@
 package fsm
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"io"
 	"strings"
 
 	"sort"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -19,22 +21,36 @@ import (
 
 type FSMClient interface {
 	GetState(id string) (string, interface{}, error)
+	GetStateNameFast(id string) (string, error)
+	StateHistogram(req *swf.ListOpenWorkflowExecutionsInput) (map[string]int, error)
 	GetStateForRun(workflow, run string) (string, interface{}, error)
+	GetSerializedState(id string) (*SerializedState, error)
 	GetSerializedStateForRun(workflow, run string) (*SerializedState, *swf.GetWorkflowExecutionHistoryOutput, error)
+	GetSerializedStateAndCorrelatorForRun(workflow, run string) (*SerializedState, *EventCorrelator, error)
 	Signal(id string, signal string, input interface{}) error
+	SignalWithRetry(id string, signal string, input interface{}, retries int, delay time.Duration) error
 	Start(startTemplate swf.StartWorkflowExecutionInput, id string, input interface{}) (*swf.StartWorkflowExecutionOutput, error)
+	StartOrGet(startTemplate swf.StartWorkflowExecutionInput, id string, input interface{}) (runId string, started bool, state string, data interface{}, err error)
+	StartIfNotExists(startTemplate swf.StartWorkflowExecutionInput, id string, input interface{}) (runId string, started bool, err error)
 	RequestCancel(id string) error
+	Terminate(id string, reason, details string) error
 	GetWorkflowExecutionHistoryPages(execution *swf.WorkflowExecution, fn func(p *swf.GetWorkflowExecutionHistoryOutput, lastPage bool) (shouldContinue bool)) error
 	GetWorkflowExecutionHistoryFromReader(reader io.Reader) (*swf.GetWorkflowExecutionHistoryOutput, error)
 	FindAll(input *FindInput) (output *FindOutput, err error)
 	FindAllWalk(input *FindInput, fn func(info *swf.WorkflowExecutionInfo, done bool) (cont bool)) (err error)
 	FindLatestByWorkflowID(workflowID string) (exec *swf.WorkflowExecution, err error)
+	GetRunId(workflowId string) (string, error)
 	NewHistorySegmentor() HistorySegmentor
+	ExportSnapshots(workflowId string, w io.Writer) error
+	GetWorkflowFailure(id string) (*WorkflowFailure, error)
+	GetHistoryEvents(workflowId string, filter func(*swf.HistoryEvent) bool) ([]*swf.HistoryEvent, error)
+	GetHistoryEventsReverse(workflowId string, filter func(*swf.HistoryEvent) bool) ([]*swf.HistoryEvent, error)
 }
 
 type ClientSWFOps interface {
 	ListOpenWorkflowExecutions(req *swf.ListOpenWorkflowExecutionsInput) (resp *swf.WorkflowExecutionInfos, err error)
 	ListClosedWorkflowExecutions(req *swf.ListClosedWorkflowExecutionsInput) (resp *swf.WorkflowExecutionInfos, err error)
+	DescribeWorkflowExecution(req *swf.DescribeWorkflowExecutionInput) (resp *swf.DescribeWorkflowExecutionOutput, err error)
 	GetWorkflowExecutionHistory(req *swf.GetWorkflowExecutionHistoryInput) (resp *swf.GetWorkflowExecutionHistoryOutput, err error)
 	GetWorkflowExecutionHistoryPages(input *swf.GetWorkflowExecutionHistoryInput, fn func(p *swf.GetWorkflowExecutionHistoryOutput, lastPage bool) (shouldContinue bool)) error
 	SignalWorkflowExecution(req *swf.SignalWorkflowExecutionInput) (resp *swf.SignalWorkflowExecutionOutput, err error)
@@ -104,6 +120,52 @@ func (c *client) GetSerializedStateForRun(id, run string) (*SerializedState, *sw
 	return nil, nil, err
 }
 
+// GetSerializedStateAndCorrelatorForRun walks the history of the run once, newest first, until both the
+// most recent state marker and correlator marker are found, falling back to the start input of the run for both.
+func (c *client) GetSerializedStateAndCorrelatorForRun(id, run string) (*SerializedState, *EventCorrelator, error) {
+	var (
+		state      *SerializedState
+		correlator *EventCorrelator
+		err        error
+	)
+
+	eachPage := func(historyPage *swf.GetWorkflowExecutionHistoryOutput, lastPage bool) (shouldContinue bool) {
+		for _, event := range historyPage.Events {
+			if state == nil && err == nil {
+				state, err = c.f.statefulHistoryEventToSerializedState(event)
+			}
+			if correlator == nil && err == nil && (c.f.isCorrelatorMarker(event) || *event.EventType == swf.EventTypeWorkflowExecutionStarted) {
+				correlator, err = c.f.findSerializedEventCorrelator([]*swf.HistoryEvent{event})
+			}
+		}
+		return !lastPage && err == nil && (state == nil || correlator == nil)
+	}
+
+	pagingErr := c.c.GetWorkflowExecutionHistoryPages(&swf.GetWorkflowExecutionHistoryInput{
+		Domain: S(c.f.Domain),
+		Execution: &swf.WorkflowExecution{
+			WorkflowId: S(id),
+			RunId:      S(run),
+		},
+		ReverseOrder: aws.Bool(true),
+	}, eachPage)
+
+	if pagingErr != nil {
+		Log.Printf("component=client fn=GetSerializedStateAndCorrelatorForRun at=get-history error=%q", pagingErr)
+		return nil, nil, pagingErr
+	}
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if state == nil {
+		return nil, nil, &ErrNoSerializedState{}
+	}
+	if correlator == nil {
+		correlator = &EventCorrelator{Serializer: c.f.SystemSerializer}
+	}
+	return state, correlator, nil
+}
+
 func (c *client) GetStateForRun(id, run string) (string, interface{}, error) {
 	serialized, _, err := c.GetSerializedStateForRun(id, run)
 	if err != nil {
@@ -121,11 +183,82 @@ func (c *client) GetStateForRun(id, run string) (string, interface{}, error) {
 }
 
 func (c *client) GetState(id string) (string, interface{}, error) {
-	execution, err := c.FindLatestByWorkflowID(id)
+	runId, err := c.GetRunId(id)
 	if err != nil {
 		return "", nil, err
 	}
-	return c.GetStateForRun(id, *execution.RunId)
+	return c.GetStateForRun(id, runId)
+}
+
+// GetSerializedState returns the SerializedState of the latest run of the workflow,
+// whose EnteredAt tells how long the workflow has been in its state.
+func (c *client) GetSerializedState(id string) (*SerializedState, error) {
+	runId, err := c.GetRunId(id)
+	if err != nil {
+		return nil, err
+	}
+	state, _, err := c.GetSerializedStateForRun(id, runId)
+	return state, err
+}
+
+// GetStateNameFast returns the state name of the latest run of the workflow by reading the latestExecutionContext
+// from DescribeWorkflowExecution, which the FSM sets to the state name, rather than reading history.
+// Only the state name is available this way, use GetState if the data is needed.
+func (c *client) GetStateNameFast(id string) (string, error) {
+	runId, err := c.GetRunId(id)
+	if err != nil {
+		return "", err
+	}
+	return c.getStateNameFastForRun(&swf.WorkflowExecution{WorkflowId: S(id), RunId: S(runId)})
+}
+
+func (c *client) getStateNameFastForRun(execution *swf.WorkflowExecution) (string, error) {
+	resp, err := c.c.DescribeWorkflowExecution(&swf.DescribeWorkflowExecutionInput{
+		Domain:    S(c.f.Domain),
+		Execution: execution,
+	})
+	if err != nil {
+		Log.Printf("component=client fn=GetStateNameFast at=describe-workflow-execution error=%q", err)
+		return "", err
+	}
+	if resp.LatestExecutionContext == nil {
+		return "", errors.Trace(fmt.Errorf("no execution context for id %s", LS(execution.WorkflowId)))
+	}
+	return ExecutionContextStateName(*resp.LatestExecutionContext), nil
+}
+
+// StateHistogram walks the open workflow executions listed by req, and counts them per state name.
+// The state name is read from the latestExecutionContext as in GetStateNameFast, falling back to history
+// for executions that have no execution context yet. The Domain defaults to the Domain of the FSM,
+// and the StartTimeFilter required by SWF must be set. The req is not modified.
+func (c *client) StateHistogram(req *swf.ListOpenWorkflowExecutionsInput) (map[string]int, error) {
+	page := *req
+	if page.Domain == nil {
+		page.Domain = S(c.f.Domain)
+	}
+	histogram := make(map[string]int)
+	for {
+		resp, err := c.c.ListOpenWorkflowExecutions(&page)
+		if err != nil {
+			Log.Printf("component=client fn=StateHistogram at=list-open-workflow-executions error=%q", err)
+			return nil, err
+		}
+		for _, info := range resp.ExecutionInfos {
+			state, err := c.getStateNameFastForRun(info.Execution)
+			if err != nil {
+				serialized, _, historyErr := c.GetSerializedStateForRun(LS(info.Execution.WorkflowId), LS(info.Execution.RunId))
+				if historyErr != nil {
+					return nil, historyErr
+				}
+				state = serialized.StateName
+			}
+			histogram[state]++
+		}
+		if resp.NextPageToken == nil {
+			return histogram, nil
+		}
+		page.NextPageToken = resp.NextPageToken
+	}
 }
 
 func (c *client) Signal(id string, signal string, input interface{}) error {
@@ -151,6 +284,25 @@ func (c *client) Signal(id string, signal string, input interface{}) error {
 	return err
 }
 
+// SignalWithRetry signals the workflow, retrying up to retries times with the given delay if the workflow
+// is not yet known to SWF, as can happen right after it is started. Other errors are returned immediately.
+func (c *client) SignalWithRetry(id string, signal string, input interface{}, retries int, delay time.Duration) error {
+	err := c.Signal(id, signal, input)
+	for i := 0; i < retries && isSignalRetryable(err); i++ {
+		Log.Printf("component=client fn=SignalWithRetry at=retry workflow-id=%s signal=%s attempt=%d error=%q", id, signal, i+1, err)
+		time.Sleep(delay)
+		err = c.Signal(id, signal, input)
+	}
+	return err
+}
+
+func isSignalRetryable(err error) bool {
+	if ae, ok := err.(awserr.Error); ok {
+		return ae.Code() == ErrorTypeUnknownResourceFault || ae.Code() == ErrorTypeOperationNotPermittedFault
+	}
+	return false
+}
+
 func (c *client) Start(startTemplate swf.StartWorkflowExecutionInput, id string, input interface{}) (*swf.StartWorkflowExecutionOutput, error) {
 	var serializedInput *string
 	if input != nil {
@@ -162,9 +314,47 @@ func (c *client) Start(startTemplate swf.StartWorkflowExecutionInput, id string,
 	if len(startTemplate.TagList) == 0 {
 		startTemplate.TagList = GetTagsIfTaggable(input)
 	}
+	if startTemplate.WorkflowType == nil && c.f.WorkflowType != nil {
+		startTemplate.WorkflowType = &swf.WorkflowType{Name: c.f.WorkflowType.Name, Version: c.f.WorkflowType.Version}
+	}
 	return c.c.StartWorkflowExecution(&startTemplate)
 }
 
+// StartOrGet starts the workflow, or if it is already running, returns the run id, state name and state data of the
+// existing run. started is true only when this call started the workflow, in which case state and data are empty.
+func (c *client) StartOrGet(startTemplate swf.StartWorkflowExecutionInput, id string, input interface{}) (string, bool, string, interface{}, error) {
+	runId, started, err := c.StartIfNotExists(startTemplate, id, input)
+	if err != nil || started {
+		return runId, started, "", nil, err
+	}
+	state, data, err := c.GetStateForRun(id, runId)
+	if err != nil {
+		return "", false, "", nil, err
+	}
+	return runId, false, state, data, nil
+}
+
+// StartIfNotExists starts the workflow, or if it is already running, returns the run id of the existing run,
+// so that callers retrying a start, e.g. after a network error, do not fail on the run started by an earlier attempt.
+// started is true only when this call started the workflow.
+func (c *client) StartIfNotExists(startTemplate swf.StartWorkflowExecutionInput, id string, input interface{}) (string, bool, error) {
+	resp, err := c.Start(startTemplate, id, input)
+	if err == nil {
+		return *resp.RunId, true, nil
+	}
+	if ae, ok := err.(awserr.Error); !ok || ae.Code() != ErrorTypeWorkflowExecutionAlreadyStartedFault {
+		return "", false, err
+	}
+
+	runId, err := c.GetRunId(id)
+	if err != nil {
+		Log.Printf("component=client fn=StartIfNotExists at=get-run-id workflow-id=%s error=%q", id, err)
+		return "", false, err
+	}
+	return runId, false, nil
+}
+
+// RequestCancel requests the cancellation of the open run of the workflow.
 func (c *client) RequestCancel(id string) error {
 	_, err := c.c.RequestCancelWorkflowExecution(&swf.RequestCancelWorkflowExecutionInput{
 		Domain:     S(c.f.Domain),
@@ -173,6 +363,31 @@ func (c *client) RequestCancel(id string) error {
 	return err
 }
 
+// Terminate terminates the latest run of the workflow with the given reason and details, which are recorded in its history.
+// Empty reason or details are omitted.
+func (c *client) Terminate(id string, reason, details string) error {
+	runId, err := c.GetRunId(id)
+	if err != nil {
+		return err
+	}
+	req := &swf.TerminateWorkflowExecutionInput{
+		Domain:     S(c.f.Domain),
+		WorkflowId: S(id),
+		RunId:      S(runId),
+	}
+	if reason != "" {
+		req.Reason = S(reason)
+	}
+	if details != "" {
+		req.Details = S(details)
+	}
+	_, err = c.c.TerminateWorkflowExecution(req)
+	if err != nil {
+		Log.Printf("component=client fn=Terminate at=terminate-workflow-execution workflow-id=%s run-id=%s error=%q", id, runId, err)
+	}
+	return err
+}
+
 func (c *client) GetWorkflowExecutionHistoryPages(execution *swf.WorkflowExecution, fn func(p *swf.GetWorkflowExecutionHistoryOutput, lastPage bool) (shouldContinue bool)) error {
 	req := &swf.GetWorkflowExecutionHistoryInput{
 		Domain:       S(c.f.Domain),
@@ -204,6 +419,118 @@ func (c *client) NewHistorySegmentor() HistorySegmentor {
 	return NewHistorySegmentor(c)
 }
 
+// ExportSnapshots streams the HistorySegments of every run of the workflow to w, one JSON document per line.
+// Runs are walked from the latest back through ContinuedExecutionRunId, and are written as each history page is segmented,
+// so segments appear newest first.
+func (c *client) ExportSnapshots(workflowId string, w io.Writer) error {
+	latestRunId, err := c.GetRunId(workflowId)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	runId := S(latestRunId)
+	for runId != nil {
+		var segmentErr error
+		var continuedRunId *string
+
+		segmentor := c.NewHistorySegmentor()
+		segmentor.OnSegment(func(segment HistorySegment) {
+			if segmentErr != nil {
+				return
+			}
+			if segment.ContinuedExecutionRunId != nil {
+				continuedRunId = segment.ContinuedExecutionRunId
+			}
+			segmentErr = enc.Encode(segment)
+		})
+		segmentor.OnError(func(err error) {
+			segmentErr = err
+		})
+
+		execution := &swf.WorkflowExecution{WorkflowId: S(workflowId), RunId: runId}
+		err := c.GetWorkflowExecutionHistoryPages(execution, func(p *swf.GetWorkflowExecutionHistoryOutput, lastPage bool) bool {
+			return segmentor.FromPage(p, lastPage) && segmentErr == nil
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if segmentErr != nil {
+			return errors.Trace(segmentErr)
+		}
+
+		runId = continuedRunId
+	}
+
+	return nil
+}
+
+// GetWorkflowFailure returns the failure recorded by FSMContext.FailWorkflowStructured or FailWorkflowWithFailure in the latest run of the workflow,
+// or nil if there is none.
+func (c *client) GetWorkflowFailure(id string) (*WorkflowFailure, error) {
+	runId, err := c.GetRunId(id)
+	if err != nil {
+		return nil, err
+	}
+	exec := &swf.WorkflowExecution{WorkflowId: S(id), RunId: S(runId)}
+
+	var failure *WorkflowFailure
+	var failureErr error
+	err = c.GetWorkflowExecutionHistoryPages(exec, func(p *swf.GetWorkflowExecutionHistoryOutput, lastPage bool) bool {
+		for _, e := range p.Events {
+			if *e.EventType == swf.EventTypeMarkerRecorded && *e.MarkerRecordedEventAttributes.MarkerName == FailureMarker {
+				failure = &WorkflowFailure{}
+				failureErr = json.Unmarshal([]byte(*e.MarkerRecordedEventAttributes.Details), failure)
+				return false
+			}
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if failureErr != nil {
+		return nil, errors.Trace(failureErr)
+	}
+	return failure, nil
+}
+
+// GetHistoryEvents pages through the history of the latest run of the workflow, oldest first, and returns the events matching filter.
+// A nil filter matches every event.
+func (c *client) GetHistoryEvents(workflowId string, filter func(*swf.HistoryEvent) bool) ([]*swf.HistoryEvent, error) {
+	return c.getHistoryEvents(workflowId, filter, false)
+}
+
+// GetHistoryEventsReverse is GetHistoryEvents, with the events returned newest first.
+func (c *client) GetHistoryEventsReverse(workflowId string, filter func(*swf.HistoryEvent) bool) ([]*swf.HistoryEvent, error) {
+	return c.getHistoryEvents(workflowId, filter, true)
+}
+
+func (c *client) getHistoryEvents(workflowId string, filter func(*swf.HistoryEvent) bool, reverse bool) ([]*swf.HistoryEvent, error) {
+	runId, err := c.GetRunId(workflowId)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*swf.HistoryEvent
+	err = c.c.GetWorkflowExecutionHistoryPages(&swf.GetWorkflowExecutionHistoryInput{
+		Domain:       S(c.f.Domain),
+		Execution:    &swf.WorkflowExecution{WorkflowId: S(workflowId), RunId: S(runId)},
+		ReverseOrder: aws.Bool(reverse),
+	}, func(p *swf.GetWorkflowExecutionHistoryOutput, lastPage bool) bool {
+		for _, e := range p.Events {
+			if filter == nil || filter(e) {
+				events = append(events, e)
+			}
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return events, nil
+}
+
 func (c *client) FindAll(input *FindInput) (output *FindOutput, err error) {
 	return NewFinder(c.f.Domain, c.c).FindAll(input)
 }
@@ -236,6 +563,17 @@ func (c *client) FindAllWalk(input *FindInput, fn func(info *swf.WorkflowExecuti
 	return nil
 }
 
+// GetRunId returns the run id of the latest run of the workflow, which is the most recently started open run
+// when there are open runs, and the most recently started closed run otherwise, e.g. after the workflow completed.
+// It returns an error when the workflow is not found.
+func (c *client) GetRunId(workflowId string) (string, error) {
+	execution, err := c.FindLatestByWorkflowID(workflowId)
+	if err != nil {
+		return "", err
+	}
+	return LS(execution.RunId), nil
+}
+
 func (c *client) FindLatestByWorkflowID(workflowID string) (exec *swf.WorkflowExecution, err error) {
 	ex, err := NewFinder(c.f.Domain, c.c).FindLatestByWorkflowID(workflowID)
 	if err == nil && ex == nil {
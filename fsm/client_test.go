@@ -1,6 +1,8 @@
 package fsm
 
 import (
+	"bytes"
+	"encoding/json"
 	"os"
 	"reflect"
 	"testing"
@@ -10,12 +12,14 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/swf"
 	"github.com/pborman/uuid"
 	. "github.com/sclasen/swfsm/log"
 	"github.com/sclasen/swfsm/migrator"
+	. "github.com/sclasen/swfsm/sugar"
 	"github.com/sclasen/swfsm/testing/mocks"
 )
 
@@ -161,6 +165,32 @@ func TestStringDoesntSerialize(t *testing.T) {
 	mockSwf.AssertExpectations(t)
 }
 
+func TestSignalWithRetryWhenUnknownResourceExpectsRetriedUntilSuccess(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_SignalWorkflowExecution().Return(nil, awserr.New(ErrorTypeUnknownResourceFault, "not yet", nil)).Once()
+	mockSwf.MockOnAny_SignalWorkflowExecution().Return(nil, nil).Once()
+
+	err := NewFSMClient(dummyFsm(), mockSwf).SignalWithRetry("wf", "signal", "simple", 3, time.Millisecond)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockSwf.AssertExpectations(t)
+	mockSwf.AssertNumberOfCalls(t, "SignalWorkflowExecution", 2)
+}
+
+func TestSignalWithRetryWhenOtherErrorExpectsNoRetry(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_SignalWorkflowExecution().Return(nil, awserr.New("ValidationException", "bad", nil))
+
+	err := NewFSMClient(dummyFsm(), mockSwf).SignalWithRetry("wf", "signal", "simple", 3, time.Millisecond)
+
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	mockSwf.AssertNumberOfCalls(t, "SignalWorkflowExecution", 1)
+}
+
 func TestFindAll_Empty(t *testing.T) {
 	input := &FindInput{}
 
@@ -580,6 +610,89 @@ func TestFindAll_FindLatestByWorkflowID(t *testing.T) {
 	mockSwf.AssertExpectations(t)
 }
 
+func TestGetStateNameFast(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_ListOpenWorkflowExecutions().Return(&swf.WorkflowExecutionInfos{
+		ExecutionInfos: []*swf.WorkflowExecutionInfo{
+			&swf.WorkflowExecutionInfo{
+				Execution:      &swf.WorkflowExecution{WorkflowId: aws.String("workflow-A"), RunId: aws.String("run-A")},
+				StartTimestamp: aws.Time(time.Now()),
+			},
+		},
+	}, nil)
+	mockSwf.MockOnAny_DescribeWorkflowExecution().Return(func(req *swf.DescribeWorkflowExecutionInput) *swf.DescribeWorkflowExecutionOutput {
+		if *req.Execution.RunId != "run-A" {
+			t.Fatal("not the latest run", req.Execution)
+		}
+		return &swf.DescribeWorkflowExecutionOutput{LatestExecutionContext: aws.String("working")}
+	}, nil)
+
+	state, err := NewFSMClient(dummyFsm(), mockSwf).GetStateNameFast("workflow-A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state != "working" {
+		t.Fatal(state)
+	}
+}
+
+func TestStateHistogram(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	execution := func(id string) *swf.WorkflowExecutionInfo {
+		return &swf.WorkflowExecutionInfo{
+			Execution:      &swf.WorkflowExecution{WorkflowId: aws.String(id), RunId: aws.String("run-" + id)},
+			StartTimestamp: aws.Time(time.Now()),
+		}
+	}
+	mockSwf.MockOnTyped_ListOpenWorkflowExecutions(&swf.ListOpenWorkflowExecutionsInput{
+		Domain: aws.String(dummyFsm().Domain),
+	}).Return(&swf.WorkflowExecutionInfos{
+		ExecutionInfos: []*swf.WorkflowExecutionInfo{execution("A"), execution("B")},
+		NextPageToken:  aws.String("page-2"),
+	}, nil)
+	mockSwf.MockOnTyped_ListOpenWorkflowExecutions(&swf.ListOpenWorkflowExecutionsInput{
+		Domain:        aws.String(dummyFsm().Domain),
+		NextPageToken: aws.String("page-2"),
+	}).Return(&swf.WorkflowExecutionInfos{
+		ExecutionInfos: []*swf.WorkflowExecutionInfo{execution("C")},
+	}, nil)
+	mockSwf.MockOnAny_DescribeWorkflowExecution().Return(func(req *swf.DescribeWorkflowExecutionInput) *swf.DescribeWorkflowExecutionOutput {
+		if *req.Execution.WorkflowId == "C" {
+			//not decided yet
+			return &swf.DescribeWorkflowExecutionOutput{}
+		}
+		return &swf.DescribeWorkflowExecutionOutput{LatestExecutionContext: aws.String("working" + ExecutionContextSeparator + *req.Execution.WorkflowId)}
+	}, nil)
+	fsm := dummyFsm()
+	mockSwf.MockOnAny_GetWorkflowExecutionHistoryPages().Return(
+		func(input *swf.GetWorkflowExecutionHistoryInput, pager func(*swf.GetWorkflowExecutionHistoryOutput, bool) bool) error {
+			if *input.Execution.WorkflowId != "C" {
+				t.Fatal("expected history to be read only without an execution context", input.Execution)
+			}
+			pager(&swf.GetWorkflowExecutionHistoryOutput{Events: []*swf.HistoryEvent{
+				EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+					Input: StartFSMWorkflowInput(fsm, new(TestData)),
+				}),
+			}}, true)
+			return nil
+		},
+	)
+
+	req := &swf.ListOpenWorkflowExecutionsInput{}
+	histogram, err := NewFSMClient(fsm, mockSwf).StateHistogram(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(histogram) != 2 || histogram["working"] != 2 || histogram["initial"] != 1 {
+		t.Fatal(histogram)
+	}
+	if req.Domain != nil || req.NextPageToken != nil {
+		t.Fatal("expected the request not to be modified", req)
+	}
+}
+
 func TestFindAll_OpenPriorityWorkflow_ByTagIncludingContinuations(t *testing.T) {
 	input := &FindInput{
 		StatusFilter: FilterStatusOpenPriorityWorkflow,
@@ -754,6 +867,38 @@ func TestEmptyFindLatestByWorkflowID(t *testing.T) {
 	mockSwf.AssertExpectations(t)
 }
 
+func TestClient_GetRunId(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_ListOpenWorkflowExecutions().Return(&swf.WorkflowExecutionInfos{
+		ExecutionInfos: []*swf.WorkflowExecutionInfo{
+			&swf.WorkflowExecutionInfo{
+				Execution:      &swf.WorkflowExecution{WorkflowId: aws.String("workflow-A"), RunId: aws.String("run-A")},
+				StartTimestamp: aws.Time(time.Now()),
+			},
+		},
+	}, nil)
+
+	runId, err := NewFSMClient(dummyFsm(), mockSwf).GetRunId("workflow-A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if runId != "run-A" {
+		t.Fatal(runId)
+	}
+	mockSwf.AssertNumberOfCalls(t, "ListClosedWorkflowExecutions", 0)
+}
+
+func TestClient_GetRunIdWhenNotFound(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_ListOpenWorkflowExecutions().Return(&swf.WorkflowExecutionInfos{}, nil)
+	mockSwf.MockOnAny_ListClosedWorkflowExecutions().Return(&swf.WorkflowExecutionInfos{}, nil)
+
+	if _, err := NewFSMClient(dummyFsm(), mockSwf).GetRunId("workflow-A"); err == nil {
+		t.Fatal("expected an error when no runs")
+	}
+}
+
 func TestClient_FindAllWalk(t *testing.T) {
 	mockSwf := setupFindAllWalkMocks()
 
@@ -960,6 +1105,407 @@ func Test_Client_GetSerializedStateForRun(t *testing.T) {
 	}
 }
 
+func Test_Client_GetSerializedStateAndCorrelatorForRun(t *testing.T) {
+	state := &SerializedState{
+		StateVersion: 2,
+		StateName:    "testing",
+		StateData:    "{}",
+		WorkflowId:   "test-workflow-id",
+	}
+	stateMarker, _ := JSONStateSerializer{}.Serialize(state)
+	correlatorMarker, _ := JSONStateSerializer{}.Serialize(&EventCorrelator{
+		Activities: map[string]*ActivityInfo{"1": {ActivityId: "activity-id"}},
+	})
+
+	pages := []*swf.GetWorkflowExecutionHistoryOutput{
+		{Events: []*swf.HistoryEvent{
+			{
+				EventType:                     aws.String(swf.EventTypeMarkerRecorded),
+				MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{Details: aws.String(stateMarker), MarkerName: aws.String(StateMarker)},
+			},
+		}},
+		{Events: []*swf.HistoryEvent{
+			{
+				EventType:                     aws.String(swf.EventTypeMarkerRecorded),
+				MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{Details: aws.String(correlatorMarker), MarkerName: aws.String(CorrelatorMarker)},
+			},
+		}},
+	}
+
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_GetWorkflowExecutionHistoryPages().Return(
+		func(input *swf.GetWorkflowExecutionHistoryInput, pager func(*swf.GetWorkflowExecutionHistoryOutput, bool) bool) error {
+			for i, historyPage := range pages {
+				if !pager(historyPage, i == len(pages)-1) {
+					return nil
+				}
+			}
+			return nil
+		},
+	).Once()
+
+	gotState, gotCorrelator, err := NewFSMClient(dummyFsm(), mockSwf).GetSerializedStateAndCorrelatorForRun("test-workflow-id", "test-run-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotState, state) {
+		t.Fatalf("gotState = %v, want %v", gotState, state)
+	}
+	if gotCorrelator.Activities["1"].ActivityId != "activity-id" {
+		t.Fatalf("gotCorrelator = %v", gotCorrelator)
+	}
+	mockSwf.AssertExpectations(t)
+}
+
+func Test_Client_GetSerializedStateAndCorrelatorForRunWhenContinuedWithCorrelator(t *testing.T) {
+	correlator, _ := JSONStateSerializer{}.Serialize(&EventCorrelator{
+		Activities: map[string]*ActivityInfo{"1": {ActivityId: "activity-id"}},
+	})
+	input, _ := JSONStateSerializer{}.Serialize(&SerializedState{
+		StateVersion:    3,
+		StateName:       "testing",
+		StateData:       "{}",
+		WorkflowId:      "test-workflow-id",
+		EventCorrelator: correlator,
+	})
+	startedEvent := &swf.HistoryEvent{
+		EventType:                               aws.String(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{Input: aws.String(input)},
+	}
+
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_GetWorkflowExecutionHistoryPages().Return(
+		func(input *swf.GetWorkflowExecutionHistoryInput, pager func(*swf.GetWorkflowExecutionHistoryOutput, bool) bool) error {
+			pager(&swf.GetWorkflowExecutionHistoryOutput{Events: []*swf.HistoryEvent{startedEvent}}, true)
+			return nil
+		},
+	).Once()
+
+	gotState, gotCorrelator, err := NewFSMClient(dummyFsm(), mockSwf).GetSerializedStateAndCorrelatorForRun("test-workflow-id", "test-run-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotState.StateName != "testing" || gotState.StateVersion != 3 {
+		t.Fatalf("gotState = %v", gotState)
+	}
+	if gotCorrelator.Activities["1"] == nil || gotCorrelator.Activities["1"].ActivityId != "activity-id" {
+		t.Fatalf("expected the correlator carried in the start input, gotCorrelator = %v", gotCorrelator)
+	}
+	mockSwf.AssertExpectations(t)
+}
+
+func TestClient_ExportSnapshots(t *testing.T) {
+	fsm := dummyFsm()
+	histories := map[string][]*swf.HistoryEvent{
+		"run-2": {
+			{
+				EventId:   aws.Int64(1),
+				EventType: aws.String(swf.EventTypeWorkflowExecutionStarted),
+				WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+					Input:                   StartFSMWorkflowInput(fsm, &TestData{States: []string{"second"}}),
+					ContinuedExecutionRunId: aws.String("run-1"),
+				},
+			},
+		},
+		"run-1": {
+			{
+				EventId:   aws.Int64(1),
+				EventType: aws.String(swf.EventTypeWorkflowExecutionStarted),
+				WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+					Input: StartFSMWorkflowInput(fsm, &TestData{States: []string{"first"}}),
+				},
+			},
+		},
+	}
+
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_ListOpenWorkflowExecutions().Return(&swf.WorkflowExecutionInfos{
+		ExecutionInfos: []*swf.WorkflowExecutionInfo{
+			&swf.WorkflowExecutionInfo{
+				Execution:      &swf.WorkflowExecution{WorkflowId: aws.String("workflow-A"), RunId: aws.String("run-2")},
+				StartTimestamp: aws.Time(time.Now()),
+			},
+		},
+	}, nil)
+	mockSwf.MockOnAny_GetWorkflowExecutionHistoryPages().Return(
+		func(input *swf.GetWorkflowExecutionHistoryInput, pager func(*swf.GetWorkflowExecutionHistoryOutput, bool) bool) error {
+			pager(&swf.GetWorkflowExecutionHistoryOutput{Events: histories[*input.Execution.RunId]}, true)
+			return nil
+		},
+	)
+
+	out := &bytes.Buffer{}
+	err := NewFSMClient(fsm, mockSwf).ExportSnapshots("workflow-A", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal(lines)
+	}
+	for i, expected := range []string{"second", "first"} {
+		segment := HistorySegment{}
+		if err := json.Unmarshal([]byte(lines[i]), &segment); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(lines[i], expected) {
+			t.Fatal(i, lines[i])
+		}
+	}
+	mockSwf.AssertNumberOfCalls(t, "GetWorkflowExecutionHistoryPages", 2)
+}
+
+func TestClient_GetWorkflowFailure(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_ListOpenWorkflowExecutions().Return(&swf.WorkflowExecutionInfos{
+		ExecutionInfos: []*swf.WorkflowExecutionInfo{
+			&swf.WorkflowExecutionInfo{
+				Execution:      &swf.WorkflowExecution{WorkflowId: aws.String("workflow-A"), RunId: aws.String("run-A")},
+				StartTimestamp: aws.Time(time.Now()),
+			},
+		},
+	}, nil)
+	outcome := (&FSMContext{}).FailWorkflowWithFailure(nil, WorkflowFailure{Code: "code", Message: "message", Action: "action", Retriable: true})
+	mockSwf.MockOnAny_GetWorkflowExecutionHistoryPages().Return(
+		func(input *swf.GetWorkflowExecutionHistoryInput, pager func(*swf.GetWorkflowExecutionHistoryOutput, bool) bool) error {
+			pager(&swf.GetWorkflowExecutionHistoryOutput{Events: []*swf.HistoryEvent{
+				EventFromPayload(2, &swf.WorkflowExecutionFailedEventAttributes{Reason: aws.String("code")}),
+				EventFromPayload(1, &swf.MarkerRecordedEventAttributes{
+					MarkerName: outcome.Decisions[0].RecordMarkerDecisionAttributes.MarkerName,
+					Details:    outcome.Decisions[0].RecordMarkerDecisionAttributes.Details,
+				}),
+			}}, true)
+			return nil
+		},
+	)
+
+	failure, err := NewFSMClient(dummyFsm(), mockSwf).GetWorkflowFailure("workflow-A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &WorkflowFailure{Code: "code", Message: "message", Action: "action", Retriable: true}
+	if !reflect.DeepEqual(failure, expected) {
+		t.Fatal(failure)
+	}
+}
+
+func TestClient_GetHistoryEvents(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_ListOpenWorkflowExecutions().Return(&swf.WorkflowExecutionInfos{
+		ExecutionInfos: []*swf.WorkflowExecutionInfo{
+			&swf.WorkflowExecutionInfo{
+				Execution:      &swf.WorkflowExecution{WorkflowId: aws.String("workflow-A"), RunId: aws.String("run-A")},
+				StartTimestamp: aws.Time(time.Now()),
+			},
+		},
+	}, nil)
+	signal := func(id int) *swf.HistoryEvent {
+		return EventFromPayload(id, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: aws.String("signal")})
+	}
+	timer := func(id int) *swf.HistoryEvent {
+		return EventFromPayload(id, &swf.TimerFiredEventAttributes{TimerId: aws.String("timer")})
+	}
+	mockSwf.MockOnAny_GetWorkflowExecutionHistoryPages().Return(
+		func(input *swf.GetWorkflowExecutionHistoryInput, pager func(*swf.GetWorkflowExecutionHistoryOutput, bool) bool) error {
+			if *input.Execution.RunId != "run-A" {
+				t.Fatal("expected the latest run", input.Execution)
+			}
+			pages := [][]*swf.HistoryEvent{{signal(1), timer(2)}, {signal(3), timer(4)}}
+			if *input.ReverseOrder {
+				pages = [][]*swf.HistoryEvent{{timer(4), signal(3)}, {timer(2), signal(1)}}
+			}
+			for i, page := range pages {
+				if !pager(&swf.GetWorkflowExecutionHistoryOutput{Events: page}, i == len(pages)-1) {
+					break
+				}
+			}
+			return nil
+		},
+	)
+	signals := func(e *swf.HistoryEvent) bool {
+		return *e.EventType == swf.EventTypeWorkflowExecutionSignaled
+	}
+	client := NewFSMClient(dummyFsm(), mockSwf)
+
+	events, err := client.GetHistoryEvents("workflow-A", signals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || *events[0].EventId != 1 || *events[1].EventId != 3 {
+		t.Fatal("expected signals across pages oldest first", events)
+	}
+
+	events, err = client.GetHistoryEventsReverse("workflow-A", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 4 || *events[0].EventId != 4 || *events[3].EventId != 1 {
+		t.Fatal("expected every event newest first", events)
+	}
+}
+
+func TestClient_GetSerializedState(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_ListOpenWorkflowExecutions().Return(&swf.WorkflowExecutionInfos{
+		ExecutionInfos: []*swf.WorkflowExecutionInfo{
+			&swf.WorkflowExecutionInfo{
+				Execution:      &swf.WorkflowExecution{WorkflowId: aws.String("workflow-A"), RunId: aws.String("run-A")},
+				StartTimestamp: aws.Time(time.Now()),
+			},
+		},
+	}, nil)
+	enteredAt := time.Unix(1500000000, 0).UTC()
+	fsm := dummyFsm()
+	marker, _ := fsm.SystemSerializer.Serialize(&SerializedState{StateName: "waiting", StateData: "{}", EnteredAt: &enteredAt})
+	mockSwf.MockOnAny_GetWorkflowExecutionHistoryPages().Return(
+		func(input *swf.GetWorkflowExecutionHistoryInput, pager func(*swf.GetWorkflowExecutionHistoryOutput, bool) bool) error {
+			pager(&swf.GetWorkflowExecutionHistoryOutput{Events: []*swf.HistoryEvent{
+				EventFromPayload(1, &swf.MarkerRecordedEventAttributes{
+					MarkerName: aws.String(StateMarker),
+					Details:    aws.String(marker),
+				}),
+			}}, true)
+			return nil
+		},
+	)
+
+	state, err := NewFSMClient(fsm, mockSwf).GetSerializedState("workflow-A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.StateName != "waiting" || state.EnteredAt == nil || !state.EnteredAt.Equal(enteredAt) {
+		t.Fatal(state)
+	}
+}
+
+func TestClient_StartOrGetWhenNotRunningExpectsStarted(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_StartWorkflowExecution().Return(&swf.StartWorkflowExecutionOutput{RunId: aws.String("run-A")}, nil)
+
+	runId, started, state, data, err := NewFSMClient(dummyFsm(), mockSwf).StartOrGet(swf.StartWorkflowExecutionInput{}, "workflow-A", &TestData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if runId != "run-A" || !started || state != "" || data != nil {
+		t.Fatal(runId, started, state, data)
+	}
+}
+
+func TestClient_StartOrGetWhenAlreadyStartedExpectsExistingRun(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_StartWorkflowExecution().Return(nil, awserr.New(ErrorTypeWorkflowExecutionAlreadyStartedFault, "already started", nil))
+	mockSwf.MockOnAny_ListOpenWorkflowExecutions().Return(&swf.WorkflowExecutionInfos{
+		ExecutionInfos: []*swf.WorkflowExecutionInfo{
+			&swf.WorkflowExecutionInfo{
+				Execution:      &swf.WorkflowExecution{WorkflowId: aws.String("workflow-A"), RunId: aws.String("run-A")},
+				StartTimestamp: aws.Time(time.Now()),
+			},
+		},
+	}, nil)
+	fsm := dummyFsm()
+	marker, _ := fsm.SystemSerializer.Serialize(&SerializedState{StateName: "waiting", StateData: `{"States":["one"]}`})
+	mockSwf.MockOnAny_GetWorkflowExecutionHistoryPages().Return(
+		func(input *swf.GetWorkflowExecutionHistoryInput, pager func(*swf.GetWorkflowExecutionHistoryOutput, bool) bool) error {
+			pager(&swf.GetWorkflowExecutionHistoryOutput{Events: []*swf.HistoryEvent{
+				EventFromPayload(1, &swf.MarkerRecordedEventAttributes{
+					MarkerName: aws.String(StateMarker),
+					Details:    aws.String(marker),
+				}),
+			}}, true)
+			return nil
+		},
+	)
+
+	runId, started, state, data, err := NewFSMClient(fsm, mockSwf).StartOrGet(swf.StartWorkflowExecutionInput{}, "workflow-A", &TestData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if runId != "run-A" || started || state != "waiting" {
+		t.Fatal(runId, started, state)
+	}
+	if testData, ok := data.(*TestData); !ok || len(testData.States) != 1 || testData.States[0] != "one" {
+		t.Fatal(data)
+	}
+}
+
+func TestClient_StartOrGetWhenOtherErrorExpectsError(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_StartWorkflowExecution().Return(nil, awserr.New("ValidationException", "bad", nil))
+
+	_, _, _, _, err := NewFSMClient(dummyFsm(), mockSwf).StartOrGet(swf.StartWorkflowExecutionInput{}, "workflow-A", &TestData{})
+
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	mockSwf.AssertNumberOfCalls(t, "ListOpenWorkflowExecutions", 0)
+}
+
+func TestClient_StartIfNotExistsWhenAlreadyStartedExpectsExistingRun(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_StartWorkflowExecution().Return(nil, awserr.New(ErrorTypeWorkflowExecutionAlreadyStartedFault, "already started", nil))
+	mockSwf.MockOnAny_ListOpenWorkflowExecutions().Return(&swf.WorkflowExecutionInfos{
+		ExecutionInfos: []*swf.WorkflowExecutionInfo{
+			&swf.WorkflowExecutionInfo{
+				Execution:      &swf.WorkflowExecution{WorkflowId: aws.String("workflow-A"), RunId: aws.String("run-A")},
+				StartTimestamp: aws.Time(time.Now()),
+			},
+		},
+	}, nil)
+
+	runId, started, err := NewFSMClient(dummyFsm(), mockSwf).StartIfNotExists(swf.StartWorkflowExecutionInput{}, "workflow-A", &TestData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if runId != "run-A" || started {
+		t.Fatal(runId, started)
+	}
+	mockSwf.AssertNumberOfCalls(t, "GetWorkflowExecutionHistoryPages", 0)
+}
+
+func TestClient_StartIfNotExistsWhenNotRunningExpectsStarted(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_StartWorkflowExecution().Return(&swf.StartWorkflowExecutionOutput{RunId: aws.String("run-B")}, nil)
+
+	runId, started, err := NewFSMClient(dummyFsm(), mockSwf).StartIfNotExists(swf.StartWorkflowExecutionInput{}, "workflow-B", &TestData{})
+
+	if err != nil || runId != "run-B" || !started {
+		t.Fatal(runId, started, err)
+	}
+	mockSwf.AssertNumberOfCalls(t, "ListOpenWorkflowExecutions", 0)
+}
+
+func TestClient_Terminate(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_ListOpenWorkflowExecutions().Return(&swf.WorkflowExecutionInfos{
+		ExecutionInfos: []*swf.WorkflowExecutionInfo{
+			&swf.WorkflowExecutionInfo{
+				Execution:      &swf.WorkflowExecution{WorkflowId: aws.String("workflow-A"), RunId: aws.String("run-A")},
+				StartTimestamp: aws.Time(time.Now()),
+			},
+		},
+	}, nil)
+	var terminated *swf.TerminateWorkflowExecutionInput
+	mockSwf.MockOnAny_TerminateWorkflowExecution().Return(func(req *swf.TerminateWorkflowExecutionInput) *swf.TerminateWorkflowExecutionOutput {
+		terminated = req
+		return &swf.TerminateWorkflowExecutionOutput{}
+	}, nil)
+
+	err := NewFSMClient(dummyFsm(), mockSwf).Terminate("workflow-A", "stuck", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if terminated == nil || *terminated.WorkflowId != "workflow-A" || *terminated.RunId != "run-A" || *terminated.Reason != "stuck" || terminated.Details != nil {
+		t.Fatal(terminated)
+	}
+}
+
 func setupFindAllWalkMocks() *mocks.SWFAPI {
 	mockSwf := &mocks.SWFAPI{}
 
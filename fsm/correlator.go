@@ -3,7 +3,9 @@ package fsm
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/swf"
 )
 
@@ -21,7 +23,28 @@ type EventCorrelator struct {
 	CancelationAttempts map[string]int               // workflowId -> attempts
 	Children            map[string]*ChildInfo        // initiatedEventID -> info
 	ChildrenAttempts    map[string]int               // workflowID -> attempts
-	Serializer          StateSerializer              `json:"-"`
+	Lambdas             map[string]*LambdaInfo       // scheduledEventId -> info
+	// ActivityProgress is the latest ActivityStartedSignal or ActivityUpdatedSignal of in-flight activities, by activityId.
+	// It is recorded in the correlator marker on every decision task, so its inputs are bounded by MaxActivityProgressInput.
+	ActivityProgress map[string]*ActivityProgressInfo `json:",omitempty"`
+	Serializer       StateSerializer                  `json:"-"`
+}
+
+// MaxActivityProgressInput is the longest progress Input kept in ActivityProgressInfo. Longer inputs are left out
+// of the correlator marker, and can be read from the signal event in history instead.
+// Since the correlator marker is recorded on every decision task, each write carries up to this many characters
+// per in-flight activity with progress, so raise it with care.
+var MaxActivityProgressInput = 1024
+
+// ActivityProgressInfo holds the latest progress signaled for an in-flight activity.
+type ActivityProgressInfo struct {
+	// EventId is the id of the WorkflowExecutionSignaled event of the latest progress.
+	EventId int64
+	// Input is the progress serialized with the worker Serializer, unless it is longer than MaxActivityProgressInput.
+	Input *string `json:",omitempty"`
+	// TooLarge is true when the progress was left out of Input for being longer than MaxActivityProgressInput,
+	// so that it can be told apart from a progress signaled without input.
+	TooLarge bool `json:",omitempty"`
 }
 
 // ActivityInfo holds the ActivityId and ActivityType for an activity
@@ -29,6 +52,52 @@ type ActivityInfo struct {
 	ActivityId string
 	*swf.ActivityType
 	Input *string
+	// LogicalKey is the key stamped on the activity with SetActivityLogicalKey, if any.
+	LogicalKey string `json:",omitempty"`
+}
+
+// LogicalKeyControlPrefix prefixes the Control of ScheduleActivityTask decisions stamped with SetActivityLogicalKey.
+// It is followed by the key and LogicalKeyControlSeparator, then by the Control set by the caller, if any.
+const LogicalKeyControlPrefix = "FSM.LogicalKey:"
+
+// LogicalKeyControlSeparator ends the logical key in the Control of a ScheduleActivityTask decision.
+const LogicalKeyControlSeparator = "\n"
+
+// SetActivityLogicalKey stamps a logical key, such as the id of the business entity the activity works on,
+// on a ScheduleActivityTask decision, so that the in-flight activity can be found with ActivityInfoByLogicalKey
+// whatever its ActivityId is. The key is carried in front of the Control of the decision, since the activity input belongs
+// to the activity worker. A Control that is already set, e.g. by StampControl, is kept after the key and can be read back
+// with ActivityControl. LogicalKeyControlSeparator and "%" are escaped in the key. Other decisions are returned unchanged.
+func SetActivityLogicalKey(d *swf.Decision, key string) *swf.Decision {
+	if attrs := d.ScheduleActivityTaskDecisionAttributes; attrs != nil {
+		attrs.Control = aws.String(withLogicalKey(key, ActivityControl(attrs.Control)))
+	}
+	return d
+}
+
+// ActivityControl returns the Control of a ScheduleActivityTask decision or ActivityTaskScheduled event
+// without the logical key stamped by SetActivityLogicalKey.
+func ActivityControl(control *string) string {
+	c := aws.StringValue(control)
+	if !strings.HasPrefix(c, LogicalKeyControlPrefix) {
+		return c
+	}
+	if i := strings.Index(c, LogicalKeyControlSeparator); i >= 0 {
+		return c[i+len(LogicalKeyControlSeparator):]
+	}
+	return ""
+}
+
+var (
+	logicalKeyEscaper   = strings.NewReplacer("%", "%25", LogicalKeyControlSeparator, "%0A")
+	logicalKeyUnescaper = strings.NewReplacer("%0A", LogicalKeyControlSeparator, "%25", "%")
+)
+
+func withLogicalKey(key, control string) string {
+	if key == "" {
+		return control
+	}
+	return LogicalKeyControlPrefix + logicalKeyEscaper.Replace(key) + LogicalKeyControlSeparator + control
 }
 
 // SignalInfo holds the SignalName and Input for an activity
@@ -58,6 +127,13 @@ type ChildInfo struct {
 	*swf.WorkflowType
 }
 
+//LambdaInfo holds the Id, Name and Input of a scheduled lambda function
+type LambdaInfo struct {
+	Id    string
+	Name  string
+	Input *string
+}
+
 // Track will add or remove entries based on the EventType.
 // A new entry is added when there is a new ActivityTask, or an entry is removed when the ActivityTask is terminating.
 func (a *EventCorrelator) Track(h *swf.HistoryEvent) {
@@ -74,6 +150,23 @@ func (a *EventCorrelator) Correlate(h *swf.HistoryEvent) {
 			ActivityId:   *h.ActivityTaskScheduledEventAttributes.ActivityId,
 			ActivityType: h.ActivityTaskScheduledEventAttributes.ActivityType,
 			Input:        h.ActivityTaskScheduledEventAttributes.Input,
+			LogicalKey:   logicalKey(h.ActivityTaskScheduledEventAttributes.Control),
+		}
+	}
+
+	if a.nilSafeEq(h.EventType, swf.EventTypeWorkflowExecutionSignaled) && a.Serializer != nil {
+		event := h.WorkflowExecutionSignaledEventAttributes
+		if event.Input != nil && (a.nilSafeEq(event.SignalName, ActivityStartedSignal) || a.nilSafeEq(event.SignalName, ActivityUpdatedSignal)) {
+			state := new(SerializedActivityState)
+			if err := a.Serializer.Deserialize(*event.Input, state); err == nil && a.activityInFlight(state.ActivityId) {
+				info := &ActivityProgressInfo{EventId: *h.EventId}
+				if state.Input != nil && len(*state.Input) <= MaxActivityProgressInput {
+					info.Input = state.Input
+				} else if state.Input != nil {
+					info.TooLarge = true
+				}
+				a.ActivityProgress[state.ActivityId] = info
+			}
 		}
 	}
 
@@ -108,6 +201,14 @@ func (a *EventCorrelator) Correlate(h *swf.HistoryEvent) {
 		}
 	}
 
+	if a.nilSafeEq(h.EventType, swf.EventTypeLambdaFunctionScheduled) {
+		a.Lambdas[a.key(h.EventId)] = &LambdaInfo{
+			Id:    *h.LambdaFunctionScheduledEventAttributes.Id,
+			Name:  *h.LambdaFunctionScheduledEventAttributes.Name,
+			Input: h.LambdaFunctionScheduledEventAttributes.Input,
+		}
+	}
+
 }
 
 // RemoveCorrelation gcs a mapping of eventId to ActivityType. The HistoryEvent is expected to be of type EventTypeActivityTaskCompleted,EventTypeActivityTaskFailed,EventTypeActivityTaskTimedOut.
@@ -120,15 +221,19 @@ func (a *EventCorrelator) RemoveCorrelation(h *swf.HistoryEvent) {
 	/*Activities*/
 	case swf.EventTypeActivityTaskCompleted:
 		delete(a.ActivityAttempts, a.safeActivityId(h))
+		delete(a.ActivityProgress, a.safeActivityId(h))
 		delete(a.Activities, a.key(h.ActivityTaskCompletedEventAttributes.ScheduledEventId))
 	case swf.EventTypeActivityTaskFailed:
 		a.incrementActivityAttempts(h)
+		delete(a.ActivityProgress, a.safeActivityId(h))
 		delete(a.Activities, a.key(h.ActivityTaskFailedEventAttributes.ScheduledEventId))
 	case swf.EventTypeActivityTaskTimedOut:
 		a.incrementActivityAttempts(h)
+		delete(a.ActivityProgress, a.safeActivityId(h))
 		delete(a.Activities, a.key(h.ActivityTaskTimedOutEventAttributes.ScheduledEventId))
 	case swf.EventTypeActivityTaskCanceled:
 		delete(a.ActivityAttempts, a.safeActivityId(h))
+		delete(a.ActivityProgress, a.safeActivityId(h))
 		delete(a.Activities, a.key(h.ActivityTaskCanceledEventAttributes.ScheduledEventId))
 	/*Signals*/
 	case swf.EventTypeExternalWorkflowExecutionSignaled:
@@ -162,6 +267,15 @@ func (a *EventCorrelator) RemoveCorrelation(h *swf.HistoryEvent) {
 		info := a.Children[key]
 		delete(a.ChildrenAttempts, info.WorkflowId)
 		delete(a.Children, key)
+	/*Lambdas*/
+	case swf.EventTypeLambdaFunctionCompleted:
+		delete(a.Lambdas, a.key(h.LambdaFunctionCompletedEventAttributes.ScheduledEventId))
+	case swf.EventTypeLambdaFunctionFailed:
+		delete(a.Lambdas, a.key(h.LambdaFunctionFailedEventAttributes.ScheduledEventId))
+	case swf.EventTypeLambdaFunctionTimedOut:
+		delete(a.Lambdas, a.key(h.LambdaFunctionTimedOutEventAttributes.ScheduledEventId))
+	case swf.EventTypeStartLambdaFunctionFailed:
+		delete(a.Lambdas, a.key(h.StartLambdaFunctionFailedEventAttributes.ScheduledEventId))
 
 	}
 }
@@ -172,6 +286,38 @@ func (a *EventCorrelator) ActivityInfo(h *swf.HistoryEvent) *ActivityInfo {
 	return a.Activities[a.getId(h)]
 }
 
+// ActivityInfoByLogicalKey returns the ActivityInfo of the in-flight activity stamped with the logical key by SetActivityLogicalKey.
+// If several in-flight activities have the key, the most recently scheduled one is returned. It returns nil if there is none,
+// or if the key is empty.
+func (a *EventCorrelator) ActivityInfoByLogicalKey(key string) *ActivityInfo {
+	if key == "" {
+		return nil
+	}
+	a.checkInit()
+	var found *ActivityInfo
+	foundId := int64(-1)
+	for id, info := range a.Activities {
+		if info.LogicalKey != key {
+			continue
+		}
+		if scheduledId, err := strconv.ParseInt(id, 10, 64); err == nil && scheduledId > foundId {
+			found, foundId = info, scheduledId
+		}
+	}
+	return found
+}
+
+func logicalKey(control *string) string {
+	if control == nil || !strings.HasPrefix(*control, LogicalKeyControlPrefix) {
+		return ""
+	}
+	key := strings.TrimPrefix(*control, LogicalKeyControlPrefix)
+	if i := strings.Index(key, LogicalKeyControlSeparator); i >= 0 {
+		key = key[:i]
+	}
+	return logicalKeyUnescaper.Replace(key)
+}
+
 // SignalInfo returns the SignalInfo that is correlates with a given event. The HistoryEvent is expected to be of type EventTypeSignalExternalWorkflowExecutionFailed,EventTypeExternalWorkflowExecutionSignaled.
 func (a *EventCorrelator) SignalInfo(h *swf.HistoryEvent) *SignalInfo {
 	a.checkInit()
@@ -203,6 +349,11 @@ func (a *EventCorrelator) ChildInfo(h *swf.HistoryEvent) *ChildInfo {
 	return a.Children[a.getId(h)]
 }
 
+func (a *EventCorrelator) LambdaInfo(h *swf.HistoryEvent) *LambdaInfo {
+	a.checkInit()
+	return a.Lambdas[a.getId(h)]
+}
+
 //AttemptsForActivity returns the number of times a given activity has been attempted.
 //It will return 0 if the activity has never failed, has been canceled, or has been completed successfully
 func (a *EventCorrelator) AttemptsForActivity(info *ActivityInfo) int {
@@ -268,6 +419,59 @@ func (a *EventCorrelator) Attempts(h *swf.HistoryEvent) int {
 	return 0
 }
 
+// CorrelatorStats holds the number of entries in each map of an EventCorrelator.
+type CorrelatorStats struct {
+	Activities          int
+	ActivityAttempts    int
+	Signals             int
+	SignalAttempts      int
+	Timers              int
+	Cancellations       int
+	CancelationAttempts int
+	Children            int
+	ChildrenAttempts    int
+	Lambdas             int
+	ActivityProgress    int
+}
+
+// Largest returns the number of entries in the largest map.
+func (s CorrelatorStats) Largest() int {
+	largest := 0
+	for _, n := range []int{s.Activities, s.ActivityAttempts, s.Signals, s.SignalAttempts, s.Timers,
+		s.Cancellations, s.CancelationAttempts, s.Children, s.ChildrenAttempts, s.Lambdas, s.ActivityProgress} {
+		if n > largest {
+			largest = n
+		}
+	}
+	return largest
+}
+
+// String returns the stats as logfmt.
+func (s CorrelatorStats) String() string {
+	return fmt.Sprintf("activities=%d activity-attempts=%d signals=%d signal-attempts=%d timers=%d "+
+		"cancellations=%d cancelation-attempts=%d children=%d children-attempts=%d lambdas=%d activity-progress=%d",
+		s.Activities, s.ActivityAttempts, s.Signals, s.SignalAttempts, s.Timers,
+		s.Cancellations, s.CancelationAttempts, s.Children, s.ChildrenAttempts, s.Lambdas, s.ActivityProgress)
+}
+
+// Stats returns the number of entries in each map of the correlator, which only grow when correlations are
+// not removed, e.g. for events that are not tracked, so they can be used to find leaks.
+func (a *EventCorrelator) Stats() CorrelatorStats {
+	return CorrelatorStats{
+		Activities:          len(a.Activities),
+		ActivityAttempts:    len(a.ActivityAttempts),
+		Signals:             len(a.Signals),
+		SignalAttempts:      len(a.SignalAttempts),
+		Timers:              len(a.Timers),
+		Cancellations:       len(a.Cancellations),
+		CancelationAttempts: len(a.CancelationAttempts),
+		Children:            len(a.Children),
+		ChildrenAttempts:    len(a.ChildrenAttempts),
+		Lambdas:             len(a.Lambdas),
+		ActivityProgress:    len(a.ActivityProgress),
+	}
+}
+
 func (a *EventCorrelator) checkInit() {
 	if a.Activities == nil {
 		a.Activities = make(map[string]*ActivityInfo)
@@ -296,6 +500,21 @@ func (a *EventCorrelator) checkInit() {
 	if a.ChildrenAttempts == nil {
 		a.ChildrenAttempts = make(map[string]int)
 	}
+	if a.Lambdas == nil {
+		a.Lambdas = make(map[string]*LambdaInfo)
+	}
+	if a.ActivityProgress == nil {
+		a.ActivityProgress = make(map[string]*ActivityProgressInfo)
+	}
+}
+
+func (a *EventCorrelator) activityInFlight(activityId string) bool {
+	for _, info := range a.Activities {
+		if info.ActivityId == activityId {
+			return true
+		}
+	}
+	return false
 }
 
 func (a *EventCorrelator) getId(h *swf.HistoryEvent) (id string) {
@@ -373,6 +592,31 @@ func (a *EventCorrelator) getId(h *swf.HistoryEvent) (id string) {
 		if h.EventId != nil {
 			id = a.key(h.EventId)
 		}
+	/*Lambdas*/
+	case swf.EventTypeLambdaFunctionScheduled:
+		if h.EventId != nil {
+			id = a.key(h.EventId)
+		}
+	case swf.EventTypeLambdaFunctionStarted:
+		if h.LambdaFunctionStartedEventAttributes != nil {
+			id = a.key(h.LambdaFunctionStartedEventAttributes.ScheduledEventId)
+		}
+	case swf.EventTypeLambdaFunctionCompleted:
+		if h.LambdaFunctionCompletedEventAttributes != nil {
+			id = a.key(h.LambdaFunctionCompletedEventAttributes.ScheduledEventId)
+		}
+	case swf.EventTypeLambdaFunctionFailed:
+		if h.LambdaFunctionFailedEventAttributes != nil {
+			id = a.key(h.LambdaFunctionFailedEventAttributes.ScheduledEventId)
+		}
+	case swf.EventTypeLambdaFunctionTimedOut:
+		if h.LambdaFunctionTimedOutEventAttributes != nil {
+			id = a.key(h.LambdaFunctionTimedOutEventAttributes.ScheduledEventId)
+		}
+	case swf.EventTypeStartLambdaFunctionFailed:
+		if h.StartLambdaFunctionFailedEventAttributes != nil {
+			id = a.key(h.StartLambdaFunctionFailedEventAttributes.ScheduledEventId)
+		}
 	/*Received Signal*/
 	case swf.EventTypeWorkflowExecutionSignaled:
 		event := h.WorkflowExecutionSignaledEventAttributes
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/service/swf"
@@ -641,3 +642,168 @@ func TestActivityInfoFromSignalEvent(t *testing.T) {
 	}
 
 }
+
+func TestActivityInfoByLogicalKey(t *testing.T) {
+	scheduled := func(decision *swf.Decision) *swf.ActivityTaskScheduledEventAttributes {
+		attrs := decision.ScheduleActivityTaskDecisionAttributes
+		return &swf.ActivityTaskScheduledEventAttributes{ActivityId: attrs.ActivityId, ActivityType: attrs.ActivityType, Control: attrs.Control}
+	}
+	decision := func(activityId string) *swf.Decision {
+		return &swf.Decision{
+			DecisionType: S(swf.DecisionTypeScheduleActivityTask),
+			ScheduleActivityTaskDecisionAttributes: &swf.ScheduleActivityTaskDecisionAttributes{
+				ActivityId:   S(activityId),
+				ActivityType: &swf.ActivityType{Name: S("ship-line"), Version: S("1")},
+			},
+		}
+	}
+
+	c := new(EventCorrelator)
+	c.Track(EventFromPayload(1, scheduled(SetActivityLogicalKey(decision("line-7-attempt-1"), "line-7"))))
+	c.Track(EventFromPayload(2, scheduled(SetActivityLogicalKey(decision("line-8-attempt-1"), "line-8"))))
+	c.Track(EventFromPayload(3, &swf.ActivityTaskFailedEventAttributes{ScheduledEventId: I(1)}))
+	c.Track(EventFromPayload(4, scheduled(SetActivityLogicalKey(decision("line-7-attempt-2"), "line-7"))))
+	c.Track(EventFromPayload(5, scheduled(decision("unkeyed"))))
+
+	info := c.ActivityInfoByLogicalKey("line-7")
+	if info == nil || info.ActivityId != "line-7-attempt-2" {
+		t.Fatal("expected the retried activity for the logical key", info)
+	}
+	if c.ActivityInfoByLogicalKey("line-9") != nil {
+		t.Fatal("expected no activity for an unknown logical key")
+	}
+	if c.ActivityInfo(EventFromPayload(6, &swf.ActivityTaskCompletedEventAttributes{ScheduledEventId: I(5)})).LogicalKey != "" {
+		t.Fatal("expected no logical key on an unkeyed activity")
+	}
+
+	controlled := decision("controlled")
+	controlled.ScheduleActivityTaskDecisionAttributes.Control = S("caller-control")
+	SetActivityLogicalKey(controlled, "line-9")
+	if ActivityControl(controlled.ScheduleActivityTaskDecisionAttributes.Control) != "caller-control" {
+		t.Fatal("expected an existing Control kept", LS(controlled.ScheduleActivityTaskDecisionAttributes.Control))
+	}
+	c.Track(EventFromPayload(7, scheduled(SetActivityLogicalKey(controlled, "line-10"))))
+	if info := c.ActivityInfoByLogicalKey("line-10"); info == nil || info.ActivityId != "controlled" {
+		t.Fatal("expected an activity with a Control found by its logical key", info)
+	}
+	if ActivityControl(S("unkeyed")) != "unkeyed" {
+		t.Fatal("expected a Control without a logical key returned as is")
+	}
+	if c.ActivityInfoByLogicalKey("") != nil {
+		t.Fatal("expected no activity for an empty logical key, though unkeyed activities are in flight")
+	}
+
+	multiline := decision("multiline")
+	multiline.ScheduleActivityTaskDecisionAttributes.Control = S("caller-control")
+	c.Track(EventFromPayload(8, scheduled(SetActivityLogicalKey(multiline, "line\n11%0A"))))
+	if ActivityControl(multiline.ScheduleActivityTaskDecisionAttributes.Control) != "caller-control" {
+		t.Fatal("expected the Control kept after a key with a separator", LS(multiline.ScheduleActivityTaskDecisionAttributes.Control))
+	}
+	if info := c.ActivityInfoByLogicalKey("line\n11%0A"); info == nil || info.ActivityId != "multiline" {
+		t.Fatal("expected an activity found by a logical key with a separator", info)
+	}
+}
+
+func TestActivityProgress(t *testing.T) {
+	serializer := JSONStateSerializer{}
+	progress := func(id int, signal, activityId, input string) *swf.HistoryEvent {
+		serialized, _ := serializer.Serialize(&SerializedActivityState{ActivityId: activityId, Input: S(input)})
+		return EventFromPayload(id, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S(signal), Input: S(serialized)})
+	}
+
+	c := &EventCorrelator{Serializer: serializer}
+	ctx := &FSMContext{eventCorrelator: c}
+	c.Track(EventFromPayload(1, &swf.ActivityTaskScheduledEventAttributes{ActivityId: S("activity"), ActivityType: &swf.ActivityType{Name: S("ship"), Version: S("1")}}))
+	c.Track(progress(2, ActivityStartedSignal, "activity", "started"))
+	c.Track(progress(3, ActivityUpdatedSignal, "activity", "half-way"))
+	c.Track(progress(4, ActivityUpdatedSignal, "unknown", "ignored"))
+
+	if p := ctx.ActivityProgress("activity"); p == nil || *p.Input != "half-way" || p.EventId != 3 || p.TooLarge {
+		t.Fatal("expected the latest progress of the activity", p)
+	}
+	if ctx.ActivityProgress("unknown") != nil {
+		t.Fatal("expected no progress for an activity not in flight")
+	}
+	if c.Stats().ActivityProgress != 1 {
+		t.Fatal("expected the progress counted", c.Stats())
+	}
+
+	c.Track(progress(6, ActivityUpdatedSignal, "activity", strings.Repeat("x", MaxActivityProgressInput+1)))
+	if p := ctx.ActivityProgress("activity"); p == nil || p.Input != nil || !p.TooLarge || p.EventId != 6 {
+		t.Fatal("expected only the event id of a progress longer than MaxActivityProgressInput, flagged as too large", p)
+	}
+
+	c.Track(EventFromPayload(5, &swf.ActivityTaskCompletedEventAttributes{ScheduledEventId: I(1)}))
+	if ctx.ActivityProgress("activity") != nil {
+		t.Fatal("expected the progress removed once the activity completed")
+	}
+}
+
+func TestLambdaTracking(t *testing.T) {
+	scheduled := EventFromPayload(1, &swf.LambdaFunctionScheduledEventAttributes{
+		Id:    S("the-lambda"),
+		Name:  S("the-function"),
+		Input: S("the-input"),
+	})
+	completed := EventFromPayload(3, &swf.LambdaFunctionCompletedEventAttributes{
+		ScheduledEventId: I(1),
+		Result:           S(`"the-result"`),
+	})
+
+	c := new(EventCorrelator)
+	c.Track(scheduled)
+
+	info := c.LambdaInfo(completed)
+	if info == nil || info.Id != "the-lambda" || info.Name != "the-function" || *info.Input != "the-input" {
+		t.Fatal("lambda not being tracked", info, c.Lambdas)
+	}
+
+	var result string
+	testFSM().EventData(completed, &result)
+	if result != "the-result" {
+		t.Fatal("expected the lambda result as event data", result)
+	}
+
+	result = "unchanged"
+	testFSM().EventData(EventFromPayload(3, &swf.LambdaFunctionCompletedEventAttributes{ScheduledEventId: I(1)}), &result)
+	if result != "unchanged" {
+		t.Fatal("expected the event data left as is for a lambda without a result", result)
+	}
+
+	c.Track(completed)
+	if c.LambdaInfo(completed) != nil || len(c.Lambdas) != 0 {
+		t.Fatal("expected completed lambda to be removed", c.Lambdas)
+	}
+
+	c.Track(EventFromPayload(4, &swf.LambdaFunctionScheduledEventAttributes{Id: S("the-lambda"), Name: S("the-function")}))
+	c.Track(EventFromPayload(5, &swf.LambdaFunctionFailedEventAttributes{ScheduledEventId: I(4)}))
+	if len(c.Lambdas) != 0 {
+		t.Fatal("expected failed lambda to be removed", c.Lambdas)
+	}
+
+	c.Track(EventFromPayload(6, &swf.LambdaFunctionScheduledEventAttributes{Id: S("the-lambda"), Name: S("the-function")}))
+	c.Track(EventFromPayload(7, &swf.StartLambdaFunctionFailedEventAttributes{ScheduledEventId: I(6)}))
+	if len(c.Lambdas) != 0 {
+		t.Fatal("expected lambda that failed to start to be removed", c.Lambdas)
+	}
+}
+
+func TestCorrelatorStats(t *testing.T) {
+	c := new(EventCorrelator)
+	c.Track(EventFromPayload(1, &swf.TimerStartedEventAttributes{TimerId: S("a"), StartToFireTimeout: S("10")}))
+	c.Track(EventFromPayload(2, &swf.TimerStartedEventAttributes{TimerId: S("b"), StartToFireTimeout: S("10")}))
+	c.Track(EventFromPayload(3, &swf.ActivityTaskScheduledEventAttributes{ActivityId: S("c"), ActivityType: &swf.ActivityType{Name: S("c")}}))
+
+	stats := c.Stats()
+	if stats.Timers != 2 || stats.Activities != 1 || stats.Largest() != 2 {
+		t.Fatal("expected the tracked timers and activity counted", stats)
+	}
+	if !strings.Contains(stats.String(), "activities=1 ") || !strings.Contains(stats.String(), "timers=2 ") {
+		t.Fatal("expected the stats as logfmt", stats.String())
+	}
+
+	c.Track(EventFromPayload(4, &swf.TimerFiredEventAttributes{TimerId: S("a"), StartedEventId: I(1)}))
+	if c.Stats().Timers != 1 {
+		t.Fatal("expected the fired timer removed", c.Stats())
+	}
+}
@@ -3,6 +3,8 @@ package fsm
 import (
 	"fmt"
 	"reflect"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/swf"
 	. "github.com/sclasen/swfsm/log"
@@ -54,15 +56,14 @@ func (c *ComposedDecider) Decide(ctx *FSMContext, h *swf.HistoryEvent, data inte
 }
 
 func logf(ctx *FSMContext, format string, data ...interface{}) {
-	format = fmt.Sprintf("workflow=%s workflow-id=%s state=%s ", LS(ctx.WorkflowType.Name), LS(ctx.WorkflowId), ctx.State) + format
-	Log.Printf(format, data...)
+	Logf(ctx.logger, "workflow=%s workflow-id=%s state=%s "+format, append([]interface{}{LS(ctx.WorkflowType.Name), LS(ctx.WorkflowId), ctx.State}, data...)...)
 }
 
 //DefaultDecider is a 'catch-all' decider that simply logs the unhandled decision.
 //You should place this or one like it as the last decider in your top level ComposableDecider.
 func DefaultDecider() Decider {
 	return func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
-		Log.Printf("at=unhandled-event event=%s state=%s default=stay decisions=0", LS(h.EventType), ctx.State)
+		logf(ctx, "at=unhandled-event event=%s default=stay decisions=0", LS(h.EventType))
 		return ctx.Stay(data, ctx.EmptyDecisions())
 	}
 }
@@ -73,6 +74,9 @@ type DecisionFunc func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) *
 //MultiDecisionFunc is a building block for composable deciders that returns a [] of decision.
 type MultiDecisionFunc func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) []*swf.Decision
 
+//DurationFunc is a building block for composable deciders that computes a duration, e.g. from the FSM stateData, at decide time.
+type DurationFunc func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) time.Duration
+
 //StateFunc is a building block for composable deciders mutates the FSM stateData.
 type StateFunc func(ctx *FSMContext, h *swf.HistoryEvent, data interface{})
 
@@ -245,6 +249,18 @@ func OnDataUnless(predicate PredicateFunc, deciders ...Decider) Decider {
 	return OnData(unlessPredicate, deciders...)
 }
 
+// InState builds a composed decider that fires only when the current state is the named state,
+// so that a decider shared by several states can scope some of its parts to one of them.
+func InState(name string, deciders ...Decider) Decider {
+	return func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+		if ctx.State == name {
+			logf(ctx, "at=in-state state=%s", name)
+			return NewComposedDecider(deciders...)(ctx, h, data)
+		}
+		return ctx.Pass()
+	}
+}
+
 // OnSignalsReceived builds a composed decider that fires on when one of the matching signal is received.
 func OnSignalsReceived(signalNames []string, deciders ...Decider) Decider {
 	return func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
@@ -266,6 +282,21 @@ func OnSignalReceived(signalName string, deciders ...Decider) Decider {
 	return OnSignalsReceived([]string{signalName}, deciders...)
 }
 
+// OnSignalNamePredicate builds a composed decider that fires on when a matching signal is received
+// and the predicate, which may deserialize the signal input, returns true.
+func OnSignalNamePredicate(signalName string, predicate func(*FSMContext, *swf.HistoryEvent, interface{}) bool, deciders ...Decider) Decider {
+	return func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+		switch *h.EventType {
+		case swf.EventTypeWorkflowExecutionSignaled:
+			if *h.WorkflowExecutionSignaledEventAttributes.SignalName == signalName && predicate(ctx, h, data) {
+				logf(ctx, "at=on-signal-name-predicate")
+				return NewComposedDecider(deciders...)(ctx, h, data)
+			}
+		}
+		return ctx.Pass()
+	}
+}
+
 // OnSignalSent builds a composed decider that fires on when a matching signal is received.
 func OnSignalSent(signalName string, deciders ...Decider) Decider {
 	return func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
@@ -457,9 +488,53 @@ func OnChildStartFailed(deciders ...Decider) Decider {
 	return onChildEvent("on-child-failed", swf.EventTypeStartChildWorkflowExecutionFailed, deciders...)
 }
 
-// OnChildCompleted builds a composed decider that fires on EventTypeChildWorkflowExecutionCompleted.
-func OnChildCompleted(deciders ...Decider) Decider {
-	return onChildEvent("on-child-completed", swf.EventTypeChildWorkflowExecutionCompleted, deciders...)
+// OnChildCompleted builds a composed decider that fires on EventTypeChildWorkflowExecutionCompleted
+// for children of the given workflow type name, or for any child if childWorkflowType is empty.
+func OnChildCompleted(childWorkflowType string, deciders ...Decider) Decider {
+	return onChildClosed("on-child-completed", swf.EventTypeChildWorkflowExecutionCompleted, childWorkflowType, deciders...)
+}
+
+// OnChildFailed builds a composed decider that fires on EventTypeChildWorkflowExecutionFailed
+// for children of the given workflow type name, or for any child if childWorkflowType is empty.
+func OnChildFailed(childWorkflowType string, deciders ...Decider) Decider {
+	return onChildClosed("on-child-failed", swf.EventTypeChildWorkflowExecutionFailed, childWorkflowType, deciders...)
+}
+
+// OnChildTerminated builds a composed decider that fires on EventTypeChildWorkflowExecutionTerminated
+// for children of the given workflow type name, or for any child if childWorkflowType is empty.
+func OnChildTerminated(childWorkflowType string, deciders ...Decider) Decider {
+	return onChildClosed("on-child-terminated", swf.EventTypeChildWorkflowExecutionTerminated, childWorkflowType, deciders...)
+}
+
+// onChildClosed matches on the WorkflowType of the event attributes rather than the correlator's ChildInfo,
+// which is removed once the child has started.
+func onChildClosed(at string, event string, childWorkflowType string, deciders ...Decider) Decider {
+	return func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+		if *h.EventType != event {
+			return ctx.Pass()
+		}
+		if childWorkflowType != "" && childWorkflowTypeName(h) != childWorkflowType {
+			return ctx.Pass()
+		}
+		logf(ctx, "at=%s child-workflow-type=%s", at, childWorkflowTypeName(h))
+		return NewComposedDecider(deciders...)(ctx, h, data)
+	}
+}
+
+func childWorkflowTypeName(h *swf.HistoryEvent) string {
+	var workflowType *swf.WorkflowType
+	switch *h.EventType {
+	case swf.EventTypeChildWorkflowExecutionCompleted:
+		workflowType = h.ChildWorkflowExecutionCompletedEventAttributes.WorkflowType
+	case swf.EventTypeChildWorkflowExecutionFailed:
+		workflowType = h.ChildWorkflowExecutionFailedEventAttributes.WorkflowType
+	case swf.EventTypeChildWorkflowExecutionTerminated:
+		workflowType = h.ChildWorkflowExecutionTerminatedEventAttributes.WorkflowType
+	}
+	if workflowType == nil || workflowType.Name == nil {
+		return ""
+	}
+	return *workflowType.Name
 }
 
 func onChildEvent(at string, event string, deciders ...Decider) Decider {
@@ -658,6 +733,63 @@ func AddDecisions(signalFn MultiDecisionFunc) Decider {
 	}
 }
 
+// StartTimer adds a StartTimer decision for the timer, with a duration computed at decide time.
+// The duration is rounded up to whole seconds, as required by SWF, and can be read back with TimerDuration when the timer fires.
+// The Control of the timer is left unset, e.g. for StampControl.
+func StartTimer(timerId string, durationFn DurationFunc) Decider {
+	return func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+		duration := durationFn(ctx, h, data)
+		logf(ctx, "at=start-timer timer=%q duration=%s", timerId, duration)
+		return ctx.ContinueDecider(data, append(ctx.EmptyDecisions(), startTimerDecision(timerId, duration, "")))
+	}
+}
+
+// ScheduleActivityOnce schedules an activity of the type, with the input returned by inputFn from the state data,
+// unless one of the same name and version is already in flight according to the correlator,
+// or was already scheduled by ScheduleActivityOnce while deciding the same decision task. An empty taskList uses the
+// default task list of the activity type. Either way it continues to the next decider, so it can be used to enter a state
+// that waits for the activity.
+func ScheduleActivityOnce(activityType *swf.ActivityType, taskList string, inputFn func(interface{}) interface{}) Decider {
+	key := LS(activityType.Name) + "/" + LS(activityType.Version)
+	return func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+		if ctx.scheduledOnce[key] {
+			logf(ctx, "at=schedule-activity-once status=already-scheduled activity=%s", key)
+			return ctx.ContinueDecider(data, ctx.EmptyDecisions())
+		}
+		for _, info := range ctx.ActivitiesInfo() {
+			if info.ActivityType != nil && LS(info.ActivityType.Name) == LS(activityType.Name) && LS(info.ActivityType.Version) == LS(activityType.Version) {
+				logf(ctx, "at=schedule-activity-once status=in-flight activity=%s activity-id=%s", key, info.ActivityId)
+				return ctx.ContinueDecider(data, ctx.EmptyDecisions())
+			}
+		}
+
+		var input interface{}
+		if inputFn != nil {
+			input = inputFn(data)
+		}
+		d, activityId := ctx.ScheduleActivity(activityType, taskList, input)
+		if ctx.scheduledOnce == nil {
+			ctx.scheduledOnce = make(map[string]bool)
+		}
+		ctx.scheduledOnce[key] = true
+		logf(ctx, "at=schedule-activity-once status=scheduled activity=%s activity-id=%s", key, activityId)
+		return ctx.ContinueDecider(data, append(ctx.EmptyDecisions(), d))
+	}
+}
+
+// TimerDuration returns the whole seconds duration a timer was started with, from its StartToFireTimeout.
+// It returns false if the StartToFireTimeout is not known.
+func TimerDuration(info *TimerInfo) (time.Duration, bool) {
+	if info == nil {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(info.StartToFireTimeout, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
 // UpdateState allows you to modicy the state data without generating decisions.
 func UpdateState(updateFunc StateFunc) Decider {
 	return func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
@@ -678,7 +810,7 @@ func Transition(toState string) Decider {
 // CompleteWorkflow completes the workflow
 func CompleteWorkflow() Decider {
 	return func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
-		Log.Printf("at=complete-workflow workflowId=%s", LS(ctx.WorkflowId))
+		logf(ctx, "at=complete-workflow")
 		return ctx.CompleteWorkflow(data)
 	}
 }
@@ -686,7 +818,7 @@ func CompleteWorkflow() Decider {
 // CancelWorkflow cancels the workflow
 func CancelWorkflow(details *string) Decider {
 	return func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
-		Log.Printf("at=cancel-workflow workflowId=%s", LS(ctx.WorkflowId))
+		logf(ctx, "at=cancel-workflow")
 		return ctx.CancelWorkflow(data, details)
 	}
 }
@@ -694,7 +826,7 @@ func CancelWorkflow(details *string) Decider {
 // FailWorkflow fails the workflow
 func FailWorkflow(details *string) Decider {
 	return func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
-		Log.Printf("at=fail-workflow workflowId=%s", LS(ctx.WorkflowId))
+		logf(ctx, "at=fail-workflow")
 		return ctx.FailWorkflow(data, details)
 	}
 }
@@ -1,7 +1,9 @@
 package fsm
 
 import (
+	"fmt"
 	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
@@ -9,6 +11,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/swf"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/sclasen/swfsm/log"
 	s "github.com/sclasen/swfsm/sugar"
 )
 
@@ -311,6 +314,32 @@ func TestOnDataUnless(t *testing.T) {
 	}
 }
 
+func TestInState(t *testing.T) {
+	decider := Transition("some-state")
+	ctx := deciderTestContext()
+	composedDecider := InState("state", decider)
+
+	event := &swf.HistoryEvent{
+		EventId:        s.L(129),
+		EventTimestamp: aws.Time(time.Now()),
+		EventType:      s.S(swf.EventTypeWorkflowExecutionStarted),
+	}
+
+	outcome := composedDecider(ctx, event, nil)
+	expected := decider(ctx, event, nil)
+
+	if !reflect.DeepEqual(outcome, expected) {
+		t.Fatal("Outcomes not equal", outcome, expected)
+	}
+
+	ctx.State = "other-state"
+	outcome = composedDecider(ctx, event, nil)
+
+	if !reflect.DeepEqual(outcome, ctx.Pass()) {
+		t.Fatal("Expected a pass in another state", outcome)
+	}
+}
+
 func TestOnSignalReceived(t *testing.T) {
 	signal := "the-signal"
 	ctx := deciderTestContext()
@@ -345,6 +374,35 @@ func TestOnSignalReceived(t *testing.T) {
 	}
 }
 
+func TestOnSignalNamePredicate(t *testing.T) {
+	signal := "the-signal"
+	ctx := deciderTestContext()
+	decider := Transition("some-state")
+	composedDecider := OnSignalNamePredicate(signal, func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) bool {
+		return *h.WorkflowExecutionSignaledEventAttributes.Input == "match"
+	}, decider)
+
+	for _, input := range []string{"match", "no-match"} {
+		event := &swf.HistoryEvent{
+			EventType: s.S(swf.EventTypeWorkflowExecutionSignaled),
+			EventId:   s.L(129),
+			WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{
+				SignalName: s.S(signal),
+				Input:      s.S(input),
+			},
+		}
+		data := &TestingType{Field: "yes"}
+		outcome := composedDecider(ctx, event, data)
+		expected := ctx.Pass()
+		if input == "match" {
+			expected = decider(ctx, event, data)
+		}
+		if !reflect.DeepEqual(outcome, expected) {
+			t.Fatal("Outcomes not equal", input, outcome, expected)
+		}
+	}
+}
+
 func TestOnSignalSent(t *testing.T) {
 	signal := "the-signal"
 	decider := Transition("some-state")
@@ -511,7 +569,56 @@ func TestOnActivityFailed(t *testing.T) {}
 
 func TestOnChildStartFailed(t *testing.T) {}
 
-func TestOnChildCompleted(t *testing.T) {}
+func TestOnChildClosed(t *testing.T) {
+	decider := func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+		return ctx.Goto("some-state", data, ctx.EmptyDecisions())
+	}
+	childType := &swf.WorkflowType{Name: s.S("child"), Version: s.S("1")}
+	otherType := &swf.WorkflowType{Name: s.S("other"), Version: s.S("1")}
+
+	cases := []struct {
+		builder func(string, ...Decider) Decider
+		event   string
+		payload func(*swf.WorkflowType) interface{}
+	}{
+		{OnChildCompleted, swf.EventTypeChildWorkflowExecutionCompleted, func(wt *swf.WorkflowType) interface{} {
+			return &swf.ChildWorkflowExecutionCompletedEventAttributes{WorkflowType: wt}
+		}},
+		{OnChildFailed, swf.EventTypeChildWorkflowExecutionFailed, func(wt *swf.WorkflowType) interface{} {
+			return &swf.ChildWorkflowExecutionFailedEventAttributes{WorkflowType: wt}
+		}},
+		{OnChildTerminated, swf.EventTypeChildWorkflowExecutionTerminated, func(wt *swf.WorkflowType) interface{} {
+			return &swf.ChildWorkflowExecutionTerminatedEventAttributes{WorkflowType: wt}
+		}},
+	}
+
+	for _, c := range cases {
+		filtered := c.builder("child", decider)
+		anyChild := c.builder("", decider)
+		for _, et := range s.SWFHistoryEventTypes() {
+			ctx := deciderTestContext()
+			switch et {
+			case c.event:
+				if filtered(ctx, s.EventFromPayload(129, c.payload(childType)), new(TestData)).State != "some-state" {
+					t.Fatal("expected matching child type to fire", c.event)
+				}
+				if filtered(ctx, s.EventFromPayload(129, c.payload(otherType)), new(TestData)).State != "" {
+					t.Fatal("expected other child type to pass", c.event)
+				}
+				if anyChild(ctx, s.EventFromPayload(129, c.payload(otherType)), new(TestData)).State != "some-state" {
+					t.Fatal("expected empty child type to fire for any child", c.event)
+				}
+			default:
+				event := &swf.HistoryEvent{
+					EventType: s.S(et),
+				}
+				if anyChild(ctx, event, new(TestData)).State != "" {
+					t.Fatal("Non nil decision", et)
+				}
+			}
+		}
+	}
+}
 
 func TestOnStartTimerFailed(t *testing.T) {}
 
@@ -525,6 +632,25 @@ func TestTransition(t *testing.T) {}
 
 func TestCompleteWorkflow(t *testing.T) {}
 
+func TestDecidersExpectLogsToFSMLogger(t *testing.T) {
+	// arrange
+	f := testFSM()
+	logger := &log.CapturingLogger{}
+	f.Logger = logger
+	ctx := testContext(f)
+	event := &swf.HistoryEvent{EventType: s.S(swf.EventTypeWorkflowExecutionSignaled)}
+
+	// act
+	DefaultDecider()(ctx, event, nil)
+	CompleteWorkflow()(ctx, event, nil)
+
+	// assert
+	if assert.Len(t, logger.Lines, 2, "Expected the decider logs on the FSM Logger") {
+		assert.Contains(t, logger.Lines[0], "at=unhandled-event")
+		assert.Contains(t, logger.Lines[1], "workflow-id=test-workflow-1 state=InitialState at=complete-workflow")
+	}
+}
+
 func TestFailWorkflow(t *testing.T) {
 	// arrange
 	data := &TestingType{"Some data"}
@@ -545,6 +671,132 @@ func TestFailWorkflow(t *testing.T) {
 		"Expected details in the fail decision to match what was passed in")
 }
 
+func TestStartTimer(t *testing.T) {
+	// arrange
+	backoff := func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) time.Duration {
+		return time.Duration(1<<uint(len(data.(*TestingType).Field)))*time.Second - 500*time.Millisecond
+	}
+	data := &TestingType{"xxx"}
+	ctx := deciderTestContext()
+
+	// act
+	outcome := StartTimer("poll", backoff)(ctx, &swf.HistoryEvent{}, data)
+
+	// assert
+	assert.Equal(t, data, outcome.Data, "Expected data to be passed through")
+	assert.Equal(t, "", outcome.State, "Expected StartTimer to continue")
+	timer := FindDecision(outcome.Decisions, startTimerPredicate)
+	if assert.NotNil(t, timer, "Expected a start timer decision") {
+		attrs := timer.StartTimerDecisionAttributes
+		assert.Equal(t, "poll", *attrs.TimerId)
+		assert.Equal(t, "8", *attrs.StartToFireTimeout, "Expected partial seconds rounded up")
+		assert.Nil(t, attrs.Control, "Expected the Control left unset")
+
+		duration, ok := TimerDuration(&TimerInfo{TimerId: *attrs.TimerId, StartToFireTimeout: *attrs.StartToFireTimeout})
+		assert.True(t, ok, "Expected the duration read from the StartToFireTimeout")
+		assert.Equal(t, 8*time.Second, duration)
+	}
+}
+
+func TestScheduleActivityOnce(t *testing.T) {
+	// arrange
+	activityType := &swf.ActivityType{Name: s.S("sync"), Version: s.S("1")}
+	decider := ScheduleActivityOnce(activityType, "tasks", func(data interface{}) interface{} {
+		return &TestingType{Field: data.(*TestingType).Field + "-input"}
+	})
+	data := &TestingType{"xxx"}
+	ctx := testContext(testFSM())
+	inFlight := testContext(testFSM())
+	inFlight.eventCorrelator.Track(s.EventFromPayload(1, &swf.ActivityTaskScheduledEventAttributes{
+		ActivityId: s.S("sync-1"), ActivityType: activityType,
+	}))
+
+	// act
+	first := decider(ctx, &swf.HistoryEvent{}, data)
+	second := decider(ctx, &swf.HistoryEvent{}, data)
+	alreadyInFlight := decider(inFlight, &swf.HistoryEvent{}, data)
+	otherVersion := ScheduleActivityOnce(&swf.ActivityType{Name: s.S("sync"), Version: s.S("2")}, "", nil)(inFlight, &swf.HistoryEvent{}, data)
+
+	// assert
+	assert.Equal(t, "", first.State, "Expected ScheduleActivityOnce to continue")
+	if assert.Len(t, first.Decisions, 1, "Expected the activity scheduled") {
+		attrs := first.Decisions[0].ScheduleActivityTaskDecisionAttributes
+		assert.Equal(t, activityType, attrs.ActivityType)
+		assert.Equal(t, "tasks", *attrs.TaskList.Name)
+		assert.Contains(t, *attrs.Input, "xxx-input")
+	}
+	assert.Empty(t, second.Decisions, "Expected no second schedule in the same decision task")
+	assert.Empty(t, alreadyInFlight.Decisions, "Expected no schedule while the activity is in flight")
+	assert.Len(t, otherVersion.Decisions, 1, "Expected another version of the activity type scheduled")
+}
+
+func TestTimerDurationWithoutStartToFireTimeout(t *testing.T) {
+	_, ok := TimerDuration(&TimerInfo{TimerId: "other"})
+	assert.False(t, ok)
+	_, ok = TimerDuration(&TimerInfo{TimerId: "other", StartToFireTimeout: "not-seconds"})
+	assert.False(t, ok)
+	_, ok = TimerDuration(nil)
+	assert.False(t, ok)
+}
+
+func ExampleStartTimer() {
+	//an adaptive polling loop: check on an external job each time the "poll" timer fires,
+	//doubling the interval with the attempt count kept in the state data, up to 5 minutes.
+	type PollState struct {
+		Attempts int
+	}
+	typed := Typed(new(PollState))
+
+	interval := func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) time.Duration {
+		if d := 10 * time.Second << uint(data.(*PollState).Attempts); d < 5*time.Minute {
+			return d
+		}
+		return 5 * time.Minute
+	}
+
+	polling := NewComposedDecider(
+		OnTimerFired("poll",
+			UpdateState(typed.StateFunc(func(ctx *FSMContext, h *swf.HistoryEvent, data *PollState) {
+				//the duration of the timer that fired is its StartToFireTimeout.
+				info := ctx.TimersInfo()[strconv.FormatInt(*h.TimerFiredEventAttributes.StartedEventId, 10)]
+				if waited, ok := TimerDuration(info); ok {
+					fmt.Println("polled after", waited)
+				}
+				data.Attempts++
+			})),
+			StartTimer("poll", interval),
+			Stay(),
+		),
+		DefaultDecider(),
+	)
+
+	ctx := NewFSMContext(nil,
+		swf.WorkflowType{Name: s.S("poller"), Version: s.S("1")},
+		swf.WorkflowExecution{WorkflowId: s.S("id"), RunId: s.S("runid")},
+		&EventCorrelator{}, "polling", nil, 1)
+
+	//start the first timer on entering the polling state, then simulate the timer firing three times.
+	data := &PollState{}
+	outcome := StartTimer("poll", interval)(ctx, &swf.HistoryEvent{}, data)
+	for eventId := int64(1); eventId < 6; eventId += 2 {
+		attrs := outcome.Decisions[0].StartTimerDecisionAttributes
+		ctx.Decide(s.EventFromPayload(int(eventId), &swf.TimerStartedEventAttributes{
+			TimerId: attrs.TimerId, Control: attrs.Control, StartToFireTimeout: attrs.StartToFireTimeout,
+		}), data, Stay())
+		outcome = ctx.Decide(s.EventFromPayload(int(eventId+1), &swf.TimerFiredEventAttributes{
+			TimerId: attrs.TimerId, StartedEventId: &eventId,
+		}), data, polling)
+		data = outcome.Data.(*PollState)
+	}
+	fmt.Println("next poll in", *outcome.Decisions[0].StartTimerDecisionAttributes.StartToFireTimeout, "seconds")
+
+	// Output:
+	// polled after 10s
+	// polled after 20s
+	// polled after 40s
+	// next poll in 80 seconds
+}
+
 func TestStay(t *testing.T) {}
 
 func testContextWithActivity(scheduledEventId int, event *swf.ActivityTaskScheduledEventAttributes) func() *FSMContext {
@@ -2,8 +2,12 @@ package fsm
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/aws/aws-sdk-go/service/swf"
+	. "github.com/sclasen/swfsm/log"
+	"github.com/sclasen/swfsm/poller"
+	. "github.com/sclasen/swfsm/sugar"
 )
 
 //DecisionTaskDispatcher is used by the FSM machinery to
@@ -21,11 +25,21 @@ func (*CallingGoroutineDispatcher) DispatchTask(task *swf.PollForDecisionTaskOut
 
 //NewGoroutineDispatcher is a DecisionTaskDispatcher that runs the decision handler in a new goroutine.
 type NewGoroutineDispatcher struct {
+	inFlight int32
 }
 
 //DispatchTask calls the handler in a new  goroutine.
-func (*NewGoroutineDispatcher) DispatchTask(task *swf.PollForDecisionTaskOutput, handler func(*swf.PollForDecisionTaskOutput)) {
-	go handler(task)
+func (n *NewGoroutineDispatcher) DispatchTask(task *swf.PollForDecisionTaskOutput, handler func(*swf.PollForDecisionTaskOutput)) {
+	atomic.AddInt32(&n.inFlight, 1)
+	go func() {
+		defer atomic.AddInt32(&n.inFlight, -1)
+		handler(task)
+	}()
+}
+
+//InFlight returns the number of tasks being handled, it implements poller.Drainer.
+func (n *NewGoroutineDispatcher) InFlight() int {
+	return int(atomic.LoadInt32(&n.inFlight))
 }
 
 //BoundedGoroutineDispatcher is a DecisionTaskDispatcher that uses a bounded number of goroutines to run decision handlers.
@@ -33,6 +47,7 @@ type BoundedGoroutineDispatcher struct {
 	NumGoroutines int
 	started       bool
 	tasks         chan *swf.PollForDecisionTaskOutput
+	inFlight      int32
 }
 
 //DispatchTask calls sends the task on a channel that NumGoroutines goroutines are selecting on.
@@ -52,6 +67,7 @@ func (b *BoundedGoroutineDispatcher) DispatchTask(task *swf.PollForDecisionTaskO
 					select {
 					case t := <-b.tasks:
 						handler(t)
+						atomic.AddInt32(&b.inFlight, -1)
 					}
 				}
 			}()
@@ -59,9 +75,140 @@ func (b *BoundedGoroutineDispatcher) DispatchTask(task *swf.PollForDecisionTaskO
 		b.started = true
 	}
 
+	atomic.AddInt32(&b.inFlight, 1)
 	b.tasks <- task
 }
 
+//InFlight returns the number of tasks being handled or waiting for a goroutine, it implements poller.Drainer.
+func (b *BoundedGoroutineDispatcher) InFlight() int {
+	return int(atomic.LoadInt32(&b.inFlight))
+}
+
+//ClassifyingDispatcher is a DecisionTaskDispatcher that dispatches each task to one of a set of DecisionTaskDispatchers,
+//chosen by classifying the task, for example by its workflow type or by the tags of its workflow, see WorkflowTags.
+//This allows e.g. high priority workflows to be processed by dedicated goroutines.
+type ClassifyingDispatcher struct {
+	//Classifier returns the key of the dispatcher in Dispatchers to use for the task.
+	Classifier func(*swf.PollForDecisionTaskOutput) string
+	//Dispatchers by classification.
+	Dispatchers map[string]DecisionTaskDispatcher
+	//Default is used when the classification has no dispatcher in Dispatchers. If unset a CallingGoroutineDispatcher is used.
+	Default DecisionTaskDispatcher
+}
+
+//DispatchTask classifies the task and dispatches it with the matching dispatcher, or the Default dispatcher.
+func (c *ClassifyingDispatcher) DispatchTask(task *swf.PollForDecisionTaskOutput, handler func(*swf.PollForDecisionTaskOutput)) {
+	if c.Classifier != nil {
+		if dispatcher, ok := c.Dispatchers[c.Classifier(task)]; ok {
+			dispatcher.DispatchTask(task, handler)
+			return
+		}
+	}
+	//resolve the default without setting it, since pollers dispatch concurrently.
+	var dispatcher DecisionTaskDispatcher = &CallingGoroutineDispatcher{}
+	if c.Default != nil {
+		dispatcher = c.Default
+	}
+	dispatcher.DispatchTask(task, handler)
+}
+
+//InFlight returns the sum of the tasks in flight of the Dispatchers and Default that implement poller.Drainer.
+func (c *ClassifyingDispatcher) InFlight() int {
+	inFlight := 0
+	for _, d := range c.Dispatchers {
+		if drainer, ok := d.(poller.Drainer); ok {
+			inFlight += drainer.InFlight()
+		}
+	}
+	if drainer, ok := c.Default.(poller.Drainer); ok {
+		inFlight += drainer.InFlight()
+	}
+	return inFlight
+}
+
+//StartedEventTags returns the tags of the WorkflowExecutionStarted event of the task, or nil if the task does not have it.
+//The poller stops paging history once a task is ready, so only the first tasks of a workflow have the started event.
+//Classify tasks with WorkflowTags to get the tags of the later tasks as well.
+func StartedEventTags(task *swf.PollForDecisionTaskOutput) []*string {
+	if e := startedEvent(task); e != nil {
+		return e.WorkflowExecutionStartedEventAttributes.TagList
+	}
+	return nil
+}
+
+func startedEvent(task *swf.PollForDecisionTaskOutput) *swf.HistoryEvent {
+	for _, e := range task.Events {
+		if e.EventType != nil && *e.EventType == swf.EventTypeWorkflowExecutionStarted && e.WorkflowExecutionStartedEventAttributes != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+//DescribeWorkflowOps is the subset of swf.SWF ops required by WorkflowTags.
+type DescribeWorkflowOps interface {
+	DescribeWorkflowExecution(*swf.DescribeWorkflowExecutionInput) (*swf.DescribeWorkflowExecutionOutput, error)
+}
+
+//WorkflowTags looks up the tags of the workflows of decision tasks, for use in a ClassifyingDispatcher Classifier.
+//The tags are read from the started event of the task if it has one, otherwise with DescribeWorkflowExecution,
+//and are cached by run id, since the tags of a run do not change. The lookup runs on the goroutine dispatching the task.
+type WorkflowTags struct {
+	Domain string
+	SWF    DescribeWorkflowOps
+	//CacheSize is the number of runs whose tags are cached, the cache is cleared when it is full. Defaults to 10000.
+	CacheSize int
+
+	mu    sync.Mutex
+	cache map[string][]*string
+}
+
+//Tags returns the tags of the workflow of the task. If the workflow cannot be described, the error is logged and nil is returned.
+func (w *WorkflowTags) Tags(task *swf.PollForDecisionTaskOutput) []*string {
+	if task.WorkflowExecution == nil || task.WorkflowExecution.RunId == nil {
+		return StartedEventTags(task)
+	}
+	runId := *task.WorkflowExecution.RunId
+
+	w.mu.Lock()
+	tags, ok := w.cache[runId]
+	w.mu.Unlock()
+	if ok {
+		return tags
+	}
+
+	if e := startedEvent(task); e != nil {
+		tags = e.WorkflowExecutionStartedEventAttributes.TagList
+	} else {
+		resp, err := w.SWF.DescribeWorkflowExecution(&swf.DescribeWorkflowExecutionInput{
+			Domain:    S(w.Domain),
+			Execution: task.WorkflowExecution,
+		})
+		if err != nil {
+			Log.Printf("component=workflow-tags at=describe-workflow-failed workflow-id=%s run-id=%s error=%q", LS(task.WorkflowExecution.WorkflowId), runId, err.Error())
+			return nil
+		}
+		if resp.ExecutionInfo != nil {
+			tags = resp.ExecutionInfo.TagList
+		}
+	}
+
+	w.mu.Lock()
+	if w.cache == nil || len(w.cache) >= w.cacheSize() {
+		w.cache = make(map[string][]*string)
+	}
+	w.cache[runId] = tags
+	w.mu.Unlock()
+	return tags
+}
+
+func (w *WorkflowTags) cacheSize() int {
+	if w.CacheSize <= 0 {
+		return 10000
+	}
+	return w.CacheSize
+}
+
 //GoroutinePerWorkflowDispatcher allows a single goroutine per workflow execution (RunID) to run at a time.
 //Tasks are queued for each workflow execution.
 //Any workflow execution with maxPendingTasks can cause DispatchTask to block until at least one of them gets handled.
@@ -76,16 +223,24 @@ type goroutinePerWorkflowDispatcher struct {
 	tasks           map[string]chan *swf.PollForDecisionTaskOutput
 	tasksBufferSize int
 	tasksMux        sync.Mutex
+	inFlight        int32
 }
 
 func (b *goroutinePerWorkflowDispatcher) DispatchTask(task *swf.PollForDecisionTaskOutput, handler func(*swf.PollForDecisionTaskOutput)) {
 	tasks := b.tasksFor(*task.WorkflowExecution.RunId)
+	atomic.AddInt32(&b.inFlight, 1)
 	go func(queue chan *swf.PollForDecisionTaskOutput) {
+		defer atomic.AddInt32(&b.inFlight, -1)
 		handler(<-queue)
 	}(tasks)
 	tasks <- task // can block if there are maxPendingTasks for this workflow execution
 }
 
+//InFlight returns the number of tasks being handled or queued, it implements poller.Drainer.
+func (b *goroutinePerWorkflowDispatcher) InFlight() int {
+	return int(atomic.LoadInt32(&b.inFlight))
+}
+
 func (b *goroutinePerWorkflowDispatcher) tasksFor(workflowRunID string) chan *swf.PollForDecisionTaskOutput {
 	b.tasksMux.Lock()
 	defer b.tasksMux.Unlock()
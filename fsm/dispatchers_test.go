@@ -6,6 +6,8 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/swf"
+	"github.com/sclasen/swfsm/poller"
+	"github.com/sclasen/swfsm/testing/mocks"
 
 	"time"
 )
@@ -26,6 +28,111 @@ func TestGoroutinePerWorkflowDispatcher(t *testing.T) {
 func TestGoroutinePerWorkflowDispatcherUnbuffered(t *testing.T) {
 	testDispatcher(GoroutinePerWorkflowDispatcher(0), t)
 }
+func TestClassifyingDispatcher(t *testing.T) {
+	testDispatcher(&ClassifyingDispatcher{}, t)
+
+	priority := &countingDispatcher{}
+	dispatcher := &ClassifyingDispatcher{
+		Classifier: func(task *swf.PollForDecisionTaskOutput) string {
+			for _, tag := range StartedEventTags(task) {
+				if *tag == "priority" {
+					return "priority"
+				}
+			}
+			return ""
+		},
+		Dispatchers: map[string]DecisionTaskDispatcher{"priority": priority},
+	}
+	task := &swf.PollForDecisionTaskOutput{
+		Events: []*swf.HistoryEvent{{
+			EventType: aws.String(swf.EventTypeWorkflowExecutionStarted),
+			WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+				TagList: []*string{aws.String("priority")},
+			},
+		}},
+	}
+	dispatcher.DispatchTask(task, func(*swf.PollForDecisionTaskOutput) {})
+	dispatcher.DispatchTask(&swf.PollForDecisionTaskOutput{}, func(*swf.PollForDecisionTaskOutput) {})
+
+	if priority.dispatched != 1 {
+		t.Fatal("expected only the priority task on the priority dispatcher, got", priority.dispatched)
+	}
+	if dispatcher.Default != nil {
+		t.Fatal("expected the Default left unset by concurrent dispatches, got", dispatcher.Default)
+	}
+}
+
+func TestWorkflowTags(t *testing.T) {
+	mockSwf := &mocks.SWFAPI{}
+	mockSwf.MockOnAny_DescribeWorkflowExecution().Return(func(req *swf.DescribeWorkflowExecutionInput) *swf.DescribeWorkflowExecutionOutput {
+		if *req.Domain != "domain" || *req.Execution.RunId != "run-later" {
+			t.Fatal("unexpected describe", req)
+		}
+		return &swf.DescribeWorkflowExecutionOutput{ExecutionInfo: &swf.WorkflowExecutionInfo{TagList: []*string{aws.String("priority")}}}
+	}, nil).Once()
+	tags := &WorkflowTags{Domain: "domain", SWF: mockSwf}
+
+	first := &swf.PollForDecisionTaskOutput{
+		WorkflowExecution: &swf.WorkflowExecution{WorkflowId: aws.String("workflow"), RunId: aws.String("run-first")},
+		Events: []*swf.HistoryEvent{{
+			EventType:                               aws.String(swf.EventTypeWorkflowExecutionStarted),
+			WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{TagList: []*string{aws.String("first")}},
+		}},
+	}
+	if got := tags.Tags(first); len(got) != 1 || *got[0] != "first" {
+		t.Fatal("expected the tags of the started event", got)
+	}
+
+	later := &swf.PollForDecisionTaskOutput{
+		WorkflowExecution: &swf.WorkflowExecution{WorkflowId: aws.String("workflow"), RunId: aws.String("run-later")},
+	}
+	for i := 0; i < 2; i++ {
+		if got := tags.Tags(later); len(got) != 1 || *got[0] != "priority" {
+			t.Fatal("expected the tags of a task without the started event described, then cached", got)
+		}
+	}
+	mockSwf.AssertExpectations(t)
+}
+
+func TestDispatchersInFlight(t *testing.T) {
+	testDrainer(&NewGoroutineDispatcher{}, t)
+	testDrainer(&BoundedGoroutineDispatcher{NumGoroutines: 2}, t)
+	testDrainer(GoroutinePerWorkflowDispatcher(1), t)
+	testDrainer(&ClassifyingDispatcher{Default: &NewGoroutineDispatcher{}}, t)
+}
+
+func testDrainer(dispatcher DecisionTaskDispatcher, t *testing.T) {
+	drainer, ok := dispatcher.(poller.Drainer)
+	if !ok {
+		t.Fatalf("%T does not implement poller.Drainer", dispatcher)
+	}
+	task := &swf.PollForDecisionTaskOutput{
+		WorkflowExecution: &swf.WorkflowExecution{
+			RunId: aws.String("workflow-dummy"),
+		},
+	}
+	release := make(chan struct{})
+	dispatcher.DispatchTask(task, func(*swf.PollForDecisionTaskOutput) { <-release })
+
+	if drainer.InFlight() != 1 {
+		t.Fatalf("%T expected 1 task in flight, got %d", dispatcher, drainer.InFlight())
+	}
+	close(release)
+	for start := time.Now(); drainer.InFlight() != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("%T timed out waiting for 0 tasks in flight", dispatcher)
+		}
+	}
+}
+
+type countingDispatcher struct {
+	dispatched int
+}
+
+func (c *countingDispatcher) DispatchTask(task *swf.PollForDecisionTaskOutput, handler func(*swf.PollForDecisionTaskOutput)) {
+	c.dispatched++
+	handler(task)
+}
 
 func testDispatcher(dispatcher DecisionTaskDispatcher, t *testing.T) {
 	task := &swf.PollForDecisionTaskOutput{
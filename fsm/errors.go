@@ -0,0 +1,97 @@
+package fsm
+
+import (
+	"fmt"
+)
+
+// Errors returned by FSM.Tick, and passed to the TaskErrorHandler, when the FSM machinery fails rather than a decider,
+// so callers can tell them apart with errors.As, e.g. to alert on an ErrMissingState but retry an ErrCorrelatorDeserialize.
+// They are returned as is rather than traced, since traced errors cannot be unwrapped.
+
+// ErrMissingState is returned when the state the workflow is in is not a state of the FSM.
+type ErrMissingState struct {
+	State string
+}
+
+func (e *ErrMissingState) Error() string {
+	return "marked-state-not-in-fsm state=" + e.State
+}
+
+// ErrNoSerializedState is returned when no state marker, or start input, is found in the history.
+type ErrNoSerializedState struct{}
+
+func (e *ErrNoSerializedState) Error() string {
+	return "Cant Find Current Data"
+}
+
+// ErrStateDeserialize is returned when the state marker, or the state data in it, cannot be deserialized.
+type ErrStateDeserialize struct {
+	Err error
+}
+
+func (e *ErrStateDeserialize) Error() string {
+	return fmt.Sprintf("deserialize state: %s", e.Err)
+}
+
+func (e *ErrStateDeserialize) Unwrap() error {
+	return e.Err
+}
+
+// ErrCorrelatorDeserialize is returned when the correlator marker cannot be deserialized.
+type ErrCorrelatorDeserialize struct {
+	Err error
+}
+
+func (e *ErrCorrelatorDeserialize) Error() string {
+	return fmt.Sprintf("deserialize correlator: %s", e.Err)
+}
+
+func (e *ErrCorrelatorDeserialize) Unwrap() error {
+	return e.Err
+}
+
+// ErrNonMonotonicStateVersion is reported by AssertMonotonicStateVersion when a state marker does not have the next version.
+type ErrNonMonotonicStateVersion struct {
+	Version  uint64
+	Expected uint64
+}
+
+func (e *ErrNonMonotonicStateVersion) Error() string {
+	return fmt.Sprintf("state marker has version %d, expected %d", e.Version, e.Expected)
+}
+
+// ErrOpenLimitExceeded is reported by LimitOpenActivities and LimitOpenTimers for each decision they drop.
+type ErrOpenLimitExceeded struct {
+	Interceptor string
+	Max         int
+	Open        int
+}
+
+func (e *ErrOpenLimitExceeded) Error() string {
+	return fmt.Sprintf("%s dropped a decision with %d open, max %d", e.Interceptor, e.Open, e.Max)
+}
+
+// ErrRetry is returned by the DecisionErrorHandler built by RetryThenFail while the failed event is still retried.
+// Its Attempts are recorded in the RetryAttempts of the SerializedErrorState.
+type ErrRetry struct {
+	Attempts int
+	Err      error
+}
+
+func (e *ErrRetry) Error() string {
+	return fmt.Sprintf("retry-attempts=%d error=%s", e.Attempts, e.Err)
+}
+
+// ErrUnprocessedWindowExceeded is returned when more events than FSM.MaxUnprocessedWindow are unprocessed since an error,
+// from the ErrorEvent to the StartedEventId of the decision task, and is reported to an UnprocessedWindowReporter.
+// The workflow is stuck from then on: every decision task fails, until an operator either fixes the failing decider
+// and raises MaxUnprocessedWindow above the Window so the workflow is recovered, or terminates the workflow.
+type ErrUnprocessedWindowExceeded struct {
+	Window       int64
+	ErrorEventId int64
+	Max          int64
+}
+
+func (e *ErrUnprocessedWindowExceeded) Error() string {
+	return fmt.Sprintf("unprocessed window of %d events from error event %d exceeds MaxUnprocessedWindow %d", e.Window, e.ErrorEventId, e.Max)
+}
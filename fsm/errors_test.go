@@ -0,0 +1,57 @@
+package fsm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+	. "github.com/sclasen/swfsm/sugar"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTickErrorsExpectsTypedErrors(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.AllowPanics = false
+	f.AddInitialState(&FSMState{
+		Name: "initial",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+
+	marker := func(id int, name, details string) *swf.HistoryEvent {
+		e := testHistoryEvent(id, swf.EventTypeMarkerRecorded)
+		e.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(name), Details: S(details)}
+		return e
+	}
+	stateIn := func(name string) string {
+		serialized, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: name, StateData: "{}", WorkflowId: "test-workflow-1"})
+		return serialized
+	}
+	tick := func(events ...*swf.HistoryEvent) error {
+		_, _, _, err := f.Tick(testDecisionTask(0, append([]*swf.HistoryEvent{testHistoryEvent(4, swf.EventTypeDecisionTaskStarted)}, events...)))
+		return err
+	}
+
+	// act
+	missingErr := tick(testHistoryEvent(3, swf.EventTypeWorkflowExecutionSignaled), marker(2, StateMarker, stateIn("unknown")))
+	noStateErr := tick(testHistoryEvent(3, swf.EventTypeDecisionTaskScheduled))
+	stateErr := tick(marker(3, StateMarker, "not-json"))
+	correlatorErr := tick(marker(3, CorrelatorMarker, "not-json"), marker(2, StateMarker, stateIn("initial")))
+
+	// assert
+	var missing *ErrMissingState
+	if assert.True(t, errors.As(missingErr, &missing), "Expected ErrMissingState, got %v", missingErr) {
+		assert.Equal(t, "unknown", missing.State)
+	}
+	var noState *ErrNoSerializedState
+	assert.True(t, errors.As(noStateErr, &noState), "Expected ErrNoSerializedState, got %v", noStateErr)
+	var deserialize *ErrStateDeserialize
+	assert.True(t, errors.As(stateErr, &deserialize), "Expected ErrStateDeserialize, got %v", stateErr)
+	var correlator *ErrCorrelatorDeserialize
+	if assert.True(t, errors.As(correlatorErr, &correlator), "Expected ErrCorrelatorDeserialize, got %v", correlatorErr) {
+		assert.Error(t, errors.Unwrap(correlator))
+	}
+}
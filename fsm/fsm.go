@@ -1,18 +1,44 @@
 package fsm
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/swf"
 	"github.com/juju/errors"
 	"github.com/sclasen/swfsm/internal/panicinfo"
 	. "github.com/sclasen/swfsm/log"
+	"github.com/sclasen/swfsm/metrics"
 	"github.com/sclasen/swfsm/poller"
 	s "github.com/sclasen/swfsm/sugar"
 )
 
+// DefaultUnknownStateDeferral is the default FSM.UnknownStateDeferral.
+const DefaultUnknownStateDeferral = 30 * time.Second
+
+// DefaultCheckpointMargin is the default FSM.CheckpointMargin.
+const DefaultCheckpointMargin = time.Second
+
+// ExecutionContextSeparator separates the state name from the output of FSM.ExecutionContextFunc in the ExecutionContext.
+const ExecutionContextSeparator = " | "
+
+// MaxExecutionContextLength is the number of characters SWF allows in the ExecutionContext of a decision task.
+const MaxExecutionContextLength = 32768
+
+// ExecutionContextStateName returns the state name at the start of an ExecutionContext recorded by an FSM.
+func ExecutionContextStateName(executionContext string) string {
+	return strings.SplitN(executionContext, ExecutionContextSeparator, 2)[0]
+}
+
 //SWFOps is the subset of swf.SWF ops required by the fsm package
 type SWFOps interface {
 	PollForDecisionTaskPages(*swf.PollForDecisionTaskInput, func(*swf.PollForDecisionTaskOutput, bool) bool) error
@@ -27,12 +53,20 @@ type FSM struct {
 	Domain string
 	// TaskList that the underlying poller will poll for decision tasks.
 	TaskList string
-	// Identity used in PollForDecisionTaskRequests, can be empty.
+	// TaskLists, if set, are polled for decision tasks as well as the TaskList, e.g. when the workflows are sharded across task lists.
+	// The FSM starts PollerCount pollers per task list.
+	TaskLists []string
+	// Identity used in PollForDecisionTaskRequests, can be empty. {host} and {pid} are expanded, see poller.ExpandIdentity.
 	Identity string
+	// WorkflowType of the workflow associated with the FSM, can be nil.
+	// When set it is used by FSMContext.WorkflowTypeRef and by FSMClient.Start when the start template has no WorkflowType.
+	WorkflowType *swf.WorkflowType
 	// Client used to make SWF api requests.
 	SWF SWFOps
 	// Strategy for replication of state. Events may be delivered out of order.
 	ReplicationHandler ReplicationHandler
+	// Context aware strategy for replication of state. If set, it is used instead of ReplicationHandler.
+	ContextReplicationHandler ContextReplicationHandler
 	// DataType of the data struct associated with this FSM.
 	// The data is automatically peristed to and loaded from workflow history by the FSM.
 	DataType interface{}
@@ -74,8 +108,94 @@ type FSM struct {
 	//AllowPanics is mainly for testing, it should be set to false in production.
 	//when true, instead of recovering from panics in deciders, it allows them to propagate.
 	AllowPanics bool
-	// Logger is used for output on a FSM. If not set, will use log.Log
+	// Logger is used for output on a FSM. If not set, will use log.Log.
+	// If it implements log.StructuredLogger, log lines are passed to it as fields.
 	Logger StdLogger
+	// DecisionTaskCompletedDecorator, if set, is called right before RespondDecisionTaskCompleted
+	// so that the request can be changed, e.g. its ExecutionContext overridden or Decisions added.
+	DecisionTaskCompletedDecorator func(*swf.RespondDecisionTaskCompletedInput)
+	// ExecutionContextFunc, if set, produces a summary, e.g. of the state data, that is recorded after the state name and
+	// the ExecutionContextSeparator in the ExecutionContext of each RespondDecisionTaskCompleted, shown as the latest
+	// execution context in the SWF console. If unset, the ExecutionContext is the state name.
+	// FSMClient.GetStateNameFast and StateHistogram read the state name with ExecutionContextStateName either way.
+	ExecutionContextFunc func(*FSMContext, *SerializedState) string
+	// MinimizeCorrelatorWrites, when true, skips recording the CorrelatorMarker on a decision task
+	// if the serialized correlator is identical to the one loaded from history.
+	MinimizeCorrelatorWrites bool
+	// OverflowStore, if set, stores the serialized state, correlator and error state when they are at least OverflowThreshold long,
+	// and a pointer to them is recorded in their markers instead, which keeps workflows with very large state viable.
+	// The FSM, and any FSMClient reading its markers, must have the OverflowStore set for as long as such markers are in history.
+	OverflowStore OverflowStore
+	// OverflowThreshold is the length of serialized markers from which they are put in the OverflowStore.
+	// Defaults to DefaultOverflowThreshold.
+	OverflowThreshold int
+	// IDGenerator generates the poll ids of the poller, and the unique part of the ActivityIds created by FSMContext.ScheduleActivity,
+	// e.g. to produce stable ids in tests. A stable generator must still return a unique value on each call, or activities
+	// scheduled by a workflow will collide. If not set, the poller uses poller.IDGenerator and ScheduleActivity uses uuid.New.
+	IDGenerator func() string
+	// AuditDecisions, when true, emits a log line per decision with its type and identifiers as JSON.
+	// Payloads such as inputs, details and results are never included.
+	AuditDecisions bool
+	// DeferUnknownStates, when true, defers decision tasks for workflows whose marked state is not in the FSM instead of failing them,
+	// which protects workflows when a rolling deploy adds states while older deciders still poll the task list.
+	// A deferred task records a DeferMarker and starts a DeferTimer, and the deferred events are decided
+	// by the next FSM that knows the state.
+	DeferUnknownStates bool
+	// CodeVersion, if set, is recorded in the SerializedState, and compared with the CodeVersion of the state loaded from history
+	// on each decision task, so that in-flight workflows can be migrated when the deciders change incompatibly.
+	CodeVersion string
+	// OnVersionMismatch, if set, is called when CodeVersion is set and the CodeVersion of the state loaded from history differs,
+	// before any event is decided. The Outcome it returns, if not nil, replaces the loaded state and data, and its decisions are added,
+	// e.g. to route the workflow to a compatibility state, or to a state whose decider continues the workflow as new.
+	// Once the state is recorded with the new CodeVersion, it is not called again for the workflow.
+	// States in start inputs without a CodeVersion, such as those built by StartFSMWorkflowInput, are taken to be of the current CodeVersion.
+	OnVersionMismatch func(ctx *FSMContext, state *SerializedState, data interface{}) *Outcome
+	// UnknownStateDeferral is the StartToFireTimeout of the DeferTimer. Defaults to DefaultUnknownStateDeferral.
+	UnknownStateDeferral time.Duration
+	// DecisionTaskTimeout, if set, is the deadline for deciding a decision task, after which it is abandoned
+	// and handed to the TaskErrorHandler. Set it below the TaskStartToCloseTimeout of the workflow.
+	DecisionTaskTimeout time.Duration
+	// CheckpointMargin is how long before the DecisionTaskTimeout FSMContext.Checkpoint starts reporting that the deadline is near.
+	// Defaults to DefaultCheckpointMargin.
+	CheckpointMargin time.Duration
+	// DecisionTaskContextFunc, if set, derives the context of each polled decision task, e.g. to start a tracing span
+	// or attach a request id. The context is passed to TickContext, bounded by the DecisionTaskTimeout, and without that deadline
+	// to the ContextReplicationHandler.
+	DecisionTaskContextFunc func(ctx context.Context, decisionTask *swf.PollForDecisionTaskOutput) context.Context
+	// ReplicationBufferSize, when positive, buffers up to this many replications while replication is disabled or failing, see FlushReplication.
+	ReplicationBufferSize int
+	// SnapshotStore, if set, is given the SerializedState of a workflow after its decision task is completed,
+	// e.g. to keep snapshots of long running workflows in S3 for analytics. Unlike replication, snapshots are
+	// keyed by state version and failures to store them are only logged.
+	SnapshotStore SnapshotStore
+	// SnapshotEvery is the interval of state versions between snapshots. Defaults to 1, which snapshots every version.
+	SnapshotEvery uint64
+	// RespondRetrier, if set, retries RespondDecisionTaskCompleted on throttling and server errors
+	// before handing the decision task to the TaskErrorHandler.
+	RespondRetrier *RespondRetrier
+	// EventTransformer, if set, is called with the events of each decision task before they are processed,
+	// and the events it returns are used instead. It is a migration hook, e.g. to rename a deprecated signal,
+	// and must return events in the same newest-first order.
+	EventTransformer func(events []*swf.HistoryEvent) []*swf.HistoryEvent
+	// EventFilter, if set, is called with each event after the previous decision task, and the events it returns false for
+	// are ignored entirely: they are not decided, and not tracked by the EventCorrelator, so filtering the events of
+	// activities, signals or timers scheduled by the FSM breaks their correlation. It is meant for events that the FSM
+	// does not use, e.g. markers recorded by another system. If unset, all events are kept.
+	EventFilter func(*swf.HistoryEvent) bool
+	// CorrelatorSizeWarning, when positive, logs the EventCorrelator Stats at the end of a tick when any of its maps
+	// has more entries than this, which is usually a sign of correlations that are never removed.
+	CorrelatorSizeWarning int
+	// MaxUnprocessedWindow, when positive, caps the number of events decided again when recovering a workflow in error.
+	// Past it, the decision tasks of the workflow fail with an ErrUnprocessedWindowExceeded.
+	MaxUnprocessedWindow int64
+	// TaskReadyFunc is called by the pollers with the pages of a decision task read so far, and stops the paging once it returns true.
+	// It must not return true before the pages hold the events needed to decide, e.g. in history without the FSM markers.
+	// This includes the events deferred by a DeferMarker newer than the last state marker, from its EarliestUnprocessedEventId on,
+	// which can predate the PreviousStartedEventId of the task.
+	// If unset, DefaultTaskReady will be used.
+	TaskReadyFunc func(*swf.PollForDecisionTaskOutput) bool
+	// MetricsSink receives metrics about decision tasks, and is also given to the pollers. If not set, will use metrics.Sink.
+	MetricsSink metrics.MetricsSink
 
 	states        map[string]*FSMState
 	errorHandlers map[string]DecisionErrorHandler
@@ -87,6 +207,10 @@ type FSM struct {
 	stopAck       chan bool
 	//stasher makes intermediate copies of state for error handling if necessary
 	stasher *Stasher
+	//replicationDisabled is accessed atomically, 0 means replication is enabled.
+	replicationDisabled int32
+	replicationMu       sync.Mutex // protects replicationBuffer
+	replicationBuffer   []*ReplicationData
 }
 
 // StateSerializer is the implementation of FSMSerializer.StateSerializer()
@@ -94,6 +218,11 @@ func (f *FSM) StateSerializer() StateSerializer {
 	return f.Serializer
 }
 
+// SystemStateSerializer is the implementation of SystemSerialization.SystemStateSerializer()
+func (f *FSM) SystemStateSerializer() StateSerializer {
+	return f.SystemSerializer
+}
+
 // AddInitialState adds a state to the FSM and uses it as the initial state when a workflow execution is started.
 func (f *FSM) AddInitialState(state *FSMState) {
 	f.AddState(state)
@@ -113,6 +242,52 @@ func (f *FSM) AddState(state *FSMState) {
 	f.states[state.Name] = state
 }
 
+// AddSubMachine adds a set of states to the FSM under a namespace, so reusable sub state machines can be composed into
+// multiple FSMs without name collisions. Each state is added as SubMachineState(name, state.Name).
+// The parent enters the sub machine by transitioning to SubMachineEntry(name, states), which is the first of the states.
+// Inside the sub machine, transitions to the un-namespaced name of one of its states stay inside the sub machine,
+// and transitions to any other state name exit the sub machine to the state of that name in the parent FSM.
+// The EventDeciders, OnEnter and OnExit of the states are kept, and see the namespaced state names in the FSMContext.
+func (f *FSM) AddSubMachine(name string, states []*FSMState) {
+	local := make(map[string]bool, len(states))
+	for _, state := range states {
+		local[state.Name] = true
+	}
+	namespaced := func(decider Decider) Decider {
+		return func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			outcome := decider(ctx, h, data)
+			if local[outcome.State] {
+				outcome.State = SubMachineState(name, outcome.State)
+			}
+			return outcome
+		}
+	}
+	for _, state := range states {
+		added := *state
+		added.Name = SubMachineState(name, state.Name)
+		if state.Decider != nil {
+			added.Decider = namespaced(state.Decider)
+		}
+		if state.EventDeciders != nil {
+			added.EventDeciders = make(map[string]Decider, len(state.EventDeciders))
+			for eventType, decider := range state.EventDeciders {
+				added.EventDeciders[eventType] = namespaced(decider)
+			}
+		}
+		f.AddState(&added)
+	}
+}
+
+// SubMachineState returns the namespaced name of a state added to an FSM with AddSubMachine.
+func SubMachineState(name, state string) string {
+	return name + SubMachineSeparator + state
+}
+
+// SubMachineEntry returns the namespaced name of the first state of the sub machine added to an FSM with AddSubMachine.
+func SubMachineEntry(name string, states []*FSMState) string {
+	return SubMachineState(name, states[0].Name)
+}
+
 // AddCompleteState adds a state to the FSM and uses it as the final state of a workflow.
 // It will only receive events if you returned FSMContext.Complete(...) and the workflow was unable to complete.
 func (f *FSM) AddCompleteState(state *FSMState) {
@@ -199,6 +374,33 @@ func (f *FSM) DefaultFailedState() *FSMState {
 	}
 }
 
+// DefaultDrainingState is the state used by FSMContext.CancelAllInFlightAndThen while in-flight activities are canceled.
+// It stays until the event that ends the last in-flight activity, whether canceled, completed, failed or timed out,
+// and then goes to the pending close outcome.
+func (f *FSM) DefaultDrainingState() *FSMState {
+	return &FSMState{
+		Name: DrainingState,
+		Decider: func(fsm *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			inFlight := len(fsm.ActivitiesInfo())
+			switch s.LS(h.EventType) {
+			case swf.EventTypeActivityTaskCompleted, swf.EventTypeActivityTaskFailed,
+				swf.EventTypeActivityTaskTimedOut, swf.EventTypeActivityTaskCanceled:
+				if fsm.ActivityInfo(h) != nil {
+					//the correlator stops tracking the activity after this decider.
+					inFlight--
+				}
+			}
+			if inFlight > 0 || fsm.pendingClose == nil {
+				return fsm.Stay(data, fsm.EmptyDecisions())
+			}
+			pending := fsm.pendingClose
+			fsm.pendingClose = nil
+			f.log("state=draining at=activities-drained next-state=%s", pending.State)
+			return fsm.Goto(pending.State, data, pending.Decisions)
+		},
+	}
+}
+
 // DefaultDecisionInterceptor is an interceptor that handles removing
 // duplicate close decisions, moving close decisions to the end of the decision list
 // for an outcome, and making sure the highest priority close decision is the one
@@ -228,6 +430,32 @@ func (f *FSM) DefaultDecisionErrorHandler(ctx *FSMContext, event *swf.HistoryEve
 	return nil, err
 }
 
+// RetryThenFail returns a DecisionErrorHandler that leaves the workflow in error when a decider fails on an event,
+// and retries the event on each subsequent decision task. Once the event has been retried n times and failed again,
+// the Outcome returned by onGiveup is used instead, e.g. one from FSMContext.FailWorkflow.
+// The number of failed attempts is tracked in the RetryAttempts of the SerializedErrorState.
+func RetryThenFail(n int, onGiveup func(*FSMContext, *swf.HistoryEvent, error) *Outcome) DecisionErrorHandler {
+	return func(ctx *FSMContext, event *swf.HistoryEvent, stateBeforeEvent interface{}, stateAfterError interface{}, err error) (*Outcome, error) {
+		if err == nil {
+			//the workflow is in error, retry the event from the recorded state.
+			return &Outcome{State: ctx.State, Data: stateBeforeEvent}, nil
+		}
+		attempts := 1
+		if errorState := ctx.ErrorState(); errorState != nil {
+			attempts = RetryAttempts(errorState) + 1
+		}
+		if attempts > n {
+			return onGiveup(ctx, event, err), err
+		}
+		return nil, &ErrRetry{Attempts: attempts, Err: err}
+	}
+}
+
+// RetryAttempts returns the number of failed attempts recorded by RetryThenFail in a SerializedErrorState.
+func RetryAttempts(errorState *SerializedErrorState) int {
+	return errorState.RetryAttempts
+}
+
 // DefaultTaskErrorHandler is the default TaskErrorHandler that is used if a
 // TaskErrorHandler is not set on this FSM.  DefaultTaskErrorHandler simply logs the error.
 // With no further intervention the decision task will timeout.
@@ -261,6 +489,11 @@ func (f *FSM) ErrorSerializingStateData(decisionTask *swf.PollForDecisionTaskOut
 
 }
 
+// ErrorUnprocessedWindowExceeded is part of the FSM implementation of UnprocessedWindowReporter
+func (f *FSM) ErrorUnprocessedWindowExceeded(decisionTask *swf.PollForDecisionTaskOutput, errorState *SerializedErrorState, err error) {
+	f.log("action=tick workflow=%s workflow-id=%s at=unprocessed-window-exceeded error=%q", s.LS(decisionTask.WorkflowType.Name), s.LS(decisionTask.WorkflowExecution.WorkflowId), err)
+}
+
 // Init initializes any optional, unspecified values such as the error state, stop channel, serializer, PollerShutdownManager.
 // it gets called by Start(), so you should only call this if you are manually managing polling for tasks, and calling Tick yourself.
 func (f *FSM) Init() {
@@ -280,6 +513,8 @@ func (f *FSM) Init() {
 		f.AddFailedState(f.DefaultFailedState())
 	}
 
+	f.AddState(f.DefaultDrainingState())
+
 	if f.stop == nil {
 		f.stop = make(chan bool, 1)
 	}
@@ -302,6 +537,10 @@ func (f *FSM) Init() {
 		f.ShutdownManager = poller.NewShutdownManager()
 	}
 
+	if f.OverflowThreshold == 0 {
+		f.OverflowThreshold = DefaultOverflowThreshold
+	}
+
 	if f.DecisionTaskDispatcher == nil {
 		f.DecisionTaskDispatcher = &CallingGoroutineDispatcher{}
 	}
@@ -318,10 +557,26 @@ func (f *FSM) Init() {
 		f.DecisionInterceptor = f.DefaultDecisionInterceptor()
 	}
 
+	if f.TaskReadyFunc == nil {
+		f.TaskReadyFunc = f.DefaultTaskReady
+	}
+
 	if f.FSMErrorReporter == nil {
 		f.FSMErrorReporter = f
 	}
 
+	if f.UnknownStateDeferral == 0 {
+		f.UnknownStateDeferral = DefaultUnknownStateDeferral
+	}
+
+	if f.CheckpointMargin == 0 {
+		f.CheckpointMargin = DefaultCheckpointMargin
+	}
+
+	if f.SnapshotEvery == 0 {
+		f.SnapshotEvery = 1
+	}
+
 	if f.stasher == nil && f.DataType != nil {
 		f.stasher = NewStasher(f.zeroStateData())
 	}
@@ -332,23 +587,54 @@ func (f *FSM) Init() {
 // If you wish to manage polling and calling Tick() yourself, you dont need to start the FSM, just call Init().
 func (f *FSM) Start() {
 	f.Init()
-	if f.PollerCount <= 0 {
-		f.startPoller(f.Name, f.Identity)
-	} else {
-		for i := 1; i <= f.PollerCount; i++ {
-			f.startPoller(fmt.Sprintf("%s-%d", f.Name, i), fmt.Sprintf("%s-%d", f.Identity, i))
+	if drainer, ok := f.DecisionTaskDispatcher.(poller.Drainer); ok {
+		f.ShutdownManager.RegisterDrainer(fmt.Sprintf("%s-dispatcher", f.Name), drainer)
+	}
+	taskLists := f.pollTaskLists()
+	for _, taskList := range taskLists {
+		name := f.Name
+		if len(taskLists) > 1 {
+			name = fmt.Sprintf("%s-%s", f.Name, taskList)
+		}
+		if f.PollerCount <= 0 {
+			f.startPoller(name, f.Identity, taskList)
+		} else {
+			for i := 1; i <= f.PollerCount; i++ {
+				f.startPoller(fmt.Sprintf("%s-%d", name, i), fmt.Sprintf("%s-%d", f.Identity, i), taskList)
+			}
+		}
+	}
+}
+
+// pollTaskLists returns the TaskList followed by the TaskLists, without duplicates.
+func (f *FSM) pollTaskLists() []string {
+	taskLists := []string{}
+	seen := make(map[string]bool)
+	for _, taskList := range append([]string{f.TaskList}, f.TaskLists...) {
+		if seen[taskList] || (taskList == "" && len(f.TaskLists) > 0) {
+			continue
 		}
+		seen[taskList] = true
+		taskLists = append(taskLists, taskList)
 	}
+	return taskLists
 }
 
-func (f *FSM) startPoller(name, identity string) {
-	poller := poller.NewDecisionTaskPoller(f.SWF, f.Domain, identity, f.TaskList)
-	go poller.PollUntilShutdownBy(f.ShutdownManager, fmt.Sprintf("%s-poller", name), f.dispatchTask, f.taskReady)
+func (f *FSM) startPoller(name, identity, taskList string) {
+	poller := poller.NewDecisionTaskPoller(f.SWF, f.Domain, identity, taskList)
+	poller.Logger = f.Logger
+	poller.MetricsSink = f.MetricsSink
+	poller.IDGenerator = f.IDGenerator
+	go poller.PollUntilShutdownBy(f.ShutdownManager, fmt.Sprintf("%s-poller", name), f.dispatchTask, f.TaskReadyFunc)
 }
 
-// signals the poller to stop reading decision task pages once we have marker events
-func (f *FSM) taskReady(task *swf.PollForDecisionTaskOutput) bool {
+// DefaultTaskReady signals the poller to stop reading decision task pages once we have the state and correlator markers
+// and the events since the previous decision task, or the start event.
+// When a DeferMarker is newer than the last state marker, the paging continues until the EarliestUnprocessedEventId
+// of the deferral, since the deferred events predate the previous decision task, by many pages after repeated deferrals.
+func (f *FSM) DefaultTaskReady(task *swf.PollForDecisionTaskOutput) bool {
 	var state, correlator, prev bool
+	prevStarted := aws.Int64Value(task.PreviousStartedEventId)
 	for _, e := range task.Events {
 		if f.isStateMarker(e) {
 			state = true
@@ -358,7 +644,15 @@ func (f *FSM) taskReady(task *swf.PollForDecisionTaskOutput) bool {
 			correlator = true
 		}
 
-		if *e.EventId <= *task.PreviousStartedEventId {
+		if !state && f.isDeferMarker(e) {
+			deferral := &SerializedDeferral{}
+			if err := f.SystemSerializer.Deserialize(*e.MarkerRecordedEventAttributes.Details, deferral); err == nil &&
+				deferral.EarliestUnprocessedEventId-1 < prevStarted {
+				prevStarted = deferral.EarliestUnprocessedEventId - 1
+			}
+		}
+
+		if *e.EventId <= prevStarted {
 			prev = true
 		}
 
@@ -382,30 +676,139 @@ func (f *FSM) dispatchTask(decisionTask *swf.PollForDecisionTaskOutput) {
 }
 
 func (f *FSM) handleDecisionTask(decisionTask *swf.PollForDecisionTaskOutput) {
-	context, decisions, state, err := f.Tick(decisionTask)
+	taskCtx := context.Background()
+	if f.DecisionTaskContextFunc != nil {
+		taskCtx = f.DecisionTaskContextFunc(taskCtx, decisionTask)
+	}
+	//the DecisionTaskTimeout only bounds deciding, replication happens after the task is completed.
+	ctx := taskCtx
+	if f.DecisionTaskTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(taskCtx, f.DecisionTaskTimeout)
+		defer cancel()
+	}
+
+	started := time.Now()
+	fsmContext, decisions, state, err := f.TickContext(ctx, decisionTask)
+	tags := map[string]string{"workflow": s.LS(decisionTask.WorkflowType.Name)}
+	metrics.Timing(f.MetricsSink, metrics.DecisionTaskTick, time.Since(started), tags)
 	if err != nil {
 		f.TaskErrorHandler(decisionTask, err)
 		return
 	}
+	if fsmContext.WorkflowClosed() {
+		//SWF rejects responses for closed workflows, and the state was never recorded, so there is nothing to replicate.
+		return
+	}
+	metrics.Count(f.MetricsSink, metrics.DecisionTaskDecisions, len(decisions), tags)
 	complete := &swf.RespondDecisionTaskCompletedInput{
 		Decisions: decisions,
 		TaskToken: decisionTask.TaskToken,
 	}
 
-	complete.ExecutionContext = aws.String(state.StateName)
+	if f.ExecutionContextFunc != nil {
+		complete.ExecutionContext = aws.String(f.executionContext(fsmContext, state))
+	} else {
+		complete.ExecutionContext = aws.String(state.StateName)
+	}
 
-	if _, err := f.SWF.RespondDecisionTaskCompleted(complete); err != nil {
+	if f.DecisionTaskCompletedDecorator != nil {
+		f.DecisionTaskCompletedDecorator(complete)
+	}
+
+	if err := f.respondDecisionTaskCompleted(complete); err != nil {
 		f.TaskErrorHandler(decisionTask, err)
 		return
 	}
 
-	if f.ReplicationHandler != nil {
-		repErr := f.ReplicationHandler(context, decisionTask, complete, state)
-		if repErr != nil {
-			f.TaskErrorHandler(decisionTask, err)
+	f.replicate(taskCtx, fsmContext, decisionTask, complete, state)
+	f.snapshot(decisionTask, state)
+}
+
+// executionContext returns the state name and the output of the ExecutionContextFunc, which is truncated so that
+// the ExecutionContext fits in MaxExecutionContextLength, since SWF rejects the whole response otherwise.
+func (f *FSM) executionContext(fsmContext *FSMContext, state *SerializedState) string {
+	prefix := state.StateName + ExecutionContextSeparator
+	custom := []rune(f.ExecutionContextFunc(fsmContext, state))
+	max := MaxExecutionContextLength - utf8.RuneCountInString(prefix)
+	if max < 0 {
+		max = 0
+	}
+	if len(custom) > max {
+		f.clog(fsmContext, "action=respond at=truncate-execution-context length=%d max=%d", len(custom), max)
+		custom = custom[:max]
+	}
+	return prefix + string(custom)
+}
+
+// RespondRetrier configures retries of RespondDecisionTaskCompleted.
+type RespondRetrier struct {
+	// Retries is the number of retries after the first failed attempt.
+	Retries int
+	// Backoff is the delay before the first retry, doubled on each subsequent retry.
+	Backoff time.Duration
+	// MaxBackoff, if set, caps the delay between retries.
+	MaxBackoff time.Duration
+}
+
+func (f *FSM) respondDecisionTaskCompleted(complete *swf.RespondDecisionTaskCompletedInput) error {
+	_, err := f.SWF.RespondDecisionTaskCompleted(complete)
+	if f.RespondRetrier == nil {
+		return err
+	}
+	backoff := f.RespondRetrier.Backoff
+	for i := 0; i < f.RespondRetrier.Retries && isRespondRetryable(err); i++ {
+		f.log("at=respond-retry attempt=%d backoff=%s error=%q", i+1, backoff, err)
+		time.Sleep(backoff)
+		_, err = f.SWF.RespondDecisionTaskCompleted(complete)
+		backoff *= 2
+		if f.RespondRetrier.MaxBackoff > 0 && backoff > f.RespondRetrier.MaxBackoff {
+			backoff = f.RespondRetrier.MaxBackoff
 		}
 	}
+	return err
+}
 
+func isRespondRetryable(err error) bool {
+	if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() >= 500 {
+		return true
+	}
+	if ae, ok := err.(awserr.Error); ok {
+		return ae.Code() == s.ErrorTypeThrottlingException
+	}
+	return false
+}
+
+// replicate prefers the ContextReplicationHandler and falls back to the ReplicationHandler.
+// While replication is disabled or failing, replications are buffered if ReplicationBufferSize is set.
+func (f *FSM) replicate(ctx context.Context, fsmContext *FSMContext, decisionTask *swf.PollForDecisionTaskOutput, complete *swf.RespondDecisionTaskCompletedInput, state *SerializedState) {
+	if f.ContextReplicationHandler == nil && f.ReplicationHandler == nil {
+		return
+	}
+	data := &ReplicationData{Context: fsmContext, DecisionTask: decisionTask, Completed: complete, State: state}
+
+	if !f.ReplicationEnabled() {
+		f.bufferReplication(data, "replication-disabled")
+		return
+	}
+
+	if repErr := f.replicateData(ctx, data); repErr != nil {
+		if f.ReplicationBufferSize > 0 {
+			f.bufferReplication(data, "replication-failed")
+			return
+		}
+		f.TaskErrorHandler(decisionTask, repErr)
+	}
+}
+
+func (f *FSM) replicateData(ctx context.Context, data *ReplicationData) error {
+	switch {
+	case f.ContextReplicationHandler != nil:
+		return f.ContextReplicationHandler(ctx, data.Context, data.DecisionTask, data.Completed, data.State)
+	case f.ReplicationHandler != nil:
+		return f.ReplicationHandler(data.Context, data.DecisionTask, data.Completed, data.State)
+	}
+	return nil
 }
 
 // Serialize uses the FSM.Serializer to serialize data to a string.
@@ -434,11 +837,36 @@ func (f *FSM) Deserialize(serialized string, data interface{}) {
 // On errors, a nil *SerializedState is returned, and an error Outcome is included in the Decision list.
 // It is exported to facilitate testing.
 func (f *FSM) Tick(decisionTask *swf.PollForDecisionTaskOutput) (*FSMContext, []*swf.Decision, *SerializedState, error) {
+	return f.TickContext(context.Background(), decisionTask)
+}
+
+// TickContext is Tick with a context that is checked before each event is decided.
+// If the context is done, the tick is aborted with an error and no decisions are returned.
+func (f *FSM) TickContext(ctx context.Context, decisionTask *swf.PollForDecisionTaskOutput) (*FSMContext, []*swf.Decision, *SerializedState, error) {
 	//BeforeDecision interceptor invocation
 	if f.DecisionInterceptor != nil {
 		f.DecisionInterceptor.BeforeTask(decisionTask)
 	}
-	lastEvents := f.findLastEvents(*decisionTask.PreviousStartedEventId, decisionTask.Events)
+	if f.EventTransformer != nil {
+		//transform a copy so the polled task is left untouched.
+		transformed := *decisionTask
+		transformed.Events = f.EventTransformer(decisionTask.Events)
+		decisionTask = &transformed
+	}
+	prevStarted := *decisionTask.PreviousStartedEventId
+	deferral, err := f.findSerializedDeferral(decisionTask.Events)
+	if err != nil {
+		f.FSMErrorReporter.ErrorFindingStateData(decisionTask, err)
+		if f.AllowPanics {
+			panic(err)
+		}
+		return nil, nil, nil, errors.Trace(err)
+	}
+	if deferral != nil {
+		//decide the events of deferred decision tasks as well.
+		prevStarted = deferral.EarliestUnprocessedEventId - 1
+	}
+	lastEvents := f.findLastEvents(prevStarted, decisionTask.Events)
 	outcome := new(Outcome)
 	context := NewFSMContext(f,
 		*decisionTask.WorkflowType,
@@ -447,13 +875,23 @@ func (f *FSM) Tick(decisionTask *swf.PollForDecisionTaskOutput) (*FSMContext, []
 		"", nil, uint64(0),
 	)
 
+	context.decidedAt = decisionTaskTime(decisionTask)
+	context.decisionTask = decisionTask
+	f.configureContext(context)
+	if deadline, ok := ctx.Deadline(); ok {
+		context.checkpointBy = deadline.Add(-f.CheckpointMargin)
+	}
+
 	serializedState, err := f.findSerializedState(decisionTask.Events)
 	if err != nil {
 		f.FSMErrorReporter.ErrorFindingStateData(decisionTask, err)
 		if f.AllowPanics {
 			panic(err)
 		}
-		return nil, nil, nil, errors.Trace(err)
+		if _, ok := err.(*ErrNoSerializedState); ok {
+			return nil, nil, nil, err
+		}
+		return nil, nil, nil, &ErrStateDeserialize{Err: err}
 	}
 	eventCorrelator, err := f.findSerializedEventCorrelator(decisionTask.Events)
 	if err != nil {
@@ -461,9 +899,16 @@ func (f *FSM) Tick(decisionTask *swf.PollForDecisionTaskOutput) (*FSMContext, []
 		if f.AllowPanics {
 			panic(err)
 		}
-		return nil, nil, nil, errors.Trace(err)
+		return nil, nil, nil, &ErrCorrelatorDeserialize{Err: err}
 	}
 	context.eventCorrelator = eventCorrelator
+	if f.MinimizeCorrelatorWrites {
+		//serialize the correlator as loaded, so it can be compared to the one recorded at the end of the tick.
+		eventCorrelator.checkInit()
+		if serialized, err := f.SystemSerializer.Serialize(eventCorrelator); err == nil {
+			context.serializedEventCorrelator = serialized
+		}
+	}
 
 	f.clog(context, "action=tick at=find-serialized-state state=%s", serializedState.StateName)
 
@@ -474,12 +919,15 @@ func (f *FSM) Tick(decisionTask *swf.PollForDecisionTaskOutput) (*FSMContext, []
 			if f.AllowPanics {
 				panic(err)
 			}
-			return nil, nil, nil, errors.Trace(err)
+			return nil, nil, nil, &ErrStateDeserialize{Err: err}
 		}
 		f.clog(context, "action=tick at=find-current-data data=%v", data)
 		outcome.Data = data
 		outcome.State = serializedState.StateName
 		context.stateVersion = serializedState.StateVersion
+		context.enteredState = serializedState.StateName
+		context.enteredAt = serializedState.EnteredAt
+		context.pendingClose = serializedState.PendingClose
 		// BeforeDecisionContext interceptor invocation
 		if f.DecisionInterceptor != nil {
 			before := &Outcome{Data: outcome.Data, Decisions: outcome.Decisions, State: outcome.State}
@@ -490,26 +938,80 @@ func (f *FSM) Tick(decisionTask *swf.PollForDecisionTaskOutput) (*FSMContext, []
 		}
 	}
 
+	if terminal := findTerminalEvent(decisionTask.Events); terminal != nil {
+		//SWF rejects decisions for closed workflows, so dont decide at all.
+		f.clog(context, "action=tick at=workflow-already-terminal id=%d type=%s", *terminal.EventId, *terminal.EventType)
+		context.closed = true
+		return context, []*swf.Decision{}, serializedState, nil
+	}
+
+	if f.CodeVersion != "" && serializedState.CodeVersion != f.CodeVersion {
+		f.clog(context, "action=tick at=code-version-mismatch state=%s code-version=%s fsm-code-version=%s", outcome.State, serializedState.CodeVersion, f.CodeVersion)
+		if f.OnVersionMismatch != nil {
+			context.State = outcome.State
+			context.stateData = outcome.Data
+			if migrated := f.OnVersionMismatch(context, serializedState, outcome.Data); migrated != nil {
+				f.mergeOutcomes(outcome, *migrated)
+			}
+		}
+	}
+
 	errorState, err := f.findSerializedErrorState(decisionTask.Events)
+	if errorState != nil && errorState.ErrorEvent != nil && f.MaxUnprocessedWindow > 0 {
+		if window := *decisionTask.StartedEventId - *errorState.ErrorEvent.EventId + 1; window > f.MaxUnprocessedWindow {
+			err := &ErrUnprocessedWindowExceeded{Window: window, ErrorEventId: *errorState.ErrorEvent.EventId, Max: f.MaxUnprocessedWindow}
+			if reporter, ok := f.FSMErrorReporter.(UnprocessedWindowReporter); ok {
+				reporter.ErrorUnprocessedWindowExceeded(decisionTask, errorState, err)
+			} else {
+				f.ErrorUnprocessedWindowExceeded(decisionTask, errorState, err)
+			}
+			if f.AllowPanics {
+				panic(err)
+			}
+			return nil, nil, nil, err
+		}
+	}
 	if errorState != nil {
+		context.State = outcome.State
+		context.stateData = outcome.Data
+		context.errorState = errorState
 		recovery, err := f.ErrorStateTick(decisionTask, errorState, context, outcome.Data)
 		if recovery != nil {
 			outcome = recovery
+			context.errorState = nil
 		} else {
 			logf(context, "at=error-recovery-failed error=%q", err)
 			//bump the unprocessed window, and re-record the error marker
 			errorState.LatestUnprocessedEventId = *decisionTask.StartedEventId
+			if err != nil {
+				//keep the details of the latest failure, which is how handlers carry state across decision tasks.
+				errorState.Details = err.Error()
+				if retry, ok := err.(*ErrRetry); ok {
+					errorState.RetryAttempts = retry.Attempts
+				}
+			}
 			final, serializedState, err := f.recordStateMarkers(context, outcome, eventCorrelator, errorState)
 			//update Error State Marker and exit with 3 marker decisions
 			return context, final, serializedState, err
 		}
 	}
 
+	if _, ok := f.states[outcome.State]; !ok && f.DeferUnknownStates {
+		return f.deferDecisionTask(decisionTask, context, serializedState, prevStarted)
+	}
+
+	//the events from checkpointedEventId on are deferred to the next decision task when a decider checkpoints.
+	var checkpointedEventId int64
+	context.checkpointed = false
 	//iterate through events oldest to newest, calling the decider for the current state.
 	//if the outcome changes the state use the right FSMState
 	for i := len(lastEvents) - 1; i >= 0; i-- {
 		e := lastEvents[i]
 		f.clog(context, "action=tick at=history id=%d type=%s", *e.EventId, *e.EventType)
+		if err := ctx.Err(); err != nil {
+			f.clog(context, "action=tick at=context-done id=%d error=%q", *e.EventId, err)
+			return nil, nil, nil, errors.Annotate(err, "tick aborted")
+		}
 		fsmState, ok := f.states[outcome.State]
 		if ok {
 			context.State = outcome.State
@@ -537,9 +1039,12 @@ func (f *FSM) Tick(decisionTask *swf.PollForDecisionTaskOutput) (*FSMContext, []
 					errorState := &SerializedErrorState{
 						Details:                    notRescuedSerialized,
 						ErrorEvent:                 e,
-						EarliestUnprocessedEventId: *decisionTask.PreviousStartedEventId + 1,
+						EarliestUnprocessedEventId: prevStarted + 1,
 						LatestUnprocessedEventId:   *decisionTask.StartedEventId,
 					}
+					if retry, ok := notRescued.(*ErrRetry); ok {
+						errorState.RetryAttempts = retry.Attempts
+					}
 					final, serializedState, err := f.recordStateMarkers(context, outcome, eventCorrelator, errorState)
 					if err != nil {
 						f.FSMErrorReporter.ErrorSerializingStateData(decisionTask, *outcome, *eventCorrelator, err)
@@ -551,18 +1056,31 @@ func (f *FSM) Tick(decisionTask *swf.PollForDecisionTaskOutput) (*FSMContext, []
 					return context, final, serializedState, nil
 				}
 			}
+			if context.checkpointed {
+				//the outcome of the interrupted decider is discarded, the event is decided again from the checkpointed data.
+				f.clog(context, "action=tick at=checkpoint state=%s id=%d", outcome.State, *e.EventId)
+				outcome.Data = context.checkpointData
+				checkpointedEventId = *e.EventId
+				break
+			}
 			//NOTE this call is handled in fsmContext.Decide. The double call causes nil panics
 			//eventCorrelator.Track(e)
 			curr := outcome.State
 			f.mergeOutcomes(outcome, anOutcome)
+			f.transition(context, curr, outcome)
 			f.clog(context, "action=tick at=decided-event state=%s next-state=%s decisions=%d", curr, outcome.State, len(anOutcome.Decisions))
 		} else {
 			f.FSMErrorReporter.ErrorMissingFSMState(decisionTask, *outcome)
-			return nil, nil, nil, errors.New("marked-state-not-in-fsm state=" + outcome.State)
+			return nil, nil, nil, &ErrMissingState{State: outcome.State}
 		}
 	}
 
 	f.clog(context, "action=tick at=events-processed next-state=%s decisions=%d", outcome.State, len(outcome.Decisions))
+	if f.CorrelatorSizeWarning > 0 {
+		if stats := context.eventCorrelator.Stats(); stats.Largest() > f.CorrelatorSizeWarning {
+			f.clog(context, "action=tick at=correlator-size-warning threshold=%d %s", f.CorrelatorSizeWarning, stats)
+		}
+	}
 
 	for _, d := range outcome.Decisions {
 		f.clog(context, "action=tick at=decide next-state=%s decision=%s", outcome.State, *d.DecisionType)
@@ -587,11 +1105,27 @@ func (f *FSM) Tick(decisionTask *swf.PollForDecisionTaskOutput) (*FSMContext, []
 		return nil, nil, nil, errors.Trace(err)
 	}
 
+	if checkpointedEventId != 0 {
+		deferred, err := f.deferCheckpointedEvents(decisionTask, serializedState, checkpointedEventId)
+		if err != nil {
+			return nil, nil, nil, errors.Trace(err)
+		}
+		final = insertBeforeCloseDecisions(final, deferred...)
+	}
+
+	if f.AuditDecisions {
+		for _, d := range final {
+			f.clog(context, "action=tick at=audit-decision decision=%s", auditDecision(d))
+		}
+	}
+
 	return context, final, serializedState, nil
 }
 
 // ErrorStateTick is called when the DecisionTaskPoller receives a PollForDecisionTaskResponse in its polling loop
 // that contains an error marker in its history.
+// The error handler of the current state is called with a nil error, and if it returns an Outcome, the events from the
+// ErrorEvent to the LatestUnprocessedEventId are decided again starting from that Outcome.
 func (f *FSM) ErrorStateTick(decisionTask *swf.PollForDecisionTaskOutput, error *SerializedErrorState, context *FSMContext, data interface{}) (*Outcome, error) {
 	handler := f.errorHandlers[context.State]
 	if handler == nil {
@@ -603,43 +1137,56 @@ func (f *FSM) ErrorStateTick(decisionTask *swf.PollForDecisionTaskOutput, error
 	}
 
 	//todo we are assuming all history events in the range
-	//error.EarliestUnprocessedEventId to error.LatestUnprocessedEventId
+	//error.ErrorEvent.EventId to error.LatestUnprocessedEventId
 	//are in the decisionTaks.History
-	filteredDecisionTask := new(swf.PollForDecisionTaskOutput)
-	s, e := f.SystemSerializer.Serialize(decisionTask)
-	if e != nil {
-		return nil, e
-	}
-	e = f.SystemSerializer.Deserialize(s, filteredDecisionTask)
-	if e != nil {
-		return nil, e
+	var unprocessed []*swf.HistoryEvent
+	for _, e := range f.findLastEvents(*error.ErrorEvent.EventId-1, decisionTask.Events) {
+		//the error markers recorded while the workflow was in error are not decided again.
+		if *e.EventId <= error.LatestUnprocessedEventId && !f.isErrorMarker(e) {
+			unprocessed = append(unprocessed, e)
+		}
 	}
 
-	filtered := make([]*swf.HistoryEvent, 0)
-	for _, h := range decisionTask.Events {
-		if f.isErrorMarker(h) {
-			continue
+	outcome := &Outcome{State: handled.State, Data: handled.Data, Decisions: handled.Decisions}
+	for i := len(unprocessed) - 1; i >= 0; i-- {
+		e := unprocessed[i]
+		fsmState, ok := f.states[outcome.State]
+		if !ok {
+			return nil, &ErrMissingState{State: outcome.State}
 		}
-		filtered = append(filtered, h)
+		context.State = outcome.State
+		context.stateData = outcome.Data
+		stashed := f.stasher.Stash(outcome.Data)
+		anOutcome, err := f.panicSafeDecide(fsmState, context, e, outcome.Data)
+		if err != nil {
+			stashedData := f.zeroStateData()
+			f.stasher.Unstash(stashed, stashedData)
+			handler := f.errorHandlers[fsmState.Name]
+			if handler == nil {
+				handler = f.DecisionErrorHandler
+			}
+			rescued, notRescued := handler(context, e, stashedData, outcome.Data, err)
+			if rescued == nil {
+				return nil, notRescued
+			}
+			anOutcome = *rescued
+		}
+		curr := outcome.State
+		f.mergeOutcomes(outcome, anOutcome)
+		f.transition(context, curr, outcome)
 	}
-	filteredDecisionTask.Events = filtered
-	filteredDecisionTask.StartedEventId = &error.LatestUnprocessedEventId
-	filteredDecisionTask.PreviousStartedEventId = &error.EarliestUnprocessedEventId
-
-	_, decisions, serializedState, err := f.Tick(filteredDecisionTask)
-	if err != nil {
-		data := f.zeroStateData()
-		f.Deserialize(serializedState.StateData, data)
-
-		return &Outcome{
-			State:     serializedState.StateName,
-			Decisions: decisions,
-			Data:      data,
-		}, nil
 
-	}
+	return outcome, nil
+}
 
-	return nil, err
+// configureContext sets the settings of the FSM that the FSMContext uses while deciding.
+func (f *FSM) configureContext(context *FSMContext) {
+	context.workflowType = f.WorkflowType
+	context.logger = f.Logger
+	context.errorReporter = f.FSMErrorReporter
+	context.allowPanics = f.AllowPanics
+	context.codeVersion = f.CodeVersion
+	context.idGenerator = f.IDGenerator
 }
 
 func (f *FSM) mergeOutcomes(final *Outcome, intermediate Outcome) {
@@ -650,6 +1197,24 @@ func (f *FSM) mergeOutcomes(final *Outcome, intermediate Outcome) {
 	}
 }
 
+// transition calls the OnExit hook of the state left, then the OnEnter hook of the state entered, when the outcome
+// of a decided event is in another state than from, and adds the decisions they return to the outcome.
+func (f *FSM) transition(context *FSMContext, from string, outcome *Outcome) {
+	if outcome.State == from {
+		return
+	}
+	context.stateData = outcome.Data
+	if state, ok := f.states[from]; ok && state.OnExit != nil {
+		context.State = from
+		outcome.Decisions = append(outcome.Decisions, state.OnExit(context, outcome.Data)...)
+	}
+	if state, ok := f.states[outcome.State]; ok && state.OnEnter != nil {
+		context.State = outcome.State
+		outcome.Decisions = append(outcome.Decisions, state.OnEnter(context, outcome.Data)...)
+	}
+	f.clog(context, "action=tick at=transition state=%s next-state=%s", from, outcome.State)
+}
+
 func (f *FSM) panicSafeDecide(state *FSMState, context *FSMContext, event *swf.HistoryEvent, data interface{}) (anOutcome Outcome, anErr error) {
 	defer func() {
 		if !f.AllowPanics {
@@ -657,16 +1222,16 @@ func (f *FSM) panicSafeDecide(state *FSMState, context *FSMContext, event *swf.H
 				file, line, name := panicinfo.LocatePanic(r)
 				f.log("at=decide-panic-recovery func=%q file=\"%s:%d\" error=%q", name, file, line, r)
 				if err, ok := r.(error); ok && err != nil {
-					anErr = errors.Trace(err)
+					anErr = errors.Annotatef(err, "panic in decider %s", panicinfo.Describe(file, line, name))
 				} else {
-					anErr = errors.New(fmt.Sprintf("panic in decider: %#v", r))
+					anErr = errors.Errorf("panic in decider: %#v %s", r, panicinfo.Describe(file, line, name))
 				}
 			}
 		} else {
-			Log.Printf("at=panic-safe-decide-allowing-panic fsm-allow-panics=%t", f.AllowPanics)
+			f.log("at=panic-safe-decide-allowing-panic fsm-allow-panics=%t", f.AllowPanics)
 		}
 	}()
-	anOutcome = context.Decide(event, data, state.Decider)
+	anOutcome = context.Decide(event, data, state.decide)
 	return
 }
 
@@ -686,6 +1251,12 @@ func (f *FSM) EventData(event *swf.HistoryEvent, eventData interface{}) {
 			serialized = *event.WorkflowExecutionCompletedEventAttributes.Result
 		case swf.EventTypeChildWorkflowExecutionCompleted:
 			serialized = *event.ChildWorkflowExecutionCompletedEventAttributes.Result
+		case swf.EventTypeLambdaFunctionCompleted:
+			//lambda functions can complete without a result.
+			if event.LambdaFunctionCompletedEventAttributes.Result == nil {
+				return
+			}
+			serialized = *event.LambdaFunctionCompletedEventAttributes.Result
 		case swf.EventTypeWorkflowExecutionSignaled:
 			switch *event.WorkflowExecutionSignaledEventAttributes.SignalName {
 			case ActivityStartedSignal, ActivityUpdatedSignal:
@@ -698,9 +1269,9 @@ func (f *FSM) EventData(event *swf.HistoryEvent, eventData interface{}) {
 				serialized = *event.WorkflowExecutionSignaledEventAttributes.Input
 			}
 		case swf.EventTypeWorkflowExecutionStarted:
-			serialized = *event.WorkflowExecutionStartedEventAttributes.Input
+			serialized = f.startInputData(*event.WorkflowExecutionStartedEventAttributes.Input)
 		case swf.EventTypeWorkflowExecutionContinuedAsNew:
-			serialized = *event.WorkflowExecutionContinuedAsNewEventAttributes.Input
+			serialized = f.startInputData(*event.WorkflowExecutionContinuedAsNewEventAttributes.Input)
 		}
 		if serialized != "" {
 			f.Deserialize(serialized, eventData)
@@ -711,22 +1282,63 @@ func (f *FSM) EventData(event *swf.HistoryEvent, eventData interface{}) {
 
 }
 
-func (f *FSM) log(format string, data ...interface{}) {
-	actualFormat := fmt.Sprintf("component=FSM name=%s %s", f.Name, format)
-	if f.Logger != nil {
-		f.Logger.Printf(actualFormat, data...)
-	} else {
-		Log.Printf(actualFormat, data...)
+// startInputData unwraps the StateData of a start input, which is a SerializedState envelope when it is built by
+// StartFSMWorkflowInput or a continue decision. Inputs that are not an envelope are the data itself.
+func (f *FSM) startInputData(input string) string {
+	if state, err := ParseStartInput(f, input); err == nil && state.StateData != "" {
+		return state.StateData
 	}
+	return input
+}
+
+func (f *FSM) log(format string, data ...interface{}) {
+	Logf(f.Logger, "component=FSM name=%s "+format, append([]interface{}{f.Name}, data...)...)
 }
 
 func (f *FSM) clog(ctx *FSMContext, format string, data ...interface{}) {
-	actualFormat := fmt.Sprintf("component=FSM name=%s type=%s id=%s %s", f.Name, s.LS(ctx.WorkflowType.Name), s.LS(ctx.WorkflowId), format)
-	if f.Logger != nil {
-		f.Logger.Printf(actualFormat, data...)
-	} else {
-		Log.Printf(actualFormat, data...)
+	Logf(f.Logger, "component=FSM name=%s type=%s id=%s "+format, append([]interface{}{f.Name, s.LS(ctx.WorkflowType.Name), s.LS(ctx.WorkflowId)}, data...)...)
+}
+
+// auditDecision renders the type and identifiers of a decision as JSON, leaving out any payloads.
+func auditDecision(d *swf.Decision) string {
+	audit := map[string]string{"type": s.LS(d.DecisionType)}
+	put := func(key string, value *string) {
+		if value != nil {
+			audit[key] = *value
+		}
 	}
+	switch {
+	case d.ScheduleActivityTaskDecisionAttributes != nil:
+		put("activity-id", d.ScheduleActivityTaskDecisionAttributes.ActivityId)
+		if t := d.ScheduleActivityTaskDecisionAttributes.ActivityType; t != nil {
+			put("activity-type", t.Name)
+			put("activity-version", t.Version)
+		}
+	case d.RequestCancelActivityTaskDecisionAttributes != nil:
+		put("activity-id", d.RequestCancelActivityTaskDecisionAttributes.ActivityId)
+	case d.StartTimerDecisionAttributes != nil:
+		put("timer-id", d.StartTimerDecisionAttributes.TimerId)
+	case d.CancelTimerDecisionAttributes != nil:
+		put("timer-id", d.CancelTimerDecisionAttributes.TimerId)
+	case d.SignalExternalWorkflowExecutionDecisionAttributes != nil:
+		put("signal-name", d.SignalExternalWorkflowExecutionDecisionAttributes.SignalName)
+		put("workflow-id", d.SignalExternalWorkflowExecutionDecisionAttributes.WorkflowId)
+	case d.RequestCancelExternalWorkflowExecutionDecisionAttributes != nil:
+		put("workflow-id", d.RequestCancelExternalWorkflowExecutionDecisionAttributes.WorkflowId)
+	case d.StartChildWorkflowExecutionDecisionAttributes != nil:
+		put("workflow-id", d.StartChildWorkflowExecutionDecisionAttributes.WorkflowId)
+		if t := d.StartChildWorkflowExecutionDecisionAttributes.WorkflowType; t != nil {
+			put("workflow-type", t.Name)
+			put("workflow-version", t.Version)
+		}
+	case d.RecordMarkerDecisionAttributes != nil:
+		put("marker-name", d.RecordMarkerDecisionAttributes.MarkerName)
+	}
+	serialized, err := json.Marshal(audit)
+	if err != nil {
+		return fmt.Sprintf("%q", s.LS(d.DecisionType))
+	}
+	return string(serialized)
 }
 
 func (f *FSM) findSerializedState(events []*swf.HistoryEvent) (*SerializedState, error) {
@@ -735,24 +1347,27 @@ func (f *FSM) findSerializedState(events []*swf.HistoryEvent) (*SerializedState,
 			return state, err
 		}
 	}
-	return nil, errors.New("Cant Find Current Data")
+	return nil, &ErrNoSerializedState{}
 }
 
 func (f *FSM) statefulHistoryEventToSerializedState(event *swf.HistoryEvent) (*SerializedState, error) {
 	if f.isStateMarker(event) {
 		state := &SerializedState{}
-		err := f.SystemSerializer.Deserialize(*event.MarkerRecordedEventAttributes.Details, state)
+		details, err := f.underflow(*event.MarkerRecordedEventAttributes.Details)
+		if err != nil {
+			return state, err
+		}
+		err = f.SystemSerializer.Deserialize(details, state)
 		return state, err
 	} else if *event.EventType == swf.EventTypeWorkflowExecutionStarted {
-		state := &SerializedState{}
-		err := f.Serializer.Deserialize(*event.WorkflowExecutionStartedEventAttributes.Input, state)
-		if err == nil {
-			if state.StateName == "" {
-				state.StateName = f.initialState.Name
-			}
+		state, err := ParseStartInput(f, *event.WorkflowExecutionStartedEventAttributes.Input)
+		if err != nil {
+			return &SerializedState{}, err
 		}
-		return state, err
-
+		if state.CodeVersion == "" {
+			state.CodeVersion = f.CodeVersion
+		}
+		return state, nil
 	}
 	return nil, nil
 }
@@ -763,9 +1378,29 @@ func (f *FSM) findSerializedEventCorrelator(events []*swf.HistoryEvent) (*EventC
 			correlator := &EventCorrelator{
 				Serializer: f.SystemSerializer,
 			}
-			err := f.Serializer.Deserialize(*event.MarkerRecordedEventAttributes.Details, correlator)
+			//markers are recorded with the SystemSerializer, see recordMarkers.
+			details, err := f.underflow(*event.MarkerRecordedEventAttributes.Details)
+			if err != nil {
+				return correlator, err
+			}
+			err = f.SystemSerializer.Deserialize(details, correlator)
 			return correlator, err
 		}
+		if *event.EventType == swf.EventTypeWorkflowExecutionStarted {
+			//a run continued with ContinueWorkflowDecisionWithCorrelator carries the correlator in its input.
+			state, err := f.statefulHistoryEventToSerializedState(event)
+			if err == nil && state.EventCorrelator != "" {
+				correlator := &EventCorrelator{
+					Serializer: f.SystemSerializer,
+				}
+				//the correlator is serialized with the SystemSerializer, as in markers, or the Serializer in older inputs.
+				err := f.SystemSerializer.Deserialize(state.EventCorrelator, correlator)
+				if err != nil && f.Serializer.Deserialize(state.EventCorrelator, correlator) == nil {
+					err = nil
+				}
+				return correlator, err
+			}
+		}
 	}
 	return &EventCorrelator{
 		Serializer: f.SystemSerializer,
@@ -775,38 +1410,92 @@ func (f *FSM) findSerializedEventCorrelator(events []*swf.HistoryEvent) (*EventC
 func (f *FSM) findSerializedErrorState(events []*swf.HistoryEvent) (*SerializedErrorState, error) {
 	for _, event := range events {
 		if f.isErrorMarker(event) {
+			details, err := f.underflow(*event.MarkerRecordedEventAttributes.Details)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
 			errState := &SerializedErrorState{}
-			err := f.Serializer.Deserialize(*event.MarkerRecordedEventAttributes.Details, errState)
+			err = f.SystemSerializer.Deserialize(details, errState)
 			return errState, err
 		}
 	}
 	return nil, nil
 }
 
+// findSerializedDeferral returns the deferral of the decision tasks since the last state marker, if any.
+func (f *FSM) findSerializedDeferral(events []*swf.HistoryEvent) (*SerializedDeferral, error) {
+	for _, event := range events {
+		if f.isStateMarker(event) {
+			return nil, nil
+		}
+		if f.isDeferMarker(event) {
+			deferral := &SerializedDeferral{}
+			err := f.SystemSerializer.Deserialize(*event.MarkerRecordedEventAttributes.Details, deferral)
+			return deferral, err
+		}
+	}
+	return nil, nil
+}
+
+// findTerminalEvent returns the event that closed the workflow, such as a WorkflowExecutionTimedOut
+// or WorkflowExecutionTerminated event, or nil if the workflow is not closed.
+func findTerminalEvent(events []*swf.HistoryEvent) *swf.HistoryEvent {
+	for _, event := range events {
+		switch *event.EventType {
+		case swf.EventTypeWorkflowExecutionCompleted, swf.EventTypeWorkflowExecutionFailed,
+			swf.EventTypeWorkflowExecutionCanceled, swf.EventTypeWorkflowExecutionContinuedAsNew,
+			swf.EventTypeWorkflowExecutionTimedOut, swf.EventTypeWorkflowExecutionTerminated:
+			return event
+		}
+	}
+	return nil
+}
+
+// findLastEvents returns the events after prevStarted that are decided, newest first, so callers iterate it backwards
+// to decide the events strictly from oldest to newest, e.g. a marker recorded before an activity completed is decided first.
+// The order is by EventId, whatever the order of the given events, which can be out of order after an EventTransformer.
+// Events dropped by the EventFilter are not returned.
 func (f *FSM) findLastEvents(prevStarted int64, events []*swf.HistoryEvent) []*swf.HistoryEvent {
 	var lastEvents []*swf.HistoryEvent
 
 	for _, event := range events {
-		if *event.EventId == prevStarted {
-			return lastEvents
+		if *event.EventId <= prevStarted {
+			continue
+		}
+		if f.EventFilter != nil && !f.EventFilter(event) {
+			continue
 		}
 		switch *event.EventType {
 		case swf.EventTypeDecisionTaskCompleted, swf.EventTypeDecisionTaskScheduled,
 			swf.EventTypeDecisionTaskStarted:
 			//no-op, dont even process these?
 		case swf.EventTypeMarkerRecorded:
-			if !f.isStateMarker(event) && !f.isCorrelatorMarker(event) {
+			if !f.isStateMarker(event) && !f.isCorrelatorMarker(event) && !f.isDeferMarker(event) {
 				lastEvents = append(lastEvents, event)
 			}
 		default:
-			lastEvents = append(lastEvents, event)
+			if !f.isDeferTimerEvent(event) {
+				lastEvents = append(lastEvents, event)
+			}
 		}
 
 	}
 
+	sort.SliceStable(lastEvents, func(i, j int) bool {
+		return *lastEvents[i].EventId > *lastEvents[j].EventId
+	})
 	return lastEvents
 }
 
+// decisionTaskTime returns the time of the newest event of the decision task, which is used rather than the clock
+// so that deciding the same decision task again records the same times.
+func decisionTaskTime(decisionTask *swf.PollForDecisionTaskOutput) time.Time {
+	if len(decisionTask.Events) > 0 && decisionTask.Events[0].EventTimestamp != nil {
+		return *decisionTask.Events[0].EventTimestamp
+	}
+	return time.Now()
+}
+
 func (f *FSM) recordStateMarkers(context *FSMContext, outcome *Outcome, eventCorrelator *EventCorrelator, errorState *SerializedErrorState) ([]*swf.Decision, *SerializedState, error) {
 	serializedData, err := f.Serializer.Serialize(outcome.Data)
 
@@ -815,6 +1504,15 @@ func (f *FSM) recordStateMarkers(context *FSMContext, outcome *Outcome, eventCor
 		StateName:    outcome.State,
 		StateData:    serializedData,
 		WorkflowId:   *context.WorkflowId,
+		EnteredAt:    context.enteredAt,
+		CodeVersion:  f.CodeVersion,
+	}
+	if outcome.State == DrainingState {
+		state.PendingClose = context.pendingClose
+	}
+	if outcome.State != context.enteredState || context.enteredAt == nil {
+		enteredAt := context.decidedAt
+		state.EnteredAt = &enteredAt
 	}
 	serializedMarker, err := f.SystemSerializer.Serialize(state)
 
@@ -828,25 +1526,110 @@ func (f *FSM) recordStateMarkers(context *FSMContext, outcome *Outcome, eventCor
 		return nil, state, errors.Trace(err)
 	}
 
+	serializedMarker, err = f.overflow(context, StateMarker, state.StateVersion, serializedMarker)
+	if err != nil {
+		return nil, state, errors.Trace(err)
+	}
 	d := f.recordStringMarker(StateMarker, serializedMarker)
-	c := f.recordStringMarker(CorrelatorMarker, serializedCorrelator)
 	decisions := f.EmptyDecisions()
-	decisions = append(decisions, d, c)
+	decisions = append(decisions, d)
+
+	if f.MinimizeCorrelatorWrites && context.serializedEventCorrelator != "" && context.serializedEventCorrelator == serializedCorrelator {
+		f.clog(context, "action=tick at=skip-unchanged-correlator-marker")
+	} else {
+		serializedCorrelator, err = f.overflow(context, CorrelatorMarker, state.StateVersion, serializedCorrelator)
+		if err != nil {
+			return nil, state, errors.Trace(err)
+		}
+		c := f.recordStringMarker(CorrelatorMarker, serializedCorrelator)
+		decisions = append(decisions, c)
+	}
 
 	if errorState != nil {
 		serializedError, err := f.SystemSerializer.Serialize(*errorState)
 
+		if err != nil {
+			return nil, state, errors.Trace(err)
+		}
+		serializedError, err = f.overflow(context, ErrorMarker, state.StateVersion, serializedError)
 		if err != nil {
 			return nil, state, errors.Trace(err)
 		}
 		e := f.recordStringMarker(ErrorMarker, serializedError)
 		decisions = append(decisions, e)
+		metrics.Count(f.MetricsSink, metrics.ErrorMarkersRecorded, 1, map[string]string{"workflow": s.LS(context.WorkflowType.Name)})
 	}
 
 	decisions = append(decisions, outcome.Decisions...)
 	return decisions, state, nil
 }
 
+// deferDecisionTask records a DeferMarker, and starts a DeferTimer unless one is already running, without calling any deciders.
+// The serialized state is returned as found, so nothing about the workflow is changed by an FSM that does not know its state.
+func (f *FSM) deferDecisionTask(decisionTask *swf.PollForDecisionTaskOutput, context *FSMContext, state *SerializedState, prevStarted int64) (*FSMContext, []*swf.Decision, *SerializedState, error) {
+	deferral := SerializedDeferral{
+		StateName:                  state.StateName,
+		EarliestUnprocessedEventId: prevStarted + 1,
+	}
+	serializedDeferral, err := f.SystemSerializer.Serialize(deferral)
+	if err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+
+	f.clog(context, "action=tick at=defer-unknown-state state=%s earliest-unprocessed-event-id=%d", state.StateName, deferral.EarliestUnprocessedEventId)
+	decisions := f.EmptyDecisions()
+	decisions = append(decisions, f.recordStringMarker(DeferMarker, serializedDeferral))
+	decisions = append(decisions, f.startDeferTimer(decisionTask.Events, f.UnknownStateDeferral)...)
+	return context, decisions, state, nil
+}
+
+// deferCheckpointedEvents records a DeferMarker after the state markers of a checkpointed decision task,
+// and starts a DeferTimer that fires right away unless one is already running,
+// so that the events from the checkpointed event on are decided by the next decision task.
+func (f *FSM) deferCheckpointedEvents(decisionTask *swf.PollForDecisionTaskOutput, state *SerializedState, checkpointedEventId int64) ([]*swf.Decision, error) {
+	deferral := SerializedDeferral{
+		StateName:                  state.StateName,
+		EarliestUnprocessedEventId: checkpointedEventId,
+	}
+	serializedDeferral, err := f.SystemSerializer.Serialize(deferral)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	decisions := f.EmptyDecisions()
+	decisions = append(decisions, f.recordStringMarker(DeferMarker, serializedDeferral))
+	decisions = append(decisions, f.startDeferTimer(decisionTask.Events, 0)...)
+	return decisions, nil
+}
+
+// startDeferTimer returns a decision to start the DeferTimer, or no decision if it is already running.
+func (f *FSM) startDeferTimer(events []*swf.HistoryEvent, startToFire time.Duration) []*swf.Decision {
+	if f.deferTimerRunning(events) {
+		return nil
+	}
+	return []*swf.Decision{startTimerDecision(DeferTimer, startToFire, "")}
+}
+
+// deferTimerRunning looks through the events, newest first, for the last state of the DeferTimer.
+func (f *FSM) deferTimerRunning(events []*swf.HistoryEvent) bool {
+	for _, event := range events {
+		if !f.isDeferTimerEvent(event) {
+			continue
+		}
+		switch *event.EventType {
+		case swf.EventTypeTimerStarted:
+			return true
+		case swf.EventTypeStartTimerFailed:
+			if s.LS(event.StartTimerFailedEventAttributes.Cause) == swf.StartTimerFailedCauseTimerIdAlreadyInUse {
+				return true
+			}
+		case swf.EventTypeTimerFired, swf.EventTypeTimerCanceled:
+			return false
+		}
+	}
+	return false
+}
+
 func (f *FSM) recordMarker(markerName string, details interface{}) (*swf.Decision, error) {
 	serialized, err := f.Serializer.Serialize(details)
 	if err != nil {
@@ -887,6 +1670,25 @@ func (f *FSM) isErrorMarker(e *swf.HistoryEvent) bool {
 	return *e.EventType == swf.EventTypeMarkerRecorded && *e.MarkerRecordedEventAttributes.MarkerName == ErrorMarker
 }
 
+func (f *FSM) isDeferMarker(e *swf.HistoryEvent) bool {
+	return *e.EventType == swf.EventTypeMarkerRecorded && *e.MarkerRecordedEventAttributes.MarkerName == DeferMarker
+}
+
+func (f *FSM) isDeferTimerEvent(e *swf.HistoryEvent) bool {
+	var timerId *string
+	switch *e.EventType {
+	case swf.EventTypeTimerStarted:
+		timerId = e.TimerStartedEventAttributes.TimerId
+	case swf.EventTypeTimerFired:
+		timerId = e.TimerFiredEventAttributes.TimerId
+	case swf.EventTypeTimerCanceled:
+		timerId = e.TimerCanceledEventAttributes.TimerId
+	case swf.EventTypeStartTimerFailed:
+		timerId = e.StartTimerFailedEventAttributes.TimerId
+	}
+	return s.LS(timerId) == DeferTimer
+}
+
 // EmptyDecisions is a helper method to give you an empty decisions array for use in your Deciders.
 func (f *FSM) EmptyDecisions() []*swf.Decision {
 	return make([]*swf.Decision, 0)
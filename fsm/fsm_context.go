@@ -1,9 +1,18 @@
 package fsm
 
 import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/swf"
+	"github.com/juju/errors"
+	"github.com/pborman/uuid"
 
+	. "github.com/sclasen/swfsm/log"
 	. "github.com/sclasen/swfsm/sugar"
 )
 
@@ -16,6 +25,41 @@ type FSMContext struct {
 	State           string
 	stateData       interface{}
 	stateVersion    uint64
+
+	// serializedEventCorrelator is the serialized EventCorrelator as loaded from history, if any.
+	serializedEventCorrelator string
+	// errorState is the SerializedErrorState of a workflow in error, while it is being recovered.
+	errorState *SerializedErrorState
+	// enteredState and enteredAt are the state as loaded from history and when it was entered.
+	enteredState string
+	enteredAt    *time.Time
+	// decidedAt is the time of the decision task being decided.
+	decidedAt time.Time
+	// decisionTask is the decision task being decided.
+	decisionTask *swf.PollForDecisionTaskOutput
+	// eventId and eventTime are the id and timestamp of the event being decided.
+	eventId   int64
+	eventTime time.Time
+	// checkpointBy is when Checkpoint starts reporting that the decision deadline is near, zero without a deadline.
+	checkpointBy time.Time
+	// checkpointed is set by Checkpoint when the deadline is near, along with the data to record.
+	checkpointed   bool
+	checkpointData interface{}
+	// pendingClose is the outcome deferred by CancelAllInFlightAndThen while in the DrainingState.
+	pendingClose *PendingClose
+	// closed is set by Tick when the history shows the workflow already closed, so nothing was decided.
+	closed bool
+	// scheduledOnce is the activity types scheduled by ScheduleActivityOnce during this decision task,
+	// which are not in the correlator until their ActivityTaskScheduled events are.
+	scheduledOnce map[string]bool
+
+	// the settings of the FSM deciding the decision task, set by TickContext.
+	workflowType  *swf.WorkflowType
+	logger        StdLogger
+	errorReporter FSMErrorReporter
+	allowPanics   bool
+	codeVersion   string
+	idGenerator   func() string
 }
 
 // NewFSMContext constructs an FSMContext.
@@ -43,6 +87,19 @@ func (f *FSMContext) StateSerializer() StateSerializer {
 	return f.serialization.StateSerializer()
 }
 
+func (f *FSMContext) SystemStateSerializer() StateSerializer {
+	return envelopeSerializer(f.serialization)
+}
+
+// WorkflowTypeRef returns a new *swf.WorkflowType for the workflow this context belongs to.
+// If the FSM has a WorkflowType configured it is used, otherwise the type of the current execution is used.
+func (f *FSMContext) WorkflowTypeRef() *swf.WorkflowType {
+	if f.workflowType != nil {
+		return &swf.WorkflowType{Name: f.workflowType.Name, Version: f.workflowType.Version}
+	}
+	return &swf.WorkflowType{Name: f.WorkflowType.Name, Version: f.WorkflowType.Version}
+}
+
 // ContinueDecider is a helper func to easily create a ContinueOutcome.
 func (f *FSMContext) ContinueDecider(data interface{}, decisions []*swf.Decision) Outcome {
 	return Outcome{
@@ -132,13 +189,67 @@ func (f *FSMContext) FailWorkflow(data interface{}, details *string) Outcome {
 	}
 }
 
+// FailWorkflowStructured fails the workflow with the current state data, and a WorkflowFailure of the code, message
+// and suggested action, which is not retriable. See FailWorkflowWithFailure.
+func (f *FSMContext) FailWorkflowStructured(code, message, action string) Outcome {
+	return f.FailWorkflowWithFailure(f.stateData, WorkflowFailure{Code: code, Message: message, Action: action})
+}
+
+// FailWorkflowWithFailure is like FailWorkflow, with the failure serialized as json as the details of the FailWorkflow decision,
+// and recorded in a FailureMarker. The failure Code is used as the reason of the FailWorkflow decision.
+func (f *FSMContext) FailWorkflowWithFailure(data interface{}, failure WorkflowFailure) Outcome {
+	details, err := json.Marshal(failure)
+	if err != nil {
+		panic(err)
+	}
+	marker := &swf.Decision{
+		DecisionType: S(swf.DecisionTypeRecordMarker),
+		RecordMarkerDecisionAttributes: &swf.RecordMarkerDecisionAttributes{
+			MarkerName: S(FailureMarker),
+			Details:    S(string(details)),
+		},
+	}
+	d := &swf.Decision{
+		DecisionType: S(swf.DecisionTypeFailWorkflowExecution),
+		FailWorkflowExecutionDecisionAttributes: &swf.FailWorkflowExecutionDecisionAttributes{
+			Reason:  S(failure.Code),
+			Details: S(string(details)),
+		},
+	}
+	return Outcome{
+		State:     FailedState,
+		Data:      data,
+		Decisions: []*swf.Decision{marker, d},
+	}
+}
+
 // Decide executes a decider making sure that Activity tasks are being tracked.
 func (f *FSMContext) Decide(h *swf.HistoryEvent, data interface{}, decider Decider) Outcome {
+	f.eventId = aws.Int64Value(h.EventId)
+	f.eventTime = aws.TimeValue(h.EventTimestamp)
 	outcome := decider(f, h, data)
-	f.eventCorrelator.Track(h)
+	if !f.checkpointed {
+		// a checkpointed event is deferred and decided again, so it must not be tracked yet.
+		f.eventCorrelator.Track(h)
+	}
 	return outcome
 }
 
+// Checkpoint lets a long running decider give up before the decision deadline, set by the FSM DecisionTaskTimeout, without
+// losing its progress. It returns true once the deadline is within the FSM CheckpointMargin, in which case the decider should
+// return right away: its outcome is discarded, the data is recorded as the state data of the current state, and the event
+// being decided and the ones after it are deferred to a decision task scheduled by a DeferTimer. The decider is then called
+// again with the event and the checkpointed data, which must carry enough to resume the computation.
+// Without a deadline it always returns false.
+func (f *FSMContext) Checkpoint(data interface{}) bool {
+	if f.checkpointBy.IsZero() || time.Now().Before(f.checkpointBy) {
+		return false
+	}
+	f.checkpointed = true
+	f.checkpointData = data
+	return true
+}
+
 // EventData will extract a payload from the given HistoryEvent and unmarshall it into the given struct.
 func (f *FSMContext) EventData(h *swf.HistoryEvent, data interface{}) {
 	f.serialization.EventData(h, data)
@@ -156,6 +267,37 @@ func (f *FSMContext) ActivitiesInfo() map[string]*ActivityInfo {
 	return f.eventCorrelator.Activities
 }
 
+// ActivityProgress returns the latest ActivityStartedSignal or ActivityUpdatedSignal sent for the in-flight activity,
+// e.g. by ActivityWorker.SignalProgress, or nil if there is none. Its Input is the progress serialized with the worker Serializer,
+// or nil with TooLarge set when it is longer than MaxActivityProgressInput.
+func (f *FSMContext) ActivityProgress(activityId string) *ActivityProgressInfo {
+	return f.eventCorrelator.ActivityProgress[activityId]
+}
+
+// ActivityInfoByLogicalKey will find information for the in-flight activity stamped with the logical key by SetActivityLogicalKey.
+// When there is no such activity, nil is returned.
+func (f *FSMContext) ActivityInfoByLogicalKey(key string) *ActivityInfo {
+	return f.eventCorrelator.ActivityInfoByLogicalKey(key)
+}
+
+// ActivityTimeoutType returns the TimeoutType, e.g. START_TO_CLOSE or HEARTBEAT, of an EventTypeActivityTaskTimedOut event.
+// For any other event, an empty string is returned.
+func (f *FSMContext) ActivityTimeoutType(h *swf.HistoryEvent) string {
+	if h.ActivityTaskTimedOutEventAttributes == nil {
+		return ""
+	}
+	return aws.StringValue(h.ActivityTaskTimedOutEventAttributes.TimeoutType)
+}
+
+// ActivityFailureReason returns the Reason of an EventTypeActivityTaskFailed event.
+// For any other event, an empty string is returned.
+func (f *FSMContext) ActivityFailureReason(h *swf.HistoryEvent) string {
+	if h.ActivityTaskFailedEventAttributes == nil {
+		return ""
+	}
+	return aws.StringValue(h.ActivityTaskFailedEventAttributes.Reason)
+}
+
 // SignalInfo will find information for ActivityTasks being tracked. It can only be used when handling events related to ActivityTasks.
 // ActivityTasks are automatically tracked after a EventTypeActivityTaskScheduled event.
 // When there is no pending activity related to the event, nil is returned.
@@ -168,6 +310,23 @@ func (f *FSMContext) SignalsInfo() map[string]*SignalInfo {
 	return f.eventCorrelator.Signals
 }
 
+// TimersInfo will return a map of startedId -> TimerInfo for all in-flight timers in the workflow.
+func (f *FSMContext) TimersInfo() map[string]*TimerInfo {
+	return f.eventCorrelator.Timers
+}
+
+// LambdaInfo will find information for lambda functions being tracked. It can only be used when handling events related to lambda functions.
+// Lambda functions are automatically tracked after a EventTypeLambdaFunctionScheduled event.
+// When there is no pending lambda function related to the event, nil is returned.
+func (f *FSMContext) LambdaInfo(h *swf.HistoryEvent) *LambdaInfo {
+	return f.eventCorrelator.LambdaInfo(h)
+}
+
+// ChildrenInfo will return a map of initiatedId -> ChildInfo for all in-flight child workflows in the workflow.
+func (f *FSMContext) ChildrenInfo() map[string]*ChildInfo {
+	return f.eventCorrelator.Children
+}
+
 // Serialize will use the current fsm's Serializer to serialize the given struct. It will panic on errors, which is ok in the context of a Decider.
 // If you want to handle errors, use Serializer().Serialize(...) instead.
 func (f *FSMContext) Serialize(data interface{}) string {
@@ -195,29 +354,313 @@ func (f *FSMContext) Decision(d *swf.Decision) []*swf.Decision {
 	return append(f.EmptyDecisions(), d)
 }
 
+// ScheduleActivity is a helper func to create a ScheduleActivityTask decision with an input serialized with the fsm Serializer,
+// and a unique ActivityId, which is returned so that it can be stored. An empty taskList uses the default task list of the activity type.
+// Like Serialize, it panics on serialization errors.
+func (f *FSMContext) ScheduleActivity(activityType *swf.ActivityType, taskList string, input interface{}) (*swf.Decision, string) {
+	activityId := LS(activityType.Name) + "-" + f.newId()
+	attrs := &swf.ScheduleActivityTaskDecisionAttributes{
+		ActivityId:   S(activityId),
+		ActivityType: activityType,
+	}
+	if input != nil {
+		attrs.Input = S(f.Serialize(input))
+	}
+	if taskList != "" {
+		attrs.TaskList = &swf.TaskList{Name: S(taskList)}
+	}
+	return &swf.Decision{
+		DecisionType:                           S(swf.DecisionTypeScheduleActivityTask),
+		ScheduleActivityTaskDecisionAttributes: attrs,
+	}, activityId
+}
+
+// SignalExternalWorkflow is a helper func to create a SignalExternalWorkflowExecution decision with an input serialized
+// with the fsm Serializer. The workflow is signaled in the domain of this workflow, which is the only one SWF allows,
+// and an empty runId signals its current run. Like Serialize, it panics on serialization errors.
+func (f *FSMContext) SignalExternalWorkflow(workflowId, runId, signalName string, input interface{}) *swf.Decision {
+	attrs := &swf.SignalExternalWorkflowExecutionDecisionAttributes{
+		WorkflowId: S(workflowId),
+		SignalName: S(signalName),
+	}
+	if runId != "" {
+		attrs.RunId = S(runId)
+	}
+	if input != nil {
+		attrs.Input = S(f.Serialize(input))
+	}
+	return &swf.Decision{
+		DecisionType: S(swf.DecisionTypeSignalExternalWorkflowExecution),
+		SignalExternalWorkflowExecutionDecisionAttributes: attrs,
+	}
+}
+
+// StartChildWorkflow is a helper func to create a StartChildWorkflowExecution decision with an input serialized
+// with the fsm Serializer. An empty taskList uses the default task list of the workflow type.
+// A child workflow managed by an FSM expects its input built by StartFSMWorkflowInput, which can be set on the returned decision.
+// Like Serialize, it panics on serialization errors.
+func (f *FSMContext) StartChildWorkflow(workflowType *swf.WorkflowType, workflowId, taskList string, input interface{}) *swf.Decision {
+	attrs := &swf.StartChildWorkflowExecutionDecisionAttributes{
+		WorkflowId:   S(workflowId),
+		WorkflowType: workflowType,
+	}
+	if input != nil {
+		attrs.Input = S(f.Serialize(input))
+	}
+	if taskList != "" {
+		attrs.TaskList = &swf.TaskList{Name: S(taskList)}
+	}
+	return &swf.Decision{
+		DecisionType: S(swf.DecisionTypeStartChildWorkflowExecution),
+		StartChildWorkflowExecutionDecisionAttributes: attrs,
+	}
+}
+
+// StartTimer is a helper func to create a StartTimer decision firing after the duration, which is rounded up to whole seconds
+// as required by SWF, so that the timer never fires early. An empty control is not set on the decision.
+func (f *FSMContext) StartTimer(timerId string, d time.Duration, control string) *swf.Decision {
+	return startTimerDecision(timerId, d, control)
+}
+
+// startTimerDecision builds the StartTimer decisions of the FSM, so that all timers round their duration the same way.
+func startTimerDecision(timerId string, d time.Duration, control string) *swf.Decision {
+	seconds := int64(d / time.Second)
+	if d%time.Second > 0 {
+		seconds++
+	}
+	if seconds < 0 {
+		seconds = 0
+	}
+	attrs := &swf.StartTimerDecisionAttributes{
+		TimerId:            S(timerId),
+		StartToFireTimeout: S(strconv.FormatInt(seconds, 10)),
+	}
+	if control != "" {
+		attrs.Control = S(control)
+	}
+	return &swf.Decision{
+		DecisionType:                 S(swf.DecisionTypeStartTimer),
+		StartTimerDecisionAttributes: attrs,
+	}
+}
+
+// CancelTimer is a helper func to create a CancelTimer decision for the timer.
+func (f *FSMContext) CancelTimer(timerId string) *swf.Decision {
+	return &swf.Decision{
+		DecisionType: S(swf.DecisionTypeCancelTimer),
+		CancelTimerDecisionAttributes: &swf.CancelTimerDecisionAttributes{
+			TimerId: S(timerId),
+		},
+	}
+}
+
+// CancelAllActivities is a helper func to create a RequestCancelActivityTask decision for each in-flight activity,
+// in the order the activities were scheduled.
+func (f *FSMContext) CancelAllActivities() []*swf.Decision {
+	decisions := f.EmptyDecisions()
+	keys := make([]string, 0, len(f.eventCorrelator.Activities))
+	for key := range f.eventCorrelator.Activities {
+		keys = append(keys, key)
+	}
+	for _, key := range sortEventIdKeys(keys) {
+		decisions = append(decisions, &swf.Decision{
+			DecisionType: S(swf.DecisionTypeRequestCancelActivityTask),
+			RequestCancelActivityTaskDecisionAttributes: &swf.RequestCancelActivityTaskDecisionAttributes{
+				ActivityId: S(f.eventCorrelator.Activities[key].ActivityId),
+			},
+		})
+	}
+	return decisions
+}
+
+// CancelAllTimers is a helper func to create a CancelTimer decision for each in-flight timer,
+// in the order the timers were started.
+func (f *FSMContext) CancelAllTimers() []*swf.Decision {
+	decisions := f.EmptyDecisions()
+	keys := make([]string, 0, len(f.eventCorrelator.Timers))
+	for key := range f.eventCorrelator.Timers {
+		keys = append(keys, key)
+	}
+	for _, key := range sortEventIdKeys(keys) {
+		decisions = append(decisions, f.CancelTimer(f.eventCorrelator.Timers[key].TimerId))
+	}
+	return decisions
+}
+
+// sortEventIdKeys sorts correlator keys, which are event ids, numerically.
+func sortEventIdKeys(keys []string) []string {
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := strconv.ParseInt(keys[i], 10, 64)
+		b, _ := strconv.ParseInt(keys[j], 10, 64)
+		return a < b
+	})
+	return keys
+}
+
+// CancelAllInFlightAndThen is a helper func to close the workflow cleanly when activities may still be in flight.
+// When there are none, closeOutcome, such as the Outcome of CompleteWorkflow, is returned as is. Otherwise a
+// RequestCancelActivityTask decision is made for each in-flight activity, and the workflow goes to the DrainingState,
+// which goes to closeOutcome with its decisions once no activity is in flight anymore.
+// A closeOutcome without a State returns to the current state.
+func (f *FSMContext) CancelAllInFlightAndThen(closeOutcome Outcome) Outcome {
+	cancels := f.CancelAllActivities()
+	if len(cancels) == 0 {
+		return closeOutcome
+	}
+	pending := &PendingClose{State: closeOutcome.State, Decisions: closeOutcome.Decisions}
+	if pending.State == "" {
+		pending.State = f.State
+	}
+	f.pendingClose = pending
+	return f.Goto(DrainingState, closeOutcome.Data, cancels)
+}
+
+// DeterministicUUID returns a UUID derived from the run id, the id of the event being decided, and the salt,
+// so that deciding the same event again, e.g. when a decision task is retried, returns the same UUID.
+// Use a distinct salt for each UUID needed while deciding an event.
+func (f *FSMContext) DeterministicUUID(salt string) string {
+	name := fmt.Sprintf("%s/%d/%s", LS(f.RunId), f.eventId, salt)
+	return uuid.NewSHA1(deterministicUUIDSpace, []byte(name)).String()
+}
+
+var deterministicUUIDSpace = uuid.NewSHA1(uuid.NameSpace_URL, []byte("https://github.com/sclasen/swfsm"))
+
 func (f *FSMContext) Correlator() *EventCorrelator {
 	return f.eventCorrelator
 }
 
+// DecisionTask returns the decision task being decided, or nil outside of a Tick.
+// Its Events are those of the page or pages the FSM was handed, newest first, and include events that the FSM skips,
+// so deciders relying on it are coupled to the paging behavior of the poller and should prefer the HistoryEvent they are given.
+func (f *FSMContext) DecisionTask() *swf.PollForDecisionTaskOutput {
+	return f.decisionTask
+}
+
+// Now returns the EventTimestamp of the event being decided, or the time of the decision task when the event has none.
+// Deciders should use it instead of time.Now(), so that they decide the same way when events are decided again,
+// e.g. when a workflow in error is recovered, or a history is replayed. Outside of a Tick, it returns time.Now().
+func (f *FSMContext) Now() time.Time {
+	switch {
+	case !f.eventTime.IsZero():
+		return f.eventTime
+	case !f.decidedAt.IsZero():
+		return f.decidedAt
+	}
+	return time.Now()
+}
+
+// IsFirstDecision returns true while deciding the first decision task of the workflow, whose PreviousStartedEventId is 0,
+// whatever other events, e.g. signals, arrived along with the WorkflowExecutionStarted event. It returns false outside of a Tick.
+func (f *FSMContext) IsFirstDecision() bool {
+	return f.decisionTask != nil && aws.Int64Value(f.decisionTask.PreviousStartedEventId) == 0
+}
+
+// WorkflowInput deserializes the data the workflow was started with into data. The input of the WorkflowExecutionStarted event
+// is a SerializedState envelope, see StartFSMWorkflowInput, so it is unwrapped, and its StateData deserialized with the Serializer.
+// It errors when the WorkflowExecutionStarted event is not in the decision task, which it always is on the first decision task.
+func (f *FSMContext) WorkflowInput(data interface{}) error {
+	if f.decisionTask == nil {
+		return errors.New("workflow input is only available during a Tick")
+	}
+	for _, e := range f.decisionTask.Events {
+		if aws.StringValue(e.EventType) != swf.EventTypeWorkflowExecutionStarted {
+			continue
+		}
+		state, err := ParseStartInput(f.serialization, aws.StringValue(e.WorkflowExecutionStartedEventAttributes.Input))
+		if err != nil {
+			return errors.Annotate(err, "parse start input")
+		}
+		return errors.Trace(f.StateSerializer().Deserialize(state.StateData, data))
+	}
+	return errors.New("no WorkflowExecutionStarted event in the decision task")
+}
+
+// ErrorState returns the SerializedErrorState of a workflow in error while a DecisionErrorHandler is recovering it, or nil.
+func (f *FSMContext) ErrorState() *SerializedErrorState {
+	return f.errorState
+}
+
 func (f *FSMContext) Attempts(h *swf.HistoryEvent) int {
 	return f.eventCorrelator.Attempts(h)
 }
 
+// ActivityAttempts returns the number of times the activity correlated with the event has been attempted,
+// or 0 if the event does not correlate with an in-flight activity.
+func (f *FSMContext) ActivityAttempts(h *swf.HistoryEvent) int {
+	return f.eventCorrelator.AttemptsForActivity(f.ActivityInfo(h))
+}
+
+// SignalAttempts returns the number of times the signal correlated with the event has been attempted,
+// or 0 if the event does not correlate with an in-flight signal.
+func (f *FSMContext) SignalAttempts(h *swf.HistoryEvent) int {
+	return f.eventCorrelator.AttemptsForSignal(f.SignalInfo(h))
+}
+
 // ContinueWorkflowDecision will build a ContinueAsNewWorkflow decision that has the expected SerializedState marshalled to json as its input.
 // This decision should be used when it is appropriate to Continue your workflow.
 // You are unable to ContinueAsNew a workflow that has running activites, so you should assure there are none running before using this.
 // As such there is no need to copy over the ActivityCorrelator.
 // If the FSM Data Struct is Taggable, its tags will be used on the Continue Decisions
 func (f *FSMContext) ContinueWorkflowDecision(continuedState string, data interface{}) *swf.Decision {
+	return f.continueWorkflowDecision(SerializedState{
+		StateName:    continuedState,
+		StateData:    f.Serialize(data),
+		StateVersion: f.stateVersion,
+	}, data)
+}
+
+// ContinueWorkflowDecisionWithCorrelator is like ContinueWorkflowDecision, but also carries the correlator over to the new run,
+// where it is used until the new run records its own correlator marker.
+// This is useful when signals or other correlated events are expected to be re-delivered to the new run.
+func (f *FSMContext) ContinueWorkflowDecisionWithCorrelator(continuedState string, data interface{}, correlator *EventCorrelator) *swf.Decision {
+	return f.continueWorkflowDecision(SerializedState{
+		StateName:       continuedState,
+		StateData:       f.Serialize(data),
+		StateVersion:    f.stateVersion,
+		EventCorrelator: f.serializeSystem(correlator),
+	}, data)
+}
+
+// WorkflowClosed returns true if the history of the decision task shows the workflow already closed,
+// e.g. timed out or terminated, in which case Tick decides nothing and there is nothing to respond, replicate or snapshot.
+func (f *FSMContext) WorkflowClosed() bool {
+	return f.closed
+}
+
+// serializeSystem serializes with the SystemStateSerializer, and like Serialize, panics on errors.
+func (f *FSMContext) serializeSystem(data interface{}) string {
+	serialized, err := f.SystemStateSerializer().Serialize(data)
+	if err != nil {
+		panic(err)
+	}
+	return serialized
+}
+
+func (f *FSMContext) deserializeSystem(serialized string, data interface{}) {
+	if err := f.SystemStateSerializer().Deserialize(serialized, data); err != nil {
+		panic(err)
+	}
+}
+
+// newId uses the IDGenerator of the FSM, if any.
+func (f *FSMContext) newId() string {
+	if f.idGenerator != nil {
+		return f.idGenerator()
+	}
+	return uuid.New()
+}
+
+func (f *FSMContext) continueWorkflowDecision(state SerializedState, data interface{}) *swf.Decision {
+	state.CodeVersion = f.codeVersion
+	//the input is a start input, whose envelope is serialized with the SystemSerializer.
+	input, err := f.SystemStateSerializer().Serialize(state)
+	if err != nil {
+		panic(err)
+	}
 	return &swf.Decision{
 		DecisionType: aws.String(swf.DecisionTypeContinueAsNewWorkflowExecution),
 		ContinueAsNewWorkflowExecutionDecisionAttributes: &swf.ContinueAsNewWorkflowExecutionDecisionAttributes{
-			Input: aws.String(f.Serialize(SerializedState{
-				StateName:    continuedState,
-				StateData:    f.Serialize(data),
-				StateVersion: f.stateVersion,
-			},
-			)),
+			Input:   aws.String(input),
 			TagList: GetTagsIfTaggable(data),
 		},
 	}
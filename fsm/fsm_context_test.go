@@ -1,8 +1,11 @@
 package fsm
 
 import (
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/service/swf"
 	"github.com/stretchr/testify/assert"
 
 	. "github.com/sclasen/swfsm/sugar"
@@ -49,3 +52,272 @@ func TestFailWorkflowExpectsFailedStateAndFailWorkflowDecision(t *testing.T) {
 	assert.Equal(t, details, *failDecision.FailWorkflowExecutionDecisionAttributes.Details,
 		"Expected details in the fail decision to match what was passed in")
 }
+
+func TestWorkflowTypeRefWhenFSMWorkflowTypeSetExpectsFSMWorkflowType(t *testing.T) {
+	// arrange
+	f := &FSM{WorkflowType: &swf.WorkflowType{Name: S("configured"), Version: S("2")}}
+	fsmContext := &FSMContext{serialization: f, WorkflowType: swf.WorkflowType{Name: S("execution"), Version: S("1")}}
+	f.configureContext(fsmContext)
+
+	// act
+	ref := fsmContext.WorkflowTypeRef()
+
+	// assert
+	assert.Equal(t, "configured", *ref.Name, "Expected the FSM configured workflow type name")
+	assert.Equal(t, "2", *ref.Version, "Expected the FSM configured workflow type version")
+	assert.False(t, ref == f.WorkflowType, "Expected a copy of the FSM configured workflow type")
+}
+
+func TestWorkflowTypeRefWhenFSMWorkflowTypeUnsetExpectsExecutionWorkflowType(t *testing.T) {
+	// arrange
+	fsmContext := &FSMContext{serialization: &FSM{}, WorkflowType: swf.WorkflowType{Name: S("execution"), Version: S("1")}}
+
+	// act
+	ref := fsmContext.WorkflowTypeRef()
+
+	// assert
+	assert.Equal(t, "execution", *ref.Name, "Expected the execution workflow type name")
+	assert.Equal(t, "1", *ref.Version, "Expected the execution workflow type version")
+}
+
+func TestActivityAttemptsExpectsAttemptsOfCorrelatedActivity(t *testing.T) {
+	// arrange
+	correlator := &EventCorrelator{}
+	correlator.Track(EventFromPayload(1, &swf.ActivityTaskScheduledEventAttributes{ActivityId: S("the-id")}))
+	correlator.Track(EventFromPayload(2, &swf.ActivityTaskFailedEventAttributes{ScheduledEventId: I(1)}))
+	correlator.Track(EventFromPayload(3, &swf.ActivityTaskScheduledEventAttributes{ActivityId: S("the-id")}))
+	fsmContext := &FSMContext{eventCorrelator: correlator}
+	timeout := EventFromPayload(4, &swf.ActivityTaskTimedOutEventAttributes{ScheduledEventId: I(3)})
+	signaled := EventFromPayload(5, &swf.ExternalWorkflowExecutionSignaledEventAttributes{InitiatedEventId: I(1)})
+
+	// act
+	activityAttempts := fsmContext.ActivityAttempts(timeout)
+	signalAttempts := fsmContext.SignalAttempts(signaled)
+
+	// assert
+	assert.Equal(t, 1, activityAttempts, "Expected the failed attempt of the correlated activity")
+	assert.Equal(t, 0, signalAttempts, "Expected 0 attempts for an event without a correlated signal")
+}
+
+func TestActivityTimeoutTypeAndFailureReasonExpectsValuesOnlyForMatchingEvents(t *testing.T) {
+	// arrange
+	fsmContext := &FSMContext{}
+	timedOut := EventFromPayload(1, &swf.ActivityTaskTimedOutEventAttributes{TimeoutType: S(swf.ActivityTaskTimeoutTypeHeartbeat)})
+	failed := EventFromPayload(2, &swf.ActivityTaskFailedEventAttributes{Reason: S("the-reason")})
+	failedWithoutReason := EventFromPayload(3, &swf.ActivityTaskFailedEventAttributes{})
+
+	// act
+	timeoutType := fsmContext.ActivityTimeoutType(timedOut)
+	reason := fsmContext.ActivityFailureReason(failed)
+
+	// assert
+	assert.Equal(t, swf.ActivityTaskTimeoutTypeHeartbeat, timeoutType)
+	assert.Equal(t, "the-reason", reason)
+	assert.Equal(t, "", fsmContext.ActivityTimeoutType(failed), "Expected no timeout type for a failed event")
+	assert.Equal(t, "", fsmContext.ActivityFailureReason(timedOut), "Expected no reason for a timed out event")
+	assert.Equal(t, "", fsmContext.ActivityFailureReason(failedWithoutReason), "Expected no reason when unset")
+}
+
+func TestTimersInfoAndChildrenInfoExpectsInFlightTimersAndChildren(t *testing.T) {
+	// arrange
+	correlator := &EventCorrelator{}
+	correlator.Track(EventFromPayload(1, &swf.TimerStartedEventAttributes{TimerId: S("timer-1"), StartToFireTimeout: S("10")}))
+	correlator.Track(EventFromPayload(2, &swf.TimerStartedEventAttributes{TimerId: S("timer-2"), StartToFireTimeout: S("10")}))
+	correlator.Track(EventFromPayload(3, &swf.TimerFiredEventAttributes{TimerId: S("timer-1"), StartedEventId: I(1)}))
+	correlator.Track(EventFromPayload(4, &swf.StartChildWorkflowExecutionInitiatedEventAttributes{WorkflowId: S("child")}))
+	fsmContext := &FSMContext{eventCorrelator: correlator}
+
+	// act
+	timers := fsmContext.TimersInfo()
+	children := fsmContext.ChildrenInfo()
+
+	// assert
+	assert.Len(t, timers, 1, "Expected only the unfired timer")
+	assert.Equal(t, "timer-2", timers["2"].TimerId)
+	assert.Len(t, children, 1, "Expected the initiated child")
+	assert.Equal(t, "child", children["4"].WorkflowId)
+}
+
+func TestFailWorkflowStructuredExpectsFailureMarkerAndFailDecision(t *testing.T) {
+	// arrange
+	data := &TestingType{"Some data"}
+	fsmContext := &FSMContext{stateData: data}
+
+	// act
+	outcome := fsmContext.FailWorkflowStructured("payment-declined", "the card was declined", "ask the customer for another card")
+	retriable := fsmContext.FailWorkflowWithFailure(data, WorkflowFailure{Code: "timeout", Retriable: true})
+
+	// assert
+	assert.Equal(t, FailedState, outcome.State, "Expected failed state")
+	assert.Equal(t, data, outcome.Data, "Expected data to be passed into failed outcome")
+	if assert.Len(t, outcome.Decisions, 2, "Expected a marker and a fail decision") {
+		marker := outcome.Decisions[0].RecordMarkerDecisionAttributes
+		fail := outcome.Decisions[1].FailWorkflowExecutionDecisionAttributes
+		assert.Equal(t, FailureMarker, *marker.MarkerName)
+		assert.Equal(t, "payment-declined", *fail.Reason, "Expected the code as the fail reason")
+		assert.Equal(t, *marker.Details, *fail.Details, "Expected the same failure in the marker and the fail decision")
+		assert.Equal(t, `{"code":"payment-declined","message":"the card was declined","action":"ask the customer for another card","retriable":false}`, *fail.Details)
+	}
+	if assert.Len(t, retriable.Decisions, 2) {
+		assert.Contains(t, *retriable.Decisions[1].FailWorkflowExecutionDecisionAttributes.Details, `"retriable":true`)
+	}
+}
+
+func TestScheduleActivityExpectsUniqueActivityIdsAndSerializedInput(t *testing.T) {
+	// arrange
+	fsmContext := testContext(testFSM())
+	activityType := &swf.ActivityType{Name: S("ship"), Version: S("1")}
+
+	// act
+	first, firstId := fsmContext.ScheduleActivity(activityType, "shipping", &TestData{States: []string{"a"}})
+	second, secondId := fsmContext.ScheduleActivity(activityType, "", nil)
+
+	// assert
+	assert.NotEqual(t, firstId, secondId, "Expected unique activity ids")
+	assert.Equal(t, firstId, *first.ScheduleActivityTaskDecisionAttributes.ActivityId)
+	assert.Equal(t, swf.DecisionTypeScheduleActivityTask, *first.DecisionType)
+	assert.Equal(t, "shipping", *first.ScheduleActivityTaskDecisionAttributes.TaskList.Name)
+	input := &TestData{}
+	fsmContext.Deserialize(*first.ScheduleActivityTaskDecisionAttributes.Input, input)
+	assert.Equal(t, []string{"a"}, input.States)
+	assert.Nil(t, second.ScheduleActivityTaskDecisionAttributes.TaskList, "Expected the default task list")
+	assert.Nil(t, second.ScheduleActivityTaskDecisionAttributes.Input, "Expected no input")
+}
+
+func TestScheduleActivityWhenIDGeneratorSetExpectsGeneratedActivityIds(t *testing.T) {
+	// arrange
+	f := testFSM()
+	next := 0
+	f.IDGenerator = func() string {
+		next++
+		return strconv.Itoa(next)
+	}
+	fsmContext := testContext(f)
+	activityType := &swf.ActivityType{Name: S("ship"), Version: S("1")}
+
+	// act
+	_, firstId := fsmContext.ScheduleActivity(activityType, "", nil)
+	_, secondId := fsmContext.ScheduleActivity(activityType, "", nil)
+
+	// assert
+	assert.Equal(t, "ship-1", firstId)
+	assert.Equal(t, "ship-2", secondId)
+}
+
+func TestSignalExternalWorkflowAndStartChildWorkflowExpectsSerializedInput(t *testing.T) {
+	// arrange
+	fsmContext := testContext(testFSM())
+	childType := &swf.WorkflowType{Name: S("child"), Version: S("1")}
+
+	// act
+	signal := fsmContext.SignalExternalWorkflow("other-id", "", "wake-up", &TestData{States: []string{"a"}})
+	child := fsmContext.StartChildWorkflow(childType, "child-id", "children", nil)
+
+	// assert
+	assert.Equal(t, swf.DecisionTypeSignalExternalWorkflowExecution, *signal.DecisionType)
+	signalAttrs := signal.SignalExternalWorkflowExecutionDecisionAttributes
+	assert.Equal(t, "other-id", *signalAttrs.WorkflowId)
+	assert.Equal(t, "wake-up", *signalAttrs.SignalName)
+	assert.Nil(t, signalAttrs.RunId, "Expected the current run signaled")
+	input := &TestData{}
+	fsmContext.Deserialize(*signalAttrs.Input, input)
+	assert.Equal(t, []string{"a"}, input.States)
+
+	assert.Equal(t, swf.DecisionTypeStartChildWorkflowExecution, *child.DecisionType)
+	childAttrs := child.StartChildWorkflowExecutionDecisionAttributes
+	assert.Equal(t, "child-id", *childAttrs.WorkflowId)
+	assert.Equal(t, childType, childAttrs.WorkflowType)
+	assert.Equal(t, "children", *childAttrs.TaskList.Name)
+	assert.Nil(t, childAttrs.Input, "Expected no input")
+}
+
+func TestDeterministicUUIDExpectsStableAcrossReplays(t *testing.T) {
+	// arrange
+	decide := func(fsmContext *FSMContext, eventId int) (first, second string) {
+		fsmContext.Decide(&swf.HistoryEvent{EventId: I(eventId)}, nil, func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			first = ctx.DeterministicUUID("activity")
+			second = ctx.DeterministicUUID("idempotency-key")
+			return ctx.Pass()
+		})
+		return
+	}
+
+	// act
+	first, second := decide(testContext(testFSM()), 7)
+	replayedFirst, replayedSecond := decide(testContext(testFSM()), 7)
+	nextFirst, _ := decide(testContext(testFSM()), 8)
+
+	// assert
+	assert.Equal(t, first, replayedFirst, "Expected the same UUID when the event is decided again")
+	assert.Equal(t, second, replayedSecond)
+	assert.NotEqual(t, first, second, "Expected distinct UUIDs for distinct salts")
+	assert.NotEqual(t, first, nextFirst, "Expected distinct UUIDs for distinct events")
+	assert.Len(t, first, 36)
+}
+
+func TestCancelAllActivitiesAndTimersExpectsCancelDecisionsForInFlight(t *testing.T) {
+	// arrange
+	activityType := &swf.ActivityType{Name: S("ship"), Version: S("1")}
+	correlator := &EventCorrelator{}
+	correlator.Track(EventFromPayload(9, &swf.ActivityTaskScheduledEventAttributes{ActivityId: S("activity-9"), ActivityType: activityType}))
+	correlator.Track(EventFromPayload(10, &swf.ActivityTaskScheduledEventAttributes{ActivityId: S("activity-10"), ActivityType: activityType}))
+	correlator.Track(EventFromPayload(11, &swf.ActivityTaskScheduledEventAttributes{ActivityId: S("activity-11"), ActivityType: activityType}))
+	correlator.Track(EventFromPayload(12, &swf.ActivityTaskCompletedEventAttributes{ScheduledEventId: I(10)}))
+	correlator.Track(EventFromPayload(13, &swf.TimerStartedEventAttributes{TimerId: S("timer-13"), StartToFireTimeout: S("10")}))
+	fsmContext := &FSMContext{eventCorrelator: correlator}
+
+	// act
+	activities := fsmContext.CancelAllActivities()
+	timers := fsmContext.CancelAllTimers()
+
+	// assert
+	if assert.Len(t, activities, 2, "Expected only the in-flight activities") {
+		assert.Equal(t, swf.DecisionTypeRequestCancelActivityTask, *activities[0].DecisionType)
+		assert.Equal(t, "activity-9", *activities[0].RequestCancelActivityTaskDecisionAttributes.ActivityId, "Expected scheduled order")
+		assert.Equal(t, "activity-11", *activities[1].RequestCancelActivityTaskDecisionAttributes.ActivityId)
+	}
+	if assert.Len(t, timers, 1) {
+		assert.Equal(t, swf.DecisionTypeCancelTimer, *timers[0].DecisionType)
+		assert.Equal(t, "timer-13", *timers[0].CancelTimerDecisionAttributes.TimerId)
+	}
+	assert.Empty(t, (&FSMContext{eventCorrelator: &EventCorrelator{}}).CancelAllTimers())
+}
+
+func TestStartTimerAndCancelTimerExpectsWholeSecondTimeouts(t *testing.T) {
+	// arrange
+	fsmContext := &FSMContext{}
+
+	// act
+	start := fsmContext.StartTimer("timer", 1500*time.Millisecond, "some-control")
+	exact := fsmContext.StartTimer("exact", 2*time.Minute, "")
+	cancel := fsmContext.CancelTimer("timer")
+
+	// assert
+	assert.Equal(t, swf.DecisionTypeStartTimer, *start.DecisionType)
+	assert.Equal(t, "timer", *start.StartTimerDecisionAttributes.TimerId)
+	assert.Equal(t, "2", *start.StartTimerDecisionAttributes.StartToFireTimeout, "Expected partial seconds rounded up")
+	assert.Equal(t, "some-control", *start.StartTimerDecisionAttributes.Control)
+	assert.Equal(t, "120", *exact.StartTimerDecisionAttributes.StartToFireTimeout)
+	assert.Nil(t, exact.StartTimerDecisionAttributes.Control, "Expected empty control to be unset")
+	assert.Equal(t, swf.DecisionTypeCancelTimer, *cancel.DecisionType)
+	assert.Equal(t, "timer", *cancel.CancelTimerDecisionAttributes.TimerId)
+}
+
+func TestDecideWhenDeciderCheckpointsExpectsEventNotTracked(t *testing.T) {
+	// arrange
+	fsmContext := &FSMContext{eventCorrelator: &EventCorrelator{}, checkpointBy: time.Now().Add(-time.Second)}
+	fsmContext.eventCorrelator.Track(EventFromPayload(1, &swf.ActivityTaskScheduledEventAttributes{
+		ActivityId:   S("activity"),
+		ActivityType: &swf.ActivityType{Name: S("activity"), Version: S("1")},
+	}))
+	completed := EventFromPayload(2, &swf.ActivityTaskCompletedEventAttributes{ScheduledEventId: I(1)})
+
+	// act
+	fsmContext.Decide(completed, &testData{}, func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+		ctx.Checkpoint(data)
+		return ctx.Stay(data, nil)
+	})
+
+	// assert
+	assert.NotNil(t, fsmContext.ActivityInfo(completed), "Expected the checkpointed event to be decided again with the activity tracked")
+}
@@ -9,6 +9,7 @@ import (
 
 	"fmt"
 	"reflect"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/swf"
@@ -19,6 +20,9 @@ const (
 	StateMarker       = "FSM.State"
 	CorrelatorMarker  = "FSM.Correlator"
 	ErrorMarker       = "FSM.Error"
+	DeferMarker       = "FSM.Defer"
+	DeferTimer        = "FSM.Defer"
+	FailureMarker     = "FSM.Failure"
 	RepiarStateSignal = "FSM.RepairState"
 	ContinueTimer     = "FSM.ContinueWorkflow"
 	ContinueSignal    = "FSM.ContinueWorkflow"
@@ -26,6 +30,8 @@ const (
 	CanceledState     = "canceled"
 	FailedState       = "failed"
 	ErrorState        = "error"
+	//DrainingState is reserved for FSMContext.CancelAllInFlightAndThen, so it is namespaced like the markers.
+	DrainingState = "FSM.Draining"
 	//the FSM was not configured with a state named in an outcome.
 	FSMErrorMissingState = "ErrorMissingFsmState"
 	//the FSM encountered an erryor while serializaing stateData
@@ -38,6 +44,8 @@ const (
 	ActivityStartedSignal = "FSM.ActivityStarted"
 	//Signal send when long Lived worker sends an update from Work()
 	ActivityUpdatedSignal = "FSM.ActivityUpdated"
+	//Separator between the sub machine name and state name of states added with AddSubMachine
+	SubMachineSeparator = "."
 )
 
 // Decider decides an Outcome based on an event and the current data for an
@@ -61,6 +69,27 @@ type FSMState struct {
 	Name string
 	// Decider decides an Outcome given the current state, data, and an event.
 	Decider Decider
+	// EventDeciders, if set, decide the events of the types they are keyed by, such as swf.EventTypeTimerFired,
+	// in place of the Decider, which still decides the events of unlisted types. Without a Decider, the events of
+	// unlisted types leave the state and data unchanged.
+	EventDeciders map[string]Decider
+	// OnEnter, if set, is called when a decided event moves the FSM into this state from another state,
+	// and the decisions it returns are added to the outcome. The data can be updated in place.
+	OnEnter func(ctx *FSMContext, data interface{}) []*swf.Decision
+	// OnExit, if set, is called when a decided event moves the FSM out of this state into another state, before OnEnter of
+	// the next state, and the decisions it returns are added to the outcome. The data can be updated in place.
+	OnExit func(ctx *FSMContext, data interface{}) []*swf.Decision
+}
+
+// decide calls the EventDecider registered for the type of the event, falling back to the Decider, if any.
+func (s *FSMState) decide(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+	if decider, ok := s.EventDeciders[aws.StringValue(h.EventType)]; ok {
+		return decider(ctx, h, data)
+	}
+	if s.Decider == nil {
+		return ctx.Stay(data, ctx.EmptyDecisions())
+	}
+	return s.Decider(ctx, h, data)
 }
 
 //DecisionErrorHandler is the error handling contract for panics that occur in Deciders.
@@ -86,6 +115,26 @@ type FSMErrorReporter interface {
 	ErrorSerializingStateData(decisionTask *swf.PollForDecisionTaskOutput, outcome Outcome, eventCorrelator EventCorrelator, err error)
 }
 
+// StateVersionReporter can be implemented by an FSMErrorReporter to be told when AssertMonotonicStateVersion finds a state marker
+// that does not have the next version. FSMErrorReporters that do not implement it get an ErrNonMonotonicStateVersion
+// in ErrorSerializingStateData instead.
+type StateVersionReporter interface {
+	ErrorNonMonotonicStateVersion(decisionTask *swf.PollForDecisionTaskOutput, outcome Outcome, err *ErrNonMonotonicStateVersion)
+}
+
+// DroppedDecisionReporter can be implemented by an FSMErrorReporter to be told when LimitOpenActivities or LimitOpenTimers
+// drops a decision, e.g. to alert on deciders left waiting for an activity or timer that never starts.
+// FSMErrorReporters that do not implement it only have the dropped decision logged.
+type DroppedDecisionReporter interface {
+	ErrorDecisionDropped(decisionTask *swf.PollForDecisionTaskOutput, decision *swf.Decision, err *ErrOpenLimitExceeded)
+}
+
+// UnprocessedWindowReporter can be implemented by an FSMErrorReporter to be told when the unprocessed window of a workflow
+// in error exceeds FSM.MaxUnprocessedWindow. FSMErrorReporters that do not implement it have the FSM log it instead.
+type UnprocessedWindowReporter interface {
+	ErrorUnprocessedWindowExceeded(decisionTask *swf.PollForDecisionTaskOutput, errorState *SerializedErrorState, err error)
+}
+
 // StateSerializer defines the interface for serializing state to and deserializing state from the workflow history.
 type StateSerializer interface {
 	Serialize(state interface{}) (string, error)
@@ -93,12 +142,18 @@ type StateSerializer interface {
 }
 
 // JSONStateSerializer is a StateSerializer that uses go json serialization.
-type JSONStateSerializer struct{}
+type JSONStateSerializer struct {
+	// EscapeHTML, when true, escapes <, > and & in strings, as encoding/json does by default.
+	// It is off so that data such as URLs is recorded in history as it is, which both forms deserialize the same.
+	EscapeHTML bool
+}
 
 // Serialize serializes the given struct to a json string.
 func (j JSONStateSerializer) Serialize(state interface{}) (string, error) {
 	var b bytes.Buffer
-	if err := json.NewEncoder(&b).Encode(state); err != nil {
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(j.EscapeHTML)
+	if err := encoder.Encode(state); err != nil {
 		return "", err
 	}
 	return b.String(), nil
@@ -120,6 +175,21 @@ type Serialization interface {
 	InitialState() string
 }
 
+// SystemSerialization is implemented by a Serialization that serializes the SerializedState envelope
+// with its own StateSerializer, as the FSM does with its SystemSerializer.
+type SystemSerialization interface {
+	SystemStateSerializer() StateSerializer
+}
+
+// envelopeSerializer returns the StateSerializer of the SerializedState envelope, which is the SystemStateSerializer
+// when there is one, so that the envelope is read the same way whether it comes from a start input or a state marker.
+func envelopeSerializer(serializer Serialization) StateSerializer {
+	if system, ok := serializer.(SystemSerialization); ok && system.SystemStateSerializer() != nil {
+		return system.SystemStateSerializer()
+	}
+	return serializer.StateSerializer()
+}
+
 // FSM Data types that implement this interface will have the resulting tags used by
 // FSMClient when starting workflows and by the FSMContext when calling ContinueWorkflow()
 // it is []*string since thats what SWF api takes atm.
@@ -144,6 +214,28 @@ type SerializedState struct {
 	StateName    string `json:"stateName"`
 	StateData    string `json:"stateData"`
 	WorkflowId   string `json:"workflowId"`
+	// EventCorrelator is only set on the input of runs continued with ContinueWorkflowDecisionWithCorrelator.
+	EventCorrelator string `json:"eventCorrelator,omitempty"`
+	// EnteredAt is when the workflow entered the state, as of the decision task that changed the state.
+	// It is nil on states recorded before it was introduced, until the state next changes.
+	EnteredAt *time.Time `json:"enteredAt,omitempty"`
+	// PendingClose is the outcome a workflow in the DrainingState goes to once its activities are no longer in flight.
+	PendingClose *PendingClose `json:"pendingClose,omitempty"`
+	// CodeVersion is the FSM CodeVersion of the deciders that recorded the state, see FSM.OnVersionMismatch.
+	CodeVersion string `json:"codeVersion,omitempty"`
+}
+
+// PendingClose is the outcome deferred by FSMContext.CancelAllInFlightAndThen until in-flight activities are canceled.
+type PendingClose struct {
+	State     string          `json:"state"`
+	Decisions []*swf.Decision `json:"decisions,omitempty"`
+}
+
+// SerializedDeferral is recorded in a DeferMarker when a decision task is deferred because its marked state is not in the FSM.
+// EarliestUnprocessedEventId is the first event that has not been decided yet.
+type SerializedDeferral struct {
+	StateName                  string
+	EarliestUnprocessedEventId int64
 }
 
 //ErrorState is used as the input to a marker that signifies that the workflow is in an error state.
@@ -152,6 +244,17 @@ type SerializedErrorState struct {
 	EarliestUnprocessedEventId int64
 	LatestUnprocessedEventId   int64
 	ErrorEvent                 *swf.HistoryEvent
+	// RetryAttempts is the number of failed attempts at the ErrorEvent, when the error handler returned an ErrRetry.
+	RetryAttempts int `json:",omitempty"`
+}
+
+// WorkflowFailure is a structured failure recorded by FSMContext.FailWorkflowStructured or FailWorkflowWithFailure, as json in a FailureMarker
+// and as the details of the FailWorkflowExecution decision, so that tools can surface remediation hints.
+type WorkflowFailure struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Action    string `json:"action"`
+	Retriable bool   `json:"retriable"`
 }
 
 //Payload of Signals ActivityStartedSignal and ActivityUpdatedSignal
@@ -162,14 +265,47 @@ type SerializedActivityState struct {
 
 // StartFSMWorkflowInput should be used to construct the input for any StartWorkflowExecutionRequests.
 // This panics on errors cause really this should never err.
+// The SerializedState envelope is serialized with the SystemSerializer, and the data in it with the Serializer.
 func StartFSMWorkflowInput(serializer Serialization, data interface{}) *string {
 	ss := new(SerializedState)
 	stateData := serializer.Serialize(data)
 	ss.StateData = stateData
-	serialized := serializer.Serialize(ss)
+	serialized, err := envelopeSerializer(serializer).Serialize(ss)
+	if err != nil {
+		panic(err)
+	}
 	return aws.String(serialized)
 }
 
+// BuildStartInput builds the input of a StartWorkflowExecutionRequest for a workflow managed by an FSM,
+// for systems that start workflows without an FSMClient.
+// The input is a SerializedState envelope serialized with the FSM SystemSerializer, whose stateData is the data serialized with the FSM Serializer.
+// The stateName is left empty, which starts the workflow in the initial state. With the JSONStateSerializer that is
+//
+//	{"stateVersion":0,"stateName":"","stateData":"<data as a json string>","workflowId":""}
+//
+// This panics on errors, as StartFSMWorkflowInput does.
+func BuildStartInput(serializer Serialization, data interface{}) string {
+	return *StartFSMWorkflowInput(serializer, data)
+}
+
+// ParseStartInput parses the input of a WorkflowExecutionStarted event into its SerializedState envelope.
+// An empty stateName is replaced by the initial state of the FSM.
+// Inputs whose envelope was serialized with the Serializer, as it was before the SystemSerializer was used, are parsed as well.
+func ParseStartInput(serializer Serialization, input string) (*SerializedState, error) {
+	state := &SerializedState{}
+	if err := envelopeSerializer(serializer).Deserialize(input, state); err != nil {
+		state = &SerializedState{}
+		if fallbackErr := serializer.StateSerializer().Deserialize(input, state); fallbackErr != nil {
+			return nil, err
+		}
+	}
+	if state.StateName == "" {
+		state.StateName = serializer.InitialState()
+	}
+	return state, nil
+}
+
 //Stasher is used to take snapshots of StateData between each event so that we can have shap
 type Stasher struct {
 	dataType interface{}
@@ -75,8 +75,8 @@ func TestPanicRecovery(t *testing.T) {
 			_, err := tf.panicSafeDecide(ts, new(FSMContext), &swf.HistoryEvent{}, tc.data)
 			if err == nil {
 				t.Errorf("%s: Panic expected, but not received", tc.name)
-			} else {
-				t.Log(err)
+			} else if !strings.Contains(err.Error(), "file="+tc.file+":"+tc.line) {
+				t.Errorf("%s: Expected the panic location in the error, got: %s", tc.name, err)
 			}
 			var fn, file, line string
 			for _, l := range cl.Lines {
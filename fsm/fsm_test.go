@@ -1,16 +1,29 @@
 package fsm
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"errors"
 	"reflect"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/swf"
 	. "github.com/sclasen/swfsm/log"
+	"github.com/sclasen/swfsm/metrics"
+	"github.com/sclasen/swfsm/poller"
 	. "github.com/sclasen/swfsm/sugar"
 	"github.com/sclasen/swfsm/testing/mocks"
 	"github.com/stretchr/testify/assert"
@@ -509,6 +522,86 @@ func TestContinueWorkflowDecision(t *testing.T) {
 
 }
 
+func TestContinueWorkflowDecisionWithCorrelator(t *testing.T) {
+
+	fsm := testFSM()
+	ctx := testContext(fsm)
+	ctx.stateData = &TestData{States: []string{"continuing"}}
+	fsm.AddInitialState(&FSMState{
+		Name: "InitialState",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Pass()
+		},
+	},
+	)
+	correlator := &EventCorrelator{}
+	correlator.Track(&swf.HistoryEvent{
+		EventId:   I(5),
+		EventType: S(swf.EventTypeSignalExternalWorkflowExecutionInitiated),
+		SignalExternalWorkflowExecutionInitiatedEventAttributes: &swf.SignalExternalWorkflowExecutionInitiatedEventAttributes{
+			SignalName: S("the-signal"),
+			WorkflowId: S("other-workflow"),
+		},
+	})
+
+	cont := ctx.ContinueWorkflowDecisionWithCorrelator("InitialState", ctx.stateData, correlator)
+	started := &swf.HistoryEvent{
+		EventId:   I(1),
+		EventType: S(swf.EventTypeWorkflowExecutionStarted),
+		WorkflowExecutionStartedEventAttributes: &swf.WorkflowExecutionStartedEventAttributes{
+			Input: cont.ContinueAsNewWorkflowExecutionDecisionAttributes.Input,
+		},
+	}
+	continued, err := fsm.findSerializedEventCorrelator([]*swf.HistoryEvent{started})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, ok := continued.Signals["5"]; !ok || info.SignalName != "the-signal" {
+		t.Fatal(continued)
+	}
+
+}
+
+func TestContinueWorkflowDecisionWithCorrelatorWhenSerializersDifferExpectsSystemSerializer(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.Serializer = gzipStateSerializer{}
+	f.AddInitialState(&FSMState{
+		Name: "InitialState",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Pass()
+		},
+	})
+	f.Init()
+	ctx := testContext(f)
+	correlator := &EventCorrelator{}
+	correlator.Track(EventFromPayload(5, &swf.SignalExternalWorkflowExecutionInitiatedEventAttributes{
+		SignalName: S("the-signal"),
+		WorkflowId: S("other-workflow"),
+	}))
+
+	// act
+	cont := ctx.ContinueWorkflowDecisionWithCorrelator("InitialState", &TestData{States: []string{"continuing"}}, correlator)
+	started := EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+		Input: cont.ContinueAsNewWorkflowExecutionDecisionAttributes.Input,
+	})
+	continued, err := f.findSerializedEventCorrelator([]*swf.HistoryEvent{started})
+	data := &TestData{}
+	f.EventData(started, data)
+
+	// assert
+	envelope := &SerializedState{}
+	if assert.NoError(t, f.SystemSerializer.Deserialize(*started.WorkflowExecutionStartedEventAttributes.Input, envelope)) {
+		assert.NoError(t, f.SystemSerializer.Deserialize(envelope.EventCorrelator, &EventCorrelator{}), "Expected the correlator serialized with the SystemSerializer")
+	}
+	assert.NoError(t, err)
+	if assert.NotNil(t, continued.Signals["5"]) {
+		assert.Equal(t, "the-signal", continued.Signals["5"].SignalName)
+	}
+	assert.Equal(t, []string{"continuing"}, data.States, "Expected EventData to unwrap the start input")
+}
+
 func TestCompleteState(t *testing.T) {
 	fsm := testFSM()
 
@@ -570,6 +663,25 @@ func TestSerializationInterface(t *testing.T) {
 	f(&FSMContext{})
 }
 
+func TestJSONStateSerializerExpectsHTMLNotEscapedUnlessEscapeHTML(t *testing.T) {
+	// arrange
+	data := &TestData{States: []string{"https://example.com/?a=<b>&c"}}
+
+	// act
+	serialized, err := JSONStateSerializer{}.Serialize(data)
+	escaped, escapedErr := JSONStateSerializer{EscapeHTML: true}.Serialize(data)
+	roundTripped := &TestData{}
+	deserializeErr := JSONStateSerializer{}.Deserialize(serialized, roundTripped)
+
+	// assert
+	assert.NoError(t, err)
+	assert.NoError(t, escapedErr)
+	assert.NoError(t, deserializeErr)
+	assert.Contains(t, serialized, `"https://example.com/?a=<b>&c"`)
+	assert.Contains(t, escaped, `\u003cb\u003e\u0026c`)
+	assert.Equal(t, data.States, roundTripped.States)
+}
+
 func TestTaskReady(t *testing.T) {
 	f := testFSM()
 	prevStarted := testHistoryEvent(1, swf.EventTypeDecisionTaskStarted)
@@ -580,15 +692,39 @@ func TestTaskReady(t *testing.T) {
 	correlator := testHistoryEvent(4, swf.EventTypeMarkerRecorded)
 	correlator.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(CorrelatorMarker)}
 	task := testDecisionTask(1, []*swf.HistoryEvent{correlator, state})
-	if f.taskReady(task) {
+	if f.DefaultTaskReady(task) {
 		t.Fatal("task signaled ready, and events were missed")
 	}
 	task.Events = append(task.Events, missed, prevStarted)
-	if !f.taskReady(task) {
+	if !f.DefaultTaskReady(task) {
 		t.Fatal("task not signaled ready, but state correlator and prevStarted were present")
 	}
 }
 
+func TestTaskReadyWhenCorrelatorOlderThanStateExpectsReady(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.MinimizeCorrelatorWrites = true
+	state := testHistoryEvent(5, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker)}
+	prevStarted := testHistoryEvent(4, swf.EventTypeDecisionTaskStarted)
+	correlator := testHistoryEvent(3, swf.EventTypeMarkerRecorded)
+	correlator.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{
+		MarkerName: S(CorrelatorMarker),
+		Details:    S(`{"Activities":{"1":{"ActivityId":"activity-id"}}}`),
+	}
+	task := testDecisionTask(4, []*swf.HistoryEvent{state, prevStarted, correlator})
+
+	// act
+	ready := f.DefaultTaskReady(task)
+	eventCorrelator, err := f.findSerializedEventCorrelator(task.Events)
+
+	// assert
+	assert.True(t, ready, "Expected task ready when the most recent correlator predates the most recent state")
+	assert.NoError(t, err)
+	assert.Equal(t, "activity-id", eventCorrelator.Activities["1"].ActivityId, "Expected the most recent correlator in history")
+}
+
 func TestStasher(t *testing.T) {
 
 	mapIn := make(map[string]interface{})
@@ -643,6 +779,30 @@ func TestInitWhenTaskErrorHandlerSetExpectsSetFuncUsed(t *testing.T) {
 		"Expected FSM to use the set handler after Init()")
 }
 
+func TestInitWhenTaskReadyFuncSetExpectsSetFuncUsed(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.AddInitialState(f.DefaultCompleteState())
+	var checked *swf.PollForDecisionTaskOutput
+	f.TaskReadyFunc = func(task *swf.PollForDecisionTaskOutput) bool {
+		checked = task
+		return true
+	}
+	unset := testFSM()
+	unset.AddInitialState(unset.DefaultCompleteState())
+	task := testDecisionTask(1, []*swf.HistoryEvent{testHistoryEvent(2, swf.EventTypeWorkflowExecutionSignaled)})
+
+	// act
+	f.Init()
+	unset.Init()
+	ready := f.TaskReadyFunc(task)
+
+	// assert
+	assert.True(t, ready, "Expected the set TaskReadyFunc used after Init()")
+	assert.Equal(t, task, checked)
+	assert.False(t, unset.TaskReadyFunc(task), "Expected DefaultTaskReady used after Init() when none is set")
+}
+
 func TestInitWhenDecisionInterceptorNotSetExpectsSomeDefaultUsed(t *testing.T) {
 	// arrange
 	f := testFSM()
@@ -786,6 +946,52 @@ func TestHandleDecisionTaskReplicationErrorsExpectsTaskErrorHandlerCalled(t *tes
 	assert.True(t, handlerCalled, "Expected handler called because there was a replication error")
 }
 
+func TestHandleDecisionTaskWhenContextReplicationHandlerSetExpectsItPreferred(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.AddInitialState(f.DefaultCompleteState())
+
+	events := []*swf.HistoryEvent{
+		&swf.HistoryEvent{EventType: S("DecisionTaskStarted"), EventId: I(3)},
+		&swf.HistoryEvent{EventType: S("DecisionTaskScheduled"), EventId: I(2)},
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+	decisionTask := testDecisionTask(0, events)
+
+	mockSWFAPI := &mocks.SWFAPI{}
+	mockSWFAPI.MockOn_RespondDecisionTaskCompleted(mock.Anything).Return(nil, nil)
+	f.SWF = mockSWFAPI
+	f.DecisionTaskTimeout = time.Minute
+	f.DecisionTaskContextFunc = func(ctx context.Context, _ *swf.PollForDecisionTaskOutput) context.Context {
+		return context.WithValue(ctx, "request-id", "req-1")
+	}
+
+	legacyCalled := false
+	f.ReplicationHandler = func(*FSMContext, *swf.PollForDecisionTaskOutput, *swf.RespondDecisionTaskCompletedInput, *SerializedState) error {
+		legacyCalled = true
+		return nil
+	}
+	var replicatedCtx context.Context
+	f.ContextReplicationHandler = func(ctx context.Context, _ *FSMContext, _ *swf.PollForDecisionTaskOutput, _ *swf.RespondDecisionTaskCompletedInput, _ *SerializedState) error {
+		replicatedCtx = ctx
+		return nil
+	}
+
+	// act
+	f.Init()
+	f.handleDecisionTask(decisionTask)
+
+	// assert
+	if assert.NotNil(t, replicatedCtx, "Expected context aware handler called with a context") {
+		assert.Equal(t, "req-1", replicatedCtx.Value("request-id"), "Expected the decision task context")
+		_, hasDeadline := replicatedCtx.Deadline()
+		assert.False(t, hasDeadline, "Expected no DecisionTaskTimeout deadline on replication")
+	}
+	assert.False(t, legacyCalled, "Expected legacy handler not called when context aware handler is set")
+}
+
 func TestHandleDecisionTaskWhenNoErrorsExpectsTaskErrorHandlerNotCalled(t *testing.T) {
 	// arrange
 	f := testFSM()
@@ -821,6 +1027,55 @@ func TestHandleDecisionTaskWhenNoErrorsExpectsTaskErrorHandlerNotCalled(t *testi
 	assert.False(t, handlerCalled, "Expected handler not called because nothing errored")
 }
 
+type recordingMetricsSink struct {
+	timings map[string]int
+	counts  map[string]int
+}
+
+func (r *recordingMetricsSink) Timing(name string, d time.Duration, tags map[string]string) {
+	r.timings[name]++
+}
+
+func (r *recordingMetricsSink) Count(name string, n int, tags map[string]string) {
+	r.counts[name] += n
+}
+
+func TestHandleDecisionTaskExpectsMetrics(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.AllowPanics = false
+	sink := &recordingMetricsSink{timings: map[string]int{}, counts: map[string]int{}}
+	f.MetricsSink = sink
+	f.AddInitialState(&FSMState{
+		Name: "start",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			panic("BOOM")
+		},
+	})
+
+	events := []*swf.HistoryEvent{
+		&swf.HistoryEvent{EventType: S("DecisionTaskStarted"), EventId: I(3)},
+		&swf.HistoryEvent{EventType: S("DecisionTaskScheduled"), EventId: I(2)},
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+	decisionTask := testDecisionTask(0, events)
+
+	mockSWFAPI := &mocks.SWFAPI{}
+	mockSWFAPI.MockOn_RespondDecisionTaskCompleted(mock.Anything).Return(nil, nil)
+	f.SWF = mockSWFAPI
+
+	// act
+	f.Init()
+	f.handleDecisionTask(decisionTask)
+
+	// assert
+	assert.Equal(t, 1, sink.timings[metrics.DecisionTaskTick])
+	assert.Equal(t, 3, sink.counts[metrics.DecisionTaskDecisions], "Expected the state, correlator and error markers")
+	assert.Equal(t, 1, sink.counts[metrics.ErrorMarkersRecorded])
+}
+
 func testFSM() *FSM {
 	fsm := &FSM{
 		Name:             "test-fsm",
@@ -833,13 +1088,15 @@ func testFSM() *FSM {
 }
 
 func testContext(fsm *FSM) *FSMContext {
-	return NewFSMContext(
+	ctx := NewFSMContext(
 		fsm,
 		swf.WorkflowType{Name: S("test-workflow"), Version: S("1")},
 		swf.WorkflowExecution{WorkflowId: S("test-workflow-1"), RunId: S("123123")},
 		&EventCorrelator{Serializer: JSONStateSerializer{}},
 		"InitialState", &TestData{}, 0,
 	)
+	fsm.configureContext(ctx)
+	return ctx
 }
 
 func testDecisionTask(prevStarted int, events []*swf.HistoryEvent) *swf.PollForDecisionTaskOutput {
@@ -870,3 +1127,1798 @@ func testHistoryEvent(eventId int, eventType string) *swf.HistoryEvent {
 
 var testWorkflowExecution = &swf.WorkflowExecution{WorkflowId: S("workflow-id"), RunId: S("run-id")}
 var testWorkflowType = &swf.WorkflowType{Name: S("workflow-name"), Version: S("workflow-version")}
+
+func TestHandleDecisionTaskWhenDecoratorSetExpectsDecoratedRequest(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.AddInitialState(f.DefaultCompleteState())
+
+	events := []*swf.HistoryEvent{
+		&swf.HistoryEvent{EventType: S("DecisionTaskStarted"), EventId: I(3)},
+		&swf.HistoryEvent{EventType: S("DecisionTaskScheduled"), EventId: I(2)},
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+	decisionTask := testDecisionTask(0, events)
+
+	mockSWFAPI := &mocks.SWFAPI{}
+	mockSWFAPI.MockOn_RespondDecisionTaskCompleted(mock.Anything).Return(nil, nil)
+	f.SWF = mockSWFAPI
+	f.DecisionTaskCompletedDecorator = func(complete *swf.RespondDecisionTaskCompletedInput) {
+		complete.ExecutionContext = S("decorated")
+	}
+
+	// act
+	f.Init()
+	f.handleDecisionTask(decisionTask)
+
+	// assert
+	if assert.Len(t, mockSWFAPI.Calls, 1, "Expected RespondDecisionTaskCompleted to be called") {
+		complete := mockSWFAPI.Calls[0].Arguments.Get(0).(*swf.RespondDecisionTaskCompletedInput)
+		assert.Equal(t, "decorated", *complete.ExecutionContext, "Expected decorator to be applied before responding")
+	}
+}
+
+func TestHandleDecisionTaskWhenExecutionContextFuncSetExpectsCustomExecutionContext(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.AddInitialState(f.DefaultCompleteState())
+
+	events := []*swf.HistoryEvent{
+		&swf.HistoryEvent{EventType: S("DecisionTaskStarted"), EventId: I(3)},
+		&swf.HistoryEvent{EventType: S("DecisionTaskScheduled"), EventId: I(2)},
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+	decisionTask := testDecisionTask(0, events)
+
+	mockSWFAPI := &mocks.SWFAPI{}
+	mockSWFAPI.MockOn_RespondDecisionTaskCompleted(mock.Anything).Return(nil, nil)
+	f.SWF = mockSWFAPI
+	f.ExecutionContextFunc = func(ctx *FSMContext, state *SerializedState) string {
+		return fmt.Sprintf("v%d %s", state.StateVersion, *ctx.WorkflowId)
+	}
+
+	// act
+	f.Init()
+	f.handleDecisionTask(decisionTask)
+
+	// assert
+	if assert.Len(t, mockSWFAPI.Calls, 1, "Expected RespondDecisionTaskCompleted to be called") {
+		complete := mockSWFAPI.Calls[0].Arguments.Get(0).(*swf.RespondDecisionTaskCompletedInput)
+		assert.Equal(t, "complete | v1 workflow-id", *complete.ExecutionContext)
+		assert.Equal(t, "complete", ExecutionContextStateName(*complete.ExecutionContext))
+	}
+}
+
+func TestExecutionContextWhenTooLongExpectsTruncated(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.ExecutionContextFunc = func(ctx *FSMContext, state *SerializedState) string {
+		return strings.Repeat("é", MaxExecutionContextLength)
+	}
+
+	// act
+	executionContext := f.executionContext(testContext(f), &SerializedState{StateName: "working"})
+
+	// assert
+	assert.Equal(t, MaxExecutionContextLength, utf8.RuneCountInString(executionContext), "Expected the ExecutionContext truncated to the SWF limit")
+	assert.Equal(t, "working", ExecutionContextStateName(executionContext), "Expected the state name kept")
+	assert.True(t, utf8.ValidString(executionContext), "Expected whole characters kept")
+}
+
+func TestAuditDecisionExpectsIdentifiersWithoutPayload(t *testing.T) {
+	// arrange
+	d := &swf.Decision{
+		DecisionType: S(swf.DecisionTypeScheduleActivityTask),
+		ScheduleActivityTaskDecisionAttributes: &swf.ScheduleActivityTaskDecisionAttributes{
+			ActivityId:   S("activity-id"),
+			ActivityType: &swf.ActivityType{Name: S("activity"), Version: S("1")},
+			Input:        S("secret"),
+		},
+	}
+
+	// act
+	audit := auditDecision(d)
+
+	// assert
+	assert.Equal(t, `{"activity-id":"activity-id","activity-type":"activity","activity-version":"1","type":"ScheduleActivityTask"}`, audit)
+}
+
+func TestTickWhenCorrelatorUnchangedExpectsCorrelatorMarkerNotRecorded(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.MinimizeCorrelatorWrites = true
+	f.AddInitialState(&FSMState{
+		Name: "waiting",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "waiting", StateData: "{}", WorkflowId: "test-workflow-1"})
+	serializedCorrelator, _ := f.SystemSerializer.Serialize(&EventCorrelator{})
+
+	signal := testHistoryEvent(6, swf.EventTypeWorkflowExecutionSignaled)
+	signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("noop")}
+	state := testHistoryEvent(4, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	correlator := testHistoryEvent(3, swf.EventTypeMarkerRecorded)
+	correlator.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(CorrelatorMarker), Details: S(serializedCorrelator)}
+	decisionTask := testDecisionTask(5, []*swf.HistoryEvent{signal, testHistoryEvent(5, swf.EventTypeDecisionTaskStarted), state, correlator})
+
+	// act
+	_, decisions, _, err := f.Tick(decisionTask)
+
+	// assert
+	assert.NoError(t, err)
+	assert.NotNil(t, FindDecision(decisions, stateMarkerPredicate), "Expected the state marker to always be recorded")
+	assert.Nil(t, FindDecision(decisions, correlationMarkerPredicate), "Expected the unchanged correlator marker not to be recorded")
+}
+
+func TestTickWhenStateUnknownAndDeferUnknownStatesExpectsDeferral(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.DeferUnknownStates = true
+	f.AddInitialState(&FSMState{
+		Name: "waiting",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			t.Fatal("Expected no deciders to be called for an unknown state")
+			return ctx.Pass()
+		},
+	})
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "added-in-next-version", StateData: "{}", WorkflowId: "test-workflow-1"})
+	signal := testHistoryEvent(6, swf.EventTypeWorkflowExecutionSignaled)
+	signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("noop")}
+	state := testHistoryEvent(4, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	decisionTask := testDecisionTask(5, []*swf.HistoryEvent{signal, testHistoryEvent(5, swf.EventTypeDecisionTaskStarted), state})
+
+	// act
+	_, decisions, serialized, err := f.Tick(decisionTask)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, "added-in-next-version", serialized.StateName, "Expected the state to be returned as found")
+	assert.Nil(t, FindDecision(decisions, stateMarkerPredicate), "Expected the state marker not to be recorded")
+	marker := FindDecision(decisions, func(d *swf.Decision) bool {
+		return *d.DecisionType == swf.DecisionTypeRecordMarker && *d.RecordMarkerDecisionAttributes.MarkerName == DeferMarker
+	})
+	if assert.NotNil(t, marker, "Expected a defer marker") {
+		deferral := &SerializedDeferral{}
+		f.SystemSerializer.Deserialize(*marker.RecordMarkerDecisionAttributes.Details, deferral)
+		assert.Equal(t, int64(6), deferral.EarliestUnprocessedEventId)
+	}
+	timer := FindDecision(decisions, startTimerPredicate)
+	if assert.NotNil(t, timer, "Expected a defer timer") {
+		assert.Equal(t, DeferTimer, *timer.StartTimerDecisionAttributes.TimerId)
+		assert.Equal(t, "30", *timer.StartTimerDecisionAttributes.StartToFireTimeout)
+	}
+}
+
+func TestTickAfterDeferralExpectsDeferredEventsDecided(t *testing.T) {
+	// arrange
+	f := testFSM()
+	var decided []string
+	f.AddInitialState(&FSMState{
+		Name: "added-in-next-version",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			decided = append(decided, *h.EventType)
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "added-in-next-version", StateData: "{}", WorkflowId: "test-workflow-1"})
+	serializedDeferral, _ := f.SystemSerializer.Serialize(&SerializedDeferral{StateName: "added-in-next-version", EarliestUnprocessedEventId: 4})
+
+	fired := testHistoryEvent(9, swf.EventTypeTimerFired)
+	fired.TimerFiredEventAttributes = &swf.TimerFiredEventAttributes{TimerId: S(DeferTimer), StartedEventId: I(8)}
+	started := testHistoryEvent(8, swf.EventTypeTimerStarted)
+	started.TimerStartedEventAttributes = &swf.TimerStartedEventAttributes{TimerId: S(DeferTimer), StartToFireTimeout: S("30")}
+	deferral := testHistoryEvent(7, swf.EventTypeMarkerRecorded)
+	deferral.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(DeferMarker), Details: S(serializedDeferral)}
+	signal := testHistoryEvent(4, swf.EventTypeWorkflowExecutionSignaled)
+	signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("noop")}
+	state := testHistoryEvent(2, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	decisionTask := testDecisionTask(5, []*swf.HistoryEvent{
+		fired, started, deferral, testHistoryEvent(6, swf.EventTypeDecisionTaskCompleted),
+		testHistoryEvent(5, swf.EventTypeDecisionTaskStarted), signal, testHistoryEvent(3, swf.EventTypeDecisionTaskStarted), state,
+	})
+
+	// act
+	_, decisions, _, err := f.Tick(decisionTask)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, []string{swf.EventTypeWorkflowExecutionSignaled}, decided, "Expected only the deferred signal to be decided")
+	assert.NotNil(t, FindDecision(decisions, stateMarkerPredicate), "Expected the state marker to be recorded")
+}
+
+func TestTaskReadyAfterRepeatedDeferralsExpectsPagingUntilEarliestUnprocessedEvent(t *testing.T) {
+	// arrange
+	f := testFSM()
+	var decided []string
+	f.AddInitialState(&FSMState{
+		Name: "added-in-next-version",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			decided = append(decided, *h.WorkflowExecutionSignaledEventAttributes.SignalName)
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 2, StateName: "added-in-next-version", StateData: "{}", WorkflowId: "test-workflow-1"})
+	serializedDeferral, _ := f.SystemSerializer.Serialize(&SerializedDeferral{StateName: "added-in-next-version", EarliestUnprocessedEventId: 7})
+	deferral := func(eventId int) *swf.HistoryEvent {
+		e := testHistoryEvent(eventId, swf.EventTypeMarkerRecorded)
+		e.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(DeferMarker), Details: S(serializedDeferral)}
+		return e
+	}
+	correlator := testHistoryEvent(11, swf.EventTypeMarkerRecorded)
+	correlator.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(CorrelatorMarker), Details: S("{}")}
+	state := testHistoryEvent(10, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	signal := testHistoryEvent(7, swf.EventTypeWorkflowExecutionSignaled)
+	signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("during-last-decision")}
+	//the deferral at 14 was recorded by the task started at 13, the deferral at 18 by the task started at 17.
+	firstPage := []*swf.HistoryEvent{
+		deferral(18), testHistoryEvent(17, swf.EventTypeDecisionTaskStarted), deferral(14),
+		testHistoryEvent(13, swf.EventTypeDecisionTaskStarted), testHistoryEvent(12, swf.EventTypeDecisionTaskScheduled), correlator, state,
+	}
+	secondPage := []*swf.HistoryEvent{
+		testHistoryEvent(9, swf.EventTypeDecisionTaskCompleted), testHistoryEvent(8, swf.EventTypeDecisionTaskScheduled),
+		signal, testHistoryEvent(6, swf.EventTypeDecisionTaskStarted),
+	}
+	decisionTask := testDecisionTask(17, firstPage)
+
+	// act
+	readyAfterFirstPage := f.DefaultTaskReady(decisionTask)
+	decisionTask.Events = append(decisionTask.Events, secondPage...)
+	readyAfterSecondPage := f.DefaultTaskReady(decisionTask)
+	_, _, _, err := f.Tick(decisionTask)
+
+	// assert
+	assert.False(t, readyAfterFirstPage, "Expected the paging to continue until the earliest unprocessed event")
+	assert.True(t, readyAfterSecondPage, "Expected the task ready once the earliest unprocessed event is read")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"during-last-decision"}, decided, "Expected the signal received during the last decision to be decided")
+}
+
+func TestTickAfterDeferralWhenDeciderFailsExpectsErrorMarkerFromDeferredEvents(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.AllowPanics = false
+	f.AddInitialState(&FSMState{
+		Name: "computing",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			panic("BOOM")
+		},
+	})
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "computing", StateData: "{}", WorkflowId: "test-workflow-1"})
+	serializedDeferral, _ := f.SystemSerializer.Serialize(&SerializedDeferral{StateName: "computing", EarliestUnprocessedEventId: 4})
+	deferral := testHistoryEvent(7, swf.EventTypeMarkerRecorded)
+	deferral.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(DeferMarker), Details: S(serializedDeferral)}
+	signal := testHistoryEvent(4, swf.EventTypeWorkflowExecutionSignaled)
+	signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("noop")}
+	state := testHistoryEvent(2, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	decisionTask := testDecisionTask(5, []*swf.HistoryEvent{
+		deferral, testHistoryEvent(6, swf.EventTypeDecisionTaskCompleted), testHistoryEvent(5, swf.EventTypeDecisionTaskStarted),
+		signal, testHistoryEvent(3, swf.EventTypeDecisionTaskStarted), state,
+	})
+
+	// act
+	_, decisions, _, err := f.Tick(decisionTask)
+
+	// assert
+	assert.NoError(t, err)
+	marker := FindDecision(decisions, errorMarkerPredicate)
+	if assert.NotNil(t, marker, "Expected an error marker") {
+		errorState := &SerializedErrorState{}
+		f.SystemSerializer.Deserialize(*marker.RecordMarkerDecisionAttributes.Details, errorState)
+		assert.Equal(t, int64(4), errorState.EarliestUnprocessedEventId, "Expected the deferred events to stay unprocessed")
+	}
+}
+
+func TestHandleDecisionTaskWhenDecisionTaskTimeoutExceededExpectsTaskAbandoned(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.DecisionTaskTimeout = 10 * time.Millisecond
+	decided := 0
+	f.AddInitialState(&FSMState{
+		Name: "slow",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			decided++
+			time.Sleep(20 * time.Millisecond)
+			return ctx.Stay(data, []*swf.Decision{{DecisionType: S(swf.DecisionTypeStartTimer)}})
+		},
+	})
+	var taskErr error
+	f.TaskErrorHandler = func(decisionTask *swf.PollForDecisionTaskOutput, err error) {
+		taskErr = err
+	}
+
+	events := []*swf.HistoryEvent{
+		&swf.HistoryEvent{EventType: S(swf.EventTypeWorkflowExecutionSignaled), EventId: I(2)},
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+	decisionTask := testDecisionTask(0, events)
+
+	mockSWFAPI := &mocks.SWFAPI{}
+	f.SWF = mockSWFAPI
+
+	// act
+	f.Init()
+	f.handleDecisionTask(decisionTask)
+
+	// assert
+	assert.Equal(t, 1, decided, "Expected no deciders to be called after the deadline")
+	if assert.Error(t, taskErr, "Expected the TaskErrorHandler to be called") {
+		assert.Contains(t, taskErr.Error(), context.DeadlineExceeded.Error())
+	}
+	assert.Len(t, mockSWFAPI.Calls, 0, "Expected no partial decisions to be sent")
+}
+
+func TestTickContextWhenDeciderCheckpointsNearDeadlineExpectsRemainingEventsDeferred(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.CheckpointMargin = time.Hour
+	f.AddInitialState(&FSMState{
+		Name: "computing",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			testData := data.(*TestData)
+			signal := *h.WorkflowExecutionSignaledEventAttributes.SignalName
+			if signal == "compute" {
+				testData.States = append(testData.States, "half-computed")
+				if ctx.Checkpoint(testData) {
+					return ctx.Stay(testData, []*swf.Decision{{DecisionType: S(swf.DecisionTypeStartTimer)}})
+				}
+			}
+			testData.States = append(testData.States, signal)
+			return ctx.Stay(testData, []*swf.Decision{{DecisionType: S(swf.DecisionTypeRecordMarker), RecordMarkerDecisionAttributes: &swf.RecordMarkerDecisionAttributes{MarkerName: S(signal)}}})
+		},
+	})
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "computing", StateData: "{}", WorkflowId: "test-workflow-1"})
+	state := testHistoryEvent(2, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	signal := func(eventId int, name string) *swf.HistoryEvent {
+		e := testHistoryEvent(eventId, swf.EventTypeWorkflowExecutionSignaled)
+		e.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S(name)}
+		return e
+	}
+	decisionTask := testDecisionTask(3, []*swf.HistoryEvent{
+		signal(6, "after"), signal(5, "compute"), signal(4, "before"), testHistoryEvent(3, swf.EventTypeDecisionTaskStarted), state,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// act
+	_, decisions, serialized, err := f.TickContext(ctx, decisionTask)
+	_, _, _, noDeadlineErr := f.Tick(decisionTask)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, "computing", serialized.StateName)
+	data := &TestData{}
+	f.Serializer.Deserialize(serialized.StateData, data)
+	assert.Equal(t, []string{"before", "half-computed"}, data.States, "Expected the checkpointed data to be recorded")
+	assert.NotNil(t, FindDecision(decisions, func(d *swf.Decision) bool {
+		return *d.DecisionType == swf.DecisionTypeRecordMarker && *d.RecordMarkerDecisionAttributes.MarkerName == "before"
+	}), "Expected the decisions of the events before the checkpoint")
+	assert.Nil(t, FindDecision(decisions, func(d *swf.Decision) bool {
+		return *d.DecisionType == swf.DecisionTypeRecordMarker && *d.RecordMarkerDecisionAttributes.MarkerName == "after"
+	}), "Expected the events after the checkpoint not to be decided")
+	marker := FindDecision(decisions, func(d *swf.Decision) bool {
+		return *d.DecisionType == swf.DecisionTypeRecordMarker && *d.RecordMarkerDecisionAttributes.MarkerName == DeferMarker
+	})
+	if assert.NotNil(t, marker, "Expected a defer marker") {
+		deferral := &SerializedDeferral{}
+		f.SystemSerializer.Deserialize(*marker.RecordMarkerDecisionAttributes.Details, deferral)
+		assert.Equal(t, int64(5), deferral.EarliestUnprocessedEventId, "Expected the checkpointed event to be decided again")
+	}
+	timer := FindDecision(decisions, startTimerPredicate)
+	if assert.NotNil(t, timer, "Expected a defer timer") {
+		assert.Equal(t, DeferTimer, *timer.StartTimerDecisionAttributes.TimerId)
+		assert.Equal(t, "0", *timer.StartTimerDecisionAttributes.StartToFireTimeout)
+	}
+	assert.NoError(t, noDeadlineErr)
+}
+
+func TestTaskReadyWhenCheckpointedEventsOnLaterPageExpectsPagingUntilDeferredEvents(t *testing.T) {
+	// arrange
+	f := testFSM()
+	var decided []string
+	f.AddInitialState(&FSMState{
+		Name: "computing",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			decided = append(decided, *h.WorkflowExecutionSignaledEventAttributes.SignalName)
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 2, StateName: "computing", StateData: "{}", WorkflowId: "test-workflow-1"})
+	serializedDeferral, _ := f.SystemSerializer.Serialize(&SerializedDeferral{StateName: "computing", EarliestUnprocessedEventId: 4})
+	signal := func(eventId int, name string) *swf.HistoryEvent {
+		e := testHistoryEvent(eventId, swf.EventTypeWorkflowExecutionSignaled)
+		e.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S(name)}
+		return e
+	}
+	fired := testHistoryEvent(13, swf.EventTypeTimerFired)
+	fired.TimerFiredEventAttributes = &swf.TimerFiredEventAttributes{TimerId: S(DeferTimer), StartedEventId: I(12)}
+	started := testHistoryEvent(12, swf.EventTypeTimerStarted)
+	started.TimerStartedEventAttributes = &swf.TimerStartedEventAttributes{TimerId: S(DeferTimer), StartToFireTimeout: S("0")}
+	deferral := testHistoryEvent(11, swf.EventTypeMarkerRecorded)
+	deferral.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(DeferMarker), Details: S(serializedDeferral)}
+	correlator := testHistoryEvent(10, swf.EventTypeMarkerRecorded)
+	correlator.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(CorrelatorMarker), Details: S("{}")}
+	state := testHistoryEvent(9, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	firstPage := []*swf.HistoryEvent{
+		fired, started, deferral, correlator, state, testHistoryEvent(8, swf.EventTypeDecisionTaskCompleted),
+		testHistoryEvent(7, swf.EventTypeDecisionTaskStarted), testHistoryEvent(6, swf.EventTypeDecisionTaskScheduled),
+	}
+	secondPage := []*swf.HistoryEvent{
+		signal(5, "after"), signal(4, "compute"), testHistoryEvent(3, swf.EventTypeDecisionTaskStarted),
+	}
+	decisionTask := testDecisionTask(7, firstPage)
+
+	// act
+	readyAfterFirstPage := f.DefaultTaskReady(decisionTask)
+	decisionTask.Events = append(decisionTask.Events, secondPage...)
+	readyAfterSecondPage := f.DefaultTaskReady(decisionTask)
+	_, _, _, err := f.Tick(decisionTask)
+
+	// assert
+	assert.False(t, readyAfterFirstPage, "Expected the paging to continue until the deferred events")
+	assert.True(t, readyAfterSecondPage, "Expected the task ready once the deferred events are read")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"compute", "after"}, decided, "Expected the checkpointed events to be decided")
+}
+
+func TestTickContextWhenDeciderCheckpointsAfterCloseDecisionExpectsDeferralBeforeIt(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.CheckpointMargin = time.Hour
+	f.AddInitialState(&FSMState{
+		Name: "computing",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			if *h.WorkflowExecutionSignaledEventAttributes.SignalName == "compute" && ctx.Checkpoint(data) {
+				return ctx.Stay(data, nil)
+			}
+			return ctx.Stay(data, []*swf.Decision{{
+				DecisionType: S(swf.DecisionTypeCompleteWorkflowExecution),
+				CompleteWorkflowExecutionDecisionAttributes: &swf.CompleteWorkflowExecutionDecisionAttributes{},
+			}})
+		},
+	})
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "computing", StateData: "{}", WorkflowId: "test-workflow-1"})
+	state := testHistoryEvent(2, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	signal := func(eventId int, name string) *swf.HistoryEvent {
+		e := testHistoryEvent(eventId, swf.EventTypeWorkflowExecutionSignaled)
+		e.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S(name)}
+		return e
+	}
+	decisionTask := testDecisionTask(3, []*swf.HistoryEvent{
+		signal(5, "compute"), signal(4, "complete"), testHistoryEvent(3, swf.EventTypeDecisionTaskStarted), state,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// act
+	_, decisions, _, err := f.TickContext(ctx, decisionTask)
+
+	// assert
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, decisions) {
+		assert.Equal(t, swf.DecisionTypeCompleteWorkflowExecution, *decisions[len(decisions)-1].DecisionType, "Expected the close decision last")
+	}
+	assert.NotNil(t, FindDecision(decisions, startTimerPredicate), "Expected a defer timer")
+}
+
+func TestHandleDecisionTaskWhenRespondThrottledExpectsRetried(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.RespondRetrier = &RespondRetrier{Retries: 3, Backoff: time.Millisecond}
+	f.AddInitialState(&FSMState{
+		Name: "start",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Stay(data, nil)
+		},
+	})
+	var taskErr error
+	f.TaskErrorHandler = func(decisionTask *swf.PollForDecisionTaskOutput, err error) {
+		taskErr = err
+	}
+
+	events := []*swf.HistoryEvent{
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+	decisionTask := testDecisionTask(0, events)
+
+	mockSWFAPI := &mocks.SWFAPI{}
+	mockSWFAPI.MockOnAny_RespondDecisionTaskCompleted().Return(nil, awserr.New(ErrorTypeThrottlingException, "slow down", nil)).Once()
+	mockSWFAPI.MockOnAny_RespondDecisionTaskCompleted().Return(nil, awserr.NewRequestFailure(awserr.New("InternalFailure", "oops", nil), 503, "req")).Once()
+	mockSWFAPI.MockOnAny_RespondDecisionTaskCompleted().Return(&swf.RespondDecisionTaskCompletedOutput{}, nil).Once()
+	f.SWF = mockSWFAPI
+
+	// act
+	f.Init()
+	f.handleDecisionTask(decisionTask)
+
+	// assert
+	assert.NoError(t, taskErr)
+	mockSWFAPI.AssertNumberOfCalls(t, "RespondDecisionTaskCompleted", 3)
+}
+
+func TestHandleDecisionTaskWhenRespondFailsWithClientErrorExpectsNoRetry(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.RespondRetrier = &RespondRetrier{Retries: 3, Backoff: time.Millisecond}
+	f.AddInitialState(&FSMState{
+		Name: "start",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Stay(data, nil)
+		},
+	})
+	var taskErr error
+	f.TaskErrorHandler = func(decisionTask *swf.PollForDecisionTaskOutput, err error) {
+		taskErr = err
+	}
+
+	events := []*swf.HistoryEvent{
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+	decisionTask := testDecisionTask(0, events)
+
+	mockSWFAPI := &mocks.SWFAPI{}
+	mockSWFAPI.MockOnAny_RespondDecisionTaskCompleted().Return(nil, awserr.New(ErrorTypeUnknownResourceFault, "gone", nil))
+	f.SWF = mockSWFAPI
+
+	// act
+	f.Init()
+	f.handleDecisionTask(decisionTask)
+
+	// assert
+	assert.Error(t, taskErr, "Expected the TaskErrorHandler to be called")
+	mockSWFAPI.AssertNumberOfCalls(t, "RespondDecisionTaskCompleted", 1)
+}
+
+func TestTickWithEventTransformerExpectsDecidersSeeTransformedEvents(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.EventTransformer = func(events []*swf.HistoryEvent) []*swf.HistoryEvent {
+		transformed := make([]*swf.HistoryEvent, 0, len(events))
+		for _, e := range events {
+			if attrs := e.WorkflowExecutionSignaledEventAttributes; attrs != nil && *attrs.SignalName == "deprecated" {
+				renamed := *e
+				renamed.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("current")}
+				e = &renamed
+			}
+			transformed = append(transformed, e)
+		}
+		return transformed
+	}
+	var signals []string
+	f.AddInitialState(&FSMState{
+		Name: "start",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			if *h.EventType == swf.EventTypeWorkflowExecutionSignaled {
+				signals = append(signals, *h.WorkflowExecutionSignaledEventAttributes.SignalName)
+			}
+			return ctx.Stay(data, nil)
+		},
+	})
+
+	events := []*swf.HistoryEvent{
+		EventFromPayload(2, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("deprecated")}),
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+	decisionTask := testDecisionTask(0, events)
+
+	// act
+	f.Init()
+	_, _, _, err := f.Tick(decisionTask)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"current"}, signals)
+	assert.Equal(t, "deprecated", *decisionTask.Events[0].WorkflowExecutionSignaledEventAttributes.SignalName, "Expected the polled task to be untouched")
+}
+
+func markerEvents(decisions []*swf.Decision) []*swf.HistoryEvent {
+	var events []*swf.HistoryEvent
+	for i := len(decisions) - 1; i >= 0; i-- {
+		if d := decisions[i]; *d.DecisionType == swf.DecisionTypeRecordMarker {
+			events = append(events, &swf.HistoryEvent{
+				EventType: S(swf.EventTypeMarkerRecorded),
+				MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{
+					MarkerName: d.RecordMarkerDecisionAttributes.MarkerName,
+					Details:    d.RecordMarkerDecisionAttributes.Details,
+				},
+			})
+		}
+	}
+	return events
+}
+
+func retryThenFailFSM(failures *int, retries int) *FSM {
+	f := testFSM()
+	f.AllowPanics = false
+	f.AddInitialStateWithHandler(&FSMState{
+		Name: "start",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			if *h.EventType == swf.EventTypeWorkflowExecutionStarted && *failures > 0 {
+				*failures--
+				panic("BOOM")
+			}
+			if *h.EventType == swf.EventTypeWorkflowExecutionStarted {
+				return ctx.Goto("started", data, ctx.EmptyDecisions())
+			}
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	}, RetryThenFail(retries, func(ctx *FSMContext, h *swf.HistoryEvent, err error) *Outcome {
+		outcome := ctx.FailWorkflow(ctx.stateData, S(err.Error()))
+		return &outcome
+	}))
+	f.AddState(&FSMState{
+		Name: "started",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+	return f
+}
+
+func TestRetryThenFailWhenRetrySucceedsExpectsRecovered(t *testing.T) {
+	// arrange
+	failures := 1
+	f := retryThenFailFSM(&failures, 2)
+	events := []*swf.HistoryEvent{
+		&swf.HistoryEvent{EventType: S(swf.EventTypeDecisionTaskStarted), EventId: I(3)},
+		&swf.HistoryEvent{EventType: S(swf.EventTypeDecisionTaskScheduled), EventId: I(2)},
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+
+	// act
+	_, first, _, err := f.Tick(testDecisionTask(0, events))
+	assert.NoError(t, err)
+	signal := &swf.HistoryEvent{EventType: S(swf.EventTypeWorkflowExecutionSignaled), WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("poke")}}
+	second := append(append([]*swf.HistoryEvent{signal}, markerEvents(first)...), events...)
+	_, decisions, state, err := f.Tick(testDecisionTask(3, second))
+
+	// assert
+	assert.NoError(t, err)
+	assert.True(t, Find(first, errorMarkerPredicate), "Expected the first failure to leave the workflow in error")
+	assert.False(t, Find(decisions, errorMarkerPredicate), "Expected the retry to recover the workflow")
+	assert.Equal(t, "started", state.StateName)
+}
+
+func TestRetryThenFailWhenRetriesExhaustedExpectsGiveup(t *testing.T) {
+	// arrange
+	failures := 3
+	f := retryThenFailFSM(&failures, 1)
+	events := []*swf.HistoryEvent{
+		&swf.HistoryEvent{EventType: S(swf.EventTypeDecisionTaskStarted), EventId: I(3)},
+		&swf.HistoryEvent{EventType: S(swf.EventTypeDecisionTaskScheduled), EventId: I(2)},
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+
+	// act
+	_, first, _, err := f.Tick(testDecisionTask(0, events))
+	assert.NoError(t, err)
+	signal := &swf.HistoryEvent{EventType: S(swf.EventTypeWorkflowExecutionSignaled), WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("poke")}}
+	second := append(append([]*swf.HistoryEvent{signal}, markerEvents(first)...), events...)
+	_, decisions, _, err := f.Tick(testDecisionTask(3, second))
+
+	// assert
+	assert.NoError(t, err)
+	assert.False(t, Find(decisions, errorMarkerPredicate), "Expected the handler to give up")
+	assert.True(t, Find(decisions, func(d *swf.Decision) bool {
+		return *d.DecisionType == swf.DecisionTypeFailWorkflowExecution
+	}), "Expected the workflow to be failed")
+	assert.Equal(t, 1, failures, "Expected one retry")
+}
+
+func TestRetryAttempts(t *testing.T) {
+	// arrange
+	failures := 1
+	f := retryThenFailFSM(&failures, 2)
+	events := []*swf.HistoryEvent{
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+
+	// act
+	_, decisions, _, _ := f.Tick(testDecisionTask(0, events))
+	errorState := &SerializedErrorState{}
+	if marker := FindDecision(decisions, errorMarkerPredicate); assert.NotNil(t, marker) {
+		f.SystemSerializer.Deserialize(*marker.RecordMarkerDecisionAttributes.Details, errorState)
+	}
+
+	// assert
+	assert.Equal(t, 1, RetryAttempts(errorState))
+	assert.Equal(t, 0, RetryAttempts(&SerializedErrorState{Details: "retry-attempts=3 error=BOOM"}), "Expected the details not parsed")
+}
+
+func TestErrorStateTickWhenHandlerDoesNotRecoverExpectsErrorMarkerKept(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.AllowPanics = false
+	f.AddInitialStateWithHandler(&FSMState{
+		Name: "start",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			if *h.EventType == swf.EventTypeWorkflowExecutionStarted {
+				panic("BOOM")
+			}
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	}, func(ctx *FSMContext, h *swf.HistoryEvent, stateBeforeEvent interface{}, stateAfterError interface{}, err error) (*Outcome, error) {
+		return nil, errors.New("still-broken")
+	})
+	f.Init()
+	events := []*swf.HistoryEvent{
+		&swf.HistoryEvent{EventType: S(swf.EventTypeDecisionTaskStarted), EventId: I(3)},
+		&swf.HistoryEvent{EventType: S(swf.EventTypeDecisionTaskScheduled), EventId: I(2)},
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+
+	// act
+	_, first, _, err := f.Tick(testDecisionTask(0, events))
+	assert.NoError(t, err)
+	signal := &swf.HistoryEvent{EventType: S(swf.EventTypeWorkflowExecutionSignaled), WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("poke")}}
+	second := append(append([]*swf.HistoryEvent{signal}, markerEvents(first)...), events...)
+	secondTask := testDecisionTask(3, second)
+	_, decisions, _, err := f.Tick(secondTask)
+
+	// assert
+	assert.NoError(t, err)
+	errorState := &SerializedErrorState{}
+	if marker := FindDecision(decisions, errorMarkerPredicate); assert.NotNil(t, marker, "Expected the workflow kept in error") {
+		f.SystemSerializer.Deserialize(*marker.RecordMarkerDecisionAttributes.Details, errorState)
+	}
+	assert.Equal(t, "still-broken", errorState.Details)
+	assert.Equal(t, *secondTask.StartedEventId, errorState.LatestUnprocessedEventId, "Expected the unprocessed window bumped")
+}
+
+func TestErrorStateTickWhenHandlerRecoversExpectsUnprocessedEventsDecidedWithoutErrorMarkers(t *testing.T) {
+	// arrange
+	f := testFSM()
+	var decided []string
+	f.AddInitialStateWithHandler(&FSMState{
+		Name: "start",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			decided = append(decided, *h.WorkflowExecutionSignaledEventAttributes.SignalName)
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	}, func(ctx *FSMContext, h *swf.HistoryEvent, stateBeforeEvent interface{}, stateAfterError interface{}, err error) (*Outcome, error) {
+		return &Outcome{State: ctx.State, Data: stateBeforeEvent}, nil
+	})
+	f.Init()
+	signal := func(eventId int, name string) *swf.HistoryEvent {
+		e := testHistoryEvent(eventId, swf.EventTypeWorkflowExecutionSignaled)
+		e.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S(name)}
+		return e
+	}
+	errorMarker := testHistoryEvent(4, swf.EventTypeMarkerRecorded)
+	errorMarker.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(ErrorMarker), Details: S("{}")}
+	failed := signal(2, "failed")
+	decisionTask := testDecisionTask(3, []*swf.HistoryEvent{signal(6, "new"), signal(5, "unprocessed"), errorMarker, failed, signal(1, "decided")})
+	errorState := &SerializedErrorState{ErrorEvent: failed, EarliestUnprocessedEventId: 2, LatestUnprocessedEventId: 5}
+	ctx := testContext(f)
+	ctx.State = "start"
+
+	// act
+	outcome, err := f.ErrorStateTick(decisionTask, errorState, ctx, new(TestData))
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, "start", outcome.State)
+	assert.Equal(t, []string{"failed", "unprocessed"}, decided, "Expected the events from the ErrorEvent to the LatestUnprocessedEventId decided, without the error marker")
+}
+
+func TestFindLastEventsExpectsErrorMarkersPassedToDeciders(t *testing.T) {
+	// arrange
+	f := testFSM()
+	errorMarker := testHistoryEvent(2, swf.EventTypeMarkerRecorded)
+	errorMarker.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(ErrorMarker), Details: S("{}")}
+	stateMarker := testHistoryEvent(1, swf.EventTypeMarkerRecorded)
+	stateMarker.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S("{}")}
+
+	// act
+	lastEvents := f.findLastEvents(0, []*swf.HistoryEvent{errorMarker, stateMarker})
+
+	// assert
+	assert.Equal(t, []*swf.HistoryEvent{errorMarker}, lastEvents, "Expected error markers decided like other markers, and state markers not")
+}
+
+func TestTickExpectsEnteredAtStampedOnlyWhenStateChanges(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.AddInitialState(&FSMState{
+		Name: "start",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			if *h.WorkflowExecutionSignaledEventAttributes.SignalName == "go" {
+				return ctx.Goto("signaled", data, ctx.EmptyDecisions())
+			}
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.AddState(&FSMState{
+		Name: "signaled",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+	enteredAt := time.Unix(1500000000, 0).UTC()
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "start", StateData: "{}", WorkflowId: "test-workflow-1", EnteredAt: &enteredAt})
+	tickWith := func(signalName string) *SerializedState {
+		signal := testHistoryEvent(6, swf.EventTypeWorkflowExecutionSignaled)
+		signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S(signalName)}
+		state := testHistoryEvent(4, swf.EventTypeMarkerRecorded)
+		state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+		decisionTask := testDecisionTask(5, []*swf.HistoryEvent{signal, testHistoryEvent(5, swf.EventTypeDecisionTaskStarted), state})
+		decisionTask.Events[0].EventTimestamp = aws.Time(enteredAt.Add(time.Hour))
+		_, _, next, err := f.Tick(decisionTask)
+		assert.NoError(t, err)
+		return next
+	}
+
+	// act
+	stayed := tickWith("noop")
+	changed := tickWith("go")
+
+	// assert
+	assert.Equal(t, "start", stayed.StateName)
+	assert.Equal(t, enteredAt, *stayed.EnteredAt, "Expected EnteredAt to be kept while the state is unchanged")
+	assert.Equal(t, "signaled", changed.StateName)
+	assert.Equal(t, enteredAt.Add(time.Hour), *changed.EnteredAt, "Expected EnteredAt to be the time of the decision task that changed the state")
+}
+
+func TestTickWithEventDecidersExpectsDispatchByEventTypeAndFallback(t *testing.T) {
+	// arrange
+	f := testFSM()
+	var decided []string
+	f.AddInitialState(&FSMState{
+		Name: "start",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			decided = append(decided, "fallback:"+*h.EventType)
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+		EventDeciders: map[string]Decider{
+			swf.EventTypeWorkflowExecutionSignaled: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+				decided = append(decided, "signaled:"+*h.WorkflowExecutionSignaledEventAttributes.SignalName)
+				return ctx.Stay(data, ctx.EmptyDecisions())
+			},
+		},
+	})
+	f.Init()
+
+	signal := testHistoryEvent(2, swf.EventTypeWorkflowExecutionSignaled)
+	signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("go")}
+	events := []*swf.HistoryEvent{
+		signal,
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+
+	// act
+	_, _, _, err := f.Tick(testDecisionTask(0, events))
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"fallback:" + swf.EventTypeWorkflowExecutionStarted, "signaled:go"}, decided)
+}
+
+func TestFSMStateDecideWithoutDeciderExpectsUnlistedEventsToStay(t *testing.T) {
+	// arrange
+	f := testFSM()
+	only := &FSMState{
+		Name: "only",
+		EventDeciders: map[string]Decider{
+			swf.EventTypeWorkflowExecutionSignaled: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+				return ctx.Goto("signaled", data, nil)
+			},
+		},
+	}
+	f.AddInitialState(only)
+	f.AddSubMachine("sub", []*FSMState{{Name: "only", EventDeciders: only.EventDeciders}})
+	ctx := testContext(f)
+	ctx.State = "only"
+	data := &TestData{}
+
+	// act
+	outcome := only.decide(ctx, testHistoryEvent(2, swf.EventTypeTimerFired), data)
+	sub := f.states[SubMachineState("sub", "only")].decide(ctx, testHistoryEvent(2, swf.EventTypeTimerFired), data)
+
+	// assert
+	assert.Equal(t, "only", outcome.State, "Expected an unlisted event to stay in the state")
+	assert.Equal(t, data, outcome.Data)
+	assert.Equal(t, "only", sub.State, "Expected a sub machine state without a Decider to stay too")
+}
+
+func TestTickWithOnEnterAndOnExitExpectsHooksCalledOnTransition(t *testing.T) {
+	// arrange
+	f := testFSM()
+	var hooks []string
+	f.AddInitialState(&FSMState{
+		Name: "start",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			if *h.EventType == swf.EventTypeWorkflowExecutionSignaled {
+				return ctx.Goto("working", data, ctx.EmptyDecisions())
+			}
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+		OnEnter: func(ctx *FSMContext, data interface{}) []*swf.Decision {
+			hooks = append(hooks, "enter:start")
+			return nil
+		},
+		OnExit: func(ctx *FSMContext, data interface{}) []*swf.Decision {
+			hooks = append(hooks, "exit:"+ctx.State)
+			return []*swf.Decision{ctx.CancelTimer("start-timer")}
+		},
+	})
+	f.AddState(&FSMState{
+		Name: "working",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+		OnEnter: func(ctx *FSMContext, data interface{}) []*swf.Decision {
+			hooks = append(hooks, "enter:"+ctx.State)
+			data.(*TestData).States = append(data.(*TestData).States, "entered")
+			return []*swf.Decision{ctx.StartTimer("working-timer", time.Minute, "")}
+		},
+	})
+	f.Init()
+
+	signal := func(id int) *swf.HistoryEvent {
+		e := testHistoryEvent(id, swf.EventTypeWorkflowExecutionSignaled)
+		e.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("go")}
+		return e
+	}
+	events := []*swf.HistoryEvent{
+		signal(3),
+		signal(2),
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+
+	// act
+	_, decisions, state, err := f.Tick(testDecisionTask(0, events))
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"exit:start", "enter:working"}, hooks, "Expected hooks called once, on the transition only")
+	assert.Equal(t, "working", state.StateName)
+	data := &TestData{}
+	f.Deserialize(state.StateData, data)
+	assert.Equal(t, []string{"entered"}, data.States, "Expected data updated by OnEnter")
+	var types []string
+	for _, d := range decisions {
+		types = append(types, *d.DecisionType)
+	}
+	assert.Contains(t, types, swf.DecisionTypeCancelTimer)
+	assert.Contains(t, types, swf.DecisionTypeStartTimer)
+}
+
+func TestTickWhenCodeVersionDiffersExpectsOnVersionMismatchRouting(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.CodeVersion = "v2"
+	var decided []string
+	decider := func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+		decided = append(decided, ctx.State+":"+*h.EventType)
+		return ctx.Stay(data, ctx.EmptyDecisions())
+	}
+	f.AddInitialState(&FSMState{Name: "initial", Decider: decider})
+	f.AddState(&FSMState{Name: "compat", Decider: decider})
+	var mismatched []string
+	f.OnVersionMismatch = func(ctx *FSMContext, state *SerializedState, data interface{}) *Outcome {
+		mismatched = append(mismatched, state.CodeVersion)
+		return &Outcome{State: "compat", Data: data}
+	}
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "initial", StateData: "{}", WorkflowId: "test-workflow-1", CodeVersion: "v1"})
+	marker := testHistoryEvent(2, swf.EventTypeMarkerRecorded)
+	marker.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	signal := testHistoryEvent(3, swf.EventTypeWorkflowExecutionSignaled)
+	signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("go")}
+	started := EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{Input: StartFSMWorkflowInput(f, new(TestData))})
+
+	// act
+	_, _, migrated, err := f.Tick(testDecisionTask(2, []*swf.HistoryEvent{signal, marker}))
+	_, _, fresh, freshErr := f.Tick(testDecisionTask(0, []*swf.HistoryEvent{started}))
+
+	// assert
+	assert.NoError(t, err)
+	assert.NoError(t, freshErr)
+	assert.Equal(t, []string{"v1"}, mismatched, "Expected the hook called for the recorded state only")
+	assert.Equal(t, []string{"compat:" + swf.EventTypeWorkflowExecutionSignaled, "initial:" + swf.EventTypeWorkflowExecutionStarted}, decided)
+	assert.Equal(t, "compat", migrated.StateName)
+	assert.Equal(t, "v2", migrated.CodeVersion, "Expected the state recorded with the FSM CodeVersion")
+	assert.Equal(t, "v2", fresh.CodeVersion)
+}
+
+func TestWorkflowInputExpectsStartDataUnwrapped(t *testing.T) {
+	// arrange
+	f := testFSM()
+	var inputs []*TestData
+	var errs []error
+	f.AddInitialState(&FSMState{
+		Name: "initial",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			input := &TestData{}
+			err := ctx.WorkflowInput(input)
+			inputs = append(inputs, input)
+			errs = append(errs, err)
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+
+	started := EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+		Input: StartFSMWorkflowInput(f, &TestData{States: []string{"started"}}),
+	})
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "initial", StateData: "{}", WorkflowId: "test-workflow-1"})
+	marker := testHistoryEvent(4, swf.EventTypeMarkerRecorded)
+	marker.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	signal := testHistoryEvent(6, swf.EventTypeWorkflowExecutionSignaled)
+	signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("go")}
+
+	// act
+	f.Tick(testDecisionTask(0, []*swf.HistoryEvent{started}))
+	f.Tick(testDecisionTask(4, []*swf.HistoryEvent{signal, marker}))
+
+	// assert
+	if assert.Len(t, errs, 2) {
+		assert.NoError(t, errs[0])
+		assert.Equal(t, []string{"started"}, inputs[0].States, "Expected the data of the start input")
+		assert.Error(t, errs[1], "Expected an error without the start event")
+	}
+	assert.Error(t, (&FSMContext{}).WorkflowInput(&TestData{}), "Expected an error outside of a Tick")
+}
+
+func TestParseStartInputWhenExternallyBuiltExpectsInitialStateAndData(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.AddInitialState(&FSMState{Name: "start"})
+	external := `{"stateData":"{\"States\":[\"external\"]}"}`
+
+	// act
+	state, err := ParseStartInput(f, external)
+	roundTrip, roundTripErr := ParseStartInput(f, BuildStartInput(f, &TestData{States: []string{"built"}}))
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, "start", state.StateName, "Expected an empty state name to default to the initial state")
+	data := &TestData{}
+	f.Deserialize(state.StateData, data)
+	assert.Equal(t, []string{"external"}, data.States)
+	assert.NoError(t, roundTripErr)
+	built := &TestData{}
+	f.Deserialize(roundTrip.StateData, built)
+	assert.Equal(t, []string{"built"}, built.States)
+}
+
+func TestAddSubMachineExpectsNamespacedStatesAndTransitions(t *testing.T) {
+	// arrange
+	f := testFSM()
+	payment := []*FSMState{
+		{
+			Name: "charge",
+			Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+				return ctx.Goto("confirm", data, nil)
+			},
+		},
+		{
+			Name: "confirm",
+			Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+				return ctx.Goto("shipping", data, nil)
+			},
+		},
+	}
+
+	// act
+	f.AddSubMachine("payment", payment)
+	ctx := testContext(f)
+	charged := f.states[SubMachineEntry("payment", payment)].Decider(ctx, &swf.HistoryEvent{}, nil)
+	confirmed := f.states[SubMachineState("payment", "confirm")].Decider(ctx, &swf.HistoryEvent{}, nil)
+
+	// assert
+	assert.Equal(t, "payment.charge", SubMachineEntry("payment", payment), "Expected the entry state to be the first namespaced state")
+	assert.Equal(t, "payment.confirm", charged.State, "Expected transitions within the sub machine to be namespaced")
+	assert.Equal(t, "shipping", confirmed.State, "Expected transitions out of the sub machine to route to the parent state")
+}
+
+func TestAddSubMachineExpectsHooksAndEventDecidersKept(t *testing.T) {
+	// arrange
+	f := testFSM()
+	var entered, exited []string
+	f.AddInitialState(&FSMState{
+		Name: "initial",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Goto("payment.charge", data, nil)
+		},
+	})
+	f.AddSubMachine("payment", []*FSMState{
+		{
+			Name: "charge",
+			Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+				return ctx.Stay(data, nil)
+			},
+			EventDeciders: map[string]Decider{
+				swf.EventTypeWorkflowExecutionSignaled: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+					return ctx.Goto("confirm", data, nil)
+				},
+			},
+			OnEnter: func(ctx *FSMContext, data interface{}) []*swf.Decision {
+				entered = append(entered, ctx.State)
+				return nil
+			},
+			OnExit: func(ctx *FSMContext, data interface{}) []*swf.Decision {
+				exited = append(exited, ctx.State)
+				return nil
+			},
+		},
+		{
+			Name: "confirm",
+			Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+				return ctx.Stay(data, nil)
+			},
+			OnEnter: func(ctx *FSMContext, data interface{}) []*swf.Decision {
+				entered = append(entered, ctx.State)
+				return nil
+			},
+		},
+	})
+	f.Init()
+
+	events := []*swf.HistoryEvent{
+		&swf.HistoryEvent{EventType: S(swf.EventTypeDecisionTaskStarted), EventId: I(4)},
+		EventFromPayload(3, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("charged")}),
+		&swf.HistoryEvent{EventType: S(swf.EventTypeDecisionTaskScheduled), EventId: I(2)},
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	}
+
+	// act
+	_, _, state, err := f.Tick(testDecisionTask(0, events))
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, "payment.confirm", state.StateName, "Expected the event decider kept and namespaced")
+	assert.Equal(t, []string{"payment.charge", "payment.confirm"}, entered, "Expected OnEnter kept with namespaced states")
+	assert.Equal(t, []string{"payment.charge"}, exited, "Expected OnExit kept with namespaced states")
+}
+
+//gzipStateSerializer is a StateSerializer that gzips the json serialization.
+type gzipStateSerializer struct{}
+
+func (gzipStateSerializer) Serialize(state interface{}) (string, error) {
+	serialized, err := JSONStateSerializer{}.Serialize(state)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(serialized)); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func (gzipStateSerializer) Deserialize(serialized string, state interface{}) error {
+	compressed, err := base64.StdEncoding.DecodeString(serialized)
+	if err != nil {
+		return err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return err
+	}
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return JSONStateSerializer{}.Deserialize(string(decompressed), state)
+}
+
+func TestTickWhenFSMsUseDifferentSerializersExpectsEachDecodesItsOwnMarkers(t *testing.T) {
+	// arrange
+	newFSM := func(serializer StateSerializer) *FSM {
+		f := &FSM{Name: "test-fsm", DataType: TestData{}, Serializer: serializer, AllowPanics: false}
+		f.AddInitialState(&FSMState{
+			Name: "waiting",
+			Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+				return ctx.Stay(data, ctx.EmptyDecisions())
+			},
+		})
+		f.Init()
+		return f
+	}
+	//one poller routing decision tasks to the fsm of their workflow type.
+	routes := map[string]*FSM{
+		"json-workflow": newFSM(JSONStateSerializer{}),
+		"gzip-workflow": newFSM(gzipStateSerializer{}),
+	}
+	task := func(f *FSM, workflowType string) *swf.PollForDecisionTaskOutput {
+		data, _ := f.Serializer.Serialize(&TestData{States: []string{workflowType}})
+		state, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "waiting", StateData: data})
+		correlator := &EventCorrelator{}
+		correlator.Track(EventFromPayload(1, &swf.ActivityTaskScheduledEventAttributes{
+			ActivityId:   S("activity-1"),
+			ActivityType: &swf.ActivityType{Name: S("ship"), Version: S("1")},
+		}))
+		serializedCorrelator, _ := f.SystemSerializer.Serialize(correlator)
+		d := testDecisionTask(2, []*swf.HistoryEvent{
+			{EventType: S(swf.EventTypeWorkflowExecutionSignaled), WorkflowExecutionSignaledEventAttributes: &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("go")}},
+			{EventType: S(swf.EventTypeMarkerRecorded), MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{MarkerName: S(CorrelatorMarker), Details: S(serializedCorrelator)}},
+			{EventType: S(swf.EventTypeMarkerRecorded), MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(state)}},
+		})
+		d.WorkflowType = &swf.WorkflowType{Name: S(workflowType), Version: S("1")}
+		return d
+	}
+
+	for workflowType, f := range routes {
+		// act
+		ctx, _, state, err := f.Tick(task(f, workflowType))
+
+		// assert
+		if assert.NoError(t, err, workflowType) {
+			assert.Equal(t, "waiting", state.StateName, workflowType)
+			assert.Equal(t, "activity-1", ctx.ActivitiesInfo()["1"].ActivityId, "Expected the correlator to be decoded for %s", workflowType)
+			data := &TestData{}
+			f.Serializer.Deserialize(state.StateData, data)
+			assert.Equal(t, []string{workflowType}, data.States)
+		}
+	}
+}
+
+func TestTickWhenSerializersDifferExpectsStartInputAndMarkerDecodedAlike(t *testing.T) {
+	// arrange
+	f := &FSM{Name: "test-fsm", DataType: TestData{}, Serializer: gzipStateSerializer{}, SystemSerializer: JSONStateSerializer{}}
+	f.AddInitialState(&FSMState{
+		Name: "waiting",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			testData := data.(*TestData)
+			testData.States = append(testData.States, *h.EventType)
+			return ctx.Stay(testData, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+
+	startInput := StartFSMWorkflowInput(f, &TestData{States: []string{"started"}})
+	start := func(input *string) *swf.PollForDecisionTaskOutput {
+		return testDecisionTask(0, []*swf.HistoryEvent{
+			EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{Input: input, WorkflowType: testWorkflowType}),
+		})
+	}
+	legacyStartInput, _ := f.Serializer.Serialize(&SerializedState{StateData: f.Serialize(&TestData{States: []string{"legacy"}})})
+
+	// act
+	_, _, fromStart, startErr := f.Tick(start(startInput))
+	_, _, fromLegacyStart, legacyErr := f.Tick(start(S(legacyStartInput)))
+	envelope := &SerializedState{}
+	envelopeErr := f.SystemSerializer.Deserialize(*startInput, envelope)
+	marker, _ := f.SystemSerializer.Serialize(fromStart)
+	_, _, fromMarker, markerErr := f.Tick(testDecisionTask(4, []*swf.HistoryEvent{
+		testHistoryEvent(5, swf.EventTypeWorkflowExecutionSignaled),
+		{EventId: I(3), EventType: S(swf.EventTypeMarkerRecorded), MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(marker)}},
+	}))
+
+	// assert
+	assert.NoError(t, envelopeErr, "Expected the start input envelope to be serialized with the SystemSerializer")
+	for _, tick := range []struct {
+		name   string
+		state  *SerializedState
+		err    error
+		states []string
+	}{
+		{"start", fromStart, startErr, []string{"started", swf.EventTypeWorkflowExecutionStarted}},
+		{"legacy start", fromLegacyStart, legacyErr, []string{"legacy", swf.EventTypeWorkflowExecutionStarted}},
+		{"marker", fromMarker, markerErr, []string{"started", swf.EventTypeWorkflowExecutionStarted, swf.EventTypeWorkflowExecutionSignaled}},
+	} {
+		if assert.NoError(t, tick.err, tick.name) {
+			assert.Equal(t, "waiting", tick.state.StateName, tick.name)
+			data := &TestData{}
+			f.Deserialize(tick.state.StateData, data)
+			assert.Equal(t, tick.states, data.States, tick.name)
+		}
+	}
+}
+
+func TestCancelAllInFlightAndThenExpectsCloseAfterActivitiesCanceled(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.AddInitialState(&FSMState{
+		Name: "working",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.CancelAllInFlightAndThen(ctx.CompleteWorkflow(data))
+		},
+	})
+	userDrainingDecided := false
+	f.AddState(&FSMState{
+		Name: "draining",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			userDrainingDecided = true
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+
+	correlator := &EventCorrelator{}
+	correlator.Track(EventFromPayload(1, &swf.ActivityTaskScheduledEventAttributes{
+		ActivityId:   S("activity-1"),
+		ActivityType: &swf.ActivityType{Name: S("ship"), Version: S("1")},
+	}))
+	serializedCorrelator, _ := f.SystemSerializer.Serialize(correlator)
+	correlatorMarker := &swf.HistoryEvent{EventType: S(swf.EventTypeMarkerRecorded), MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{MarkerName: S(CorrelatorMarker), Details: S(serializedCorrelator)}}
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "working", StateData: "{}", WorkflowId: "test-workflow-1"})
+	stateMarker := &swf.HistoryEvent{EventType: S(swf.EventTypeMarkerRecorded), MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}}
+	signal := testHistoryEvent(5, swf.EventTypeWorkflowExecutionSignaled)
+	signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("done")}
+
+	// act
+	_, draining, drainingState, drainingErr := f.Tick(testDecisionTask(3, []*swf.HistoryEvent{signal, correlatorMarker, stateMarker}))
+	drainingMarker := FindDecision(draining, stateMarkerPredicate)
+	canceled := EventFromPayload(9, &swf.ActivityTaskCanceledEventAttributes{ScheduledEventId: I(1)})
+	_, closing, closingState, closingErr := f.Tick(testDecisionTask(7, []*swf.HistoryEvent{
+		canceled,
+		{EventType: S(swf.EventTypeMarkerRecorded), MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{MarkerName: S(CorrelatorMarker), Details: S(serializedCorrelator)}},
+		{EventType: S(swf.EventTypeMarkerRecorded), MarkerRecordedEventAttributes: &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: drainingMarker.RecordMarkerDecisionAttributes.Details}},
+	}))
+
+	// assert
+	assert.NoError(t, drainingErr)
+	assert.Equal(t, DrainingState, drainingState.StateName)
+	if assert.NotNil(t, drainingState.PendingClose, "Expected the close to be pending") {
+		assert.Equal(t, CompleteState, drainingState.PendingClose.State)
+	}
+	cancel := FindDecision(draining, func(d *swf.Decision) bool { return *d.DecisionType == swf.DecisionTypeRequestCancelActivityTask })
+	if assert.NotNil(t, cancel, "Expected the in-flight activity to be canceled") {
+		assert.Equal(t, "activity-1", *cancel.RequestCancelActivityTaskDecisionAttributes.ActivityId)
+	}
+	assert.Nil(t, FindDecision(draining, func(d *swf.Decision) bool { return *d.DecisionType == swf.DecisionTypeCompleteWorkflowExecution }), "Expected the close to be deferred")
+
+	assert.NoError(t, closingErr)
+	assert.Equal(t, CompleteState, closingState.StateName)
+	assert.False(t, userDrainingDecided, "Expected a user state named draining never used")
+	assert.Nil(t, closingState.PendingClose)
+	assert.NotNil(t, FindDecision(closing, func(d *swf.Decision) bool { return *d.DecisionType == swf.DecisionTypeCompleteWorkflowExecution }), "Expected the close once the activity is canceled")
+}
+
+func TestTickWhenWorkflowAlreadyTerminalExpectsNoDecisions(t *testing.T) {
+	// arrange
+	f := testFSM()
+	decided := false
+	f.AddInitialState(&FSMState{
+		Name: "initial",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			decided = true
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "initial", StateData: "{}", WorkflowId: "test-workflow-1"})
+	signal := testHistoryEvent(5, swf.EventTypeWorkflowExecutionSignaled)
+	signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("noop")}
+	state := testHistoryEvent(2, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	decisionTask := testDecisionTask(3, []*swf.HistoryEvent{
+		testHistoryEvent(7, swf.EventTypeDecisionTaskStarted), testHistoryEvent(6, swf.EventTypeWorkflowExecutionTimedOut),
+		signal, testHistoryEvent(4, swf.EventTypeDecisionTaskCompleted), testHistoryEvent(3, swf.EventTypeDecisionTaskStarted), state,
+	})
+
+	// act
+	ctx, decisions, serialized, err := f.Tick(decisionTask)
+
+	// assert
+	assert.NoError(t, err)
+	assert.False(t, decided, "Expected no events decided for a timed out workflow")
+	assert.Empty(t, decisions, "Expected no decisions for a timed out workflow")
+	assert.Equal(t, "initial", serialized.StateName)
+	assert.True(t, ctx.WorkflowClosed(), "Expected the workflow reported closed")
+}
+
+func TestHandleDecisionTaskWhenWorkflowAlreadyTerminalExpectsNoRespondOrReplication(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.AddInitialState(f.DefaultCompleteState())
+	mockSWFAPI := &mocks.SWFAPI{}
+	f.SWF = mockSWFAPI
+	replicated := false
+	f.ReplicationHandler = func(*FSMContext, *swf.PollForDecisionTaskOutput, *swf.RespondDecisionTaskCompletedInput, *SerializedState) error {
+		replicated = true
+		return nil
+	}
+	handlerCalled := false
+	f.TaskErrorHandler = func(*swf.PollForDecisionTaskOutput, error) {
+		handlerCalled = true
+	}
+	f.Init()
+
+	decisionTask := testDecisionTask(0, []*swf.HistoryEvent{
+		&swf.HistoryEvent{EventType: S(swf.EventTypeDecisionTaskStarted), EventId: I(4)},
+		&swf.HistoryEvent{EventType: S(swf.EventTypeWorkflowExecutionTerminated), EventId: I(3)},
+		&swf.HistoryEvent{EventType: S(swf.EventTypeDecisionTaskScheduled), EventId: I(2)},
+		EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+			Input: StartFSMWorkflowInput(f, new(TestData)),
+		}),
+	})
+
+	// act
+	f.handleDecisionTask(decisionTask)
+
+	// assert
+	mockSWFAPI.AssertNotCalled(t, "RespondDecisionTaskCompleted", mock.Anything)
+	assert.False(t, replicated, "Expected no replication for a terminated workflow")
+	assert.False(t, handlerCalled, "Expected no task error for a terminated workflow")
+}
+
+func TestTickExpectsDecisionTaskOnContext(t *testing.T) {
+	// arrange
+	f := testFSM()
+	var seen *swf.PollForDecisionTaskOutput
+	f.AddInitialState(&FSMState{
+		Name: "initial",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			seen = ctx.DecisionTask()
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "initial", StateData: "{}", WorkflowId: "test-workflow-1"})
+	signal := testHistoryEvent(5, swf.EventTypeWorkflowExecutionSignaled)
+	signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("noop")}
+	state := testHistoryEvent(2, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	decisionTask := testDecisionTask(3, []*swf.HistoryEvent{
+		testHistoryEvent(6, swf.EventTypeDecisionTaskStarted), signal,
+		testHistoryEvent(4, swf.EventTypeDecisionTaskCompleted), testHistoryEvent(3, swf.EventTypeDecisionTaskStarted), state,
+	})
+
+	// act
+	_, _, _, err := f.Tick(decisionTask)
+
+	// assert
+	assert.NoError(t, err)
+	assert.True(t, seen == decisionTask, "Expected the decider to see the decision task being decided")
+	assert.Nil(t, (&FSMContext{}).DecisionTask(), "Expected no decision task outside of a Tick")
+}
+
+func TestIsFirstDecision(t *testing.T) {
+	// arrange
+	f := testFSM()
+	var first []bool
+	f.AddInitialState(&FSMState{
+		Name: "initial",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			first = append(first, ctx.IsFirstDecision())
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+	signal := func(id int) *swf.HistoryEvent {
+		e := testHistoryEvent(id, swf.EventTypeWorkflowExecutionSignaled)
+		e.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("noop")}
+		return e
+	}
+	start := testHistoryEvent(1, swf.EventTypeWorkflowExecutionStarted)
+	start.WorkflowExecutionStartedEventAttributes = &swf.WorkflowExecutionStartedEventAttributes{Input: StartFSMWorkflowInput(f, &TestData{})}
+
+	// act
+	_, _, state, err := f.Tick(testDecisionTask(0, []*swf.HistoryEvent{
+		testHistoryEvent(4, swf.EventTypeDecisionTaskStarted), testHistoryEvent(3, swf.EventTypeDecisionTaskScheduled), signal(2), start,
+	}))
+	assert.NoError(t, err)
+	serializedState, _ := f.SystemSerializer.Serialize(state)
+	marker := testHistoryEvent(5, swf.EventTypeMarkerRecorded)
+	marker.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	_, _, _, err = f.Tick(testDecisionTask(4, []*swf.HistoryEvent{
+		testHistoryEvent(8, swf.EventTypeDecisionTaskStarted), signal(7), testHistoryEvent(6, swf.EventTypeDecisionTaskCompleted), marker,
+	}))
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true, true, false}, first, "Expected the start and signal of the first decision task, then not the later signal")
+	assert.False(t, (&FSMContext{}).IsFirstDecision(), "Expected false outside of a Tick")
+}
+
+func TestTickWhenUnprocessedWindowExceedsMaxExpectsReportedWithoutReplay(t *testing.T) {
+	// arrange
+	f := testFSM()
+	f.AllowPanics = false
+	reporter := &recordingErrorReporter{}
+	f.FSMErrorReporter = reporter
+	recovered := false
+	f.AddInitialState(&FSMState{
+		Name: "initial",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.DecisionErrorHandler = func(ctx *FSMContext, h *swf.HistoryEvent, stashed, current interface{}, err error) (*Outcome, error) {
+		recovered = true
+		return &Outcome{State: "initial", Data: stashed}, nil
+	}
+	f.Init()
+
+	signal := testHistoryEvent(5, swf.EventTypeWorkflowExecutionSignaled)
+	signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("stuck")}
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "initial", StateData: "{}", WorkflowId: "test-workflow-1"})
+	state := testHistoryEvent(2, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	serializedError, _ := f.SystemSerializer.Serialize(&SerializedErrorState{ErrorEvent: signal, EarliestUnprocessedEventId: 4, LatestUnprocessedEventId: 6})
+	errorMarker := testHistoryEvent(8, swf.EventTypeMarkerRecorded)
+	errorMarker.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(ErrorMarker), Details: S(serializedError)}
+	decisionTask := func() *swf.PollForDecisionTaskOutput {
+		return testDecisionTask(14, []*swf.HistoryEvent{
+			testHistoryEvent(20, swf.EventTypeDecisionTaskStarted), testHistoryEvent(19, swf.EventTypeDecisionTaskScheduled),
+			errorMarker, testHistoryEvent(6, swf.EventTypeDecisionTaskStarted), signal, state,
+		})
+	}
+
+	// act
+	f.MaxUnprocessedWindow = 10
+	_, _, _, exceededErr := f.Tick(decisionTask())
+	f.MaxUnprocessedWindow = 16
+	_, _, _, withinErr := f.Tick(decisionTask())
+	logger := &CapturingLogger{}
+	f.Logger = logger
+	f.FSMErrorReporter = legacyErrorReporter{reporter}
+	f.MaxUnprocessedWindow = 10
+	_, _, _, legacyErr := f.Tick(decisionTask())
+
+	// assert
+	assert.Error(t, exceededErr, "Expected the tick to fail once the window of 16 events exceeds 10")
+	if assert.Len(t, reporter.windowExceeded, 1) {
+		assert.Equal(t, int64(5), *reporter.windowExceeded[0].ErrorEvent.EventId)
+	}
+	assert.NoError(t, withinErr)
+	assert.True(t, recovered, "Expected recovery attempted within the window")
+	assert.Len(t, reporter.windowExceeded, 1, "Expected no report within the window, nor to reporters without ErrorUnprocessedWindowExceeded")
+	assert.Error(t, legacyErr)
+	if assert.NotEmpty(t, logger.Lines) {
+		assert.Contains(t, logger.Lines[len(logger.Lines)-1], "at=unprocessed-window-exceeded", "Expected the FSM to log it for reporters without ErrorUnprocessedWindowExceeded")
+	}
+}
+
+// legacyErrorReporter only has the methods of FSMErrorReporter.
+type legacyErrorReporter struct {
+	FSMErrorReporter
+}
+
+func TestNowExpectsTimestampOfDecidedEvent(t *testing.T) {
+	// arrange
+	f := testFSM()
+	var now []time.Time
+	f.AddInitialState(&FSMState{
+		Name: "initial",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			now = append(now, ctx.Now())
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "initial", StateData: "{}", WorkflowId: "test-workflow-1"})
+	state := testHistoryEvent(2, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	signal := func(id int) *swf.HistoryEvent {
+		e := testHistoryEvent(id, swf.EventTypeWorkflowExecutionSignaled)
+		e.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("noop")}
+		return e
+	}
+	decisionTask := testDecisionTask(3, []*swf.HistoryEvent{
+		testHistoryEvent(7, swf.EventTypeDecisionTaskStarted), signal(6), signal(5),
+		testHistoryEvent(4, swf.EventTypeDecisionTaskCompleted), testHistoryEvent(3, swf.EventTypeDecisionTaskStarted), state,
+	})
+	for i, e := range decisionTask.Events {
+		e.EventTimestamp = aws.Time(time.Unix(int64(100-i), 0))
+	}
+
+	// act
+	_, _, _, err := f.Tick(decisionTask)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Time{time.Unix(98, 0), time.Unix(99, 0)}, now, "Expected the timestamp of each signal")
+	assert.WithinDuration(t, time.Now(), (&FSMContext{}).Now(), time.Minute, "Expected the clock outside of a Tick")
+}
+
+func TestStartWhenTaskListsSetExpectsPollerPerTaskList(t *testing.T) {
+	// arrange
+	jitter := poller.DefaultStartupJitter
+	poller.DefaultStartupJitter = 0
+	defer func() { poller.DefaultStartupJitter = jitter }()
+
+	f := testFSM()
+	f.TaskList = "tenant-a"
+	f.TaskLists = []string{"tenant-a", "tenant-b"}
+	f.AddInitialState(&FSMState{Name: "initial", Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+		return ctx.Stay(data, ctx.EmptyDecisions())
+	}})
+
+	var mu sync.Mutex
+	polled := make(map[string]bool)
+	mockSWFAPI := &mocks.SWFAPI{}
+	mockSWFAPI.MockOnAny_PollForDecisionTaskPages().Return(func(req *swf.PollForDecisionTaskInput, fn func(*swf.PollForDecisionTaskOutput, bool) bool) error {
+		mu.Lock()
+		polled[*req.TaskList.Name] = true
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		fn(&swf.PollForDecisionTaskOutput{}, true)
+		return nil
+	})
+	f.SWF = mockSWFAPI
+
+	// act
+	f.Start()
+	polledAll := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(polled) == 2
+	}
+	for deadline := time.Now().Add(5 * time.Second); !polledAll() && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	f.ShutdownManager.StopPollers()
+
+	// assert
+	assert.True(t, polledAll(), "Expected both task lists polled")
+	assert.Equal(t, []string{"tenant-a", "tenant-b"}, f.pollTaskLists(), "Expected the duplicate task list polled once")
+}
+
+func TestFindLastEventsExpectsNewestFirstWithMixedMarkerAndActivityEvents(t *testing.T) {
+	// arrange
+	f := testFSM()
+	var decided []int64
+	f.AddInitialState(&FSMState{
+		Name: "initial",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			decided = append(decided, *h.EventId)
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "initial", StateData: "{}", WorkflowId: "test-workflow-1"})
+	state := testHistoryEvent(2, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	userMarker := func(id int) *swf.HistoryEvent {
+		e := testHistoryEvent(id, swf.EventTypeMarkerRecorded)
+		e.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S("user-marker")}
+		return e
+	}
+	completed := testHistoryEvent(6, swf.EventTypeActivityTaskCompleted)
+	completed.ActivityTaskCompletedEventAttributes = &swf.ActivityTaskCompletedEventAttributes{ScheduledEventId: I(4)}
+	//out of order, as an EventTransformer may return them.
+	events := []*swf.HistoryEvent{
+		testHistoryEvent(8, swf.EventTypeDecisionTaskStarted), userMarker(5), completed, userMarker(7),
+		testHistoryEvent(3, swf.EventTypeDecisionTaskStarted), state,
+	}
+
+	// act
+	lastEvents := f.findLastEvents(3, events)
+	_, _, _, err := f.Tick(testDecisionTask(3, events))
+
+	// assert
+	var ids []int64
+	for _, e := range lastEvents {
+		ids = append(ids, *e.EventId)
+	}
+	assert.Equal(t, []int64{7, 6, 5}, ids, "Expected the events after prevStarted newest first")
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{5, 6, 7}, decided, "Expected the events decided oldest to newest")
+}
+
+func TestTickWhenEventFilterSetExpectsFilteredEventsNotDecided(t *testing.T) {
+	// arrange
+	f := testFSM()
+	var decided []int64
+	f.AddInitialState(&FSMState{
+		Name: "initial",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			decided = append(decided, *h.EventId)
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.EventFilter = func(e *swf.HistoryEvent) bool {
+		return e.MarkerRecordedEventAttributes == nil || *e.MarkerRecordedEventAttributes.MarkerName != "other-system"
+	}
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "initial", StateData: "{}", WorkflowId: "test-workflow-1"})
+	state := testHistoryEvent(2, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	marker := func(id int, name string) *swf.HistoryEvent {
+		e := testHistoryEvent(id, swf.EventTypeMarkerRecorded)
+		e.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(name)}
+		return e
+	}
+	signal := testHistoryEvent(5, swf.EventTypeWorkflowExecutionSignaled)
+	signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("noop")}
+
+	// act
+	_, _, _, err := f.Tick(testDecisionTask(3, []*swf.HistoryEvent{
+		testHistoryEvent(8, swf.EventTypeDecisionTaskStarted), marker(7, "user-marker"), marker(6, "other-system"), signal,
+		testHistoryEvent(4, swf.EventTypeDecisionTaskCompleted), testHistoryEvent(3, swf.EventTypeDecisionTaskStarted), state,
+	}))
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{5, 7}, decided, "Expected the other system's marker filtered out")
+}
+
+func TestTickWhenCorrelatorLargerThanCorrelatorSizeWarningExpectsStatsLogged(t *testing.T) {
+	// arrange
+	f := testFSM()
+	var out bytes.Buffer
+	f.Logger = log.New(&out, "", 0)
+	f.CorrelatorSizeWarning = 1
+	f.AddInitialState(&FSMState{
+		Name: "initial",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "initial", StateData: "{}", WorkflowId: "test-workflow-1"})
+	state := testHistoryEvent(2, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	decisionTask := testDecisionTask(3, []*swf.HistoryEvent{
+		testHistoryEvent(6, swf.EventTypeDecisionTaskStarted),
+		EventFromPayload(5, &swf.TimerStartedEventAttributes{TimerId: S("b"), StartToFireTimeout: S("10")}),
+		EventFromPayload(4, &swf.TimerStartedEventAttributes{TimerId: S("a"), StartToFireTimeout: S("10")}),
+		testHistoryEvent(3, swf.EventTypeDecisionTaskStarted), state,
+	})
+
+	// act
+	_, _, _, err := f.Tick(decisionTask)
+
+	// assert
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(out.String(), "at=correlator-size-warning threshold=1 activities=0"), "Expected the correlator stats logged")
+	assert.True(t, strings.Contains(out.String(), " timers=2 "), "Expected the tracked timers logged")
+}
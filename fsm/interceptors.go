@@ -1,7 +1,9 @@
 package fsm
 
 import (
+	"fmt"
 	"strconv"
+	"sync"
 
 	"math/rand"
 	"time"
@@ -146,6 +148,36 @@ func DedupeDecisions(decisionType string) DecisionInterceptor {
 	}
 }
 
+// DedupeScheduleActivityByActivityId returns an interceptor that executes after a decision and removes
+// any duplicate swf.DecisionTypeScheduleActivityTask decisions with the same ActivityId from the outcome,
+// which SWF would otherwise reject the whole decision task for.
+// Duplicates are removed from the beginning of the input list, so that
+// the last schedule decision for each ActivityId is the one that remains in the list.
+func DedupeScheduleActivityByActivityId() DecisionInterceptor {
+	return &FuncInterceptor{
+		AfterDecisionFn: func(decision *swf.PollForDecisionTaskOutput, ctx *FSMContext, outcome *Outcome) {
+			in := outcome.Decisions
+			out := []*swf.Decision{}
+			scheduled := make(map[string]bool)
+
+			// iterate backwards so we can grab the last decision
+			for i := len(in) - 1; i >= 0; i-- {
+				currentDecision := in[i]
+				if *currentDecision.DecisionType == swf.DecisionTypeScheduleActivityTask {
+					activityId := LS(currentDecision.ScheduleActivityTaskDecisionAttributes.ActivityId)
+					if scheduled[activityId] {
+						continue
+					}
+					scheduled[activityId] = true
+				}
+				// prepend
+				out = append([]*swf.Decision{currentDecision}, out...)
+			}
+			outcome.Decisions = out
+		},
+	}
+}
+
 // MoveWorkflowCloseDecisionsToEnd returns an interceptor that executes after a decision and moves
 // any workflow close decisions (complete, fail, cancel) to the end of an outcome's decision list.
 //
@@ -283,25 +315,7 @@ func ManagedContinuationsWithJitter(historySize int, maxSizeJitter int, workflow
 				})
 			}
 
-			//was the ContinueTimer fired?
-			continueTimerFired := false
-			for _, h := range decision.Events {
-				if *h.EventType == swf.EventTypeTimerFired {
-					if *h.TimerFiredEventAttributes.TimerId == ContinueTimer {
-						continueTimerFired = true
-					}
-				}
-			}
-
-			//was the ContinueSignal fired?
-			continueSignalFired := false
-			for _, h := range decision.Events {
-				if *h.EventType == swf.EventTypeWorkflowExecutionSignaled {
-					if *h.WorkflowExecutionSignaledEventAttributes.SignalName == ContinueSignal {
-						continueSignalFired = true
-					}
-				}
-			}
+			continueTimerFired, continueSignalFired := continueFired(decision)
 
 			eventCount := *decision.Events[0].EventId
 			historySizeExceeded := int64(historySize+rng.Intn(maxSizeJitter)) < eventCount
@@ -309,33 +323,79 @@ func ManagedContinuationsWithJitter(historySize int, maxSizeJitter int, workflow
 			//if we pass history size or if we see ContinuteTimer or ContinueSignal fired
 			if continueTimerFired || continueSignalFired || historySizeExceeded {
 				logf(ctx, "fn=managed-continuations at=attempt-continue continue-timer=%t continue-signal=%t history-size=%t", continueTimerFired, continueSignalFired, historySizeExceeded)
-				//if we can safely continue
-				decisions := len(outcome.Decisions)
-				activities := len(ctx.Correlator().Activities)
-				signals := len(ctx.Correlator().Signals)
-				children := len(ctx.Correlator().Children)
-				cancels := len(ctx.Correlator().Cancellations)
-				if decisions == 0 && activities == 0 && signals == 0 && children == 0 && cancels == 0 {
-					logf(ctx, "fn=managed-continuations at=able-to-continue action=add-continue-decision events=%d", eventCount)
-					outcome.Decisions = append(outcome.Decisions, ctx.ContinueWorkflowDecision(ctx.State, ctx.stateData)) //stateData safe?
-				} else {
-					//re-start the timer for timerRetrySecs
-					logf(ctx, "fn=managed-continuations at=unable-to-continue decisions=%d activities=%d signals=%d children=%d cancels=%d  events=%d action=start-continue-timer-retry", decisions, activities, signals, children, cancels, eventCount)
-					if continueTimerFired || !ctx.Correlator().TimerScheduled(ContinueTimer) {
-						outcome.Decisions = append(outcome.Decisions, &swf.Decision{
-							DecisionType: S(swf.DecisionTypeStartTimer),
-							StartTimerDecisionAttributes: &swf.StartTimerDecisionAttributes{
-								TimerId:            S(ContinueTimer),
-								StartToFireTimeout: S(strconv.Itoa(timerRetrySeconds)),
-							},
-						})
-					}
+				continueOrRetry("managed-continuations", ctx, outcome, continueTimerFired, timerRetrySeconds, eventCount)
+			}
+		},
+	}
+}
+
+// ContinueAtHistorySizeRetrySeconds is how long ContinueAtHistorySize waits to try again when it is unable to continue a workflow.
+var ContinueAtHistorySizeRetrySeconds = 60
+
+// ContinueAtHistorySize returns an interceptor that executes after a decision and continues the workflow as new in its current state
+// once its history has maxEvents events, to stay clear of the SWF limit on history size. When the workflow cannot be continued safely,
+// because the outcome has decisions or activities, signals, children or cancellations are in flight, the ContinueTimer is started
+// to try again after ContinueAtHistorySizeRetrySeconds, as ManagedContinuations does. Workflows being closed are not continued.
+func ContinueAtHistorySize(maxEvents int) DecisionInterceptor {
+	return &FuncInterceptor{
+		AfterDecisionFn: func(decision *swf.PollForDecisionTaskOutput, ctx *FSMContext, outcome *Outcome) {
+			for _, d := range outcome.Decisions {
+				if stringsContain(CloseDecisionTypes(), *d.DecisionType) || *d.DecisionType == swf.DecisionTypeContinueAsNewWorkflowExecution {
+					return
 				}
 			}
+
+			eventCount := *decision.Events[0].EventId
+			if eventCount < int64(maxEvents) {
+				return
+			}
+			continueTimerFired, _ := continueFired(decision)
+			logf(ctx, "fn=continue-at-history-size at=attempt-continue max-events=%d continue-timer=%t", maxEvents, continueTimerFired)
+			continueOrRetry("continue-at-history-size", ctx, outcome, continueTimerFired, ContinueAtHistorySizeRetrySeconds, eventCount)
 		},
 	}
 }
 
+// continueFired returns whether the ContinueTimer or the ContinueSignal fired in the decision task.
+func continueFired(decision *swf.PollForDecisionTaskOutput) (continueTimerFired bool, continueSignalFired bool) {
+	for _, h := range decision.Events {
+		if attrs := h.TimerFiredEventAttributes; *h.EventType == swf.EventTypeTimerFired && attrs != nil && LS(attrs.TimerId) == ContinueTimer {
+			continueTimerFired = true
+		}
+		if attrs := h.WorkflowExecutionSignaledEventAttributes; *h.EventType == swf.EventTypeWorkflowExecutionSignaled && attrs != nil && LS(attrs.SignalName) == ContinueSignal {
+			continueSignalFired = true
+		}
+	}
+	return
+}
+
+// continueOrRetry adds a ContinueAsNew decision to the outcome if the workflow can be continued safely,
+// otherwise it starts the ContinueTimer to try again after timerRetrySeconds, unless the timer is already running.
+func continueOrRetry(fn string, ctx *FSMContext, outcome *Outcome, continueTimerFired bool, timerRetrySeconds int, eventCount int64) {
+	//if we can safely continue
+	decisions := len(outcome.Decisions)
+	activities := len(ctx.Correlator().Activities)
+	signals := len(ctx.Correlator().Signals)
+	children := len(ctx.Correlator().Children)
+	cancels := len(ctx.Correlator().Cancellations)
+	if decisions == 0 && activities == 0 && signals == 0 && children == 0 && cancels == 0 {
+		logf(ctx, "fn=%s at=able-to-continue action=add-continue-decision events=%d", fn, eventCount)
+		outcome.Decisions = append(outcome.Decisions, ctx.ContinueWorkflowDecision(ctx.State, ctx.stateData)) //stateData safe?
+	} else {
+		//re-start the timer for timerRetrySecs
+		logf(ctx, "fn=%s at=unable-to-continue decisions=%d activities=%d signals=%d children=%d cancels=%d  events=%d action=start-continue-timer-retry", fn, decisions, activities, signals, children, cancels, eventCount)
+		if continueTimerFired || !ctx.Correlator().TimerScheduled(ContinueTimer) {
+			outcome.Decisions = append(outcome.Decisions, &swf.Decision{
+				DecisionType: S(swf.DecisionTypeStartTimer),
+				StartTimerDecisionAttributes: &swf.StartTimerDecisionAttributes{
+					TimerId:            S(ContinueTimer),
+					StartToFireTimeout: S(strconv.Itoa(timerRetrySeconds)),
+				},
+			})
+		}
+	}
+}
+
 func StartCancelInterceptor() DecisionInterceptor {
 	return &FuncInterceptor{
 		AfterDecisionFn: func(decision *swf.PollForDecisionTaskOutput, ctx *FSMContext, outcome *Outcome) {
@@ -442,6 +502,18 @@ func CloseDecisionTypes() []string {
 	}
 }
 
+// insertBeforeCloseDecisions returns the decisions with the inserted ones before the first workflow close decision,
+// which SWF requires to be last, or at the end if there is none.
+func insertBeforeCloseDecisions(decisions []*swf.Decision, inserted ...*swf.Decision) []*swf.Decision {
+	i := 0
+	for i < len(decisions) && !stringsContain(CloseDecisionTypes(), *decisions[i].DecisionType) {
+		i++
+	}
+	result := append([]*swf.Decision{}, decisions[:i]...)
+	result = append(result, inserted...)
+	return append(result, decisions[i:]...)
+}
+
 func CloseDecisionIncompatableDecisionTypes() []string {
 	return []string{
 		// TODO: flush out this list with other incompatible types
@@ -480,3 +552,228 @@ func CloseWorkflowRemoveIncompatibleDecisionInterceptor() DecisionInterceptor {
 		},
 	}
 }
+
+// LimitDecisions returns an interceptor that executes after a decision and drops decisions from
+// an outcome that has more than max decisions, since SWF rejects the whole decision task in that case.
+// Workflow close decisions and markers are kept in preference to other decisions, which are kept in order until max is reached.
+// Each dropped decision is logged.
+//
+// Note: the FSM records its state and correlator markers in addition to the decisions in the outcome,
+// so max should leave room for them.
+func LimitDecisions(max int) DecisionInterceptor {
+	return &FuncInterceptor{
+		AfterDecisionFn: func(decision *swf.PollForDecisionTaskOutput, ctx *FSMContext, outcome *Outcome) {
+			if len(outcome.Decisions) <= max {
+				return
+			}
+
+			keep := make([]bool, len(outcome.Decisions))
+			kept := 0
+			for i, d := range outcome.Decisions {
+				if kept < max && (stringsContain(CloseDecisionTypes(), *d.DecisionType) || *d.DecisionType == swf.DecisionTypeRecordMarker) {
+					keep[i] = true
+					kept++
+				}
+			}
+			for i := range outcome.Decisions {
+				if kept < max && !keep[i] {
+					keep[i] = true
+					kept++
+				}
+			}
+
+			var decisions []*swf.Decision
+			for i, d := range outcome.Decisions {
+				if !keep[i] {
+					logf(ctx, "fn=LimitDecisions at=drop max=%d decisions=%d decision=%s", max, len(outcome.Decisions), auditDecision(d))
+					continue
+				}
+				decisions = append(decisions, d)
+			}
+			outcome.Decisions = decisions
+		},
+	}
+}
+
+// LimitOpenActivities returns an interceptor that executes after a decision and drops ScheduleActivityTask decisions
+// that would take the number of open activities, those in ctx.ActivitiesInfo() not canceled by the outcome plus those scheduled
+// by it, over max. It is a safety valve for deciders that would otherwise schedule activities until they hit SWF limits.
+// Each dropped decision is logged, and reported to the FSMErrorReporter if it is a DroppedDecisionReporter.
+func LimitOpenActivities(max int) DecisionInterceptor {
+	return limitOpen("LimitOpenActivities", swf.DecisionTypeScheduleActivityTask, max, func(ctx *FSMContext, outcome *Outcome) int {
+		open := map[string]bool{}
+		for _, a := range ctx.ActivitiesInfo() {
+			open[a.ActivityId] = true
+		}
+		for _, d := range outcome.Decisions {
+			if *d.DecisionType == swf.DecisionTypeRequestCancelActivityTask {
+				delete(open, LS(d.RequestCancelActivityTaskDecisionAttributes.ActivityId))
+			}
+		}
+		return len(open)
+	})
+}
+
+// LimitOpenTimers returns an interceptor that executes after a decision and drops StartTimer decisions
+// that would take the number of open timers, those in ctx.TimersInfo() not canceled by the outcome plus those started by it, over max.
+// Each dropped decision is logged, and reported to the FSMErrorReporter if it is a DroppedDecisionReporter.
+func LimitOpenTimers(max int) DecisionInterceptor {
+	return limitOpen("LimitOpenTimers", swf.DecisionTypeStartTimer, max, func(ctx *FSMContext, outcome *Outcome) int {
+		open := map[string]bool{}
+		for _, t := range ctx.TimersInfo() {
+			open[t.TimerId] = true
+		}
+		for _, d := range outcome.Decisions {
+			if *d.DecisionType == swf.DecisionTypeCancelTimer {
+				delete(open, LS(d.CancelTimerDecisionAttributes.TimerId))
+			}
+		}
+		return len(open)
+	})
+}
+
+func limitOpen(fn string, decisionType string, max int, openFn func(ctx *FSMContext, outcome *Outcome) int) DecisionInterceptor {
+	return &FuncInterceptor{
+		AfterDecisionFn: func(decision *swf.PollForDecisionTaskOutput, ctx *FSMContext, outcome *Outcome) {
+			open := openFn(ctx, outcome)
+			var decisions []*swf.Decision
+			for _, d := range outcome.Decisions {
+				if *d.DecisionType == decisionType {
+					if open >= max {
+						logf(ctx, "fn=%s at=drop max=%d open=%d decision=%s", fn, max, open, auditDecision(d))
+						if reporter, ok := ctx.errorReporter.(DroppedDecisionReporter); ok {
+							reporter.ErrorDecisionDropped(decision, d, &ErrOpenLimitExceeded{Interceptor: fn, Max: max, Open: open})
+						}
+						continue
+					}
+					open++
+				}
+				decisions = append(decisions, d)
+			}
+			outcome.Decisions = decisions
+		},
+	}
+}
+
+// RecordTickDurationMaxAge is how long RecordTickDuration keeps the start time of a decision task that never reaches AfterDecision.
+var RecordTickDurationMaxAge = time.Hour
+
+// RecordTickDuration returns an interceptor that records a marker named markerName with the time the decision task took
+// to process, from BeforeTask to AfterDecision, and the resulting state, e.g. "elapsed-ms=12 state=working".
+// The marker is added before any workflow close decision, which SWF requires to be last. The markerName must not be one
+// of the markers recorded by the FSM, which are used to find its state in history, and it panics if it is.
+//
+// Decision tasks that end without AfterDecision, e.g. on decider errors or deferrals, are not recorded, and their start
+// times are dropped once older than RecordTickDurationMaxAge.
+//
+// Note: it should be the last interceptor composed, so that the time spent in other interceptors is included.
+func RecordTickDuration(markerName string) DecisionInterceptor {
+	switch markerName {
+	case StateMarker, CorrelatorMarker, ErrorMarker, DeferMarker, FailureMarker:
+		panic(fmt.Sprintf("RecordTickDuration marker name %s is recorded by the FSM", markerName))
+	}
+
+	var mu sync.Mutex
+	started := make(map[string]time.Time) // taskToken -> start of the task
+	return &FuncInterceptor{
+		BeforeTaskFn: func(decision *swf.PollForDecisionTaskOutput) {
+			mu.Lock()
+			defer mu.Unlock()
+			now := time.Now()
+			for token, start := range started {
+				if now.Sub(start) > RecordTickDurationMaxAge {
+					delete(started, token)
+				}
+			}
+			started[LS(decision.TaskToken)] = now
+		},
+		AfterDecisionFn: func(decision *swf.PollForDecisionTaskOutput, ctx *FSMContext, outcome *Outcome) {
+			mu.Lock()
+			start, ok := started[LS(decision.TaskToken)]
+			delete(started, LS(decision.TaskToken))
+			mu.Unlock()
+			if !ok {
+				return
+			}
+
+			marker := &swf.Decision{
+				DecisionType: S(swf.DecisionTypeRecordMarker),
+				RecordMarkerDecisionAttributes: &swf.RecordMarkerDecisionAttributes{
+					MarkerName: S(markerName),
+					Details:    S(fmt.Sprintf("elapsed-ms=%d state=%s", time.Since(start)/time.Millisecond, outcome.State)),
+				},
+			}
+			outcome.Decisions = insertBeforeCloseDecisions(outcome.Decisions, marker)
+		},
+	}
+}
+
+// StampControl returns an interceptor that executes after a decision and sets the Control of the
+// ScheduleActivityTask, StartTimer and StartChildWorkflowExecution decisions in the outcome to the result of fn,
+// e.g. to carry a trace id through the workflow. Decisions that already have a Control are left as is,
+// and nothing is stamped when fn returns an empty string. A logical key stamped by SetActivityLogicalKey is not
+// a Control of the caller, so the Control is stamped after it, see ActivityControl.
+func StampControl(fn func(*FSMContext) string) DecisionInterceptor {
+	return &FuncInterceptor{
+		AfterDecisionFn: func(decision *swf.PollForDecisionTaskOutput, ctx *FSMContext, outcome *Outcome) {
+			control := fn(ctx)
+			if control == "" {
+				return
+			}
+			stamp := func(c **string) {
+				if *c == nil || **c == "" {
+					*c = S(control)
+				}
+			}
+			for _, d := range outcome.Decisions {
+				switch *d.DecisionType {
+				case swf.DecisionTypeScheduleActivityTask:
+					attrs := d.ScheduleActivityTaskDecisionAttributes
+					if ActivityControl(attrs.Control) == "" {
+						attrs.Control = S(withLogicalKey(logicalKey(attrs.Control), control))
+					}
+				case swf.DecisionTypeStartTimer:
+					stamp(&d.StartTimerDecisionAttributes.Control)
+				case swf.DecisionTypeStartChildWorkflowExecution:
+					stamp(&d.StartChildWorkflowExecutionDecisionAttributes.Control)
+				}
+			}
+		},
+	}
+}
+
+// AssertMonotonicStateVersion returns an interceptor that executes after a decision and checks that any state marker
+// in the outcome, e.g. recorded by a decider or by an earlier interceptor, has the StateVersion of the current state plus one,
+// as the state marker recorded by the FSM does. A marker with any other version is reported as an ErrNonMonotonicStateVersion
+// to the FSMErrorReporter, see StateVersionReporter, or panics when the FSM AllowPanics. Place it last when composing interceptors.
+func AssertMonotonicStateVersion() DecisionInterceptor {
+	return &FuncInterceptor{
+		AfterDecisionFn: func(decision *swf.PollForDecisionTaskOutput, ctx *FSMContext, outcome *Outcome) {
+			expected := ctx.stateVersion + 1
+			for _, d := range outcome.Decisions {
+				if *d.DecisionType != swf.DecisionTypeRecordMarker || LS(d.RecordMarkerDecisionAttributes.MarkerName) != StateMarker {
+					continue
+				}
+				state := &SerializedState{}
+				err := ctx.SystemStateSerializer().Deserialize(LS(d.RecordMarkerDecisionAttributes.Details), state)
+				if err == nil && state.StateVersion == expected {
+					continue
+				}
+				var versionErr *ErrNonMonotonicStateVersion
+				if err == nil {
+					versionErr = &ErrNonMonotonicStateVersion{Version: state.StateVersion, Expected: expected}
+					err = versionErr
+				}
+				logf(ctx, "at=non-monotonic-state-version error=%q", err)
+				if reporter, ok := ctx.errorReporter.(StateVersionReporter); ok && versionErr != nil {
+					reporter.ErrorNonMonotonicStateVersion(decision, *outcome, versionErr)
+				} else if ctx.errorReporter != nil {
+					ctx.errorReporter.ErrorSerializingStateData(decision, *outcome, *ctx.eventCorrelator, err)
+				}
+				if ctx.allowPanics {
+					panic(err)
+				}
+			}
+		},
+	}
+}
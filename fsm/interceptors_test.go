@@ -2,6 +2,7 @@ package fsm
 
 import (
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/swf"
 	"github.com/stretchr/testify/assert"
@@ -295,6 +296,41 @@ func TestManagedContinuationsInterceptor(t *testing.T) {
 
 }
 
+func TestContinueAtHistorySizeExpectsContinueOnceSafe(t *testing.T) {
+	// arrange
+	interceptor := ContinueAtHistorySize(10)
+	task := func(eventId int64) *swf.PollForDecisionTaskOutput {
+		return &swf.PollForDecisionTaskOutput{
+			Events:                 []*swf.HistoryEvent{{EventId: L(eventId), EventType: S(swf.EventTypeWorkflowExecutionSignaled)}},
+			PreviousStartedEventId: L(eventId - 1),
+		}
+	}
+	ctx := interceptorTestContext()
+	ctx.eventCorrelator.checkInit()
+	ctx.eventCorrelator.Activities["1"] = &ActivityInfo{}
+
+	// act
+	under := &Outcome{State: "state", Data: "data"}
+	interceptor.AfterDecision(task(9), ctx, under)
+	pending := &Outcome{State: "state", Data: "data"}
+	interceptor.AfterDecision(task(10), ctx, pending)
+	delete(ctx.eventCorrelator.Activities, "1")
+	safe := &Outcome{State: "state", Data: "data"}
+	interceptor.AfterDecision(task(11), ctx, safe)
+	closing := &Outcome{State: "state", Data: "data", Decisions: []*swf.Decision{completeDecision()}}
+	interceptor.AfterDecision(task(12), ctx, closing)
+
+	// assert
+	assert.Empty(t, under.Decisions, "Expected no continue under the history size")
+	if assert.Len(t, pending.Decisions, 1) {
+		assert.Equal(t, ContinueTimer, *pending.Decisions[0].StartTimerDecisionAttributes.TimerId, "Expected a retry with activities in flight")
+	}
+	if assert.Len(t, safe.Decisions, 1) {
+		assert.Equal(t, swf.DecisionTypeContinueAsNewWorkflowExecution, *safe.Decisions[0].DecisionType)
+	}
+	assert.Len(t, closing.Decisions, 1, "Expected closing workflows not continued")
+}
+
 func TestWorkflowStartCancel(t *testing.T) {
 	ctx := interceptorTestContext()
 
@@ -674,6 +710,32 @@ func TestDedupeDecisionsExpectsLastDuplicateToRemain(t *testing.T) {
 		outcome.Decisions, "Expected outcome decisions to match the expected list of decisions that have 'completes' deduped.")
 }
 
+func TestDedupeScheduleActivityByActivityIdExpectsLastScheduleOfEachIdToRemain(t *testing.T) {
+	// arrange
+	schedule := func(activityId, input string) *swf.Decision {
+		return &swf.Decision{
+			DecisionType: S(swf.DecisionTypeScheduleActivityTask),
+			ScheduleActivityTaskDecisionAttributes: &swf.ScheduleActivityTaskDecisionAttributes{
+				ActivityId: S(activityId),
+				Input:      S(input),
+			},
+		}
+	}
+	outcome := &Outcome{
+		State:     "state",
+		Data:      "data",
+		Decisions: []*swf.Decision{schedule("a", "1"), schedule("b", "1"), schedule("a", "2"), completeDecision()},
+	}
+	interceptor := NewComposedDecisionInterceptor(DedupeScheduleActivityByActivityId(), MoveWorkflowCloseDecisionsToEnd())
+
+	// act
+	interceptor.AfterDecision(nil, interceptorTestContext(), outcome)
+
+	// assert
+	assert.Equal(t, []*swf.Decision{schedule("b", "1"), schedule("a", "2"), completeDecision()},
+		outcome.Decisions, "Expected the last schedule decision of each activity id to remain, in order")
+}
+
 func TestDedupeWorkflowCloseDecisionsExpectsDuplicatesRemoved(t *testing.T) {
 	// arrange
 	outcome := &Outcome{
@@ -816,6 +878,87 @@ func TestCloseWorkflowRemoveIncompatibleDecisionInterceptor(t *testing.T) {
 	assert.Len(t, outcome.Decisions, 1, "Expected outcome to only have 1 decision because incompatables were removed")
 }
 
+func TestLimitDecisionsExpectsCloseDecisionsKeptAndOthersDropped(t *testing.T) {
+	// arrange
+	outcome := &Outcome{
+		State:     "state",
+		Data:      "data",
+		Decisions: []*swf.Decision{timerDecision(), scheduleActivityDecision(), timerDecision(), completeDecision()},
+	}
+	interceptor := LimitDecisions(2)
+
+	// act
+	interceptor.AfterDecision(nil, interceptorTestContext(), outcome)
+
+	// assert
+	assert.Equal(t, []*swf.Decision{timerDecision(), completeDecision()},
+		outcome.Decisions, "Expected the close decision and the first other decision to be kept in order")
+}
+
+func TestLimitOpenActivitiesExpectsSchedulesOverMaxDropped(t *testing.T) {
+	// arrange
+	ctx := interceptorTestContext()
+	ctx.eventCorrelator.Track(EventFromPayload(5, &swf.ActivityTaskScheduledEventAttributes{ActivityId: S("open"), ActivityType: &swf.ActivityType{Name: S("a"), Version: S("1")}}))
+	schedule := func(id string) *swf.Decision {
+		return &swf.Decision{
+			DecisionType:                           S(swf.DecisionTypeScheduleActivityTask),
+			ScheduleActivityTaskDecisionAttributes: &swf.ScheduleActivityTaskDecisionAttributes{ActivityId: S(id)},
+		}
+	}
+	outcome := &Outcome{Decisions: []*swf.Decision{schedule("first"), timerDecision(), schedule("second"), completeDecision()}}
+
+	// act
+	LimitOpenActivities(2).AfterDecision(nil, ctx, outcome)
+
+	// assert
+	assert.Equal(t, []*swf.Decision{schedule("first"), timerDecision(), completeDecision()}, outcome.Decisions,
+		"Expected only one more activity scheduled alongside the open one")
+}
+
+func TestLimitOpenActivitiesExpectsCanceledActivitiesNotCountedAndDropsReported(t *testing.T) {
+	// arrange
+	reporter := &recordingErrorReporter{}
+	ctx := interceptorTestContext()
+	ctx.errorReporter = reporter
+	ctx.eventCorrelator.Track(EventFromPayload(5, &swf.ActivityTaskScheduledEventAttributes{ActivityId: S("open"), ActivityType: &swf.ActivityType{Name: S("a"), Version: S("1")}}))
+	cancel := &swf.Decision{
+		DecisionType: S(swf.DecisionTypeRequestCancelActivityTask),
+		RequestCancelActivityTaskDecisionAttributes: &swf.RequestCancelActivityTaskDecisionAttributes{ActivityId: S("open")},
+	}
+	replaced := &Outcome{Decisions: []*swf.Decision{cancel, scheduleActivityDecision()}}
+	over := &Outcome{Decisions: []*swf.Decision{scheduleActivityDecision()}}
+
+	// act
+	LimitOpenActivities(1).AfterDecision(nil, ctx, replaced)
+	LimitOpenActivities(1).AfterDecision(nil, ctx, over)
+
+	// assert
+	assert.Equal(t, []*swf.Decision{cancel, scheduleActivityDecision()}, replaced.Decisions, "Expected a canceled activity not counted")
+	assert.Empty(t, over.Decisions, "Expected the activity over max dropped")
+	if assert.Len(t, reporter.dropped, 1, "Expected the dropped decision reported") {
+		assert.Equal(t, &ErrOpenLimitExceeded{Interceptor: "LimitOpenActivities", Max: 1, Open: 1}, reporter.dropped[0])
+	}
+}
+
+func TestLimitOpenTimersExpectsCanceledTimersNotCounted(t *testing.T) {
+	// arrange
+	ctx := interceptorTestContext()
+	ctx.eventCorrelator.Track(EventFromPayload(5, &swf.TimerStartedEventAttributes{TimerId: S("baz"), StartToFireTimeout: S("10")}))
+	start := func(id string) *swf.Decision {
+		return ctx.StartTimer(id, time.Second, "")
+	}
+	reset := &Outcome{Decisions: []*swf.Decision{ctx.CancelTimer("baz"), start("baz")}}
+	more := &Outcome{Decisions: []*swf.Decision{start("qux"), scheduleActivityDecision()}}
+
+	// act
+	LimitOpenTimers(1).AfterDecision(nil, ctx, reset)
+	LimitOpenTimers(1).AfterDecision(nil, ctx, more)
+
+	// assert
+	assert.Equal(t, []*swf.Decision{ctx.CancelTimer("baz"), start("baz")}, reset.Decisions, "Expected a restarted timer to be kept")
+	assert.Equal(t, []*swf.Decision{scheduleActivityDecision()}, more.Decisions, "Expected timers over max dropped")
+}
+
 func scheduleActivityDecision() *swf.Decision {
 	return &swf.Decision{
 		DecisionType: S(swf.DecisionTypeScheduleActivityTask),
@@ -825,6 +968,48 @@ func scheduleActivityDecision() *swf.Decision {
 	}
 }
 
+func TestRecordTickDurationExpectsMarkerBeforeCloseDecision(t *testing.T) {
+	// arrange
+	interceptor := RecordTickDuration("TickDuration")
+	task := &swf.PollForDecisionTaskOutput{TaskToken: S("token")}
+	outcome := &Outcome{State: "done", Decisions: []*swf.Decision{timerDecision(), completeDecision()}}
+
+	// act
+	interceptor.BeforeTask(task)
+	interceptor.AfterDecision(task, interceptorTestContext(), outcome)
+	interceptor.AfterDecision(task, interceptorTestContext(), &Outcome{State: "done"})
+
+	// assert
+	if assert.Len(t, outcome.Decisions, 3) {
+		marker := outcome.Decisions[1].RecordMarkerDecisionAttributes
+		if assert.NotNil(t, marker, "Expected the marker before the close decision") {
+			assert.Equal(t, "TickDuration", *marker.MarkerName)
+			assert.Regexp(t, `^elapsed-ms=\d+ state=done$`, *marker.Details)
+		}
+		assert.Equal(t, swf.DecisionTypeCompleteWorkflowExecution, *outcome.Decisions[2].DecisionType)
+	}
+	assert.Panics(t, func() { RecordTickDuration(StateMarker) }, "Expected FSM marker names to be rejected")
+}
+
+func TestRecordTickDurationExpectsStartTimesWithoutAfterDecisionDropped(t *testing.T) {
+	// arrange
+	defer func(maxAge time.Duration) { RecordTickDurationMaxAge = maxAge }(RecordTickDurationMaxAge)
+	RecordTickDurationMaxAge = 5 * time.Millisecond
+	interceptor := RecordTickDuration("TickDuration")
+	abandoned := &swf.PollForDecisionTaskOutput{TaskToken: S("abandoned")}
+	task := &swf.PollForDecisionTaskOutput{TaskToken: S("token")}
+	outcome := &Outcome{State: "done"}
+
+	// act
+	interceptor.BeforeTask(abandoned)
+	time.Sleep(10 * time.Millisecond)
+	interceptor.BeforeTask(task)
+	interceptor.AfterDecision(abandoned, interceptorTestContext(), outcome)
+
+	// assert
+	assert.Empty(t, outcome.Decisions, "Expected the start time of the abandoned task dropped")
+}
+
 func completeDecision() *swf.Decision {
 	return &swf.Decision{
 		CompleteWorkflowExecutionDecisionAttributes: &swf.CompleteWorkflowExecutionDecisionAttributes{},
@@ -846,6 +1031,97 @@ func failDecision() *swf.Decision {
 	}
 }
 
+func TestStampControlExpectsControlSetWhenUnset(t *testing.T) {
+	// arrange
+	keyed := scheduleActivityDecision()
+	SetActivityLogicalKey(keyed, "key")
+	child := &swf.Decision{
+		DecisionType: S(swf.DecisionTypeStartChildWorkflowExecution),
+		StartChildWorkflowExecutionDecisionAttributes: &swf.StartChildWorkflowExecutionDecisionAttributes{WorkflowId: S("child")},
+	}
+	outcome := &Outcome{Decisions: []*swf.Decision{scheduleActivityDecision(), timerDecision(), child, keyed, completeDecision()}}
+	interceptor := StampControl(func(ctx *FSMContext) string { return "trace-" + LS(ctx.WorkflowId) })
+
+	// act
+	interceptor.AfterDecision(nil, interceptorTestContext(), outcome)
+
+	// assert
+	assert.Equal(t, "trace-id", LS(outcome.Decisions[0].ScheduleActivityTaskDecisionAttributes.Control))
+	assert.Equal(t, "trace-id", LS(outcome.Decisions[1].StartTimerDecisionAttributes.Control))
+	assert.Equal(t, "trace-id", LS(outcome.Decisions[2].StartChildWorkflowExecutionDecisionAttributes.Control))
+	assert.Equal(t, "trace-id", ActivityControl(outcome.Decisions[3].ScheduleActivityTaskDecisionAttributes.Control), "Expected the Control stamped after the logical key")
+	assert.Equal(t, "key", logicalKey(outcome.Decisions[3].ScheduleActivityTaskDecisionAttributes.Control), "Expected the logical key kept")
+	assert.Equal(t, completeDecision(), outcome.Decisions[4], "Expected other decisions untouched")
+}
+
+func TestAssertMonotonicStateVersion(t *testing.T) {
+	// arrange
+	reporter := &recordingErrorReporter{}
+	ctx := interceptorTestContext()
+	fsm := ctx.serialization.(*FSM)
+	ctx.errorReporter = reporter
+	marker := func(version uint64) *swf.Decision {
+		serialized, _ := ctx.SystemStateSerializer().Serialize(&SerializedState{StateVersion: version, StateName: "state", WorkflowId: "id"})
+		return fsm.recordStringMarker(StateMarker, serialized)
+	}
+	interceptor := AssertMonotonicStateVersion()
+
+	// act
+	interceptor.AfterDecision(nil, ctx, &Outcome{Decisions: []*swf.Decision{marker(2), timerDecision()}})
+	reportedForNext := len(reporter.versions)
+	interceptor.AfterDecision(nil, ctx, &Outcome{Decisions: []*swf.Decision{marker(1)}})
+	ctx.errorReporter = legacyErrorReporter{reporter}
+	interceptor.AfterDecision(nil, ctx, &Outcome{Decisions: []*swf.Decision{marker(1)}})
+
+	// assert
+	assert.Equal(t, 0, reportedForNext, "Expected no error for the next state version")
+	if assert.Len(t, reporter.versions, 1, "Expected a version error for a state version that does not increase") {
+		assert.Equal(t, uint64(1), reporter.versions[0].Version)
+		assert.Equal(t, uint64(2), reporter.versions[0].Expected)
+	}
+	if assert.Len(t, reporter.errors, 1, "Expected reporters without ErrorNonMonotonicStateVersion to get it as a serialization error") {
+		assert.IsType(t, &ErrNonMonotonicStateVersion{}, reporter.errors[0])
+	}
+	ctx.allowPanics = true
+	assert.Panics(t, func() {
+		interceptor.AfterDecision(nil, ctx, &Outcome{Decisions: []*swf.Decision{marker(5)}})
+	}, "Expected a panic with AllowPanics")
+}
+
+type recordingErrorReporter struct {
+	errors         []error
+	windowExceeded []*SerializedErrorState
+	versions       []*ErrNonMonotonicStateVersion
+	dropped        []*ErrOpenLimitExceeded
+}
+
+func (r *recordingErrorReporter) ErrorDecisionDropped(decisionTask *swf.PollForDecisionTaskOutput, decision *swf.Decision, err *ErrOpenLimitExceeded) {
+	r.dropped = append(r.dropped, err)
+}
+
+func (r *recordingErrorReporter) ErrorNonMonotonicStateVersion(decisionTask *swf.PollForDecisionTaskOutput, outcome Outcome, err *ErrNonMonotonicStateVersion) {
+	r.versions = append(r.versions, err)
+}
+
+func (r *recordingErrorReporter) ErrorFindingStateData(decisionTask *swf.PollForDecisionTaskOutput, err error) {
+	r.errors = append(r.errors, err)
+}
+func (r *recordingErrorReporter) ErrorFindingCorrelator(decisionTask *swf.PollForDecisionTaskOutput, err error) {
+	r.errors = append(r.errors, err)
+}
+func (r *recordingErrorReporter) ErrorMissingFSMState(decisionTask *swf.PollForDecisionTaskOutput, outcome Outcome) {
+}
+func (r *recordingErrorReporter) ErrorDeserializingStateData(decisionTask *swf.PollForDecisionTaskOutput, serializedStateData string, err error) {
+	r.errors = append(r.errors, err)
+}
+func (r *recordingErrorReporter) ErrorSerializingStateData(decisionTask *swf.PollForDecisionTaskOutput, outcome Outcome, eventCorrelator EventCorrelator, err error) {
+	r.errors = append(r.errors, err)
+}
+func (r *recordingErrorReporter) ErrorUnprocessedWindowExceeded(decisionTask *swf.PollForDecisionTaskOutput, errorState *SerializedErrorState, err error) {
+	r.errors = append(r.errors, err)
+	r.windowExceeded = append(r.windowExceeded, errorState)
+}
+
 func timerDecision() *swf.Decision {
 	return &swf.Decision{
 		DecisionType: S(swf.DecisionTypeStartTimer),
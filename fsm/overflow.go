@@ -0,0 +1,55 @@
+package fsm
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+const (
+	// OverflowPrefix starts the details of state, correlator and error markers whose payload is in the FSM OverflowStore,
+	// and is followed by the key of the payload.
+	OverflowPrefix = "FSM.Overflow:"
+	// DefaultOverflowThreshold is the default FSM OverflowThreshold, under the 32768 characters SWF allows in marker details.
+	DefaultOverflowThreshold = 32000
+)
+
+// OverflowStore stores the payloads of state, correlator and error markers that are too large to record in history, see FSM.OverflowStore.
+type OverflowStore interface {
+	Put(key string, payload string) error
+	Get(key string) (string, error)
+}
+
+// overflow puts details of at least the OverflowThreshold in the OverflowStore, and returns the pointer to record in their place.
+// The key is unique per run, marker, state version and payload, so a decision task that timed out but still finishes
+// its Put cannot replace the payload that another decision task recorded a pointer to.
+func (f *FSM) overflow(context *FSMContext, markerName string, stateVersion uint64, details string) (string, error) {
+	if f.OverflowStore == nil || len(details) < f.OverflowThreshold {
+		return details, nil
+	}
+	key := fmt.Sprintf("%s/%s/%s/%d/%x", LS(context.WorkflowId), LS(context.RunId), markerName, stateVersion, sha256.Sum256([]byte(details)))
+	if err := f.OverflowStore.Put(key, details); err != nil {
+		return "", errors.Annotatef(err, "overflow key=%s", key)
+	}
+	f.clog(context, "action=tick at=overflow marker=%s key=%s bytes=%d", markerName, key, len(details))
+	return OverflowPrefix + key, nil
+}
+
+// underflow returns the payload that details point to in the OverflowStore, or details when they are not a pointer.
+func (f *FSM) underflow(details string) (string, error) {
+	if !strings.HasPrefix(details, OverflowPrefix) {
+		return details, nil
+	}
+	key := strings.TrimPrefix(details, OverflowPrefix)
+	if f.OverflowStore == nil {
+		return "", errors.Errorf("no OverflowStore to get key=%s", key)
+	}
+	payload, err := f.OverflowStore.Get(key)
+	if err != nil {
+		return "", errors.Annotatef(err, "underflow key=%s", key)
+	}
+	return payload, nil
+}
@@ -0,0 +1,101 @@
+package fsm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+	. "github.com/sclasen/swfsm/sugar"
+	"github.com/stretchr/testify/assert"
+)
+
+type mapOverflowStore map[string]string
+
+func (m mapOverflowStore) Put(key string, payload string) error {
+	m[key] = payload
+	return nil
+}
+
+func (m mapOverflowStore) Get(key string) (string, error) {
+	return m[key], nil
+}
+
+func TestOverflowExpectsLargeMarkersStoredAndFound(t *testing.T) {
+	// arrange
+	store := mapOverflowStore{}
+	f := testFSM()
+	f.OverflowStore = store
+	f.OverflowThreshold = 100
+	f.AddInitialState(&FSMState{
+		Name: "initial",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			data.(*TestData).States = append(data.(*TestData).States, strings.Repeat("x", 200))
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+	started := EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{Input: StartFSMWorkflowInput(f, new(TestData))})
+
+	// act
+	_, decisions, state, err := f.Tick(testDecisionTask(0, []*swf.HistoryEvent{started}))
+
+	// assert
+	assert.NoError(t, err)
+	var markers []*swf.HistoryEvent
+	pointers := map[string]bool{}
+	for i, d := range decisions {
+		if attrs := d.RecordMarkerDecisionAttributes; attrs != nil {
+			pointers[*attrs.MarkerName] = strings.HasPrefix(*attrs.Details, OverflowPrefix)
+			markers = append(markers, EventFromPayload(10-i, &swf.MarkerRecordedEventAttributes{MarkerName: attrs.MarkerName, Details: attrs.Details}))
+		}
+	}
+	assert.Equal(t, map[string]bool{StateMarker: true, CorrelatorMarker: true}, pointers, "Expected pointers recorded for the markers")
+	for _, prefix := range []string{"workflow-id/run-id/FSM.State/1/", "workflow-id/run-id/FSM.Correlator/1/"} {
+		stored := false
+		for key := range store {
+			stored = stored || strings.HasPrefix(key, prefix)
+		}
+		assert.True(t, stored, "Expected %s in the OverflowStore", prefix)
+	}
+
+	found, err := f.findSerializedState(markers)
+	if assert.NoError(t, err) {
+		assert.Equal(t, state.StateData, found.StateData, "Expected the state found from the pointer")
+	}
+	_, err = f.findSerializedEventCorrelator(markers)
+	assert.NoError(t, err)
+
+	f.OverflowStore = nil
+	_, err = f.findSerializedState(markers)
+	assert.Error(t, err, "Expected an error reading a pointer without an OverflowStore")
+}
+
+func TestOverflowExpectsKeysUniquePerPayloadAndErrorMarkersFound(t *testing.T) {
+	// arrange
+	store := mapOverflowStore{}
+	f := testFSM()
+	f.OverflowStore = store
+	f.OverflowThreshold = 100
+	ctx := testContext(f)
+	errorState := SerializedErrorState{Details: strings.Repeat("x", 200), EarliestUnprocessedEventId: 3}
+	serializedError, _ := f.SystemSerializer.Serialize(errorState)
+
+	// act
+	first, firstErr := f.overflow(ctx, StateMarker, 1, strings.Repeat("a", 200))
+	stale, staleErr := f.overflow(ctx, StateMarker, 1, strings.Repeat("b", 200))
+	errorPointer, errorErr := f.overflow(ctx, ErrorMarker, 1, serializedError)
+
+	// assert
+	assert.NoError(t, firstErr)
+	assert.NoError(t, staleErr)
+	assert.NotEqual(t, first, stale, "Expected different payloads of the same version under different keys")
+	payload, _ := f.underflow(first)
+	assert.Equal(t, strings.Repeat("a", 200), payload, "Expected the first payload not replaced")
+	if assert.NoError(t, errorErr) && assert.True(t, strings.HasPrefix(errorPointer, OverflowPrefix)) {
+		marker := EventFromPayload(4, &swf.MarkerRecordedEventAttributes{MarkerName: S(ErrorMarker), Details: S(errorPointer)})
+		found, err := f.findSerializedErrorState([]*swf.HistoryEvent{marker})
+		if assert.NoError(t, err) {
+			assert.Equal(t, errorState.Details, found.Details, "Expected the error state found from the pointer")
+		}
+	}
+}
@@ -2,30 +2,90 @@ package protobufserializer
 
 import (
 	"encoding/base64"
+	"fmt"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/juju/errors"
 )
 
+// ProtoCodec marshals and unmarshals protobuf messages. It lets messages generated by other protobuf
+// implementations, such as gogo/protobuf, be serialized with their own runtime.
+type ProtoCodec interface {
+	Marshal(msg interface{}) ([]byte, error)
+	Unmarshal(bin []byte, msg interface{}) error
+}
+
+// FuncCodec is a ProtoCodec that you can set marshal and unmarshal funcs on, e.g. those of gogo/protobuf.
+type FuncCodec struct {
+	MarshalFn   func(msg interface{}) ([]byte, error)
+	UnmarshalFn func(bin []byte, msg interface{}) error
+}
+
+// Marshal runs the MarshalFn.
+func (c FuncCodec) Marshal(msg interface{}) ([]byte, error) {
+	return c.MarshalFn(msg)
+}
+
+// Unmarshal runs the UnmarshalFn.
+func (c FuncCodec) Unmarshal(bin []byte, msg interface{}) error {
+	return c.UnmarshalFn(bin, msg)
+}
+
+// GolangProtoCodec is the ProtoCodec of github.com/golang/protobuf. The messages must satisfy its proto.Message.
+type GolangProtoCodec struct{}
+
+// Marshal marshals the message with proto.Marshal.
+func (GolangProtoCodec) Marshal(msg interface{}) ([]byte, error) {
+	m, ok := msg.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto.Message", msg)
+	}
+	return proto.Marshal(m)
+}
+
+// Unmarshal unmarshals the message with proto.Unmarshal.
+func (GolangProtoCodec) Unmarshal(bin []byte, msg interface{}) error {
+	m, ok := msg.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a proto.Message", msg)
+	}
+	return proto.Unmarshal(bin, m)
+}
+
 // ProtobufStateSerializer is a StateSerializer that uses base64 encoded protobufs.
-type ProtobufStateSerializer struct{}
+// The zero value uses the GolangProtoCodec, use NewProtobufStateSerializer for another ProtoCodec.
+type ProtobufStateSerializer struct {
+	Codec ProtoCodec
+}
+
+// NewProtobufStateSerializer returns a ProtobufStateSerializer that marshals and unmarshals messages with the codec.
+func NewProtobufStateSerializer(codec ProtoCodec) ProtobufStateSerializer {
+	return ProtobufStateSerializer{Codec: codec}
+}
+
+func (p ProtobufStateSerializer) codec() ProtoCodec {
+	if p.Codec == nil {
+		return GolangProtoCodec{}
+	}
+	return p.Codec
+}
 
-// Serialize serializes the given struct into bytes with protobuf, then base64 encodes it.  The struct passed to Serialize must satisfy proto.Message.
+// Serialize serializes the given struct into bytes with protobuf, then base64 encodes it.  The struct passed to Serialize must be a message of the Codec.
 func (p ProtobufStateSerializer) Serialize(state interface{}) (string, error) {
-	bin, err := proto.Marshal(state.(proto.Message))
+	bin, err := p.codec().Marshal(state)
 	if err != nil {
 		return "", errors.Trace(err)
 	}
 	return base64.StdEncoding.EncodeToString(bin), nil
 }
 
-// Deserialize base64 decodes the given string then unmarshalls the bytes into the struct using protobuf. The struct passed to Deserialize must satisfy proto.Message.
+// Deserialize base64 decodes the given string then unmarshalls the bytes into the struct using protobuf. The struct passed to Deserialize must be a message of the Codec.
 func (p ProtobufStateSerializer) Deserialize(serialized string, state interface{}) error {
 	bin, err := base64.StdEncoding.DecodeString(serialized)
 	if err != nil {
 		return err
 	}
-	err = proto.Unmarshal(bin, state.(proto.Message))
+	err = p.codec().Unmarshal(bin, state)
 
 	return errors.Trace(err)
 }
@@ -34,6 +34,42 @@ func TestProtobufSerialization(t *testing.T) {
 	}
 }
 
+func TestProtobufSerializationWithCodec(t *testing.T) {
+	marshalled, unmarshalled := 0, 0
+	ser := NewProtobufStateSerializer(FuncCodec{
+		MarshalFn: func(msg interface{}) ([]byte, error) {
+			marshalled++
+			return proto.Marshal(msg.(proto.Message))
+		},
+		UnmarshalFn: func(bin []byte, msg interface{}) error {
+			unmarshalled++
+			return proto.Unmarshal(bin, msg.(proto.Message))
+		},
+	})
+	key := "FOO"
+	init := &ConfigVar{Key: &key}
+	serialized, err := ser.Serialize(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deserialized := new(ConfigVar)
+	if err := ser.Deserialize(serialized, deserialized); err != nil {
+		t.Fatal(err)
+	}
+
+	if init.GetKey() != deserialized.GetKey() || marshalled != 1 || unmarshalled != 1 {
+		t.Fatal(init, deserialized, marshalled, unmarshalled)
+	}
+}
+
+func TestProtobufSerializationOfNonMessage(t *testing.T) {
+	ser := ProtobufStateSerializer{}
+	if _, err := ser.Serialize(struct{}{}); err == nil {
+		t.Fatal("expected error serializing a non proto.Message")
+	}
+}
+
 //This is c&p from som generated code
 
 type ConfigVar struct {
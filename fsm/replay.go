@@ -0,0 +1,88 @@
+package fsm
+
+import (
+	"sort"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+	"github.com/juju/errors"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+// ReplayStep is called by ReplayHistorySteps with each replayed decision task and the result of its Tick.
+type ReplayStep func(decisionTask *swf.PollForDecisionTaskOutput, ctx *FSMContext, decisions []*swf.Decision, state *SerializedState) error
+
+// ReplayDecisionTasks splits a recorded history, in either order, into the decision tasks a decider would have polled,
+// one per DecisionTaskStarted event. A history without DecisionTaskStarted events is treated as a single decision task
+// ending at its newest event, as in a history that is still waiting for its first decision.
+func ReplayDecisionTasks(events []*swf.HistoryEvent) []*swf.PollForDecisionTaskOutput {
+	chronological := make([]*swf.HistoryEvent, len(events))
+	copy(chronological, events)
+	sort.SliceStable(chronological, func(i, j int) bool {
+		return *chronological[i].EventId < *chronological[j].EventId
+	})
+
+	var started []int
+	for i, e := range chronological {
+		if *e.EventType == swf.EventTypeDecisionTaskStarted {
+			started = append(started, i)
+		}
+	}
+	if len(started) == 0 && len(chronological) > 0 {
+		started = append(started, len(chronological)-1)
+	}
+
+	workflowType := &swf.WorkflowType{}
+	for _, e := range chronological {
+		if e.WorkflowExecutionStartedEventAttributes != nil && e.WorkflowExecutionStartedEventAttributes.WorkflowType != nil {
+			workflowType = e.WorkflowExecutionStartedEventAttributes.WorkflowType
+			break
+		}
+	}
+
+	tasks := make([]*swf.PollForDecisionTaskOutput, 0, len(started))
+	previousStarted := int64(0)
+	for _, s := range started {
+		//decision tasks list their events newest first.
+		taskEvents := make([]*swf.HistoryEvent, 0, s+1)
+		for i := s; i >= 0; i-- {
+			taskEvents = append(taskEvents, chronological[i])
+		}
+		tasks = append(tasks, &swf.PollForDecisionTaskOutput{
+			Events:                 taskEvents,
+			PreviousStartedEventId: L(previousStarted),
+			StartedEventId:         chronological[s].EventId,
+			TaskToken:              S("replay"),
+			WorkflowExecution:      &swf.WorkflowExecution{WorkflowId: S(""), RunId: S("")},
+			WorkflowType:           workflowType,
+		})
+		previousStarted = *chronological[s].EventId
+	}
+	return tasks
+}
+
+// ReplayHistory ticks the FSM with the last decision task of a recorded history, and returns the result of the Tick.
+// The FSM must be Init()ed. It is meant for regression testing deciders against production histories.
+func ReplayHistory(f *FSM, events []*swf.HistoryEvent) (*FSMContext, []*swf.Decision, *SerializedState, error) {
+	tasks := ReplayDecisionTasks(events)
+	if len(tasks) == 0 {
+		return nil, nil, nil, errors.New("no events to replay")
+	}
+	return f.Tick(tasks[len(tasks)-1])
+}
+
+// ReplayHistorySteps ticks the FSM with each decision task of a recorded history in order, and calls step with the result.
+// Each Tick sees the state recorded in the history rather than the state produced by the previous step, so the decisions
+// of a step can be compared with the decisions that were recorded after it.
+// It stops at the first error from a Tick or from step.
+func ReplayHistorySteps(f *FSM, events []*swf.HistoryEvent, step ReplayStep) error {
+	for _, task := range ReplayDecisionTasks(events) {
+		ctx, decisions, state, err := f.Tick(task)
+		if err != nil {
+			return errors.Annotatef(err, "replaying decision task started-event-id=%d", *task.StartedEventId)
+		}
+		if err := step(task, ctx, decisions, state); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
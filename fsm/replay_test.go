@@ -0,0 +1,107 @@
+package fsm
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+	. "github.com/sclasen/swfsm/sugar"
+	"github.com/stretchr/testify/assert"
+)
+
+func replayTestFSM() *FSM {
+	f := testFSM()
+	f.AddInitialState(&FSMState{
+		Name: "waiting",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			if *h.EventType == swf.EventTypeWorkflowExecutionSignaled {
+				return ctx.Goto("signaled", data, ctx.EmptyDecisions())
+			}
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.AddState(&FSMState{
+		Name: "signaled",
+		Decider: func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		},
+	})
+	f.Init()
+	return f
+}
+
+func replayTestHistory(f *FSM) []*swf.HistoryEvent {
+	serializedState, _ := f.SystemSerializer.Serialize(&SerializedState{StateVersion: 1, StateName: "waiting", StateData: "{}", WorkflowId: "test-workflow-1"})
+
+	started := EventFromPayload(1, &swf.WorkflowExecutionStartedEventAttributes{
+		Input:        StartFSMWorkflowInput(f, new(TestData)),
+		WorkflowType: testWorkflowType,
+	})
+	state := testHistoryEvent(5, swf.EventTypeMarkerRecorded)
+	state.MarkerRecordedEventAttributes = &swf.MarkerRecordedEventAttributes{MarkerName: S(StateMarker), Details: S(serializedState)}
+	signal := testHistoryEvent(6, swf.EventTypeWorkflowExecutionSignaled)
+	signal.WorkflowExecutionSignaledEventAttributes = &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("go")}
+
+	//as returned by GetWorkflowExecutionHistory, oldest first.
+	return []*swf.HistoryEvent{
+		started,
+		testHistoryEvent(2, swf.EventTypeDecisionTaskScheduled),
+		testHistoryEvent(3, swf.EventTypeDecisionTaskStarted),
+		testHistoryEvent(4, swf.EventTypeDecisionTaskCompleted),
+		state,
+		signal,
+		testHistoryEvent(7, swf.EventTypeDecisionTaskScheduled),
+		testHistoryEvent(8, swf.EventTypeDecisionTaskStarted),
+	}
+}
+
+func TestReplayDecisionTasks(t *testing.T) {
+	// arrange
+	f := replayTestFSM()
+	events := replayTestHistory(f)
+
+	// act
+	tasks := ReplayDecisionTasks(events)
+
+	// assert
+	if assert.Len(t, tasks, 2) {
+		assert.Equal(t, int64(0), *tasks[0].PreviousStartedEventId)
+		assert.Equal(t, int64(3), *tasks[0].StartedEventId)
+		assert.Len(t, tasks[0].Events, 3)
+		assert.Equal(t, int64(3), *tasks[1].PreviousStartedEventId)
+		assert.Equal(t, int64(8), *tasks[1].StartedEventId)
+		assert.Equal(t, int64(8), *tasks[1].Events[0].EventId, "Expected the newest event first")
+		assert.Equal(t, testWorkflowType, tasks[1].WorkflowType)
+	}
+}
+
+func TestReplayHistory(t *testing.T) {
+	// arrange
+	f := replayTestFSM()
+	events := replayTestHistory(f)
+
+	// act
+	_, _, state, err := ReplayHistory(f, events)
+
+	// assert
+	assert.NoError(t, err)
+	if assert.NotNil(t, state) {
+		assert.Equal(t, "signaled", state.StateName)
+	}
+}
+
+func TestReplayHistorySteps(t *testing.T) {
+	// arrange
+	f := replayTestFSM()
+	events := replayTestHistory(f)
+	var states []string
+
+	// act
+	err := ReplayHistorySteps(f, events, func(decisionTask *swf.PollForDecisionTaskOutput, ctx *FSMContext, decisions []*swf.Decision, state *SerializedState) error {
+		states = append(states, state.StateName)
+		return nil
+	})
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"waiting", "signaled"}, states)
+}
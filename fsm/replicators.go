@@ -1,17 +1,127 @@
 package fsm
 
 import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/aws/aws-sdk-go/service/swf"
 	"github.com/juju/errors"
 	. "github.com/sclasen/swfsm/log"
+	. "github.com/sclasen/swfsm/sugar"
 )
 
 //ReplicationHandler can be configured on an FSM and will be called when a DecisionTask is successfully completed.
 //Note that events can be delivered out of order to the ReplicationHandler.
 type ReplicationHandler func(*FSMContext, *swf.PollForDecisionTaskOutput, *swf.RespondDecisionTaskCompletedInput, *SerializedState) error
 
+//ContextReplicationHandler is a ReplicationHandler that also receives the context.Context of the decision task.
+//If set on an FSM it takes precedence over the ReplicationHandler.
+type ContextReplicationHandler func(context.Context, *FSMContext, *swf.PollForDecisionTaskOutput, *swf.RespondDecisionTaskCompletedInput, *SerializedState) error
+
+//ReplicationData is a replication of a completed DecisionTask, as buffered by the FSM while replication is disabled or failing.
+type ReplicationData struct {
+	Context      *FSMContext
+	DecisionTask *swf.PollForDecisionTaskOutput
+	Completed    *swf.RespondDecisionTaskCompletedInput
+	State        *SerializedState
+}
+
+//SnapshotStore can be configured on an FSM to store periodic snapshots of the state of workflows, such as in S3 or DynamoDB.
+//Snapshots can be stored out of order, so implementations should use the StateVersion to keep the latest.
+type SnapshotStore interface {
+	Put(workflowId, runId string, state *SerializedState) error
+}
+
+//SetReplicationEnabled enables or disables replication at runtime, without stopping the FSM.
+//While disabled, replications are buffered if FSM.ReplicationBufferSize is set, otherwise they are skipped.
+//Re-enabling replication does not flush the buffer, call FlushReplication for that.
+func (f *FSM) SetReplicationEnabled(enabled bool) {
+	disabled := int32(1)
+	if enabled {
+		disabled = 0
+	}
+	atomic.StoreInt32(&f.replicationDisabled, disabled)
+	f.log("action=set-replication-enabled enabled=%t", enabled)
+}
+
+//ReplicationEnabled returns false if replication was disabled with SetReplicationEnabled.
+func (f *FSM) ReplicationEnabled() bool {
+	return atomic.LoadInt32(&f.replicationDisabled) == 0
+}
+
+//BufferedReplications returns the number of replications waiting to be flushed.
+func (f *FSM) BufferedReplications() int {
+	f.replicationMu.Lock()
+	defer f.replicationMu.Unlock()
+	return len(f.replicationBuffer)
+}
+
+//FlushReplication replays the buffered replications, oldest first.
+//Replications are buffered, instead of calling the TaskErrorHandler, while replication is disabled with SetReplicationEnabled(false)
+//or the replication handler fails. The buffer is only in memory, so it is lost if the process exits, and the oldest
+//replications are dropped when it is full, so consumers of replication must tolerate gaps.
+//It stops at the first error, keeping that replication and the ones after it buffered ahead of those buffered during the flush,
+//and dropping the oldest when they are more than the ReplicationBufferSize.
+//Replications sent while it runs are not held back, so they can reach the replication handler ahead of older buffered ones,
+//and consumers must tolerate state versions out of order.
+func (f *FSM) FlushReplication(ctx context.Context) error {
+	f.replicationMu.Lock()
+	buffered := f.replicationBuffer
+	f.replicationBuffer = nil
+	f.replicationMu.Unlock()
+
+	for i, data := range buffered {
+		if err := f.replicateData(ctx, data); err != nil {
+			f.replicationMu.Lock()
+			f.replicationBuffer = append(append([]*ReplicationData{}, buffered[i:]...), f.replicationBuffer...)
+			if overflow := len(f.replicationBuffer) - f.ReplicationBufferSize; overflow > 0 {
+				for _, dropped := range f.replicationBuffer[:overflow] {
+					f.log("action=flush-replication at=drop-buffered-replication workflow-id=%s", LS(dropped.DecisionTask.WorkflowExecution.WorkflowId))
+				}
+				f.replicationBuffer = f.replicationBuffer[overflow:]
+			}
+			f.replicationMu.Unlock()
+			f.log("action=flush-replication at=replication-failed flushed=%d buffered=%d error=%q", i, len(buffered)-i, err)
+			return errors.Trace(err)
+		}
+	}
+	f.log("action=flush-replication at=flushed flushed=%d", len(buffered))
+	return nil
+}
+
+func (f *FSM) bufferReplication(data *ReplicationData, reason string) {
+	if f.ReplicationBufferSize <= 0 {
+		f.log("action=replicate at=skip-replication reason=%s workflow-id=%s", reason, LS(data.DecisionTask.WorkflowExecution.WorkflowId))
+		return
+	}
+
+	f.replicationMu.Lock()
+	defer f.replicationMu.Unlock()
+	if len(f.replicationBuffer) >= f.ReplicationBufferSize {
+		dropped := f.replicationBuffer[0]
+		f.replicationBuffer = f.replicationBuffer[1:]
+		f.log("action=replicate at=drop-buffered-replication workflow-id=%s", LS(dropped.DecisionTask.WorkflowExecution.WorkflowId))
+	}
+	f.replicationBuffer = append(f.replicationBuffer, data)
+	f.log("action=replicate at=buffer-replication reason=%s workflow-id=%s buffered=%d", reason, LS(data.DecisionTask.WorkflowExecution.WorkflowId), len(f.replicationBuffer))
+}
+
+//snapshot puts the state in the SnapshotStore, if set, when its version is due for a snapshot.
+func (f *FSM) snapshot(decisionTask *swf.PollForDecisionTaskOutput, state *SerializedState) {
+	if f.SnapshotStore == nil || state.StateVersion%f.SnapshotEvery != 0 {
+		return
+	}
+	workflowId, runId := LS(decisionTask.WorkflowExecution.WorkflowId), LS(decisionTask.WorkflowExecution.RunId)
+	if err := f.SnapshotStore.Put(workflowId, runId, state); err != nil {
+		f.log("action=snapshot at=snapshot-failed workflow-id=%s run-id=%s version=%d error=%q", workflowId, runId, state.StateVersion, err)
+	}
+}
+
 //KinesisOps is the subset of kinesis.Kinesis ops required by KinesisReplication
 type KinesisOps interface {
 	PutRecord(*kinesis.PutRecordInput) (*kinesis.PutRecordOutput, error)
@@ -31,6 +141,9 @@ type KinesisReplication struct {
 	KinesisStream     string
 	KinesisReplicator KinesisReplicator
 	KinesisOps        KinesisOps
+	//PartitionKeyFunc returns the partition key of the record replicating the state. Defaults to the workflow id,
+	//so that all the records of a workflow land on the same shard, in order.
+	PartitionKeyFunc func(*FSMContext, *SerializedState) string
 }
 
 //Handler is a ReplicationHandler. to configure it on your FSM, do fsm.ReplicationHandler = &KinesisReplication{...).Handler
@@ -44,11 +157,16 @@ func (f *KinesisReplication) Handler(ctx *FSMContext, decisionTask *swf.PollForD
 		return errors.Trace(err)
 	}
 
+	//partition by workflow
+	partitionKey := LS(decisionTask.WorkflowExecution.WorkflowId)
+	if f.PartitionKeyFunc != nil {
+		partitionKey = f.PartitionKeyFunc(ctx, state)
+	}
+
 	put := func() (*kinesis.PutRecordOutput, error) {
 		return f.KinesisOps.PutRecord(&kinesis.PutRecordInput{
-			StreamName: aws.String(f.KinesisStream),
-			//partition by workflow
-			PartitionKey: decisionTask.WorkflowExecution.WorkflowId,
+			StreamName:   aws.String(f.KinesisStream),
+			PartitionKey: aws.String(partitionKey),
 			Data:         []byte(stateToReplicate),
 		})
 	}
@@ -62,3 +180,211 @@ func (f *KinesisReplication) Handler(ctx *FSMContext, decisionTask *swf.PollForD
 	}
 	return errors.Trace(err)
 }
+
+//KinesisBatchOps is the subset of kinesis.Kinesis ops required by BatchingKinesisReplication
+type KinesisBatchOps interface {
+	PutRecords(*kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
+}
+
+//KinesisPutRecordsMax is the maximum number of records in a kinesis PutRecords request.
+const KinesisPutRecordsMax = 500
+
+//KinesisPutRecordsMaxBytes is the maximum size of a kinesis PutRecords request, counting the data and partition keys of its records.
+const KinesisPutRecordsMaxBytes = 5 << 20
+
+//KinesisRecordMaxBytes is the maximum size of a kinesis record, counting its data and partition key.
+const KinesisRecordMaxBytes = 1 << 20
+
+//BatchingKinesisReplication can be used as a ReplicationHandler like KinesisReplication, but buffers the records
+//and puts them with PutRecords once MaxBatchSize records or KinesisPutRecordsMaxBytes are buffered, or FlushInterval
+//after the first buffered record, to make fewer kinesis api calls on busy domains. Flushes run in the background.
+//Records that fail are retried with exponential backoff, so records of a workflow can land out of order, as the ReplicationHandler allows.
+//Since the Handler returns before the records are put, their failures are reported to the DropHandler rather than to the FSM.
+//Buffered records are only in memory, so they are lost if the process crashes. Call Flush when stopping the FSM,
+//so that they are not lost on a clean shutdown.
+type BatchingKinesisReplication struct {
+	KinesisStream string
+	KinesisOps    KinesisBatchOps
+	//PartitionKeyFunc returns the partition key of the record replicating the state. Defaults to the workflow id.
+	PartitionKeyFunc func(*FSMContext, *SerializedState) string
+	//MaxBatchSize is the number of buffered records that triggers a flush. Defaults to, and is capped at, KinesisPutRecordsMax.
+	MaxBatchSize int
+	//FlushInterval is how long a record can stay buffered before it is flushed. Defaults to 1 second.
+	FlushInterval time.Duration
+	//MaxRetries is how many times the records that failed are put again in a flush, before they are dropped. Defaults to 3.
+	MaxRetries int
+	//RetryBackoff is the wait before the first retry of the records that failed, doubled on each further retry. Defaults to 100 milliseconds.
+	RetryBackoff time.Duration
+	//DropHandler, if set, is called with the records dropped by a flush and the last error putting them, e.g. to alert or to store them elsewhere.
+	DropHandler func(dropped []*kinesis.PutRecordsRequestEntry, err error)
+
+	mu            sync.Mutex
+	buffer        []*kinesis.PutRecordsRequestEntry
+	bufferedBytes int
+	timer         *time.Timer
+	flushes       sync.WaitGroup
+}
+
+//Handler is a ReplicationHandler. to configure it on your FSM, do fsm.ReplicationHandler = &BatchingKinesisReplication{...).Handler
+//It starts a flush when the batch is full, and returns an error only when the state cannot be serialized or is larger
+//than KinesisRecordMaxBytes, since a failed flush is about the records of other workflows as well, see DropHandler.
+func (f *BatchingKinesisReplication) Handler(ctx *FSMContext, decisionTask *swf.PollForDecisionTaskOutput, completedDecision *swf.RespondDecisionTaskCompletedInput, state *SerializedState) error {
+	if state == nil || f.KinesisStream == "" {
+		return nil
+	}
+	stateToReplicate, err := ctx.Serializer().Serialize(state)
+	if err != nil {
+		Log.Printf("component=kinesis-replication at=serialize-state-failed error=%q", err.Error())
+		return errors.Trace(err)
+	}
+
+	partitionKey := LS(decisionTask.WorkflowExecution.WorkflowId)
+	if f.PartitionKeyFunc != nil {
+		partitionKey = f.PartitionKeyFunc(ctx, state)
+	}
+
+	record := &kinesis.PutRecordsRequestEntry{
+		PartitionKey: aws.String(partitionKey),
+		Data:         []byte(stateToReplicate),
+	}
+	if size := recordSize(record); size > KinesisRecordMaxBytes {
+		Log.Printf("component=kinesis-replication at=record-too-large bytes=%d", size)
+		return errors.Errorf("replicated state of %d bytes is larger than the kinesis record limit of %d bytes", size, KinesisRecordMaxBytes)
+	}
+
+	f.mu.Lock()
+	f.buffer = append(f.buffer, record)
+	f.bufferedBytes += recordSize(record)
+	full := len(f.buffer) >= f.maxBatchSize() || f.bufferedBytes >= KinesisPutRecordsMaxBytes
+	if full {
+		f.flushes.Add(1)
+		go func() {
+			defer f.flushes.Done()
+			if err := f.flush(); err != nil {
+				Log.Printf("component=kinesis-replication at=full-flush-failed error=%q", err.Error())
+			}
+		}()
+	} else if f.timer == nil {
+		f.timer = time.AfterFunc(f.flushInterval(), func() {
+			if err := f.Flush(); err != nil {
+				Log.Printf("component=kinesis-replication at=timed-flush-failed error=%q", err.Error())
+			}
+		})
+	}
+	f.mu.Unlock()
+	return nil
+}
+
+//Flush puts the buffered records now, in batches of at most MaxBatchSize records and KinesisPutRecordsMaxBytes,
+//retrying the records that fail up to MaxRetries times, then waits for the flushes running in the background.
+//It returns an error if any of its records were dropped, after calling the DropHandler with them.
+func (f *BatchingKinesisReplication) Flush() error {
+	err := f.flush()
+	f.flushes.Wait()
+	return err
+}
+
+func (f *BatchingKinesisReplication) flush() error {
+	f.mu.Lock()
+	buffered := f.buffer
+	f.buffer = nil
+	f.bufferedBytes = 0
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	f.mu.Unlock()
+
+	var dropped []*kinesis.PutRecordsRequestEntry
+	var lastErr error
+	for len(buffered) > 0 {
+		batch := buffered[:f.nextBatchLength(buffered)]
+		buffered = buffered[len(batch):]
+		failed, err := f.putWithRetries(batch)
+		if err != nil {
+			dropped = append(dropped, failed...)
+			lastErr = err
+		}
+	}
+	if len(dropped) > 0 {
+		Log.Printf("component=kinesis-replication at=replicate-batch-failed dropped=%d error=%q", len(dropped), lastErr.Error())
+		if f.DropHandler != nil {
+			f.DropHandler(dropped, lastErr)
+		}
+		return errors.Annotate(lastErr, fmt.Sprintf("dropped %d records", len(dropped)))
+	}
+	return nil
+}
+
+//putWithRetries puts the batch, then the records of it that failed after a backoff, and returns those still failing after MaxRetries.
+func (f *BatchingKinesisReplication) putWithRetries(batch []*kinesis.PutRecordsRequestEntry) ([]*kinesis.PutRecordsRequestEntry, error) {
+	var err error
+	for attempt := 0; attempt <= f.maxRetries() && len(batch) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(f.retryBackoff() << uint(attempt-1))
+		}
+		var resp *kinesis.PutRecordsOutput
+		resp, err = f.KinesisOps.PutRecords(&kinesis.PutRecordsInput{
+			StreamName: aws.String(f.KinesisStream),
+			Records:    batch,
+		})
+		if err != nil {
+			continue
+		}
+		var failed []*kinesis.PutRecordsRequestEntry
+		for i, result := range resp.Records {
+			if result.ErrorCode != nil && i < len(batch) {
+				failed = append(failed, batch[i])
+				err = fmt.Errorf("%s: %s", LS(result.ErrorCode), LS(result.ErrorMessage))
+			}
+		}
+		Log.Printf("component=kinesis-replication at=replicated-batch records=%d failed=%d", len(batch), len(failed))
+		batch = failed
+	}
+	if len(batch) == 0 {
+		return nil, nil
+	}
+	return batch, err
+}
+
+//nextBatchLength is how many of the records fit in the next PutRecords request, at least one.
+func (f *BatchingKinesisReplication) nextBatchLength(records []*kinesis.PutRecordsRequestEntry) int {
+	n, bytes := 1, recordSize(records[0])
+	for n < len(records) && n < f.maxBatchSize() && bytes+recordSize(records[n]) <= KinesisPutRecordsMaxBytes {
+		bytes += recordSize(records[n])
+		n++
+	}
+	return n
+}
+
+func recordSize(record *kinesis.PutRecordsRequestEntry) int {
+	return len(record.Data) + len(LS(record.PartitionKey))
+}
+
+func (f *BatchingKinesisReplication) maxBatchSize() int {
+	if f.MaxBatchSize <= 0 || f.MaxBatchSize > KinesisPutRecordsMax {
+		return KinesisPutRecordsMax
+	}
+	return f.MaxBatchSize
+}
+
+func (f *BatchingKinesisReplication) flushInterval() time.Duration {
+	if f.FlushInterval <= 0 {
+		return time.Second
+	}
+	return f.FlushInterval
+}
+
+func (f *BatchingKinesisReplication) retryBackoff() time.Duration {
+	if f.RetryBackoff <= 0 {
+		return 100 * time.Millisecond
+	}
+	return f.RetryBackoff
+}
+
+func (f *BatchingKinesisReplication) maxRetries() int {
+	if f.MaxRetries <= 0 {
+		return 3
+	}
+	return f.MaxRetries
+}
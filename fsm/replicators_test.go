@@ -1,9 +1,15 @@
 package fsm
 
 import (
+	"context"
+	"errors"
 	"math/rand"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/aws/aws-sdk-go/service/swf"
@@ -94,3 +100,281 @@ func TestKinesisReplication(t *testing.T) {
 		t.Fatalf("current state being replicated is not 'done', got %q", replicatedState.StateName)
 	}
 }
+
+func TestKinesisReplicationPartitionKeyFunc(t *testing.T) {
+	client := &MockClient{}
+	rep := KinesisReplication{
+		KinesisStream:     "test-stream",
+		KinesisOps:        client,
+		KinesisReplicator: defaultKinesisReplicator(),
+	}
+	fsm := testFSM()
+	ctx := testContext(fsm)
+	decisionTask := testDecisionTask(0, nil)
+	state := &SerializedState{StateName: "done", StateData: "{}", WorkflowId: "test-workflow-1"}
+
+	if err := rep.Handler(ctx, decisionTask, nil, state); err != nil {
+		t.Fatal(err)
+	}
+	rep.PartitionKeyFunc = func(ctx *FSMContext, state *SerializedState) string {
+		return state.WorkflowId + "/" + state.StateName
+	}
+	if err := rep.Handler(ctx, decisionTask, nil, state); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.putRecords) != 2 {
+		t.Fatalf("expected two states to be replicated, got: %v", client.putRecords)
+	}
+	if key := *client.putRecords[0].PartitionKey; key != *decisionTask.WorkflowExecution.WorkflowId {
+		t.Fatalf("expected the workflow id as the default partition key, got %q", key)
+	}
+	if key := *client.putRecords[1].PartitionKey; key != "test-workflow-1/done" {
+		t.Fatalf("expected the partition key of the PartitionKeyFunc, got %q", key)
+	}
+}
+
+func TestReplicationBufferedWhileDisabledAndFlushed(t *testing.T) {
+	f := testFSM()
+	f.ReplicationBufferSize = 2
+	var replicated []string
+	fail := true
+	f.ReplicationHandler = func(ctx *FSMContext, task *swf.PollForDecisionTaskOutput, complete *swf.RespondDecisionTaskCompletedInput, state *SerializedState) error {
+		if fail {
+			return errors.New("downstream unavailable")
+		}
+		replicated = append(replicated, state.StateName)
+		return nil
+	}
+	f.TaskErrorHandler = func(task *swf.PollForDecisionTaskOutput, err error) {
+		t.Fatal("unexpected TaskErrorHandler call", err)
+	}
+	task := &swf.PollForDecisionTaskOutput{WorkflowExecution: testWorkflowExecution}
+
+	f.replicate(context.Background(), nil, task, nil, &SerializedState{StateName: "failed"})
+	f.SetReplicationEnabled(false)
+	f.replicate(context.Background(), nil, task, nil, &SerializedState{StateName: "dropped"})
+	f.replicate(context.Background(), nil, task, nil, &SerializedState{StateName: "disabled"})
+	f.replicate(context.Background(), nil, task, nil, &SerializedState{StateName: "disabled-again"})
+
+	if f.BufferedReplications() != 2 {
+		t.Fatal("expected the buffer to be bounded, got", f.BufferedReplications())
+	}
+	if err := f.FlushReplication(context.Background()); err == nil || f.BufferedReplications() != 2 {
+		t.Fatal("expected a failed flush to keep the buffer", err, f.BufferedReplications())
+	}
+
+	fail = false
+	f.SetReplicationEnabled(true)
+	if err := f.FlushReplication(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(replicated, []string{"disabled", "disabled-again"}) || f.BufferedReplications() != 0 {
+		t.Fatal("expected the newest buffered replications in order", replicated)
+	}
+}
+
+func TestFlushReplicationWhenFailingWhileReplicationsBufferedExpectsBufferBounded(t *testing.T) {
+	f := testFSM()
+	f.ReplicationBufferSize = 2
+	task := &swf.PollForDecisionTaskOutput{WorkflowExecution: testWorkflowExecution}
+	f.ReplicationHandler = func(ctx *FSMContext, task *swf.PollForDecisionTaskOutput, complete *swf.RespondDecisionTaskCompletedInput, state *SerializedState) error {
+		//a decision task completes while the flush is in progress.
+		f.replicate(context.Background(), nil, task, nil, &SerializedState{StateName: "during-flush"})
+		return errors.New("downstream unavailable")
+	}
+	f.SetReplicationEnabled(false)
+	f.replicate(context.Background(), nil, task, nil, &SerializedState{StateName: "oldest"})
+	f.replicate(context.Background(), nil, task, nil, &SerializedState{StateName: "newest"})
+
+	if err := f.FlushReplication(context.Background()); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+
+	var buffered []string
+	for _, data := range f.replicationBuffer {
+		buffered = append(buffered, data.State.StateName)
+	}
+	if !reflect.DeepEqual(buffered, []string{"newest", "during-flush"}) {
+		t.Fatal("expected the oldest replication dropped to keep the buffer bounded", buffered)
+	}
+}
+
+type recordingSnapshotStore struct {
+	versions []uint64
+	err      error
+}
+
+func (r *recordingSnapshotStore) Put(workflowId, runId string, state *SerializedState) error {
+	r.versions = append(r.versions, state.StateVersion)
+	return r.err
+}
+
+func TestSnapshotEveryVersionInterval(t *testing.T) {
+	f := testFSM()
+	store := &recordingSnapshotStore{}
+	f.SnapshotStore = store
+	f.SnapshotEvery = 3
+	task := &swf.PollForDecisionTaskOutput{WorkflowExecution: testWorkflowExecution}
+
+	for v := uint64(1); v <= 7; v++ {
+		f.snapshot(task, &SerializedState{StateVersion: v})
+	}
+	if !reflect.DeepEqual(store.versions, []uint64{3, 6}) {
+		t.Fatal("expected snapshots every 3 versions", store.versions)
+	}
+
+	store.err = errors.New("store unavailable")
+	f.snapshot(task, &SerializedState{StateVersion: 9})
+	if len(store.versions) != 3 {
+		t.Fatal("expected a failed snapshot to be attempted", store.versions)
+	}
+}
+
+type batchKinesisClient struct {
+	mu       sync.Mutex
+	requests []*kinesis.PutRecordsInput
+	//failFirst fails the first record of each request, for that many requests.
+	failFirst int
+}
+
+func (c *batchKinesisClient) PutRecords(req *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, req)
+	resp := &kinesis.PutRecordsOutput{FailedRecordCount: I(0)}
+	for i := range req.Records {
+		result := &kinesis.PutRecordsResultEntry{SequenceNumber: S(strconv.Itoa(i)), ShardId: S("shard")}
+		if i == 0 && c.failFirst > 0 {
+			c.failFirst--
+			result = &kinesis.PutRecordsResultEntry{ErrorCode: S("ProvisionedThroughputExceededException"), ErrorMessage: S("slow down")}
+			resp.FailedRecordCount = I(1)
+		}
+		resp.Records = append(resp.Records, result)
+	}
+	return resp, nil
+}
+
+func (c *batchKinesisClient) putRequests() []*kinesis.PutRecordsInput {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*kinesis.PutRecordsInput(nil), c.requests...)
+}
+
+func TestBatchingKinesisReplicationFlushesFullBatchRetryingFailedRecords(t *testing.T) {
+	client := &batchKinesisClient{failFirst: 1}
+	rep := &BatchingKinesisReplication{
+		KinesisStream: "test-stream",
+		KinesisOps:    client,
+		MaxBatchSize:  2,
+		FlushInterval: time.Hour,
+		RetryBackoff:  10 * time.Millisecond,
+	}
+	ctx := testContext(testFSM())
+	decisionTask := testDecisionTask(0, []*swf.HistoryEvent{})
+
+	if err := rep.Handler(ctx, decisionTask, nil, &SerializedState{StateVersion: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.putRequests()) != 0 {
+		t.Fatal("expected the first record buffered")
+	}
+	started := time.Now()
+	if err := rep.Handler(ctx, decisionTask, nil, &SerializedState{StateVersion: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(started) >= 10*time.Millisecond {
+		t.Fatal("expected the full batch flushed in the background, without waiting for the RetryBackoff")
+	}
+	if err := rep.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := client.putRequests()
+	if len(requests) != 2 || len(requests[0].Records) != 2 || len(requests[1].Records) != 1 {
+		t.Fatal("expected a batch of 2, then a retry of the failed record", requests)
+	}
+	if *requests[1].StreamName != "test-stream" || requests[1].Records[0] != requests[0].Records[0] {
+		t.Fatal("expected the failed record retried", requests[1])
+	}
+}
+
+func TestBatchingKinesisReplicationDropsRecordsFailingPastMaxRetries(t *testing.T) {
+	client := &batchKinesisClient{failFirst: 3}
+	var dropped []*kinesis.PutRecordsRequestEntry
+	var dropErr error
+	rep := &BatchingKinesisReplication{
+		KinesisStream: "test-stream",
+		KinesisOps:    client,
+		MaxBatchSize:  1,
+		MaxRetries:    2,
+		RetryBackoff:  time.Millisecond,
+		DropHandler: func(records []*kinesis.PutRecordsRequestEntry, err error) {
+			dropped, dropErr = records, err
+		},
+	}
+
+	err := rep.Handler(testContext(testFSM()), testDecisionTask(0, []*swf.HistoryEvent{}), nil, &SerializedState{StateVersion: 1})
+	rep.Flush()
+
+	if err != nil {
+		t.Fatal("expected the failed flush not returned to the task that filled the batch", err)
+	}
+	if len(client.putRequests()) != 3 || len(dropped) != 1 || dropErr == nil {
+		t.Fatal("expected the record dropped once it failed the put and its 2 retries", dropped, dropErr, client.putRequests())
+	}
+}
+
+func TestBatchingKinesisReplicationFlushesAfterFlushInterval(t *testing.T) {
+	client := &batchKinesisClient{}
+	rep := &BatchingKinesisReplication{KinesisStream: "test-stream", KinesisOps: client, FlushInterval: 10 * time.Millisecond}
+
+	if err := rep.Handler(testContext(testFSM()), testDecisionTask(0, []*swf.HistoryEvent{}), nil, &SerializedState{StateVersion: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(client.putRequests()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if requests := client.putRequests(); len(requests) != 1 || len(requests[0].Records) != 1 {
+		t.Fatal("expected the buffered record flushed after the FlushInterval", requests)
+	}
+}
+
+func TestBatchingKinesisReplicationCutsBatchesAtPutRecordsMaxBytes(t *testing.T) {
+	client := &batchKinesisClient{}
+	rep := &BatchingKinesisReplication{KinesisStream: "test-stream", KinesisOps: client, FlushInterval: time.Hour}
+	ctx := testContext(testFSM())
+	decisionTask := testDecisionTask(0, []*swf.HistoryEvent{})
+	stateData := strings.Repeat("x", 900<<10)
+
+	for version := uint64(1); version <= 6; version++ {
+		if err := rep.Handler(ctx, decisionTask, nil, &SerializedState{StateVersion: version, StateData: stateData}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rep.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := client.putRequests()
+	if len(requests) != 2 || len(requests[0].Records) != 5 || len(requests[1].Records) != 1 {
+		t.Fatal("expected the records of 900KiB put 5 per request, to stay under KinesisPutRecordsMaxBytes", len(requests))
+	}
+}
+
+func TestBatchingKinesisReplicationWhenRecordTooLargeExpectsError(t *testing.T) {
+	client := &batchKinesisClient{}
+	rep := &BatchingKinesisReplication{KinesisStream: "test-stream", KinesisOps: client, FlushInterval: time.Hour}
+
+	err := rep.Handler(testContext(testFSM()), testDecisionTask(0, []*swf.HistoryEvent{}), nil, &SerializedState{StateVersion: 1, StateData: strings.Repeat("x", KinesisRecordMaxBytes)})
+	rep.Flush()
+
+	if err == nil {
+		t.Fatal("expected an error for a state larger than KinesisRecordMaxBytes")
+	}
+	if len(client.putRequests()) != 0 {
+		t.Fatal("expected the record not buffered", client.putRequests())
+	}
+}
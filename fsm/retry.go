@@ -0,0 +1,212 @@
+package fsm
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+// RetryPolicy decides whether, and after how long, something that failed is attempted again,
+// given the number of failed attempts recorded by the EventCorrelator,
+// e.g. RetryPolicy{MaxAttempts: 5, InitialBackoff: 10 * time.Second, Multiplier: 2} for exponential backoff up to 5 attempts.
+type RetryPolicy struct {
+	// MaxAttempts is the number of failed attempts after which to give up. 0 retries forever.
+	MaxAttempts int
+	// InitialBackoff is the backoff after the first failed attempt.
+	InitialBackoff time.Duration
+	// Multiplier grows the backoff after each further failed attempt, values below 1 keep it constant.
+	Multiplier float64
+	// MaxBackoff caps the backoff, if set.
+	MaxBackoff time.Duration
+}
+
+// ShouldRetry returns true if another attempt should be made after the number of failed attempts.
+func (p RetryPolicy) ShouldRetry(attempts int) bool {
+	return p.MaxAttempts <= 0 || attempts < p.MaxAttempts
+}
+
+// Backoff returns how long to wait before the attempt following the number of failed attempts.
+// Attempts below 1 are treated as 1, and without a MaxBackoff the backoff is capped at the largest time.Duration.
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	multiplier := math.Max(p.Multiplier, 1)
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempts-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		return p.MaxBackoff
+	}
+	if backoff >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(backoff)
+}
+
+// BackoffTimer returns a StartTimer decision for the timer, firing after the Backoff for the number of failed attempts.
+// The Backoff is rounded up to whole seconds, and is at least 1 second, as required by SWF.
+// The timer id is given by the caller since SWF rejects a timer whose id is already used by an open timer,
+// so concurrent retries need distinct ids, such as the ones RetryActivity, RetrySignal and RetryChild derive.
+func (p RetryPolicy) BackoffTimer(timerId string, attempts int) *swf.Decision {
+	backoff := p.Backoff(attempts)
+	if backoff < time.Second {
+		backoff = time.Second
+	}
+	return startTimerDecision(timerId, backoff, "")
+}
+
+// RetryActivityTimerPrefix prefixes the ids of the timers started by RetryActivity, followed by the ActivityId.
+const RetryActivityTimerPrefix = "retry-activity-"
+
+// RetrySignalTimerPrefix prefixes the ids of the timers started by RetrySignal, followed by the signal name and WorkflowId.
+const RetrySignalTimerPrefix = "retry-signal-"
+
+// RetryChildTimerPrefix prefixes the ids of the timers started by RetryChild, followed by the WorkflowId of the child.
+const RetryChildTimerPrefix = "retry-child-"
+
+// MaxTimerIdLength is the longest TimerId SWF accepts.
+const MaxTimerIdLength = 256
+
+// MaxTimerControlLength is the longest timer Control SWF accepts.
+const MaxTimerControlLength = 32768
+
+// retryTimerId keeps timer ids within MaxTimerIdLength, replacing the end of longer ones with a hash of the whole id,
+// so they stay unique.
+func retryTimerId(id string) string {
+	if len(id) <= MaxTimerIdLength {
+		return id
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(id)))[:16]
+	return id[:MaxTimerIdLength-len(hash)-1] + "-" + hash
+}
+
+// RetryActivity applies the policy to the failed or timed out activity of the event being decided.
+// It returns a StartTimer decision for the backoff, with the ActivityId in the timer id after RetryActivityTimerPrefix,
+// and the ActivityInfo in the timer Control, since the EventCorrelator forgets the activity once it failed.
+// When the timer fires, RetryDecision returns the ScheduleActivityTask decision, with the same ActivityId so its attempts keep counting.
+// It returns nil and false when the policy gives up, the event is not correlated to an activity,
+// or the ActivityInfo is larger than MaxTimerControlLength.
+func (f *FSMContext) RetryActivity(policy RetryPolicy, h *swf.HistoryEvent) (*swf.Decision, bool) {
+	info := f.ActivityInfo(h)
+	if info == nil {
+		return nil, false
+	}
+	attempts := f.failedAttempts(h, f.ActivityAttempts(h))
+	if !policy.ShouldRetry(attempts) {
+		return nil, false
+	}
+	return f.retryTimer(policy, RetryActivityTimerPrefix+info.ActivityId, attempts, info)
+}
+
+// RetrySignal applies the policy to the failed signal of the event being decided.
+// It returns a StartTimer decision for the backoff, with the signal name and WorkflowId in the timer id after RetrySignalTimerPrefix,
+// and the SignalInfo in the timer Control, so that RetryDecision returns the SignalExternalWorkflowExecution decision when the timer fires.
+// It returns nil and false when the policy gives up, the event is not correlated to a signal,
+// or the SignalInfo is larger than MaxTimerControlLength.
+func (f *FSMContext) RetrySignal(policy RetryPolicy, h *swf.HistoryEvent) (*swf.Decision, bool) {
+	info := f.SignalInfo(h)
+	if info == nil {
+		return nil, false
+	}
+	attempts := f.failedAttempts(h, f.SignalAttempts(h))
+	if !policy.ShouldRetry(attempts) {
+		return nil, false
+	}
+	return f.retryTimer(policy, RetrySignalTimerPrefix+info.SignalName+"-"+info.WorkflowId, attempts, info)
+}
+
+// RetryChild applies the policy to the child workflow that failed to start in the event being decided.
+// It returns a StartTimer decision for the backoff, with the WorkflowId of the child in the timer id after RetryChildTimerPrefix,
+// and the ChildInfo in the timer Control, so that RetryDecision returns the StartChildWorkflowExecution decision when the timer fires.
+// It returns nil and false when the policy gives up, the event is not correlated to a child workflow,
+// or the ChildInfo is larger than MaxTimerControlLength.
+func (f *FSMContext) RetryChild(policy RetryPolicy, h *swf.HistoryEvent) (*swf.Decision, bool) {
+	info := f.eventCorrelator.ChildInfo(h)
+	if info == nil {
+		return nil, false
+	}
+	attempts := f.failedAttempts(h, f.eventCorrelator.AttemptsForChild(info))
+	if !policy.ShouldRetry(attempts) {
+		return nil, false
+	}
+	return f.retryTimer(policy, RetryChildTimerPrefix+info.WorkflowId, attempts, info)
+}
+
+// retryTimer returns the backoff timer of a retry, with the serialized info in its Control.
+// Timer ids longer than MaxTimerIdLength end in a hash instead, the info in the Control is kept whole.
+func (f *FSMContext) retryTimer(policy RetryPolicy, timerId string, attempts int, info interface{}) (*swf.Decision, bool) {
+	control := f.serializeSystem(info)
+	if len(control) > MaxTimerControlLength {
+		logf(f, "at=retry-control-too-large timer-id=%s length=%d", timerId, len(control))
+		return nil, false
+	}
+	timer := policy.BackoffTimer(retryTimerId(timerId), attempts)
+	timer.StartTimerDecisionAttributes.Control = S(control)
+	return timer, true
+}
+
+// RetryDecision returns the decision retrying what a timer started by RetryActivity, RetrySignal or RetryChild was started for,
+// when the event being decided is that timer firing. The activity is scheduled on the default task list of its activity type,
+// and the child workflow is started on the default task list of its workflow type, with the defaults of their types for
+// everything not kept in their ActivityInfo or ChildInfo. Signals are sent to the current run of the workflow.
+// It returns nil and false for any other event. Like Deserialize, it panics when the timer Control cannot be deserialized.
+func (f *FSMContext) RetryDecision(h *swf.HistoryEvent) (*swf.Decision, bool) {
+	if *h.EventType != swf.EventTypeTimerFired {
+		return nil, false
+	}
+	timer := f.eventCorrelator.TimerInfo(h)
+	if timer == nil || timer.Control == nil {
+		return nil, false
+	}
+	switch {
+	case strings.HasPrefix(timer.TimerId, RetryActivityTimerPrefix):
+		info := &ActivityInfo{}
+		f.deserializeSystem(*timer.Control, info)
+		d := &swf.Decision{
+			DecisionType: S(swf.DecisionTypeScheduleActivityTask),
+			ScheduleActivityTaskDecisionAttributes: &swf.ScheduleActivityTaskDecisionAttributes{
+				ActivityId:   S(info.ActivityId),
+				ActivityType: info.ActivityType,
+				Input:        info.Input,
+			},
+		}
+		return SetActivityLogicalKey(d, info.LogicalKey), true
+	case strings.HasPrefix(timer.TimerId, RetrySignalTimerPrefix):
+		info := &SignalInfo{}
+		f.deserializeSystem(*timer.Control, info)
+		return &swf.Decision{
+			DecisionType: S(swf.DecisionTypeSignalExternalWorkflowExecution),
+			SignalExternalWorkflowExecutionDecisionAttributes: &swf.SignalExternalWorkflowExecutionDecisionAttributes{
+				SignalName: S(info.SignalName),
+				WorkflowId: S(info.WorkflowId),
+				Input:      info.Input,
+			},
+		}, true
+	case strings.HasPrefix(timer.TimerId, RetryChildTimerPrefix):
+		info := &ChildInfo{}
+		f.deserializeSystem(*timer.Control, info)
+		return &swf.Decision{
+			DecisionType: S(swf.DecisionTypeStartChildWorkflowExecution),
+			StartChildWorkflowExecutionDecisionAttributes: &swf.StartChildWorkflowExecutionDecisionAttributes{
+				WorkflowId:   S(info.WorkflowId),
+				WorkflowType: info.WorkflowType,
+				Input:        info.Input,
+			},
+		}, true
+	}
+	return nil, false
+}
+
+// failedAttempts counts the failure being decided, which the correlator only records once the event is tracked, after deciding.
+func (f *FSMContext) failedAttempts(h *swf.HistoryEvent, recorded int) int {
+	switch *h.EventType {
+	case swf.EventTypeActivityTaskFailed, swf.EventTypeActivityTaskTimedOut, swf.EventTypeSignalExternalWorkflowExecutionFailed,
+		swf.EventTypeStartChildWorkflowExecutionFailed:
+		return recorded + 1
+	}
+	return recorded
+}
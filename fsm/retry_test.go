@@ -0,0 +1,172 @@
+package fsm
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+	. "github.com/sclasen/swfsm/sugar"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	// arrange
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Second, Multiplier: 2, MaxBackoff: 30 * time.Second}
+
+	// act & assert
+	assert.Equal(t, 10*time.Second, policy.Backoff(1))
+	assert.Equal(t, 20*time.Second, policy.Backoff(2))
+	assert.Equal(t, 30*time.Second, policy.Backoff(3), "Expected the backoff capped at MaxBackoff")
+	assert.True(t, policy.ShouldRetry(2))
+	assert.False(t, policy.ShouldRetry(3))
+	assert.True(t, RetryPolicy{}.ShouldRetry(100), "Expected no MaxAttempts to retry forever")
+	assert.Equal(t, "1", *RetryPolicy{InitialBackoff: 100 * time.Millisecond}.BackoffTimer("t", 1).StartTimerDecisionAttributes.StartToFireTimeout,
+		"Expected backoffs under a second to round up to SWF's 1 second minimum")
+	assert.Equal(t, 10*time.Second, policy.Backoff(0), "Expected no attempts to back off like the first")
+	assert.Equal(t, time.Duration(math.MaxInt64), RetryPolicy{InitialBackoff: time.Second, Multiplier: 2}.Backoff(1000),
+		"Expected an uncapped backoff not to overflow")
+}
+
+func TestRetryActivityExpectsBackoffTimersUntilMaxAttempts(t *testing.T) {
+	// arrange
+	ctx := testContext(testFSM())
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Second, Multiplier: 2}
+	var timeouts []string
+	gaveUp := false
+	decider := func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome {
+		if *h.EventType != swf.EventTypeActivityTaskFailed {
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		}
+		timer, ok := ctx.RetryActivity(policy, h)
+		if !ok {
+			gaveUp = true
+			return ctx.Stay(data, ctx.EmptyDecisions())
+		}
+		assert.Equal(t, RetryActivityTimerPrefix+"activity-id", *timer.StartTimerDecisionAttributes.TimerId)
+		timeouts = append(timeouts, *timer.StartTimerDecisionAttributes.StartToFireTimeout)
+		return ctx.Stay(data, []*swf.Decision{timer})
+	}
+
+	// act
+	for id := 1; id < 9 && !gaveUp; id += 2 {
+		ctx.Decide(EventFromPayload(id, &swf.ActivityTaskScheduledEventAttributes{
+			ActivityId:   S("activity-id"),
+			ActivityType: &swf.ActivityType{Name: S("activity"), Version: S("1")},
+		}), nil, decider)
+		ctx.Decide(EventFromPayload(id+1, &swf.ActivityTaskFailedEventAttributes{ScheduledEventId: I(id)}), nil, decider)
+	}
+
+	// assert
+	assert.Equal(t, []string{"10", "20"}, timeouts, "Expected exponential backoff for the first two failures")
+	assert.True(t, gaveUp, "Expected to give up on the third failure")
+}
+
+func TestRetrySignalExpectsBackoffTimer(t *testing.T) {
+	// arrange
+	ctx := testContext(testFSM())
+	ctx.Decide(EventFromPayload(1, &swf.SignalExternalWorkflowExecutionInitiatedEventAttributes{
+		SignalName: S("signal"), WorkflowId: S("other"),
+	}), nil, func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome { return ctx.Pass() })
+	failed := EventFromPayload(2, &swf.SignalExternalWorkflowExecutionFailedEventAttributes{InitiatedEventId: I(1)})
+
+	// act
+	timer, ok := ctx.RetrySignal(RetryPolicy{MaxAttempts: 2, InitialBackoff: 5 * time.Second}, failed)
+	_, notCorrelated := ctx.RetrySignal(RetryPolicy{}, EventFromPayload(3, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("signal")}))
+
+	// assert
+	assert.True(t, ok)
+	assert.Equal(t, RetrySignalTimerPrefix+"signal-other", *timer.StartTimerDecisionAttributes.TimerId)
+	assert.Equal(t, "5", *timer.StartTimerDecisionAttributes.StartToFireTimeout)
+	assert.False(t, notCorrelated, "Expected no retry for an event not correlated to a signal")
+}
+
+func TestRetrySignalExpectsLongTimerIdsBounded(t *testing.T) {
+	// arrange
+	ctx := testContext(testFSM())
+	workflowId := strings.Repeat("w", MaxTimerIdLength)
+	ctx.Decide(EventFromPayload(1, &swf.SignalExternalWorkflowExecutionInitiatedEventAttributes{
+		SignalName: S("signal"), WorkflowId: S(workflowId),
+	}), nil, func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome { return ctx.Pass() })
+	failed := EventFromPayload(2, &swf.SignalExternalWorkflowExecutionFailedEventAttributes{InitiatedEventId: I(1)})
+
+	// act
+	timer, ok := ctx.RetrySignal(RetryPolicy{InitialBackoff: 5 * time.Second}, failed)
+
+	// assert
+	assert.True(t, ok)
+	timerId := *timer.StartTimerDecisionAttributes.TimerId
+	assert.Len(t, timerId, MaxTimerIdLength, "Expected the timer id bounded by SWF's limit")
+	assert.True(t, strings.HasPrefix(timerId, RetrySignalTimerPrefix+"signal-w"))
+	assert.NotEqual(t, timerId, retryTimerId(RetrySignalTimerPrefix+"signal-"+workflowId+"x"), "Expected the hash to keep long ids unique")
+}
+
+func TestRetryDecisionWhenRetryTimerFiresExpectsActivityRescheduled(t *testing.T) {
+	// arrange
+	ctx := testContext(testFSM())
+	activityId := strings.Repeat("a", MaxTimerIdLength)
+	pass := func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome { return ctx.Pass() }
+	ctx.Decide(EventFromPayload(1, &swf.ActivityTaskScheduledEventAttributes{
+		ActivityId:   S(activityId),
+		ActivityType: &swf.ActivityType{Name: S("activity"), Version: S("1")},
+		Input:        S("input"),
+	}), nil, pass)
+	failed := EventFromPayload(2, &swf.ActivityTaskFailedEventAttributes{ScheduledEventId: I(1)})
+	timer, ok := ctx.RetryActivity(RetryPolicy{InitialBackoff: time.Second}, failed)
+	ctx.Decide(failed, nil, pass)
+	ctx.Decide(EventFromPayload(3, &swf.TimerStartedEventAttributes{
+		TimerId:            timer.StartTimerDecisionAttributes.TimerId,
+		Control:            timer.StartTimerDecisionAttributes.Control,
+		StartToFireTimeout: timer.StartTimerDecisionAttributes.StartToFireTimeout,
+	}), nil, pass)
+	fired := EventFromPayload(4, &swf.TimerFiredEventAttributes{TimerId: timer.StartTimerDecisionAttributes.TimerId, StartedEventId: I(3)})
+
+	// act
+	retry, retried := ctx.RetryDecision(fired)
+	_, notRetry := ctx.RetryDecision(failed)
+
+	// assert
+	assert.True(t, ok)
+	assert.Nil(t, ctx.ActivityInfo(failed), "Expected the correlator to forget the failed activity")
+	if assert.True(t, retried, "Expected the activity retried when the timer fires") {
+		attrs := retry.ScheduleActivityTaskDecisionAttributes
+		assert.Equal(t, activityId, *attrs.ActivityId, "Expected the hashed timer id not to lose the ActivityId")
+		assert.Equal(t, "activity", *attrs.ActivityType.Name)
+		assert.Equal(t, "input", *attrs.Input)
+	}
+	assert.False(t, notRetry, "Expected no retry for an event other than a retry timer firing")
+}
+
+func TestRetryChildExpectsBackoffTimerAndChildStartedWhenItFires(t *testing.T) {
+	// arrange
+	ctx := testContext(testFSM())
+	pass := func(ctx *FSMContext, h *swf.HistoryEvent, data interface{}) Outcome { return ctx.Pass() }
+	ctx.Decide(EventFromPayload(1, &swf.StartChildWorkflowExecutionInitiatedEventAttributes{
+		WorkflowId:   S("child"),
+		WorkflowType: &swf.WorkflowType{Name: S("child-workflow"), Version: S("1")},
+		Input:        S("input"),
+	}), nil, pass)
+	failed := EventFromPayload(2, &swf.StartChildWorkflowExecutionFailedEventAttributes{InitiatedEventId: I(1)})
+
+	// act
+	timer, ok := ctx.RetryChild(RetryPolicy{MaxAttempts: 2, InitialBackoff: 5 * time.Second}, failed)
+	ctx.Decide(failed, nil, pass)
+	ctx.Decide(EventFromPayload(3, &swf.TimerStartedEventAttributes{
+		TimerId:            timer.StartTimerDecisionAttributes.TimerId,
+		Control:            timer.StartTimerDecisionAttributes.Control,
+		StartToFireTimeout: timer.StartTimerDecisionAttributes.StartToFireTimeout,
+	}), nil, pass)
+	retry, retried := ctx.RetryDecision(EventFromPayload(4, &swf.TimerFiredEventAttributes{TimerId: timer.StartTimerDecisionAttributes.TimerId, StartedEventId: I(3)}))
+
+	// assert
+	assert.True(t, ok)
+	assert.Equal(t, RetryChildTimerPrefix+"child", *timer.StartTimerDecisionAttributes.TimerId)
+	assert.Equal(t, "5", *timer.StartTimerDecisionAttributes.StartToFireTimeout)
+	if assert.True(t, retried, "Expected the child started again when the timer fires") {
+		attrs := retry.StartChildWorkflowExecutionDecisionAttributes
+		assert.Equal(t, "child", *attrs.WorkflowId)
+		assert.Equal(t, "child-workflow", *attrs.WorkflowType.Name)
+		assert.Equal(t, "input", *attrs.Input)
+	}
+}
@@ -40,10 +40,34 @@ type S3Serializer struct {
 	s3Prefix string
 
 	under swfsm.StateSerializer
+
+	// serialized data of at least this length is stored in S3, 0 means use minS3Length
+	threshold int
 }
 
 func New(s3c S3Ops, bucket, prefix string, under swfsm.StateSerializer) *S3Serializer {
-	return &S3Serializer{s3c, bucket, prefix, under}
+	return &S3Serializer{s3c: s3c, s3Bucket: bucket, s3Prefix: prefix, under: under}
+}
+
+// NewWithThreshold is like New, but stores serialized data in S3 only if it is at least threshold long.
+// e.g. activity inputs and results are limited to 32768 characters by SWF.
+func NewWithThreshold(s3c S3Ops, bucket, prefix string, under swfsm.StateSerializer, threshold int) *S3Serializer {
+	s := New(s3c, bucket, prefix, under)
+	s.threshold = threshold
+	return s
+}
+
+// ActivityInput serializes the input for a ScheduleActivityTask decision of an activity whose ActivityHandler.Serializer
+// is this serializer, so large inputs are passed through S3. Deserialize reads the result of the activity.
+// It is not replay-safe: each call Puts a new object to S3 for a large input, so a decider that is run again for
+// the same events, e.g. after a decision task fails or times out, leaves the objects of earlier runs behind.
+// Deciders should call it only when scheduling the activity, never while replaying past events.
+func (s *S3Serializer) ActivityInput(input interface{}) (*string, error) {
+	ser, err := s.Serialize(input)
+	if err != nil {
+		return nil, err
+	}
+	return aws.String(ser), nil
 }
 
 func (s *S3Serializer) Serialize(state interface{}) (string, error) {
@@ -52,8 +76,13 @@ func (s *S3Serializer) Serialize(state interface{}) (string, error) {
 		return "", err
 	}
 
+	threshold := s.threshold
+	if threshold == 0 {
+		threshold = minS3Length
+	}
+
 	slen := len(ser)
-	if slen < minS3Length {
+	if slen < threshold {
 		return ser, nil
 	}
 
@@ -120,3 +149,54 @@ func (s *S3Serializer) Deserialize(deser string, state interface{}) error {
 
 	return s.under.Deserialize(string(b), state)
 }
+
+// OverflowStore is an fsm.OverflowStore that keeps the payloads of large markers in S3.
+type OverflowStore struct {
+	s3c      S3Ops
+	s3Bucket string
+	s3Prefix string
+}
+
+// NewOverflowStore returns an OverflowStore putting payloads in the bucket, under the prefix if it is not empty.
+func NewOverflowStore(s3c S3Ops, bucket, prefix string) *OverflowStore {
+	return &OverflowStore{s3c: s3c, s3Bucket: bucket, s3Prefix: prefix}
+}
+
+func (o *OverflowStore) Put(key string, payload string) error {
+	key = o.key(key)
+	_, err := o.s3c.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(o.s3Bucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader(payload),
+	})
+	if err != nil {
+		Log.Printf("component=s3serializer bucket=%q key=%q slen=%d at=overflow-put-error error=%q", o.s3Bucket, key, len(payload), err)
+	}
+	return err
+}
+
+func (o *OverflowStore) Get(key string) (string, error) {
+	key = o.key(key)
+	resp, err := o.s3c.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(o.s3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		Log.Printf("component=s3serializer bucket=%q key=%q at=overflow-get-error error=%q", o.s3Bucket, key, err)
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (o *OverflowStore) key(key string) string {
+	if o.s3Prefix != "" {
+		return o.s3Prefix + "/" + key
+	}
+	return key
+}
@@ -94,6 +94,31 @@ func TestSerialize_LargeData(t *testing.T) {
 	}
 }
 
+func TestActivityInput_WithThreshold(t *testing.T) {
+	defer func() { keyGen = defaultKeyGen }()
+	keyGen = staticKeyGen
+
+	s3c := &fakeS3{}
+	under := &fakeSerializer{}
+	ss := NewWithThreshold(s3c, bucket, prefix, under, 10)
+
+	td := strings.Repeat("x", 20)
+
+	input, err := ss.ActivityInput(td)
+
+	if err != nil {
+		t.Fatalf("expected nil err, got %q", err)
+	}
+
+	if s3c.put.input == nil {
+		t.Fatalf("expected S3 request for data over the threshold")
+	}
+
+	if !strings.HasPrefix(*input, magicPrefix) {
+		t.Fatalf("expected %q to begin with magicPrefix %q", *input, magicPrefix)
+	}
+}
+
 func TestDeserialize_NoMagic(t *testing.T) {
 	s3c := &fakeS3{}
 	under := &fakeSerializer{}
@@ -154,6 +179,30 @@ func TestDeserialize_Magic(t *testing.T) {
 	}
 }
 
+func TestOverflowStore(t *testing.T) {
+	s3c := &fakeS3{}
+	store := NewOverflowStore(s3c, bucket, prefix)
+
+	if err := store.Put("workflow/run/FSM.State/2", "payload"); err != nil {
+		t.Fatalf("expected no error, got %q", err)
+	}
+	if want, got := prefix+"/workflow/run/FSM.State/2", *s3c.put.input.Key; want != got {
+		t.Fatalf("expected S3 put to key %q, got %q", want, got)
+	}
+	if want, got := "payload", s3c.put.body; want != got {
+		t.Fatalf("expected S3 put of %q, got %q", want, got)
+	}
+
+	s3c.get.body = "payload"
+	payload, err := store.Get("workflow/run/FSM.State/2")
+	if err != nil {
+		t.Fatalf("expected no error, got %q", err)
+	}
+	if payload != "payload" || *s3c.get.input.Key != prefix+"/workflow/run/FSM.State/2" {
+		t.Fatalf("unexpected get of %q from key %q", payload, *s3c.get.input.Key)
+	}
+}
+
 type fakeS3 struct {
 	put struct {
 		input *s3.PutObjectInput
@@ -0,0 +1,182 @@
+package validatingserializer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	swfsm "github.com/sclasen/swfsm/fsm"
+)
+
+// Schema is the subset of JSON Schema that is validated: type (a single type name), properties, required,
+// additionalProperties (as a boolean), items (a single schema) and enum. Other keywords are ignored.
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+}
+
+// ValidationError describes the first part of a document that does not match the schema.
+// Path is a JSON path to the mismatched value, e.g. $.orders[2].id
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("schema validation failed at %s: %s", e.Path, e.Message)
+}
+
+// ValidatingStateSerializer is a StateSerializer that wraps a StateSerializer producing JSON,
+// and validates the documents it produces and consumes against a Schema.
+// This catches incompatible changes to the shape of state data at the serialization boundary,
+// with an error naming the mismatched field.
+type ValidatingStateSerializer struct {
+	schema *Schema
+	under  swfsm.StateSerializer
+}
+
+// New parses the JSON schema and returns a ValidatingStateSerializer wrapping under.
+func New(schema string, under swfsm.StateSerializer) (*ValidatingStateSerializer, error) {
+	s := &Schema{}
+	if err := decode(schema, s); err != nil {
+		return nil, errors.Annotate(err, "parse schema")
+	}
+	return &ValidatingStateSerializer{schema: s, under: under}, nil
+}
+
+// Serialize serializes the state with the wrapped serializer, and validates the result.
+func (v *ValidatingStateSerializer) Serialize(state interface{}) (string, error) {
+	serialized, err := v.under.Serialize(state)
+	if err != nil {
+		return "", err
+	}
+	if err := v.Validate(serialized); err != nil {
+		return "", err
+	}
+	return serialized, nil
+}
+
+// Deserialize validates the serialized state, and deserializes it with the wrapped serializer.
+func (v *ValidatingStateSerializer) Deserialize(serialized string, state interface{}) error {
+	if err := v.Validate(serialized); err != nil {
+		return err
+	}
+	return v.under.Deserialize(serialized, state)
+}
+
+// Validate validates a JSON document against the schema. It returns a *ValidationError if the document does not match.
+func (v *ValidatingStateSerializer) Validate(document string) error {
+	var value interface{}
+	if err := decode(document, &value); err != nil {
+		return &ValidationError{Path: "$", Message: err.Error()}
+	}
+	return validate("$", value, v.schema)
+}
+
+func decode(document string, into interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(document))
+	decoder.UseNumber()
+	return decoder.Decode(into)
+}
+
+func validate(path string, value interface{}, schema *Schema) error {
+	if schema == nil {
+		return nil
+	}
+
+	if schema.Type != "" && !hasType(value, schema.Type) {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("expected %s, got %s", schema.Type, typeOf(value))}
+	}
+
+	if len(schema.Enum) > 0 && !inEnum(value, schema.Enum) {
+		return &ValidationError{Path: path, Message: fmt.Sprintf("value %s is not one of the enum values", compact(value))}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				return &ValidationError{Path: path + "." + name, Message: "required property is missing"}
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := schema.Properties[name]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					return &ValidationError{Path: path + "." + name, Message: "property is not allowed by the schema"}
+				}
+				continue
+			}
+			if err := validate(path+"."+name, v[name], property); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			if err := validate(fmt.Sprintf("%s[%d]", path, i), item, schema.Items); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func hasType(value interface{}, schemaType string) bool {
+	actual := typeOf(value)
+	if schemaType == "number" && actual == "integer" {
+		return true
+	}
+	return actual == schemaType
+}
+
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func inEnum(value interface{}, enum []interface{}) bool {
+	for _, e := range enum {
+		if reflect.DeepEqual(value, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func compact(value interface{}) string {
+	b := &bytes.Buffer{}
+	if err := json.NewEncoder(b).Encode(value); err != nil {
+		return fmt.Sprint(value)
+	}
+	return strings.TrimSpace(b.String())
+}
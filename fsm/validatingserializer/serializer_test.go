@@ -0,0 +1,102 @@
+package validatingserializer
+
+import (
+	"testing"
+
+	swfsm "github.com/sclasen/swfsm/fsm"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "items"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "string"},
+		"status": {"type": "string", "enum": ["open", "closed"]},
+		"items": {
+			"type": "array",
+			"items": {
+				"type": "object",
+				"required": ["sku"],
+				"properties": {"sku": {"type": "string"}, "quantity": {"type": "integer"}}
+			}
+		}
+	}
+}`
+
+type item struct {
+	Sku      string      `json:"sku"`
+	Quantity interface{} `json:"quantity,omitempty"`
+}
+
+type order struct {
+	Id     string `json:"id"`
+	Status string `json:"status,omitempty"`
+	Items  []item `json:"items"`
+}
+
+func TestSerialize_Valid(t *testing.T) {
+	v, err := New(orderSchema, swfsm.JSONStateSerializer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ser, err := v.Serialize(&order{Id: "1", Status: "open", Items: []item{{Sku: "a", Quantity: 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &order{}
+	if err := v.Deserialize(ser, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Id != "1" || out.Items[0].Sku != "a" {
+		t.Fatal(out)
+	}
+}
+
+func TestSerialize_Invalid(t *testing.T) {
+	v, err := New(orderSchema, swfsm.JSONStateSerializer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = v.Serialize(&order{Id: "1", Items: []item{{Sku: "a"}, {Sku: "b", Quantity: 1.5}}})
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a *ValidationError, got %v", err)
+	}
+	if verr.Path != "$.items[1].quantity" {
+		t.Fatalf("expected the mismatched field path, got %q", verr.Path)
+	}
+}
+
+func TestDeserialize_Invalid(t *testing.T) {
+	v, err := New(orderSchema, swfsm.JSONStateSerializer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		`{"items":[]}`:                       "$.id",
+		`{"id":1,"items":[]}`:                "$.id",
+		`{"id":"1","items":[],"extra":true}`: "$.extra",
+		`{"id":"1","items":[],"status":"x"}`: "$.status",
+		`{"id":"1","items":[{}]}`:            "$.items[0].sku",
+		`not json`:                           "$",
+	}
+
+	for document, path := range cases {
+		err := v.Deserialize(document, &order{})
+		verr, ok := err.(*ValidationError)
+		if !ok || verr.Path != path {
+			t.Fatalf("document %s: expected a *ValidationError at %s, got %v", document, path, err)
+		}
+	}
+}
+
+func TestNew_InvalidSchema(t *testing.T) {
+	if _, err := New(`{"type": 1}`, swfsm.JSONStateSerializer{}); err == nil {
+		t.Fatal("expected an error for an invalid schema")
+	}
+}
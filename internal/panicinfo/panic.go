@@ -1,6 +1,8 @@
 package panicinfo
 
 import (
+	"fmt"
+	"path"
 	"runtime"
 	"strings"
 )
@@ -32,3 +34,9 @@ func LocatePanic(r interface{}) (file string, line int, funcName string) {
 
 	return file, line, funcName
 }
+
+// Describe formats the results of LocatePanic for an error message, with the
+// file and function trimmed to their base names, e.g. func=fsm.decide file=fsm.go:12
+func Describe(file string, line int, funcName string) string {
+	return fmt.Sprintf("func=%s file=%s:%d", path.Base(funcName), path.Base(file), line)
+}
@@ -30,3 +30,10 @@ func panicFunc() {
 	}()
 	panic("lol I paniced")
 }
+
+func TestDescribe(t *testing.T) {
+	described := Describe("/go/src/github.com/sclasen/swfsm/fsm/fsm.go", 12, "github.com/sclasen/swfsm/fsm.(*FSM).decide")
+	if described != "func=fsm.(*FSM).decide file=fsm.go:12" {
+		t.Errorf("Unexpected description: %s", described)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	golog "log"
 	"os"
+	"strings"
 )
 
 // Won't compile if StdLogger can't be realized by a log.Logger
@@ -30,6 +31,94 @@ type StdLogger interface {
 //this is what the default logger in go's log pakcage looks like
 var Log StdLogger = golog.New(os.Stderr, "", golog.LstdFlags)
 
+// StructuredLogger can be implemented by a StdLogger given to an FSM, ActivityWorker or poller
+// to receive each log line as fields rather than as a logfmt formatted string.
+type StructuredLogger interface {
+	Log(fields map[string]interface{})
+}
+
+// Logf formats a logfmt line and logs it to the logger, or to Log if the logger is nil.
+// If the logger is a StructuredLogger, it is passed the fields of the line instead, keyed by the keys of the format,
+// with the data as values rather than their formatted text, e.g. key=%d is an int and key=%q an unquoted string.
+// Formats that FormatFields does not support are passed formatted under the "msg" field.
+func Logf(logger StdLogger, format string, data ...interface{}) {
+	if logger == nil {
+		logger = Log
+	}
+	if structured, ok := logger.(StructuredLogger); ok {
+		fields, ok := FormatFields(format, data...)
+		if !ok {
+			fields = map[string]interface{}{"msg": fmt.Sprintf(format, data...)}
+		}
+		structured.Log(fields)
+		return
+	}
+	logger.Printf(format, data...)
+}
+
+// FormatFields pairs the key=value pairs of a logfmt format with the data formatted by their verbs.
+// A value that is a single %d or %t is the datum itself, other values are formatted, with %q as %s so they are not quoted.
+// Any text that is not a key=value pair is formatted and collected under the "msg" field.
+// It returns false when the verbs of the format do not consume exactly the data, e.g. with * widths.
+func FormatFields(format string, data ...interface{}) (map[string]interface{}, bool) {
+	fields := make(map[string]interface{})
+	var msg []string
+	next := 0
+	for _, token := range strings.Fields(format) {
+		verbs, ok := formatVerbs(token)
+		if !ok || next+len(verbs) > len(data) {
+			return nil, false
+		}
+		args := data[next : next+len(verbs)]
+		next += len(verbs)
+
+		eq := strings.IndexByte(token, '=')
+		if eq <= 0 || strings.ContainsRune(token[:eq], '%') {
+			msg = append(msg, fmt.Sprintf(token, args...))
+			continue
+		}
+		key, value := token[:eq], token[eq+1:]
+		if len(value) > 1 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+			value = value[1 : len(value)-1]
+		}
+		if len(verbs) == 1 && (value == "%d" || value == "%t") {
+			fields[key] = args[0]
+		} else {
+			fields[key] = fmt.Sprintf(strings.Replace(value, "%q", "%s", -1), args...)
+		}
+	}
+	if next != len(data) {
+		return nil, false
+	}
+	if len(msg) > 0 {
+		fields["msg"] = strings.Join(msg, " ")
+	}
+	return fields, true
+}
+
+// formatVerbs returns the verbs, with their flags, in a token of a format. %% is not a verb.
+// It returns false for verbs that consume more than one datum or pick their datum, which are not supported.
+func formatVerbs(token string) ([]string, bool) {
+	var verbs []string
+	for i := 0; i < len(token); i++ {
+		if token[i] != '%' {
+			continue
+		}
+		j := i + 1
+		for j < len(token) && strings.IndexByte("+-# 0123456789.", token[j]) != -1 {
+			j++
+		}
+		if j == len(token) || token[j] == '*' || token[j] == '[' {
+			return nil, false
+		}
+		if token[j] != '%' {
+			verbs = append(verbs, token[i:j+1])
+		}
+		i = j
+	}
+	return verbs, true
+}
+
 // CapturingLogger is designed to be used in testing - it will saves lines it receives
 type CapturingLogger struct {
 	Lines []string
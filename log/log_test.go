@@ -0,0 +1,70 @@
+package log
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLogfWhenStructuredLoggerExpectsFields(t *testing.T) {
+	logger := &structuredLogger{}
+
+	Logf(logger, "component=%s at=%s", "test", "structured")
+
+	if len(logger.Lines) != 0 || len(logger.fields) != 1 || logger.fields[0]["at"] != "structured" {
+		t.Fatalf("expected a single structured log, got lines=%v fields=%v", logger.Lines, logger.fields)
+	}
+}
+
+func TestFormatFields(t *testing.T) {
+	fields, ok := FormatFields(`component=FSM id=%d at=decide-panic-recovery file="%s:%d" error=%q sleep=%ds 100%% done=%t`,
+		42, "fsm.go", 12, `some "bad" thing`, 3, true)
+
+	expected := map[string]interface{}{
+		"component": "FSM",
+		"id":        42,
+		"at":        "decide-panic-recovery",
+		"file":      "fsm.go:12",
+		"error":     `some "bad" thing`,
+		"sleep":     "3s",
+		"done":      true,
+		"msg":       "100%",
+	}
+	if !ok || !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("expected %v, got %v", expected, fields)
+	}
+	if _, ok := FormatFields("width=%*d", 3, 4); ok {
+		t.Fatal("expected * widths unsupported")
+	}
+	if _, ok := FormatFields("missing=%s"); ok {
+		t.Fatal("expected missing data unsupported")
+	}
+}
+
+func TestLogfWhenStructuredLoggerAndFormatUnsupportedExpectsMsg(t *testing.T) {
+	logger := &structuredLogger{}
+
+	Logf(logger, "at=%s width=%*d", "padded", 3, 4)
+
+	if len(logger.fields) != 1 || logger.fields[0]["msg"] != "at=padded width=  4" {
+		t.Fatalf("expected the formatted line as msg, got %v", logger.fields)
+	}
+}
+
+func TestLogfWhenStructuredLoggerExpectsValuesNotReparsed(t *testing.T) {
+	logger := &structuredLogger{}
+
+	Logf(logger, "at=%s error=%q attempts=%d", "fail", "a value with spaces and key=value", 2)
+
+	if len(logger.fields) != 1 || logger.fields[0]["error"] != "a value with spaces and key=value" || logger.fields[0]["attempts"] != 2 {
+		t.Fatalf("expected the values as given, got %v", logger.fields)
+	}
+}
+
+type structuredLogger struct {
+	CapturingLogger
+	fields []map[string]interface{}
+}
+
+func (s *structuredLogger) Log(fields map[string]interface{}) {
+	s.fields = append(s.fields, fields)
+}
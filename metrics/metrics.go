@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"time"
+)
+
+// Names of the metrics emitted by pollers and FSMs.
+const (
+	// DecisionTaskLatency is the time from a decision task being started to it being received by the poller.
+	DecisionTaskLatency = "swfsm.decision-task.latency"
+	// DecisionTaskTick is the time taken to decide a decision task.
+	DecisionTaskTick = "swfsm.decision-task.tick"
+	// DecisionTaskDecisions is the number of decisions in a completed decision task.
+	DecisionTaskDecisions = "swfsm.decision-task.decisions"
+	// ErrorMarkersRecorded counts the error markers recorded for workflows in error.
+	ErrorMarkersRecorded = "swfsm.error-markers.recorded"
+)
+
+// MetricsSink receives metrics from pollers and FSMs, so they can be fed to a metrics system.
+// Tags hold dimensions such as the workflow type, and must not be modified.
+type MetricsSink interface {
+	Timing(name string, d time.Duration, tags map[string]string)
+	Count(name string, n int, tags map[string]string)
+}
+
+// NoopSink is a MetricsSink that discards all metrics.
+type NoopSink struct{}
+
+// Timing discards the timing.
+func (NoopSink) Timing(name string, d time.Duration, tags map[string]string) {}
+
+// Count discards the count.
+func (NoopSink) Count(name string, n int, tags map[string]string) {}
+
+// Sink is the MetricsSink used when none is configured, it is a NoopSink unless changed.
+var Sink MetricsSink = NoopSink{}
+
+// Timing sends the timing to the sink, or to Sink if the sink is nil.
+func Timing(sink MetricsSink, name string, d time.Duration, tags map[string]string) {
+	if sink == nil {
+		sink = Sink
+	}
+	sink.Timing(name, d, tags)
+}
+
+// Count sends the count to the sink, or to Sink if the sink is nil.
+func Count(sink MetricsSink, name string, n int, tags map[string]string) {
+	if sink == nil {
+		sink = Sink
+	}
+	sink.Count(name, n, tags)
+}
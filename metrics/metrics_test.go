@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+type recordingSink struct {
+	timings map[string]time.Duration
+	counts  map[string]int
+}
+
+func (r *recordingSink) Timing(name string, d time.Duration, tags map[string]string) {
+	r.timings[name] = d
+}
+
+func (r *recordingSink) Count(name string, n int, tags map[string]string) {
+	r.counts[name] += n
+}
+
+func TestTimingAndCountWhenSinkNilExpectsDefaultSink(t *testing.T) {
+	defaultSink := &recordingSink{timings: map[string]time.Duration{}, counts: map[string]int{}}
+	Sink = defaultSink
+	defer func() { Sink = NoopSink{} }()
+
+	Timing(nil, DecisionTaskTick, time.Second, nil)
+	Count(nil, DecisionTaskDecisions, 2, nil)
+
+	if defaultSink.timings[DecisionTaskTick] != time.Second || defaultSink.counts[DecisionTaskDecisions] != 2 {
+		t.Fatalf("expected metrics on the default sink, got timings=%v counts=%v", defaultSink.timings, defaultSink.counts)
+	}
+}
+
+func TestTimingAndCountExpectsGivenSink(t *testing.T) {
+	sink := &recordingSink{timings: map[string]time.Duration{}, counts: map[string]int{}}
+
+	Timing(sink, DecisionTaskLatency, time.Millisecond, map[string]string{"workflow": "test"})
+	Count(sink, ErrorMarkersRecorded, 1, map[string]string{"workflow": "test"})
+
+	if sink.timings[DecisionTaskLatency] != time.Millisecond || sink.counts[ErrorMarkersRecorded] != 1 {
+		t.Fatalf("expected metrics on the given sink, got timings=%v counts=%v", sink.timings, sink.counts)
+	}
+}
@@ -1,6 +1,10 @@
 package poller
 
 import (
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -9,6 +13,7 @@ import (
 	"github.com/juju/errors"
 	"github.com/pborman/uuid"
 	. "github.com/sclasen/swfsm/log"
+	"github.com/sclasen/swfsm/metrics"
 	. "github.com/sclasen/swfsm/sugar"
 )
 
@@ -21,13 +26,43 @@ type ActivityOps interface {
 	PollForActivityTask(req *swf.PollForActivityTaskInput) (resp *swf.PollForActivityTaskOutput, err error)
 }
 
+// DefaultStartupJitter is the StartupJitter used by pollers created with NewDecisionTaskPoller and NewActivityTaskPoller.
+var DefaultStartupJitter = 3 * time.Second
+
+// IDGenerator generates the poll ids of pollers that have no IDGenerator set. It can be replaced,
+// e.g. to produce stable ids in tests, or ids that line up with an external tracing system.
+var IDGenerator = uuid.New
+
+func newPollId(idGenerator func() string) string {
+	if idGenerator != nil {
+		return idGenerator()
+	}
+	return IDGenerator()
+}
+
+// ExpandIdentity replaces {host} in the identity with the hostname, and {pid} with the process id,
+// so that an identity such as "my-fsm-{host}-{pid}" tells which replica polled a task.
+// The pollers created with NewDecisionTaskPoller and NewActivityTaskPoller expand their identity.
+func ExpandIdentity(identity string) string {
+	if strings.Contains(identity, "{host}") {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "unknown-host"
+		}
+		identity = strings.Replace(identity, "{host}", host, -1)
+	}
+	return strings.Replace(identity, "{pid}", strconv.Itoa(os.Getpid()), -1)
+}
+
 // NewDecisionTaskPoller returns a DecisionTaskPoller whick can be used to poll the given task list.
+// The identity is expanded with ExpandIdentity.
 func NewDecisionTaskPoller(dwc DecisionOps, domain string, identity string, taskList string) *DecisionTaskPoller {
 	return &DecisionTaskPoller{
-		client:   dwc,
-		Domain:   domain,
-		Identity: identity,
-		TaskList: taskList,
+		client:        dwc,
+		Domain:        domain,
+		Identity:      ExpandIdentity(identity),
+		TaskList:      taskList,
+		StartupJitter: DefaultStartupJitter,
 	}
 }
 
@@ -37,6 +72,21 @@ type DecisionTaskPoller struct {
 	Identity string
 	Domain   string
 	TaskList string
+	// StartupJitter is the upper bound of a random delay before the first poll in PollUntilShutdownBy,
+	// so that pollers started together do not poll in lockstep. Zero disables the delay.
+	StartupJitter time.Duration
+	// Logger is used for output on the poller. If not set, will use log.Log.
+	Logger StdLogger
+	// OnEmptyPoll, if set, is called by PollUntilShutdownBy after each poll that returned no task, with the number
+	// of consecutive empty polls, e.g. to detect a task list that stays empty because it is misconfigured.
+	OnEmptyPoll func(consecutive int)
+	// EmptyPollDelay is waited by PollUntilShutdownBy after a poll that returned no task, before polling again,
+	// to reduce the volume of polls. Zero polls again immediately.
+	EmptyPollDelay time.Duration
+	// MetricsSink receives the latency of decision tasks. If not set, will use metrics.Sink.
+	MetricsSink metrics.MetricsSink
+	// IDGenerator generates the id of each poll, which is logged with its pages. If not set, will use poller.IDGenerator.
+	IDGenerator func() string
 }
 
 // Poll polls the task list for a task. If there is no task available, nil is
@@ -45,7 +95,7 @@ func (p *DecisionTaskPoller) Poll(taskReady func(*swf.PollForDecisionTaskOutput)
 	var (
 		resp   *swf.PollForDecisionTaskOutput
 		page   int
-		pollId = uuid.New()
+		pollId = newPollId(p.IDGenerator)
 	)
 
 	eachPage := func(out *swf.PollForDecisionTaskOutput, _ bool) bool {
@@ -68,7 +118,7 @@ func (p *DecisionTaskPoller) Poll(taskReady func(*swf.PollForDecisionTaskOutput)
 			workflowId = "no-workflow-execution"
 		}
 
-		Log.Printf("component=DecisionTaskPoller at=decision-task-page poll-id=%q task-list=%q workflow=%q page=%d "+
+		Logf(p.Logger, "component=DecisionTaskPoller at=decision-task-page poll-id=%q task-list=%q workflow=%q page=%d "+
 			"PreviousStartedEventId=%s StartedEventId=%s NumEvents=%d FirstEventId=%s LastEventId=%s",
 			pollId, p.TaskList, workflowId, page,
 			LL(out.PreviousStartedEventId), LL(out.StartedEventId), len(out.Events), LL(firstEventId), LL(lastEventId))
@@ -90,17 +140,17 @@ func (p *DecisionTaskPoller) Poll(taskReady func(*swf.PollForDecisionTaskOutput)
 	}, eachPage)
 
 	if err != nil {
-		Log.Printf("component=DecisionTaskPoller poll-id=%q task-list=%q at=error error=%q",
+		Logf(p.Logger, "component=DecisionTaskPoller poll-id=%q task-list=%q at=error error=%q",
 			pollId, p.TaskList, err.Error())
 		return nil, errors.Trace(err)
 	}
 	if resp != nil && resp.TaskToken != nil {
-		Log.Printf("component=DecisionTaskPoller poll-id=%q at=decision-task-received task-list=%q workflow=%q",
+		Logf(p.Logger, "component=DecisionTaskPoller poll-id=%q at=decision-task-received task-list=%q workflow=%q",
 			pollId, p.TaskList, LS(resp.WorkflowExecution.WorkflowId))
 		p.logTaskLatency(resp)
 		return resp, nil
 	}
-	Log.Printf("component=DecisionTaskPoller at=decision-task-empty-response poll-id=%q task-list=%q", pollId, p.TaskList)
+	Logf(p.Logger, "component=DecisionTaskPoller at=decision-task-empty-response poll-id=%q task-list=%q", pollId, p.TaskList)
 	return nil, nil
 }
 
@@ -110,22 +160,47 @@ func (p *DecisionTaskPoller) PollUntilShutdownBy(mgr *ShutdownManager, pollerNam
 	stop := make(chan bool, 1)
 	stopAck := make(chan bool, 1)
 	mgr.Register(pollerName, stop, stopAck)
+	if waitStartupJitter(p.StartupJitter, stop) {
+		Logf(p.Logger, "component=DecisionTaskPoller fn=PollUntilShutdownBy at=received-stop-during-startup-jitter action=shutting-down poller=%s task-list=%q", pollerName, p.TaskList)
+		stopAck <- true
+		return
+	}
+	emptyPolls := 0
 	for {
 		select {
 		case <-stop:
-			Log.Printf("component=DecisionTaskPoller fn=PollUntilShutdownBy at=received-stop action=shutting-down poller=%s task-list=%q", pollerName, p.TaskList)
+			Logf(p.Logger, "component=DecisionTaskPoller fn=PollUntilShutdownBy at=received-stop action=shutting-down poller=%s task-list=%q", pollerName, p.TaskList)
 			stopAck <- true
 			return
 		default:
+			if paused, stopped := mgr.waitIfPaused(pollerName, stop, func(pausedFor time.Duration) {
+				Logf(p.Logger, "component=DecisionTaskPoller fn=PollUntilShutdownBy at=paused poller=%s task-list=%q paused-for=%s", pollerName, p.TaskList, pausedFor)
+			}); stopped {
+				Logf(p.Logger, "component=DecisionTaskPoller fn=PollUntilShutdownBy at=received-stop-while-paused action=shutting-down poller=%s task-list=%q", pollerName, p.TaskList)
+				stopAck <- true
+				return
+			} else if paused {
+				continue
+			}
 			task, err := p.Poll(taskReady)
 			if err != nil {
-				Log.Printf("component=DecisionTaskPoller fn=PollUntilShutdownBy at=poll-err poller=%s task-list=%q error=%q", pollerName, p.TaskList, err)
+				Logf(p.Logger, "component=DecisionTaskPoller fn=PollUntilShutdownBy at=poll-err poller=%s task-list=%q error=%q", pollerName, p.TaskList, err)
 				continue
 			}
 			if task == nil {
-				Log.Printf("component=DecisionTaskPoller fn=PollUntilShutdownBy at=poll-no-task poller=%s task-list=%q", pollerName, p.TaskList)
+				emptyPolls++
+				Logf(p.Logger, "component=DecisionTaskPoller fn=PollUntilShutdownBy at=poll-no-task poller=%s task-list=%q empty-polls=%d", pollerName, p.TaskList, emptyPolls)
+				if p.OnEmptyPoll != nil {
+					p.OnEmptyPoll(emptyPolls)
+				}
+				if waitOrStop(p.EmptyPollDelay, stop) {
+					Logf(p.Logger, "component=DecisionTaskPoller fn=PollUntilShutdownBy at=received-stop-during-empty-poll-delay action=shutting-down poller=%s task-list=%q", pollerName, p.TaskList)
+					stopAck <- true
+					return
+				}
 				continue
 			}
+			emptyPolls = 0
 			onTask(task)
 		}
 	}
@@ -133,20 +208,23 @@ func (p *DecisionTaskPoller) PollUntilShutdownBy(mgr *ShutdownManager, pollerNam
 
 func (p *DecisionTaskPoller) logTaskLatency(resp *swf.PollForDecisionTaskOutput) {
 	for _, e := range resp.Events {
-		if e.EventId == resp.StartedEventId {
+		if aws.Int64Value(e.EventId) == aws.Int64Value(resp.StartedEventId) && e.EventTimestamp != nil {
 			elapsed := time.Since(*e.EventTimestamp)
-			Log.Printf("component=DecisionTaskPoller at=decision-task-latency latency=%s workflow=%s", elapsed, LS(resp.WorkflowType.Name))
+			Logf(p.Logger, "component=DecisionTaskPoller at=decision-task-latency latency=%s workflow=%s", elapsed, LS(resp.WorkflowType.Name))
+			metrics.Timing(p.MetricsSink, metrics.DecisionTaskLatency, elapsed, map[string]string{"workflow": LS(resp.WorkflowType.Name)})
 		}
 	}
 }
 
 // NewActivityTaskPoller returns an ActivityTaskPoller.
+// The identity is expanded with ExpandIdentity.
 func NewActivityTaskPoller(awc ActivityOps, domain string, identity string, taskList string) *ActivityTaskPoller {
 	return &ActivityTaskPoller{
-		client:   awc,
-		Domain:   domain,
-		Identity: identity,
-		TaskList: taskList,
+		client:        awc,
+		Domain:        domain,
+		Identity:      ExpandIdentity(identity),
+		TaskList:      taskList,
+		StartupJitter: DefaultStartupJitter,
 	}
 }
 
@@ -156,25 +234,46 @@ type ActivityTaskPoller struct {
 	Identity string
 	Domain   string
 	TaskList string
+	// StartupJitter is the upper bound of a random delay before the first poll in PollUntilShutdownBy,
+	// so that pollers started together do not poll in lockstep. Zero disables the delay.
+	StartupJitter time.Duration
+	// Logger is used for output on the poller. If not set, will use log.Log.
+	Logger StdLogger
+	// InputDecorator, if set, is called with each PollForActivityTaskInput before polling,
+	// so that additional fields can be set, or the TaskList changed, e.g. to poll a fallback task list.
+	InputDecorator func(*swf.PollForActivityTaskInput)
+	// OnEmptyPoll, if set, is called by PollUntilShutdownBy after each poll that returned no task, with the number
+	// of consecutive empty polls, e.g. to detect a task list that stays empty because it is misconfigured.
+	OnEmptyPoll func(consecutive int)
+	// EmptyPollDelay is waited by PollUntilShutdownBy after a poll that returned no task, before polling again,
+	// to reduce the volume of polls. Zero polls again immediately.
+	EmptyPollDelay time.Duration
+	// IDGenerator generates the id of each poll, which is logged with its outcome. If not set, will use poller.IDGenerator.
+	IDGenerator func() string
 }
 
 // Poll polls the task list for a task. If there is no task, nil is returned.
 // If an error is encountered, no task is returned.
 func (p *ActivityTaskPoller) Poll() (*swf.PollForActivityTaskOutput, error) {
-	resp, err := p.client.PollForActivityTask(&swf.PollForActivityTaskInput{
+	input := &swf.PollForActivityTaskInput{
 		Domain:   aws.String(p.Domain),
 		Identity: aws.String(p.Identity),
 		TaskList: &swf.TaskList{Name: aws.String(p.TaskList)},
-	})
+	}
+	if p.InputDecorator != nil {
+		p.InputDecorator(input)
+	}
+	pollId := newPollId(p.IDGenerator)
+	resp, err := p.client.PollForActivityTask(input)
 	if err != nil {
-		Log.Printf("component=ActivityTaskPoller at=error error=%q", err.Error())
+		Logf(p.Logger, "component=ActivityTaskPoller poll-id=%q at=error error=%q", pollId, err.Error())
 		return nil, errors.Trace(err)
 	}
 	if resp.TaskToken != nil {
-		Log.Printf("component=ActivityTaskPoller at=activity-task-received activity=%s", LS(resp.ActivityType.Name))
+		Logf(p.Logger, "component=ActivityTaskPoller poll-id=%q at=activity-task-received activity=%s", pollId, LS(resp.ActivityType.Name))
 		return resp, nil
 	}
-	Log.Println("component=ActivityTaskPoller at=activity-task-empty-response")
+	Logf(p.Logger, "component=ActivityTaskPoller poll-id=%q at=activity-task-empty-response", pollId)
 	return nil, nil
 }
 
@@ -184,34 +283,102 @@ func (p *ActivityTaskPoller) PollUntilShutdownBy(mgr *ShutdownManager, pollerNam
 	stop := make(chan bool, 1)
 	stopAck := make(chan bool, 1)
 	mgr.Register(pollerName, stop, stopAck)
+	if waitStartupJitter(p.StartupJitter, stop) {
+		Logf(p.Logger, "component=ActivityTaskPoller fn=PollUntilShutdownBy at=received-stop-during-startup-jitter action=shutting-down poller=%s task-list=%q", pollerName, p.TaskList)
+		stopAck <- true
+		return
+	}
+	emptyPolls := 0
 	for {
 		select {
 		case <-stop:
-			Log.Printf("component=ActivityTaskPoller fn=PollUntilShutdownBy at=received-stop action=shutting-down poller=%s task-list=%q", pollerName, p.TaskList)
+			Logf(p.Logger, "component=ActivityTaskPoller fn=PollUntilShutdownBy at=received-stop action=shutting-down poller=%s task-list=%q", pollerName, p.TaskList)
 			stopAck <- true
 			return
 		default:
+			if paused, stopped := mgr.waitIfPaused(pollerName, stop, func(pausedFor time.Duration) {
+				Logf(p.Logger, "component=ActivityTaskPoller fn=PollUntilShutdownBy at=paused poller=%s task-list=%q paused-for=%s", pollerName, p.TaskList, pausedFor)
+			}); stopped {
+				Logf(p.Logger, "component=ActivityTaskPoller fn=PollUntilShutdownBy at=received-stop-while-paused action=shutting-down poller=%s task-list=%q", pollerName, p.TaskList)
+				stopAck <- true
+				return
+			} else if paused {
+				continue
+			}
 			task, err := p.Poll()
 			if err != nil {
-				Log.Printf("component=ActivityTaskPoller fn=PollUntilShutdownBy at=poll-err poller=%s task-list=%q error=%q", pollerName, p.TaskList, err)
+				Logf(p.Logger, "component=ActivityTaskPoller fn=PollUntilShutdownBy at=poll-err poller=%s task-list=%q error=%q", pollerName, p.TaskList, err)
 				continue
 			}
 			if task == nil {
-				Log.Printf("component=ActivityTaskPoller fn=PollUntilShutdownBy at=poll-no-task poller=%s task-list=%q", pollerName, p.TaskList)
+				emptyPolls++
+				Logf(p.Logger, "component=ActivityTaskPoller fn=PollUntilShutdownBy at=poll-no-task poller=%s task-list=%q empty-polls=%d", pollerName, p.TaskList, emptyPolls)
+				if p.OnEmptyPoll != nil {
+					p.OnEmptyPoll(emptyPolls)
+				}
+				if waitOrStop(p.EmptyPollDelay, stop) {
+					Logf(p.Logger, "component=ActivityTaskPoller fn=PollUntilShutdownBy at=received-stop-during-empty-poll-delay action=shutting-down poller=%s task-list=%q", pollerName, p.TaskList)
+					stopAck <- true
+					return
+				}
 				continue
 			}
+			emptyPolls = 0
 			onTask(task)
 		}
 	}
 }
 
+// waitStartupJitter sleeps for a random duration up to max, returning true if stop was received while waiting.
+func waitStartupJitter(max time.Duration, stop chan bool) bool {
+	if max <= 0 {
+		return false
+	}
+	return waitOrStop(time.Duration(rand.Int63n(int64(max))), stop)
+}
+
+// waitOrStop sleeps for d, returning true if stop was received while waiting.
+func waitOrStop(d time.Duration, stop chan bool) bool {
+	if d <= 0 {
+		return false
+	}
+	select {
+	case <-stop:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
 // ShutdownManager facilitates cleanly shutting down pollers when the application decides to exit. When StopPollers() is called it will
 // send to each of the stopChan that have been registered, then recieve from each of the ackChan that have been registered. At this point StopPollers() returns.
 type ShutdownManager struct {
-	rpMu              sync.Mutex // protects registeredPollers
+	rpMu              sync.Mutex // protects registeredPollers, drainers and paused
 	registeredPollers map[string]*registeredPoller
+	drainers          map[string]Drainer
+	paused            map[string]*pauseState
+}
+
+// PausedLogInterval is how often a paused poller logs that it is paused.
+var PausedLogInterval = time.Minute
+
+// pauseCheckInterval is how often a paused poller checks whether it was resumed or stopped.
+var pauseCheckInterval = time.Second
+
+type pauseState struct {
+	since  time.Time
+	logged time.Time
 }
 
+// Drainer is implemented by task dispatchers that can report how many tasks they are still handling,
+// so that StopPollersAndDrain can wait for them once the pollers are stopped.
+type Drainer interface {
+	InFlight() int
+}
+
+// drainInterval is how often StopPollersAndDrain checks the registered Drainers.
+const drainInterval = 100 * time.Millisecond
+
 type registeredPoller struct {
 	name           string
 	stopChannel    chan bool
@@ -223,6 +390,7 @@ func NewShutdownManager() *ShutdownManager {
 
 	mgr := &ShutdownManager{
 		registeredPollers: make(map[string]*registeredPoller),
+		drainers:          make(map[string]Drainer),
 	}
 
 	return mgr
@@ -248,6 +416,110 @@ func (p *ShutdownManager) StopPollers() {
 	p.registeredPollers = map[string]*registeredPoller{}
 }
 
+//StopPollersAndDrain stops the registered pollers, then waits until the registered Drainers have no tasks in flight.
+//An error is returned if tasks are still in flight once the timeout has passed after the pollers stopped.
+func (p *ShutdownManager) StopPollersAndDrain(timeout time.Duration) error {
+	p.StopPollers()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		inFlight := p.inFlight()
+		if inFlight == 0 {
+			Log.Printf("component=PollerShutdownManager at=drained")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			Log.Printf("component=PollerShutdownManager at=drain-timeout in-flight=%d", inFlight)
+			return errors.Errorf("timed out draining with %d tasks in flight", inFlight)
+		}
+		Log.Printf("component=PollerShutdownManager at=awaiting-drain in-flight=%d", inFlight)
+		time.Sleep(drainInterval)
+	}
+}
+
+func (p *ShutdownManager) inFlight() int {
+	p.rpMu.Lock()
+	defer p.rpMu.Unlock()
+	inFlight := 0
+	for _, d := range p.drainers {
+		inFlight += d.InFlight()
+	}
+	return inFlight
+}
+
+// RegisterDrainer registers a named Drainer with the shutdown manager, that StopPollersAndDrain waits for.
+func (p *ShutdownManager) RegisterDrainer(name string, d Drainer) {
+	p.rpMu.Lock()
+	defer p.rpMu.Unlock()
+	if p.drainers == nil {
+		p.drainers = make(map[string]Drainer)
+	}
+	p.drainers[name] = d
+}
+
+// DeregisterDrainer removes a registered Drainer from the shutdown manager.
+func (p *ShutdownManager) DeregisterDrainer(name string) {
+	p.rpMu.Lock()
+	defer p.rpMu.Unlock()
+	delete(p.drainers, name)
+}
+
+// Pause stops the named poller from polling until Resume is called, e.g. to stop taking tasks from one task list during
+// maintenance while the other pollers keep polling. A poll in progress completes and its task is handled.
+// The paused poller logs that it is paused every PausedLogInterval, and still stops when StopPollers is called.
+func (p *ShutdownManager) Pause(name string) {
+	p.rpMu.Lock()
+	defer p.rpMu.Unlock()
+	if p.paused == nil {
+		p.paused = make(map[string]*pauseState)
+	}
+	if _, ok := p.paused[name]; !ok {
+		p.paused[name] = &pauseState{since: time.Now()}
+		Log.Printf("component=PollerShutdownManager at=pause name=%s", name)
+	}
+}
+
+// Resume lets a poller paused with Pause poll again.
+func (p *ShutdownManager) Resume(name string) {
+	p.rpMu.Lock()
+	defer p.rpMu.Unlock()
+	if _, ok := p.paused[name]; ok {
+		delete(p.paused, name)
+		Log.Printf("component=PollerShutdownManager at=resume name=%s", name)
+	}
+}
+
+// Paused returns true if the named poller is paused.
+func (p *ShutdownManager) Paused(name string) bool {
+	p.rpMu.Lock()
+	defer p.rpMu.Unlock()
+	_, ok := p.paused[name]
+	return ok
+}
+
+// waitIfPaused returns right away if the named poller is not paused, otherwise it calls logPaused if due and
+// waits for the pauseCheckInterval, returning stopped if stop was received while waiting.
+func (p *ShutdownManager) waitIfPaused(name string, stop chan bool, logPaused func(pausedFor time.Duration)) (paused bool, stopped bool) {
+	p.rpMu.Lock()
+	state, paused := p.paused[name]
+	var pausedFor time.Duration
+	due := false
+	if paused && time.Since(state.logged) >= PausedLogInterval {
+		state.logged = time.Now()
+		pausedFor = time.Since(state.since)
+		due = true
+	}
+	p.rpMu.Unlock()
+
+	if !paused {
+		return false, false
+	}
+	if due {
+		logPaused(pausedFor)
+	}
+	return true, waitOrStop(pauseCheckInterval, stop)
+}
+
 // Register registers a named pair of channels to the shutdown manager. Buffered channels please!
 func (p *ShutdownManager) Register(name string, stopChan chan bool, ackChan chan bool) {
 	p.rpMu.Lock()
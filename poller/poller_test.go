@@ -1,9 +1,17 @@
 package poller
 
 import (
+	"bytes"
+	"log"
+	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
 )
 
 func TestPollerManager(t *testing.T) {
@@ -47,3 +55,197 @@ func (t *TestPoller) eventLoop() {
 	<-t.stop
 	t.stopAck <- true
 }
+
+func TestPollUntilShutdownByWhenStoppedDuringStartupJitterExpectsNoPoll(t *testing.T) {
+	mgr := NewShutdownManager()
+	p := NewActivityTaskPoller(nil, "domain", "identity", "task-list")
+	p.StartupJitter = time.Hour
+
+	done := make(chan struct{})
+	go func() {
+		//a nil client would panic if polled
+		p.PollUntilShutdownBy(mgr, "jittered", nil)
+		done <- struct{}{}
+	}()
+
+	for registered := 0; registered == 0; {
+		time.Sleep(time.Millisecond)
+		mgr.rpMu.Lock()
+		registered = len(mgr.registeredPollers)
+		mgr.rpMu.Unlock()
+	}
+	mgr.StopPollers()
+
+	select {
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting on poller to stop during startup jitter")
+	case <-done:
+	}
+}
+
+type recordingActivityOps struct {
+	inputs []*swf.PollForActivityTaskInput
+}
+
+func (r *recordingActivityOps) PollForActivityTask(req *swf.PollForActivityTaskInput) (*swf.PollForActivityTaskOutput, error) {
+	r.inputs = append(r.inputs, req)
+	return &swf.PollForActivityTaskOutput{}, nil
+}
+
+func TestActivityTaskPollerPollWhenInputDecoratorSetExpectsDecoratedInput(t *testing.T) {
+	ops := &recordingActivityOps{}
+	p := NewActivityTaskPoller(ops, "domain", "identity", "task-list")
+
+	p.Poll()
+	p.InputDecorator = func(input *swf.PollForActivityTaskInput) {
+		input.TaskList = &swf.TaskList{Name: aws.String("fallback-task-list")}
+	}
+	p.Poll()
+
+	if len(ops.inputs) != 2 {
+		t.Fatal(ops.inputs)
+	}
+	if *ops.inputs[0].TaskList.Name != "task-list" {
+		t.Fatal("expected the configured task list without a decorator", ops.inputs[0])
+	}
+	if *ops.inputs[1].TaskList.Name != "fallback-task-list" || *ops.inputs[1].Domain != "domain" {
+		t.Fatal("expected the decorated task list", ops.inputs[1])
+	}
+}
+
+func TestActivityTaskPollerPollWhenIDGeneratorSetExpectsGeneratedPollIds(t *testing.T) {
+	out := &bytes.Buffer{}
+	p := NewActivityTaskPoller(&recordingActivityOps{}, "domain", "identity", "task-list")
+	p.Logger = log.New(out, "", 0)
+	p.IDGenerator = func() string { return "trace-1" }
+
+	p.Poll()
+
+	if !strings.Contains(out.String(), `poll-id="trace-1"`) {
+		t.Fatal("expected the generated poll id to be logged", out.String())
+	}
+}
+
+func TestActivityTaskPollerPollUntilShutdownByWhenEmptyExpectsOnEmptyPollAndDelay(t *testing.T) {
+	ops := &recordingActivityOps{}
+	p := NewActivityTaskPoller(ops, "domain", "identity", "task-list")
+	p.StartupJitter = 0
+	p.EmptyPollDelay = 10 * time.Millisecond
+	consecutive := make(chan int, 10)
+	p.OnEmptyPoll = func(n int) {
+		consecutive <- n
+	}
+	mgr := NewShutdownManager()
+
+	start := time.Now()
+	go p.PollUntilShutdownBy(mgr, "poller", func(*swf.PollForActivityTaskOutput) {
+		t.Fatal("expected no tasks")
+	})
+	for i := 1; i <= 3; i++ {
+		select {
+		case n := <-consecutive:
+			if n != i {
+				t.Fatal("expected consecutive empty polls", i, "got", n)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatal("timed out waiting for empty polls")
+		}
+	}
+	mgr.StopPollers()
+
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatal("expected a delay between empty polls, took", elapsed)
+	}
+}
+
+type fixedDrainer struct {
+	inFlight int32
+}
+
+func (f *fixedDrainer) InFlight() int {
+	return int(atomic.LoadInt32(&f.inFlight))
+}
+
+func TestStopPollersAndDrain(t *testing.T) {
+	mgr := NewShutdownManager()
+	drainer := &fixedDrainer{inFlight: 1}
+	mgr.RegisterDrainer("dispatcher", drainer)
+
+	if err := mgr.StopPollersAndDrain(10 * time.Millisecond); err == nil {
+		t.Fatal("expected a timeout with a task in flight")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&drainer.inFlight, 0)
+	}()
+	if err := mgr.StopPollersAndDrain(time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpandIdentity(t *testing.T) {
+	host, _ := os.Hostname()
+	pid := strconv.Itoa(os.Getpid())
+
+	if id := ExpandIdentity("worker-{host}-{pid}"); id != "worker-"+host+"-"+pid {
+		t.Fatal("expected host and pid expanded", id)
+	}
+	if id := ExpandIdentity("static"); id != "static" {
+		t.Fatal("expected identity without placeholders unchanged", id)
+	}
+	if p := NewDecisionTaskPoller(nil, "domain", "d-{pid}", "tasks"); p.Identity != "d-"+pid {
+		t.Fatal("expected decision poller identity expanded", p.Identity)
+	}
+	if p := NewActivityTaskPoller(nil, "domain", "a-{pid}", "tasks"); p.Identity != "a-"+pid {
+		t.Fatal("expected activity poller identity expanded", p.Identity)
+	}
+}
+
+func TestPauseAndResumePoller(t *testing.T) {
+	checkInterval := pauseCheckInterval
+	pauseCheckInterval = 5 * time.Millisecond
+	defer func() { pauseCheckInterval = checkInterval }()
+
+	p := NewActivityTaskPoller(&recordingActivityOps{}, "domain", "identity", "task-list")
+	p.StartupJitter = 0
+	p.EmptyPollDelay = time.Millisecond
+	polls := make(chan int, 100)
+	p.OnEmptyPoll = func(n int) {
+		polls <- n
+	}
+	mgr := NewShutdownManager()
+	mgr.Pause("poller")
+	mgr.Pause("other")
+	mgr.Resume("other")
+
+	go p.PollUntilShutdownBy(mgr, "poller", func(*swf.PollForActivityTaskOutput) {})
+
+	select {
+	case <-polls:
+		t.Fatal("expected no polls while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !mgr.Paused("poller") || mgr.Paused("other") {
+		t.Fatal("expected only the poller paused")
+	}
+
+	mgr.Resume("poller")
+	select {
+	case <-polls:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for a poll once resumed")
+	}
+
+	mgr.Pause("poller")
+	stopped := make(chan bool)
+	go func() {
+		mgr.StopPollers()
+		stopped <- true
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(1 * time.Second):
+		t.Fatal("expected a paused poller to stop")
+	}
+}
@@ -18,6 +18,8 @@ const (
 	ErrorTypeAlreadyExistsFault                   = "TypeAlreadyExistsFault"
 	ErrorTypeStreamNotFound                       = "ResourceNotFoundException"
 	ErrorTypeStreamAlreadyExists                  = "ResourceInUseException"
+	ErrorTypeOperationNotPermittedFault           = "OperationNotPermittedFault"
+	ErrorTypeThrottlingException                  = "ThrottlingException"
 )
 
 var eventTypes = map[string]func(*swf.HistoryEvent) interface{}{
@@ -156,6 +158,21 @@ func EventFromPayload(eventId int, data interface{}) *swf.HistoryEvent {
 	case *swf.FailWorkflowExecutionFailedEventAttributes:
 		event.FailWorkflowExecutionFailedEventAttributes = t
 		event.EventType = S(swf.EventTypeFailWorkflowExecutionFailed)
+	case *swf.LambdaFunctionCompletedEventAttributes:
+		event.LambdaFunctionCompletedEventAttributes = t
+		event.EventType = S(swf.EventTypeLambdaFunctionCompleted)
+	case *swf.LambdaFunctionFailedEventAttributes:
+		event.LambdaFunctionFailedEventAttributes = t
+		event.EventType = S(swf.EventTypeLambdaFunctionFailed)
+	case *swf.LambdaFunctionScheduledEventAttributes:
+		event.LambdaFunctionScheduledEventAttributes = t
+		event.EventType = S(swf.EventTypeLambdaFunctionScheduled)
+	case *swf.LambdaFunctionStartedEventAttributes:
+		event.LambdaFunctionStartedEventAttributes = t
+		event.EventType = S(swf.EventTypeLambdaFunctionStarted)
+	case *swf.LambdaFunctionTimedOutEventAttributes:
+		event.LambdaFunctionTimedOutEventAttributes = t
+		event.EventType = S(swf.EventTypeLambdaFunctionTimedOut)
 	case *swf.MarkerRecordedEventAttributes:
 		event.MarkerRecordedEventAttributes = t
 		event.EventType = S(swf.EventTypeMarkerRecorded)
@@ -186,6 +203,9 @@ func EventFromPayload(eventId int, data interface{}) *swf.HistoryEvent {
 	case *swf.StartChildWorkflowExecutionInitiatedEventAttributes:
 		event.StartChildWorkflowExecutionInitiatedEventAttributes = t
 		event.EventType = S(swf.EventTypeStartChildWorkflowExecutionInitiated)
+	case *swf.StartLambdaFunctionFailedEventAttributes:
+		event.StartLambdaFunctionFailedEventAttributes = t
+		event.EventType = S(swf.EventTypeStartLambdaFunctionFailed)
 	case *swf.StartTimerFailedEventAttributes:
 		event.StartTimerFailedEventAttributes = t
 		event.EventType = S(swf.EventTypeStartTimerFailed)
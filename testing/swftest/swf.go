@@ -0,0 +1,287 @@
+// Package swftest provides an in-memory SWF for testing FSMs and ActivityWorkers without mocking the swf api.
+package swftest
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/swf"
+	"github.com/sclasen/swfsm/activity"
+	"github.com/sclasen/swfsm/fsm"
+)
+
+var (
+	_ fsm.SWFOps      = &SWF{}
+	_ activity.SWFOps = &SWF{}
+)
+
+// SWF is an in-memory implementation of fsm.SWFOps and activity.SWFOps.
+// Decision and activity tasks are scripted with the Enqueue funcs and served in order by the polls,
+// and the responses to them are recorded so that tests can assert on them.
+// A poll with no scripted task returns an empty response right away, instead of long polling.
+type SWF struct {
+	// PageSize is the number of events per page served by PollForDecisionTaskPages. If 0, all events are served in one page.
+	PageSize int
+
+	mu                 sync.Mutex
+	tokens             int
+	decisionTasks      []*swf.PollForDecisionTaskOutput
+	activityTasks      []*swf.PollForActivityTaskOutput
+	histories          map[string][]*swf.HistoryEvent
+	cancelRequested    map[string]bool
+	decisionsCompleted []*swf.RespondDecisionTaskCompletedInput
+	activitiesDone     []*swf.RespondActivityTaskCompletedInput
+	activitiesFailed   []*swf.RespondActivityTaskFailedInput
+	activitiesCanceled []*swf.RespondActivityTaskCanceledInput
+	heartbeats         []*swf.RecordActivityTaskHeartbeatInput
+	signals            []*swf.SignalWorkflowExecutionInput
+}
+
+// New returns an empty SWF.
+func New() *SWF {
+	return &SWF{
+		histories:       make(map[string][]*swf.HistoryEvent),
+		cancelRequested: make(map[string]bool),
+	}
+}
+
+// EnqueueHistory scripts a decision task for the workflow execution with the given history, oldest event first.
+// Events without an EventId, or with EventId 0, are numbered by their position in the history, and the task gets a unique TaskToken.
+// The StartedEventId and PreviousStartedEventId are those of the last two DecisionTaskStarted events.
+// The history is also served by GetWorkflowExecutionHistory. The enqueued task is returned.
+func (s *SWF) EnqueueHistory(execution *swf.WorkflowExecution, workflowType *swf.WorkflowType, events []*swf.HistoryEvent) *swf.PollForDecisionTaskOutput {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var prevStarted, started int64
+	for i, e := range events {
+		if aws.Int64Value(e.EventId) == 0 {
+			e.EventId = aws.Int64(int64(i + 1))
+		}
+		if aws.StringValue(e.EventType) == swf.EventTypeDecisionTaskStarted {
+			prevStarted, started = started, *e.EventId
+		}
+	}
+	task := &swf.PollForDecisionTaskOutput{
+		Events:                 events,
+		PreviousStartedEventId: aws.Int64(prevStarted),
+		StartedEventId:         aws.Int64(started),
+		TaskToken:              aws.String(s.nextToken()),
+		WorkflowExecution:      execution,
+		WorkflowType:           workflowType,
+	}
+	s.histories[aws.StringValue(execution.RunId)] = events
+	s.decisionTasks = append(s.decisionTasks, task)
+	return task
+}
+
+// EnqueueActivityTask scripts an activity task. If it has no TaskToken, a unique one is set.
+func (s *SWF) EnqueueActivityTask(task *swf.PollForActivityTaskOutput) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if task.TaskToken == nil {
+		task.TaskToken = aws.String(s.nextToken())
+	}
+	s.activityTasks = append(s.activityTasks, task)
+}
+
+// RequestActivityCancel makes heartbeats of the activity task report that cancellation was requested.
+func (s *SWF) RequestActivityCancel(taskToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancelRequested[taskToken] = true
+}
+
+func (s *SWF) nextToken() string {
+	s.tokens++
+	return fmt.Sprintf("task-token-%d", s.tokens)
+}
+
+// PollForDecisionTaskPages serves the next scripted decision task, in pages of PageSize events.
+// The events are served newest first if ReverseOrder is set, as it is by the pollers.
+func (s *SWF) PollForDecisionTaskPages(req *swf.PollForDecisionTaskInput, fn func(*swf.PollForDecisionTaskOutput, bool) bool) error {
+	s.mu.Lock()
+	if len(s.decisionTasks) == 0 {
+		s.mu.Unlock()
+		fn(&swf.PollForDecisionTaskOutput{}, true)
+		return nil
+	}
+	task := s.decisionTasks[0]
+	s.decisionTasks = s.decisionTasks[1:]
+	s.mu.Unlock()
+
+	events := make([]*swf.HistoryEvent, len(task.Events))
+	copy(events, task.Events)
+	if aws.BoolValue(req.ReverseOrder) {
+		for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+			events[i], events[j] = events[j], events[i]
+		}
+	}
+
+	pageSize := s.PageSize
+	if pageSize <= 0 || pageSize > len(events) {
+		pageSize = len(events)
+	}
+	for start := 0; ; start += pageSize {
+		end := start + pageSize
+		last := end >= len(events)
+		if last {
+			end = len(events)
+		}
+		page := *task
+		page.Events = events[start:end]
+		if !last {
+			page.NextPageToken = aws.String(strconv.Itoa(end))
+		}
+		if !fn(&page, last) || last {
+			return nil
+		}
+	}
+}
+
+// RespondDecisionTaskCompleted records the request.
+func (s *SWF) RespondDecisionTaskCompleted(req *swf.RespondDecisionTaskCompletedInput) (*swf.RespondDecisionTaskCompletedOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.decisionsCompleted = append(s.decisionsCompleted, req)
+	return &swf.RespondDecisionTaskCompletedOutput{}, nil
+}
+
+// PollForActivityTask serves the next scripted activity task.
+func (s *SWF) PollForActivityTask(req *swf.PollForActivityTaskInput) (*swf.PollForActivityTaskOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.activityTasks) == 0 {
+		return &swf.PollForActivityTaskOutput{}, nil
+	}
+	task := s.activityTasks[0]
+	s.activityTasks = s.activityTasks[1:]
+	return task, nil
+}
+
+// RecordActivityTaskHeartbeat records the request, and reports whether RequestActivityCancel was called for the task.
+func (s *SWF) RecordActivityTaskHeartbeat(req *swf.RecordActivityTaskHeartbeatInput) (*swf.RecordActivityTaskHeartbeatOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heartbeats = append(s.heartbeats, req)
+	return &swf.RecordActivityTaskHeartbeatOutput{
+		CancelRequested: aws.Bool(s.cancelRequested[aws.StringValue(req.TaskToken)]),
+	}, nil
+}
+
+// RespondActivityTaskCompleted records the request.
+func (s *SWF) RespondActivityTaskCompleted(req *swf.RespondActivityTaskCompletedInput) (*swf.RespondActivityTaskCompletedOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activitiesDone = append(s.activitiesDone, req)
+	return &swf.RespondActivityTaskCompletedOutput{}, nil
+}
+
+// RespondActivityTaskFailed records the request.
+func (s *SWF) RespondActivityTaskFailed(req *swf.RespondActivityTaskFailedInput) (*swf.RespondActivityTaskFailedOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activitiesFailed = append(s.activitiesFailed, req)
+	return &swf.RespondActivityTaskFailedOutput{}, nil
+}
+
+// RespondActivityTaskCanceled records the request.
+func (s *SWF) RespondActivityTaskCanceled(req *swf.RespondActivityTaskCanceledInput) (*swf.RespondActivityTaskCanceledOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activitiesCanceled = append(s.activitiesCanceled, req)
+	return &swf.RespondActivityTaskCanceledOutput{}, nil
+}
+
+// GetWorkflowExecutionHistory serves the history enqueued for the run, in one page.
+func (s *SWF) GetWorkflowExecutionHistory(req *swf.GetWorkflowExecutionHistoryInput) (*swf.GetWorkflowExecutionHistoryOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events, ok := s.histories[aws.StringValue(req.Execution.RunId)]
+	if !ok {
+		return nil, fmt.Errorf("no history for run %s", aws.StringValue(req.Execution.RunId))
+	}
+	ordered := make([]*swf.HistoryEvent, len(events))
+	copy(ordered, events)
+	if aws.BoolValue(req.ReverseOrder) {
+		for i, j := 0, len(ordered)-1; i < j; i, j = i+1, j-1 {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		}
+	}
+	return &swf.GetWorkflowExecutionHistoryOutput{Events: ordered}, nil
+}
+
+// SignalWorkflowExecution records the request.
+func (s *SWF) SignalWorkflowExecution(req *swf.SignalWorkflowExecutionInput) (*swf.SignalWorkflowExecutionOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signals = append(s.signals, req)
+	return &swf.SignalWorkflowExecutionOutput{}, nil
+}
+
+// DecisionTasksCompleted returns the recorded RespondDecisionTaskCompleted requests.
+func (s *SWF) DecisionTasksCompleted() []*swf.RespondDecisionTaskCompletedInput {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*swf.RespondDecisionTaskCompletedInput(nil), s.decisionsCompleted...)
+}
+
+// Decisions returns the decisions of all recorded RespondDecisionTaskCompleted requests, in order.
+func (s *SWF) Decisions() []*swf.Decision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var decisions []*swf.Decision
+	for _, completed := range s.decisionsCompleted {
+		decisions = append(decisions, completed.Decisions...)
+	}
+	return decisions
+}
+
+// DecisionsOfType returns the decisions of the given DecisionType, e.g. swf.DecisionTypeScheduleActivityTask.
+func (s *SWF) DecisionsOfType(decisionType string) []*swf.Decision {
+	var decisions []*swf.Decision
+	for _, d := range s.Decisions() {
+		if aws.StringValue(d.DecisionType) == decisionType {
+			decisions = append(decisions, d)
+		}
+	}
+	return decisions
+}
+
+// ActivityTasksCompleted returns the recorded RespondActivityTaskCompleted requests.
+func (s *SWF) ActivityTasksCompleted() []*swf.RespondActivityTaskCompletedInput {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*swf.RespondActivityTaskCompletedInput(nil), s.activitiesDone...)
+}
+
+// ActivityTasksFailed returns the recorded RespondActivityTaskFailed requests.
+func (s *SWF) ActivityTasksFailed() []*swf.RespondActivityTaskFailedInput {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*swf.RespondActivityTaskFailedInput(nil), s.activitiesFailed...)
+}
+
+// ActivityTasksCanceled returns the recorded RespondActivityTaskCanceled requests.
+func (s *SWF) ActivityTasksCanceled() []*swf.RespondActivityTaskCanceledInput {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*swf.RespondActivityTaskCanceledInput(nil), s.activitiesCanceled...)
+}
+
+// Heartbeats returns the recorded RecordActivityTaskHeartbeat requests.
+func (s *SWF) Heartbeats() []*swf.RecordActivityTaskHeartbeatInput {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*swf.RecordActivityTaskHeartbeatInput(nil), s.heartbeats...)
+}
+
+// Signals returns the recorded SignalWorkflowExecution requests.
+func (s *SWF) Signals() []*swf.SignalWorkflowExecutionInput {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*swf.SignalWorkflowExecutionInput(nil), s.signals...)
+}
@@ -0,0 +1,92 @@
+package swftest
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/swf"
+	"github.com/sclasen/swfsm/fsm"
+	"github.com/sclasen/swfsm/poller"
+	. "github.com/sclasen/swfsm/sugar"
+)
+
+type testData struct {
+	Count int
+}
+
+func TestDecisionTaskRoundTrip(t *testing.T) {
+	client := New()
+	client.PageSize = 1
+
+	f := &fsm.FSM{
+		Name:     "test-fsm",
+		Domain:   "test-domain",
+		TaskList: "test-task-list",
+		DataType: testData{},
+		SWF:      client,
+	}
+	f.AddInitialState(&fsm.FSMState{
+		Name: "initial",
+		Decider: func(ctx *fsm.FSMContext, h *swf.HistoryEvent, data interface{}) fsm.Outcome {
+			if *h.EventType != swf.EventTypeWorkflowExecutionSignaled {
+				return ctx.Stay(data, ctx.EmptyDecisions())
+			}
+			d, _ := ctx.ScheduleActivity(&swf.ActivityType{Name: S("activity"), Version: S("1")}, "activities", data)
+			return ctx.Stay(data, []*swf.Decision{d})
+		},
+	})
+	f.Init()
+
+	execution := &swf.WorkflowExecution{WorkflowId: S("workflow-id"), RunId: S("run-id")}
+	enqueued := client.EnqueueHistory(execution, &swf.WorkflowType{Name: S("test-fsm"), Version: S("1")}, []*swf.HistoryEvent{
+		EventFromPayload(0, &swf.WorkflowExecutionStartedEventAttributes{Input: fsm.StartFSMWorkflowInput(f, &testData{Count: 1})}),
+		EventFromPayload(0, &swf.WorkflowExecutionSignaledEventAttributes{SignalName: S("schedule")}),
+		{EventType: S(swf.EventTypeDecisionTaskScheduled)},
+		{EventType: S(swf.EventTypeDecisionTaskStarted)},
+	})
+
+	p := poller.NewDecisionTaskPoller(client, f.Domain, "identity", f.TaskList)
+	task, err := p.Poll(func(*swf.PollForDecisionTaskOutput) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(task.Events) != 4 || *task.Events[0].EventId != 4 || *task.TaskToken != *enqueued.TaskToken {
+		t.Fatal("expected the paged history newest first", task)
+	}
+
+	_, decisions, _, err := f.Tick(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RespondDecisionTaskCompleted(&swf.RespondDecisionTaskCompletedInput{TaskToken: task.TaskToken, Decisions: decisions}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.DecisionTasksCompleted()) != 1 || len(client.DecisionsOfType(swf.DecisionTypeScheduleActivityTask)) != 1 {
+		t.Fatal("expected a recorded response scheduling the activity", client.Decisions())
+	}
+
+	empty, err := p.Poll(func(*swf.PollForDecisionTaskOutput) bool { return false })
+	if err != nil || empty != nil {
+		t.Fatal("expected an empty poll once the scripted tasks are served", empty, err)
+	}
+}
+
+func TestActivityTaskRoundTrip(t *testing.T) {
+	client := New()
+	client.EnqueueActivityTask(&swf.PollForActivityTaskOutput{ActivityId: S("activity-id")})
+
+	task, _ := client.PollForActivityTask(&swf.PollForActivityTaskInput{})
+	client.RequestActivityCancel(*task.TaskToken)
+	heartbeat, _ := client.RecordActivityTaskHeartbeat(&swf.RecordActivityTaskHeartbeatInput{TaskToken: task.TaskToken})
+	client.RespondActivityTaskCanceled(&swf.RespondActivityTaskCanceledInput{TaskToken: task.TaskToken})
+
+	if !*heartbeat.CancelRequested {
+		t.Fatal("expected the heartbeat to report the cancellation")
+	}
+	if len(client.Heartbeats()) != 1 || len(client.ActivityTasksCanceled()) != 1 {
+		t.Fatal("expected the heartbeat and cancellation recorded")
+	}
+	if empty, _ := client.PollForActivityTask(&swf.PollForActivityTaskInput{}); empty.TaskToken != nil {
+		t.Fatal("expected an empty poll once the scripted tasks are served", empty)
+	}
+}